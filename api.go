@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -13,8 +17,22 @@ import (
 // API Structure
 
 type APIServer struct {
-	listenAddr string
-	store      Storage
+	listenAddr  string
+	store       Storage
+	config      *Config
+	webhooks    *WebhookDispatcher
+	stream      *StreamBroker
+	auth        *Authenticator
+	apiKeys     *APIKeyManager
+	limits      LimitBackend
+	idempotency IdempotencyBackend
+
+	// Closed on shutdown to end the media streams, which never finish on
+	// their own.
+	done chan struct{}
+
+	// Done of the context of Run, closed as soon as the shutdown starts.
+	stopping <-chan struct{}
 }
 
 type apiFunc func(http.ResponseWriter, *http.Request) error
@@ -29,40 +47,192 @@ func WriteJSON(w http.ResponseWriter, status int, v any) error {
 	return json.NewEncoder(w).Encode(v)
 }
 
+// actorID identifies who performs a mutation, defaulting to the user it is made for.
+func actorID(r *http.Request, user int) string {
+	if claims, ok := ClaimsFromContext(r.Context()); ok {
+		return claims.Subject
+	}
+
+	return strconv.Itoa(user)
+}
+
+// callerID returns the id of the user making the request, or -1 when it is
+// unknown. An X-Actor-ID taken as is, without authentication, is unknown: it
+// must never unlock private data.
+func callerID(r *http.Request) int {
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok || !claims.Verified {
+		return -1
+	}
+
+	id, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return -1
+	}
+
+	return id
+}
+
+// visibleMediaTypes returns, per media type, whether the caller is allowed to
+// see the likes and ratings of a user.
+func (s *APIServer) visibleMediaTypes(r *http.Request, owner int) (map[string]bool, error) {
+	visible := map[string]bool{"MOV": true, "SON": true, "BOO": true}
+
+	caller := callerID(r)
+	if caller == owner {
+		return visible, nil
+	}
+
+	settings, err := s.storeFor(r).GetPrivacy(owner)
+	if err != nil {
+		return nil, err
+	}
+
+	following := false
+	if caller != -1 {
+		if following, err = s.storeFor(r).IsFollowing(caller, owner); err != nil {
+			return nil, err
+		}
+	}
+
+	for mediaType := range visible {
+		level := settings.Level(mediaType)
+		visible[mediaType] = level == PrivacyPublic || (level == PrivacyFollowers && following)
+	}
+
+	return visible, nil
+}
+
 func makeHTTPHandleFunc(f apiFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if err := f(w, r); err != nil {
+			slog.WarnContext(r.Context(), "request rejected", "error", err)
 			WriteJSON(w, http.StatusBadRequest, ApiError{Error: err.Error()})
 		}
 	}
 }
 
-func NewAPIServer(listenAddr string, store Storage) *APIServer {
+func NewAPIServer(listenAddr string, store Storage, config *Config, webhooks *WebhookDispatcher, stream *StreamBroker, auth *Authenticator, apiKeys *APIKeyManager, limits LimitBackend, idempotency IdempotencyBackend) *APIServer {
 	return &APIServer{
-		listenAddr: listenAddr,
-		store:      store,
+		listenAddr:  listenAddr,
+		store:       store,
+		config:      config,
+		webhooks:    webhooks,
+		stream:      stream,
+		auth:        auth,
+		apiKeys:     apiKeys,
+		limits:      limits,
+		idempotency: idempotency,
+		done:        make(chan struct{}),
 	}
 }
 
-func (s *APIServer) Run() {
+// Run serves the API until the context is cancelled, then stops accepting
+// connections and waits up to ShutdownTimeout for in-flight requests.
+func (s *APIServer) Run(ctx context.Context) error {
 	router := mux.NewRouter()
 
 	router.HandleFunc("/likes", makeHTTPHandleFunc(s.handleLikes)).Queries("media_type", "{media_type}", "user_id", "{user_id}", "media_id", "{media_id}")
 	router.HandleFunc("/likes", makeHTTPHandleFunc(s.handleLikes))
+	router.HandleFunc("/likes/reactions", makeHTTPHandleFunc(s.handleReactions))
 	router.HandleFunc("/likes/user/{id}", makeHTTPHandleFunc(s.handleUser)).Queries("media_type", "{media_type}", "preference", "{preference}")
 	router.HandleFunc("/likes/user/{id}", makeHTTPHandleFunc(s.handleUser)).Queries("media_type", "{media_type}")
 	router.HandleFunc("/likes/user/{id}", makeHTTPHandleFunc(s.handleUser)).Queries("preference", "{preference}")
 	router.HandleFunc("/likes/user/{id}", makeHTTPHandleFunc(s.handleUser))
+	router.HandleFunc("/likes/user/{id}/history", makeHTTPHandleFunc(s.handleHistory))
+	router.HandleFunc("/likes/user/{id}/following", makeHTTPHandleFunc(s.handleFollowing))
+	router.HandleFunc("/likes/user/{id}/following/{target}", makeHTTPHandleFunc(s.handleFollow))
+	router.HandleFunc("/likes/user/{id}/followers", makeHTTPHandleFunc(s.handleFollowers))
+	router.HandleFunc("/likes/user/{id}/feed", makeHTTPHandleFunc(s.handleFeed))
+	router.HandleFunc("/likes/user/{id}/privacy", makeHTTPHandleFunc(s.handlePrivacy))
+	router.HandleFunc("/likes/user/{id}/restore", makeHTTPHandleFunc(s.handleRestoreUser))
+	router.HandleFunc("/likes/user/{id}/gdpr-export", makeHTTPHandleFunc(s.handleUserExport))
+	router.HandleFunc("/likes/user/{id}/gdpr-erasure", makeHTTPHandleFunc(s.handleUserErasure))
 	router.HandleFunc("/likes/media/{id}", makeHTTPHandleFunc(s.handleMedia)).Queries("media_type", "{media_type}", "preference", "{preference}")
 	router.HandleFunc("/likes/media/{id}", makeHTTPHandleFunc(s.handleMedia)).Queries("media_type", "{media_type}")
+	router.HandleFunc("/likes/media/{id}/stream", makeHTTPHandleFunc(s.handleMediaStream)).Queries("media_type", "{media_type}")
+	router.HandleFunc("/likes/media/{id}/restore", makeHTTPHandleFunc(s.handleRestoreMedia)).Queries("media_type", "{media_type}")
 	router.HandleFunc("/likes/rate/{id}", makeHTTPHandleFunc(s.handleRate)).Queries("media_type", "{media_type}")
 	router.HandleFunc("/likes/rate/{id}", makeHTTPHandleFunc(s.handleRate)).Queries("media_type", "{media_type}", "user_id", "{user_id}")
 	router.HandleFunc("/likes/wishlist/{id}", makeHTTPHandleFunc(s.handleWishlist)).Queries("media_type", "{media_type}")
 	router.HandleFunc("/likes/wishlist/{id}", makeHTTPHandleFunc(s.handleWishlist))
+	router.HandleFunc("/likes/reviews/{id}", makeHTTPHandleFunc(s.handleReviews)).Queries("media_type", "{media_type}")
+	router.HandleFunc("/likes/reviews/{id}/report", makeHTTPHandleFunc(s.handleReportReview)).Queries("media_type", "{media_type}", "user_id", "{user_id}")
+	router.HandleFunc("/likes/webhooks", makeHTTPHandleFunc(s.handleWebhooks))
+	router.HandleFunc("/likes/webhooks/{id}", makeHTTPHandleFunc(s.handleWebhook))
+	router.HandleFunc("/likes/webhooks/{id}/test", makeHTTPHandleFunc(s.handleWebhookTest))
+	router.HandleFunc("/likes/webhooks/{id}/dead-letters", makeHTTPHandleFunc(s.handleDeadLetters))
+	router.HandleFunc("/likes/admin/reviews", makeHTTPHandleFunc(s.handleFlaggedReviews))
+	router.HandleFunc("/likes/admin/reviews/audit", makeHTTPHandleFunc(s.handleModerationAudit))
+	router.HandleFunc("/likes/admin/api-keys", makeHTTPHandleFunc(s.handleAPIKeys))
+	router.HandleFunc("/likes/admin/api-keys/{id}", makeHTTPHandleFunc(s.handleRevokeAPIKey))
+	router.HandleFunc("/likes/admin/api-keys/{id}/rotate", makeHTTPHandleFunc(s.handleRotateAPIKey))
+	router.HandleFunc("/likes/admin/log-level", makeHTTPHandleFunc(s.handleLogLevel))
+	router.HandleFunc("/likes/admin/integrity", makeHTTPHandleFunc(s.handleIntegrity))
+	router.HandleFunc("/likes/admin/integrity/repair", makeHTTPHandleFunc(s.handleRepairIntegrity))
+	router.HandleFunc("/likes/admin/users/merge", makeHTTPHandleFunc(s.handleMergeUsers))
+	router.HandleFunc("/likes/admin/media/rekey", makeHTTPHandleFunc(s.handleRekeyMedia))
+	router.HandleFunc("/likes/admin/reviews/{id}", makeHTTPHandleFunc(s.handleModerateReview)).Queries("media_type", "{media_type}", "user_id", "{user_id}")
+
+	router.Use(s.logRequests)
+	router.Use(s.trace)
+	router.Use(s.instrument)
+	router.Use(s.limitBody)
+	router.Use(s.authenticate)
+	router.Use(s.rateLimit)
+	router.Use(s.idempotent)
+
+	// Probes and metrics skip authentication and rate limiting
+	root := mux.NewRouter()
+	root.HandleFunc("/healthz", makeHTTPHandleFunc(s.handleHealthz))
+	root.HandleFunc("/readyz", makeHTTPHandleFunc(s.handleReadyz))
+	root.Handle("/metrics", metricsHandler())
+	root.PathPrefix("/").Handler(router)
+
+	server := &http.Server{
+		Addr:              s.listenAddr,
+		Handler:           root,
+		ReadTimeout:       s.config.ReadTimeout,
+		ReadHeaderTimeout: s.config.ReadHeaderTimeout,
+		WriteTimeout:      s.config.WriteTimeout,
+		IdleTimeout:       s.config.IdleTimeout,
+		MaxHeaderBytes:    int(s.config.MaxHeaderBytes),
+	}
+	server.RegisterOnShutdown(func() { close(s.done) })
+	s.stopping = ctx.Done()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		slog.Info("REST API server running", "addr", s.listenAddr)
+		serveErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down REST API server")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.config.ShutdownTimeout)
+	defer cancel()
+
+	return server.Shutdown(shutdownCtx)
+}
 
-	log.Println("REST API server running on port: ", s.listenAddr)
+// limitBody rejects the requests whose body is larger than MaxBodyBytes.
+func (s *APIServer) limitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > s.config.MaxBodyBytes {
+			WriteJSON(w, http.StatusRequestEntityTooLarge, ApiError{Error: "request body too large"})
+			return
+		}
 
-	http.ListenAndServe(s.listenAddr, router)
+		// Bodies without a length fail to decode past the limit
+		r.Body = http.MaxBytesReader(w, r.Body, s.config.MaxBodyBytes)
+		next.ServeHTTP(w, r)
+	})
 }
 
 // Routes Handlers
@@ -146,11 +316,22 @@ func (s *APIServer) handleCreateLike(w http.ResponseWriter, r *http.Request) err
 		return WriteJSON(w, http.StatusBadRequest, "Guard failed") // 400
 	}
 
-	like := NewLike(createLike.UserID, createLike.MediaID, createLike.MediaType, createLike.LikeType)
-	if err := s.store.SetLike(like); err != nil {
-		return WriteJSON(w, http.StatusInternalServerError, err) // 500
+	if err := s.authorize(r, createLike.UserID); err != nil {
+		return writeAuthError(w, err)
+	}
+
+	like := NewLike(createLike.UserID, createLike.MediaID, createLike.MediaType, createLike.LikeType, createLike.Reaction)
+	if err := s.resolveReaction(like); err != nil {
+		return WriteJSON(w, http.StatusBadRequest, err.Error()) // 400
+	}
+
+	version, err := s.storeFor(r).SetLike(like, actorID(r, like.UserID), ifMatch(r))
+	if err != nil {
+		return writePreconditionError(w, err)
 	}
 
+	w.Header().Set("ETag", userTag(version))
+
 	return WriteJSON(w, http.StatusCreated, "Relation created") // 201
 }
 
@@ -161,11 +342,22 @@ func (s *APIServer) handleUpdateLike(w http.ResponseWriter, r *http.Request) err
 		return WriteJSON(w, http.StatusBadRequest, "Guard failed") // 400
 	}
 
-	like := NewLike(createLike.UserID, createLike.MediaID, createLike.MediaType, createLike.LikeType)
-	if err := s.store.SetLike(like); err != nil {
-		return WriteJSON(w, http.StatusInternalServerError, err) // 500
+	if err := s.authorize(r, createLike.UserID); err != nil {
+		return writeAuthError(w, err)
+	}
+
+	like := NewLike(createLike.UserID, createLike.MediaID, createLike.MediaType, createLike.LikeType, createLike.Reaction)
+	if err := s.resolveReaction(like); err != nil {
+		return WriteJSON(w, http.StatusBadRequest, err.Error()) // 400
 	}
 
+	version, err := s.storeFor(r).SetLike(like, actorID(r, like.UserID), ifMatch(r))
+	if err != nil {
+		return writePreconditionError(w, err)
+	}
+
+	w.Header().Set("ETag", userTag(version))
+
 	return WriteJSON(w, http.StatusCreated, "Relation updated") // 201
 }
 
@@ -189,10 +381,17 @@ func (s *APIServer) handleDeleteLike(w http.ResponseWriter, r *http.Request) err
 		return WriteJSON(w, http.StatusInternalServerError, err) // 500
 	}
 
-	if err := s.store.DeleteLike(user_id, params["media_id"], params["media_type"]); err != nil {
-		return WriteJSON(w, http.StatusInternalServerError, err) // 500
+	if err := s.authorize(r, user_id); err != nil {
+		return writeAuthError(w, err)
+	}
+
+	version, err := s.storeFor(r).DeleteLike(user_id, params["media_id"], params["media_type"], actorID(r, user_id), ifMatch(r))
+	if err != nil {
+		return writePreconditionError(w, err)
 	}
 
+	w.Header().Set("ETag", userTag(version))
+
 	return WriteJSON(w, http.StatusNoContent, params) // 204
 }
 
@@ -216,7 +415,16 @@ func (s *APIServer) handleSpecificLike(w http.ResponseWriter, r *http.Request) e
 		return WriteJSON(w, http.StatusInternalServerError, err) // 500
 	}
 
-	result, err := s.store.GetSpecificLike(user_id, params["media_id"], params["media_type"])
+	visible, err := s.visibleMediaTypes(r, user_id)
+	if err != nil {
+		return WriteJSON(w, http.StatusInternalServerError, err) // 500
+	}
+
+	if !visible[params["media_type"]] {
+		return WriteJSON(w, http.StatusForbidden, "User preferences are private") // 403
+	}
+
+	result, err := s.storeFor(r).GetSpecificLike(user_id, params["media_id"], params["media_type"])
 
 	if err != nil {
 		return WriteJSON(w, http.StatusInternalServerError, err) // 500
@@ -225,6 +433,31 @@ func (s *APIServer) handleSpecificLike(w http.ResponseWriter, r *http.Request) e
 	return WriteJSON(w, http.StatusOK, result)
 }
 
+func (s *APIServer) handleReactions(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return fmt.Errorf("method not allowed %s", r.Method)
+	}
+
+	return WriteJSON(w, http.StatusOK, s.config.Reactions)
+}
+
+// resolveReaction defaults the reaction of a like to its like type and sets the
+// like type kept for older clients from the reactions vocabulary.
+func (s *APIServer) resolveReaction(like *Like) error {
+	if like.Reaction == "" {
+		like.Reaction = like.LikeType
+	}
+
+	reaction, ok := s.config.Reaction(like.Reaction)
+	if !ok {
+		return fmt.Errorf("reaction %s not allowed", like.Reaction)
+	}
+
+	like.LikeType = reaction.Legacy
+
+	return nil
+}
+
 // /likes/user Functions
 
 func (s *APIServer) handleCreateUser(w http.ResponseWriter, r *http.Request) error {
@@ -239,7 +472,14 @@ func (s *APIServer) handleCreateUser(w http.ResponseWriter, r *http.Request) err
 		return WriteJSON(w, http.StatusInternalServerError, err) // 500
 	}
 
-	if err := s.store.CreateUser(id); err != nil {
+	if err := s.authorize(r, id); err != nil {
+		return writeAuthError(w, err)
+	}
+
+	if err := s.storeFor(r).CreateUser(id); err != nil {
+		if errors.Is(err, errDeleted) {
+			return WriteJSON(w, http.StatusConflict, err.Error()) // 409
+		}
 		return WriteJSON(w, http.StatusInternalServerError, err) // 500
 	}
 
@@ -258,12 +498,36 @@ func (s *APIServer) handleGetUserLikes(w http.ResponseWriter, r *http.Request) e
 		return WriteJSON(w, http.StatusInternalServerError, err) // 500
 	}
 
-	result, err := s.store.GetUserLikes(id, params["media_type"], params["preference"])
+	etag, err := s.userETag(r, id)
+	if err != nil {
+		return WriteJSON(w, http.StatusInternalServerError, err) // 500
+	}
+
+	if notModified(w, r, etag) {
+		return nil
+	}
+
+	result, err := s.storeFor(r).GetUserLikes(id, params["media_type"], params["preference"])
+
+	if err != nil {
+		return WriteJSON(w, http.StatusInternalServerError, err) // 500
+	}
 
+	visible, err := s.visibleMediaTypes(r, id)
 	if err != nil {
 		return WriteJSON(w, http.StatusInternalServerError, err) // 500
 	}
 
+	if !visible["MOV"] {
+		result.Movies = nil
+	}
+	if !visible["SON"] {
+		result.Songs = nil
+	}
+	if !visible["BOO"] {
+		result.Books = nil
+	}
+
 	return WriteJSON(w, http.StatusOK, result)
 }
 
@@ -279,189 +543,279 @@ func (s *APIServer) handleDeleteUser(w http.ResponseWriter, r *http.Request) err
 		return WriteJSON(w, http.StatusInternalServerError, err) // 500
 	}
 
-	if err := s.store.DeleteUser(id); err != nil {
+	if err := s.authorize(r, id); err != nil {
+		return writeAuthError(w, err)
+	}
+
+	if err := s.storeFor(r).DeleteUser(id); err != nil {
 		return WriteJSON(w, http.StatusInternalServerError, err) // 500
 	}
 
 	return WriteJSON(w, http.StatusNoContent, "")
 }
 
-// /likes/media Functions
+func (s *APIServer) handleRestoreUser(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return fmt.Errorf("method not allowed %s", r.Method)
+	}
 
-func (s *APIServer) handleCreateMedia(w http.ResponseWriter, r *http.Request) error {
 	params := mux.Vars(r)
 
 	if params["id"] == "" {
-		return WriteJSON(w, http.StatusBadRequest, "Media id not provided") // 400
+		return WriteJSON(w, http.StatusBadRequest, "User id not provided") // 400
 	}
 
-	if params["media_type"] == "" {
-		return WriteJSON(w, http.StatusBadRequest, "Media type not provided") // 400
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		return WriteJSON(w, http.StatusInternalServerError, err) // 500
 	}
 
-	if err := s.store.CreateMedia(params["id"], params["media_type"]); err != nil {
-		return WriteJSON(w, http.StatusInternalServerError, err) // 500
+	if err := s.authorize(r, id); err != nil {
+		return writeAuthError(w, err)
 	}
 
-	return WriteJSON(w, http.StatusCreated, "Media created") // 201
+	if err := s.storeFor(r).RestoreUser(id); err != nil {
+		return WriteJSON(w, http.StatusNotFound, err.Error()) // 404
+	}
+
+	return WriteJSON(w, http.StatusOK, "User restored")
 }
 
-func (s *APIServer) handleGetMediaLikes(w http.ResponseWriter, r *http.Request) error {
+func (s *APIServer) handleUserExport(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return fmt.Errorf("method not allowed %s", r.Method)
+	}
+
 	params := mux.Vars(r)
 
 	if params["id"] == "" {
-		return WriteJSON(w, http.StatusBadRequest, "Media id not provided") // 400
+		return WriteJSON(w, http.StatusBadRequest, "User id not provided") // 400
 	}
 
-	if params["media_type"] == "" {
-		return WriteJSON(w, http.StatusBadRequest, "Media type not provided") // 400
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		return WriteJSON(w, http.StatusInternalServerError, err) // 500
+	}
+
+	if err := s.authorizeSubject(r, id); err != nil {
+		return writeAuthError(w, err)
 	}
 
-	result, err := s.store.GetMediaLikes(params["id"], params["media_type"], params["preference"])
+	result, err := s.storeFor(r).GetUserExport(id)
 
 	if err != nil {
 		return WriteJSON(w, http.StatusInternalServerError, err) // 500
 	}
 
+	w.Header().Add("Content-Disposition", fmt.Sprintf("attachment; filename=\"user-%d-export.json\"", id))
+
 	return WriteJSON(w, http.StatusOK, result)
 }
 
-func (s *APIServer) handleDeleteMedia(w http.ResponseWriter, r *http.Request) error {
+// handleUserErasure erases a user on POST and proves nothing is left of it on
+// GET, both answering with a signed receipt.
+func (s *APIServer) handleUserErasure(w http.ResponseWriter, r *http.Request) error {
 	params := mux.Vars(r)
 
 	if params["id"] == "" {
-		return WriteJSON(w, http.StatusBadRequest, "Media id not provided") // 400
+		return WriteJSON(w, http.StatusBadRequest, "User id not provided") // 400
 	}
 
-	if params["media_type"] == "" {
-		return WriteJSON(w, http.StatusBadRequest, "Media type not provided") // 400
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		return WriteJSON(w, http.StatusInternalServerError, err) // 500
+	}
+
+	if err := s.authorizeSubject(r, id); err != nil {
+		return writeAuthError(w, err)
+	}
+
+	var receipt *ErasureReceipt
+	status := http.StatusOK
+
+	if r.Method == "POST" {
+		receipt, err = s.storeFor(r).EraseUser(id)
+		status = http.StatusCreated
+	} else if r.Method == "GET" {
+		receipt, err = s.storeFor(r).VerifyErasure(id)
+	} else {
+		return fmt.Errorf("method not allowed %s", r.Method)
 	}
 
-	if err := s.store.DeleteMedia(params["id"], params["media_type"]); err != nil {
+	if err != nil {
 		return WriteJSON(w, http.StatusInternalServerError, err) // 500
 	}
 
-	return WriteJSON(w, http.StatusNoContent, "")
-}
+	if err := receipt.Sign(s.config.ErasureKey); err != nil {
+		return WriteJSON(w, http.StatusInternalServerError, err) // 500
+	}
 
-// /likes/rate Functions
+	return WriteJSON(w, status, receipt)
+}
 
-func (s *APIServer) handleAverage(w http.ResponseWriter, r *http.Request) error {
+func (s *APIServer) handleHistory(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return fmt.Errorf("method not allowed %s", r.Method)
+	}
 
 	params := mux.Vars(r)
 
 	if params["id"] == "" {
-		return WriteJSON(w, http.StatusBadRequest, "Media id not provided") // 400
+		return WriteJSON(w, http.StatusBadRequest, "User id not provided") // 400
 	}
 
-	if params["media_type"] == "" {
-		return WriteJSON(w, http.StatusBadRequest, "Media type not provided") // 400
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		return WriteJSON(w, http.StatusInternalServerError, err) // 500
 	}
 
-	user_id, err := strconv.Atoi(params["user_id"])
-	if err == nil {
-		result, err := s.store.GetRating(params["id"], params["media_type"], user_id)
+	if err := s.authorize(r, id); err != nil {
+		return writeAuthError(w, err)
+	}
 
-		if err != nil {
-			return WriteJSON(w, http.StatusInternalServerError, err) // 500
-		}
+	// Every filter is optional, so they are read from the query string directly
+	query := r.URL.Query()
+	filter := &HistoryFilter{
+		MediaID:   query.Get("media_id"),
+		MediaType: query.Get("media_type"),
+	}
 
-		return WriteJSON(w, http.StatusOK, result)
-	} else {
-		result, err := s.store.GetAverage(params["id"], params["media_type"])
+	if from := query.Get("from"); from != "" {
+		if filter.From, err = time.Parse(time.RFC3339, from); err != nil {
+			return WriteJSON(w, http.StatusBadRequest, "Invalid from date") // 400
+		}
+	}
 
-		if err != nil {
-			return WriteJSON(w, http.StatusInternalServerError, err) // 500
+	if to := query.Get("to"); to != "" {
+		if filter.To, err = time.Parse(time.RFC3339, to); err != nil {
+			return WriteJSON(w, http.StatusBadRequest, "Invalid to date") // 400
 		}
+	}
 
-		return WriteJSON(w, http.StatusOK, result)
+	result, err := s.storeFor(r).GetHistory(id, filter)
+
+	if err != nil {
+		return WriteJSON(w, http.StatusInternalServerError, err) // 500
 	}
+
+	return WriteJSON(w, http.StatusOK, result)
 }
 
-func (s *APIServer) handleCreateRate(w http.ResponseWriter, r *http.Request) error {
+func (s *APIServer) handlePrivacy(w http.ResponseWriter, r *http.Request) error {
+	params := mux.Vars(r)
 
-	rating := new(Rate)
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		return WriteJSON(w, http.StatusBadRequest, "User id not provided") // 400
+	}
 
-	if err := json.NewDecoder(r.Body).Decode(rating); err != nil {
-		return WriteJSON(w, http.StatusBadRequest, "Guard failed") // 400
+	if err := s.authorize(r, id); err != nil {
+		return writeAuthError(w, err)
 	}
 
-	params := mux.Vars(r)
+	if r.Method == "GET" {
+		result, err := s.storeFor(r).GetPrivacy(id)
 
-	if params["id"] == "" {
-		return WriteJSON(w, http.StatusBadRequest, "Media id not provided") // 400
+		if err != nil {
+			return WriteJSON(w, http.StatusInternalServerError, err) // 500
+		}
+
+		return WriteJSON(w, http.StatusOK, result)
 	}
+	if r.Method == "PUT" {
+		settings := new(PrivacySettings)
 
-	if params["media_type"] == "" {
-		return WriteJSON(w, http.StatusBadRequest, "Media type not provided") // 400
+		if err := json.NewDecoder(r.Body).Decode(settings); err != nil {
+			return WriteJSON(w, http.StatusBadRequest, "Guard failed") // 400
+		}
+
+		if err := settings.Validate(); err != nil {
+			return WriteJSON(w, http.StatusBadRequest, err.Error()) // 400
+		}
+
+		if err := s.storeFor(r).SetPrivacy(id, settings); err != nil {
+			return WriteJSON(w, http.StatusInternalServerError, err) // 500
+		}
+
+		return WriteJSON(w, http.StatusOK, "Privacy updated")
 	}
 
-	if params["user_id"] == "" {
+	return fmt.Errorf("method not allowed %s", r.Method)
+}
+
+func (s *APIServer) handleFollow(w http.ResponseWriter, r *http.Request) error {
+	params := mux.Vars(r)
+
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
 		return WriteJSON(w, http.StatusBadRequest, "User id not provided") // 400
 	}
 
-	user_id, errUser := strconv.Atoi(params["user_id"])
-	if errUser != nil {
-		return WriteJSON(w, http.StatusInternalServerError, errUser) // 500
+	target, err := strconv.Atoi(params["target"])
+	if err != nil {
+		return WriteJSON(w, http.StatusBadRequest, "Followed user id not provided") // 400
 	}
 
-	if err := s.store.SetAverage(user_id, params["id"], params["media_type"], rating.Rating); err != nil {
-		return WriteJSON(w, http.StatusInternalServerError, err) // 500
+	if err := s.authorize(r, id); err != nil {
+		return writeAuthError(w, err)
 	}
 
-	return WriteJSON(w, http.StatusCreated, "Rate added") // 201
-}
+	if r.Method == "POST" {
+		if id == target {
+			return WriteJSON(w, http.StatusBadRequest, "Users can not follow themselves") // 400
+		}
 
-func (s *APIServer) handleUpdateRate(w http.ResponseWriter, r *http.Request) error {
+		if err := s.storeFor(r).Follow(id, target); err != nil {
+			return WriteJSON(w, http.StatusNotFound, err.Error()) // 404
+		}
 
-	rating := new(Rate)
+		return WriteJSON(w, http.StatusCreated, "User followed") // 201
+	}
+	if r.Method == "DELETE" {
+		if err := s.storeFor(r).Unfollow(id, target); err != nil {
+			return WriteJSON(w, http.StatusInternalServerError, err) // 500
+		}
 
-	if err := json.NewDecoder(r.Body).Decode(rating); err != nil {
-		return WriteJSON(w, http.StatusBadRequest, "Guard failed") // 400
+		return WriteJSON(w, http.StatusNoContent, "")
 	}
 
-	params := mux.Vars(r)
+	return fmt.Errorf("method not allowed %s", r.Method)
+}
 
-	if params["id"] == "" {
-		return WriteJSON(w, http.StatusBadRequest, "Media id not provided") // 400
+func (s *APIServer) handleFollowing(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return fmt.Errorf("method not allowed %s", r.Method)
 	}
 
-	if params["media_type"] == "" {
-		return WriteJSON(w, http.StatusBadRequest, "Media type not provided") // 400
-	}
+	params := mux.Vars(r)
 
-	if params["user_id"] == "" {
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
 		return WriteJSON(w, http.StatusBadRequest, "User id not provided") // 400
 	}
 
-	user_id, errUser := strconv.Atoi(params["user_id"])
-	if errUser != nil {
-		return WriteJSON(w, http.StatusInternalServerError, errUser) // 500
-	}
+	result, err := s.storeFor(r).GetFollowing(id)
 
-	if err := s.store.SetAverage(user_id, params["id"], params["media_type"], rating.Rating); err != nil {
+	if err != nil {
 		return WriteJSON(w, http.StatusInternalServerError, err) // 500
 	}
 
-	return WriteJSON(w, http.StatusCreated, "Rate updated") // 201
+	return WriteJSON(w, http.StatusOK, result)
 }
 
-// /likes/wishlist Functions
-
-func (s *APIServer) handleGetWishlist(w http.ResponseWriter, r *http.Request) error {
+func (s *APIServer) handleFollowers(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return fmt.Errorf("method not allowed %s", r.Method)
+	}
 
 	params := mux.Vars(r)
 
-	if params["id"] == "" {
-		return WriteJSON(w, http.StatusBadRequest, "User id not provided") // 400
-	}
-
 	id, err := strconv.Atoi(params["id"])
 	if err != nil {
-		return WriteJSON(w, http.StatusInternalServerError, err) // 500
+		return WriteJSON(w, http.StatusBadRequest, "User id not provided") // 400
 	}
 
-	result, err := s.store.GetWishlist(id, params["media_type"])
+	result, err := s.storeFor(r).GetFollowers(id)
 
 	if err != nil {
 		return WriteJSON(w, http.StatusInternalServerError, err) // 500
@@ -470,42 +824,892 @@ func (s *APIServer) handleGetWishlist(w http.ResponseWriter, r *http.Request) er
 	return WriteJSON(w, http.StatusOK, result)
 }
 
-func (s *APIServer) handleSetMediaWish(w http.ResponseWriter, r *http.Request) error {
-
-	wish := new(ChangeWishlist)
-
-	if err := json.NewDecoder(r.Body).Decode(wish); err != nil {
-		return WriteJSON(w, http.StatusBadRequest, "Guard failed") // 400
+func (s *APIServer) handleFeed(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return fmt.Errorf("method not allowed %s", r.Method)
 	}
 
 	params := mux.Vars(r)
 
-	if params["id"] == "" {
-		return WriteJSON(w, http.StatusBadRequest, "User id not provided") // 400
-	}
-
 	id, err := strconv.Atoi(params["id"])
 	if err != nil {
 		return WriteJSON(w, http.StatusBadRequest, "User id not provided") // 400
 	}
 
-	if wish.Type == "ADD" {
+	if err := s.authorize(r, id); err != nil {
+		return writeAuthError(w, err)
+	}
 
-		if err := s.store.AddToWishlist(id, wish.MediaID, wish.MediaType); err != nil {
-			return WriteJSON(w, http.StatusInternalServerError, err) // 500
-		}
+	query := r.URL.Query()
+	filter := &FeedFilter{
+		MediaType: query.Get("media_type"),
+		Limit:     20,
+	}
 
-		return WriteJSON(w, http.StatusCreated, "Media added to user wishlist") // 201
+	if limit := query.Get("limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil || filter.Limit < 1 || filter.Limit > 100 {
+			return WriteJSON(w, http.StatusBadRequest, "Invalid limit") // 400
+		}
+	}
 
-	} else if wish.Type == "RMV" {
+	if before := query.Get("before"); before != "" {
+		if filter.Before, err = time.Parse(time.RFC3339Nano, before); err != nil {
+			return WriteJSON(w, http.StatusBadRequest, "Invalid before date") // 400
+		}
+	}
+
+	if cursor := query.Get("cursor"); cursor != "" {
+		if err := filter.ParseFeedCursor(cursor); err != nil {
+			return WriteJSON(w, http.StatusBadRequest, "Invalid cursor") // 400
+		}
+	}
+
+	result, err := s.storeFor(r).GetFeed(id, filter)
+
+	if err != nil {
+		return WriteJSON(w, http.StatusInternalServerError, err) // 500
+	}
+
+	return WriteJSON(w, http.StatusOK, result)
+}
+
+// /likes/media Functions
+
+func (s *APIServer) handleCreateMedia(w http.ResponseWriter, r *http.Request) error {
+	params := mux.Vars(r)
+
+	if err := s.authorizeAdmin(r); err != nil {
+		return writeAuthError(w, err)
+	}
+
+	if params["id"] == "" {
+		return WriteJSON(w, http.StatusBadRequest, "Media id not provided") // 400
+	}
+
+	if params["media_type"] == "" {
+		return WriteJSON(w, http.StatusBadRequest, "Media type not provided") // 400
+	}
+
+	if err := s.storeFor(r).CreateMedia(params["id"], params["media_type"]); err != nil {
+		if errors.Is(err, errDeleted) {
+			return WriteJSON(w, http.StatusConflict, err.Error()) // 409
+		}
+		return WriteJSON(w, http.StatusInternalServerError, err) // 500
+	}
+
+	return WriteJSON(w, http.StatusCreated, "Media created") // 201
+}
+
+func (s *APIServer) handleGetMediaLikes(w http.ResponseWriter, r *http.Request) error {
+	params := mux.Vars(r)
+
+	if params["id"] == "" {
+		return WriteJSON(w, http.StatusBadRequest, "Media id not provided") // 400
+	}
+
+	if params["media_type"] == "" {
+		return WriteJSON(w, http.StatusBadRequest, "Media type not provided") // 400
+	}
+
+	etag, err := s.mediaETag(r, params["id"], params["media_type"])
+	if err != nil {
+		return WriteJSON(w, http.StatusInternalServerError, err) // 500
+	}
+
+	if notModified(w, r, etag) {
+		return nil
+	}
+
+	result, err := s.storeFor(r).GetMediaLikes(params["id"], params["media_type"], params["preference"], callerID(r))
+
+	if err != nil {
+		return WriteJSON(w, http.StatusInternalServerError, err) // 500
+	}
+
+	return WriteJSON(w, http.StatusOK, result)
+}
+
+func (s *APIServer) handleDeleteMedia(w http.ResponseWriter, r *http.Request) error {
+	params := mux.Vars(r)
+
+	if err := s.authorizeAdmin(r); err != nil {
+		return writeAuthError(w, err)
+	}
+
+	if params["id"] == "" {
+		return WriteJSON(w, http.StatusBadRequest, "Media id not provided") // 400
+	}
+
+	if params["media_type"] == "" {
+		return WriteJSON(w, http.StatusBadRequest, "Media type not provided") // 400
+	}
+
+	if err := s.storeFor(r).DeleteMedia(params["id"], params["media_type"]); err != nil {
+		return WriteJSON(w, http.StatusInternalServerError, err) // 500
+	}
+
+	return WriteJSON(w, http.StatusNoContent, "")
+}
+
+func (s *APIServer) handleRestoreMedia(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return fmt.Errorf("method not allowed %s", r.Method)
+	}
+
+	params := mux.Vars(r)
+
+	if err := s.authorizeAdmin(r); err != nil {
+		return writeAuthError(w, err)
+	}
+
+	if params["id"] == "" {
+		return WriteJSON(w, http.StatusBadRequest, "Media id not provided") // 400
+	}
+
+	if params["media_type"] == "" {
+		return WriteJSON(w, http.StatusBadRequest, "Media type not provided") // 400
+	}
+
+	if err := s.storeFor(r).RestoreMedia(params["id"], params["media_type"]); err != nil {
+		return WriteJSON(w, http.StatusNotFound, err.Error()) // 404
+	}
+
+	return WriteJSON(w, http.StatusOK, "Media restored")
+}
+
+// handleMediaStream pushes the like counters of a media as Server-Sent Events
+// every time they change. Streams reconnecting with Last-Event-ID get the
+// updates they missed, or the current counters when those are gone.
+func (s *APIServer) handleMediaStream(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return fmt.Errorf("method not allowed %s", r.Method)
+	}
+
+	params := mux.Vars(r)
+
+	if params["id"] == "" {
+		return WriteJSON(w, http.StatusBadRequest, "Media id not provided") // 400
+	}
+
+	if params["media_type"] == "" {
+		return WriteJSON(w, http.StatusBadRequest, "Media type not provided") // 400
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return WriteJSON(w, http.StatusInternalServerError, "Streaming not supported") // 500
+	}
+
+	// Streams outlive the write timeout of the server
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		return WriteJSON(w, http.StatusInternalServerError, err) // 500
+	}
+
+	lastID, _ := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
 
-		if err := s.store.RemoveFromWishlist(id, wish.MediaID, wish.MediaType); err != nil {
+	updates, missed, unsubscribe := s.stream.Subscribe(params["id"], params["media_type"], lastID)
+	defer unsubscribe()
+
+	if missed == nil {
+		counts, err := s.storeFor(r).GetMediaCounts(params["id"], params["media_type"])
+		if err != nil {
 			return WriteJSON(w, http.StatusInternalServerError, err) // 500
 		}
 
-		return WriteJSON(w, http.StatusCreated, "Media removed to user wishlist") // 201
+		missed = []StreamUpdate{{ID: lastID, Counts: counts}}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	for _, update := range missed {
+		if err := writeStreamUpdate(w, update); err != nil {
+			return nil
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(s.config.StreamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil
+		case <-s.done:
+			return nil
+		case update := <-updates:
+			if err := writeStreamUpdate(w, update); err != nil {
+				return nil
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return nil
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func writeStreamUpdate(w http.ResponseWriter, update StreamUpdate) error {
+	data, err := json.Marshal(update.Counts)
+	if err != nil {
+		return err
+	}
+
+	if update.ID > 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", update.ID); err != nil {
+			return err
+		}
+	}
+
+	_, err = fmt.Fprintf(w, "event: counts\ndata: %s\n\n", data)
+	return err
+}
+
+// /likes/rate Functions
+
+func (s *APIServer) handleAverage(w http.ResponseWriter, r *http.Request) error {
+
+	params := mux.Vars(r)
+
+	if params["id"] == "" {
+		return WriteJSON(w, http.StatusBadRequest, "Media id not provided") // 400
+	}
+
+	if params["media_type"] == "" {
+		return WriteJSON(w, http.StatusBadRequest, "Media type not provided") // 400
+	}
+
+	user_id, err := strconv.Atoi(params["user_id"])
+	if err == nil {
+		visible, err := s.visibleMediaTypes(r, user_id)
+		if err != nil {
+			return WriteJSON(w, http.StatusInternalServerError, err) // 500
+		}
+
+		if !visible[params["media_type"]] {
+			return WriteJSON(w, http.StatusForbidden, "User preferences are private") // 403
+		}
+
+		result, err := s.storeFor(r).GetRating(params["id"], params["media_type"], user_id)
+
+		if err != nil {
+			return WriteJSON(w, http.StatusInternalServerError, err) // 500
+		}
 
+		return WriteJSON(w, http.StatusOK, result)
 	} else {
-		return WriteJSON(w, http.StatusBadRequest, "Action type not allowed") // 400
+		result, err := s.storeFor(r).GetAverage(params["id"], params["media_type"])
+
+		if err != nil {
+			return WriteJSON(w, http.StatusInternalServerError, err) // 500
+		}
+
+		return WriteJSON(w, http.StatusOK, result)
+	}
+}
+
+func (s *APIServer) handleCreateRate(w http.ResponseWriter, r *http.Request) error {
+
+	rating := new(Rate)
+
+	if err := json.NewDecoder(r.Body).Decode(rating); err != nil {
+		return WriteJSON(w, http.StatusBadRequest, "Guard failed") // 400
+	}
+
+	params := mux.Vars(r)
+
+	if params["id"] == "" {
+		return WriteJSON(w, http.StatusBadRequest, "Media id not provided") // 400
+	}
+
+	if params["media_type"] == "" {
+		return WriteJSON(w, http.StatusBadRequest, "Media type not provided") // 400
+	}
+
+	if params["user_id"] == "" {
+		return WriteJSON(w, http.StatusBadRequest, "User id not provided") // 400
+	}
+
+	user_id, errUser := strconv.Atoi(params["user_id"])
+	if errUser != nil {
+		return WriteJSON(w, http.StatusInternalServerError, errUser) // 500
+	}
+
+	if err := s.authorize(r, user_id); err != nil {
+		return writeAuthError(w, err)
+	}
+
+	version, err := s.storeFor(r).SetAverage(user_id, params["id"], params["media_type"], rating, actorID(r, user_id), ifMatch(r))
+	if err != nil {
+		if errors.Is(err, errReviewBanned) {
+			return WriteJSON(w, http.StatusForbidden, err.Error()) // 403
+		}
+		return writePreconditionError(w, err)
+	}
+
+	w.Header().Set("ETag", userTag(version))
+
+	return WriteJSON(w, http.StatusCreated, "Rate added") // 201
+}
+
+func (s *APIServer) handleUpdateRate(w http.ResponseWriter, r *http.Request) error {
+
+	rating := new(Rate)
+
+	if err := json.NewDecoder(r.Body).Decode(rating); err != nil {
+		return WriteJSON(w, http.StatusBadRequest, "Guard failed") // 400
+	}
+
+	params := mux.Vars(r)
+
+	if params["id"] == "" {
+		return WriteJSON(w, http.StatusBadRequest, "Media id not provided") // 400
+	}
+
+	if params["media_type"] == "" {
+		return WriteJSON(w, http.StatusBadRequest, "Media type not provided") // 400
+	}
+
+	if params["user_id"] == "" {
+		return WriteJSON(w, http.StatusBadRequest, "User id not provided") // 400
+	}
+
+	user_id, errUser := strconv.Atoi(params["user_id"])
+	if errUser != nil {
+		return WriteJSON(w, http.StatusInternalServerError, errUser) // 500
+	}
+
+	if err := s.authorize(r, user_id); err != nil {
+		return writeAuthError(w, err)
+	}
+
+	version, err := s.storeFor(r).SetAverage(user_id, params["id"], params["media_type"], rating, actorID(r, user_id), ifMatch(r))
+	if err != nil {
+		if errors.Is(err, errReviewBanned) {
+			return WriteJSON(w, http.StatusForbidden, err.Error()) // 403
+		}
+		return writePreconditionError(w, err)
 	}
+
+	w.Header().Set("ETag", userTag(version))
+
+	return WriteJSON(w, http.StatusCreated, "Rate updated") // 201
+}
+
+// /likes/wishlist Functions
+
+func (s *APIServer) handleGetWishlist(w http.ResponseWriter, r *http.Request) error {
+
+	params := mux.Vars(r)
+
+	if params["id"] == "" {
+		return WriteJSON(w, http.StatusBadRequest, "User id not provided") // 400
+	}
+
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		return WriteJSON(w, http.StatusInternalServerError, err) // 500
+	}
+
+	etag, err := s.userETag(r, id)
+	if err != nil {
+		return WriteJSON(w, http.StatusInternalServerError, err) // 500
+	}
+
+	if notModified(w, r, etag) {
+		return nil
+	}
+
+	result, err := s.storeFor(r).GetWishlist(id, params["media_type"])
+
+	if err != nil {
+		return WriteJSON(w, http.StatusInternalServerError, err) // 500
+	}
+
+	visible, err := s.visibleMediaTypes(r, id)
+	if err != nil {
+		return WriteJSON(w, http.StatusInternalServerError, err) // 500
+	}
+
+	if !visible["MOV"] {
+		result.Movies = nil
+	}
+	if !visible["SON"] {
+		result.Songs = nil
+	}
+	if !visible["BOO"] {
+		result.Books = nil
+	}
+
+	return WriteJSON(w, http.StatusOK, result)
+}
+
+func (s *APIServer) handleSetMediaWish(w http.ResponseWriter, r *http.Request) error {
+
+	wish := new(ChangeWishlist)
+
+	if err := json.NewDecoder(r.Body).Decode(wish); err != nil {
+		return WriteJSON(w, http.StatusBadRequest, "Guard failed") // 400
+	}
+
+	params := mux.Vars(r)
+
+	if params["id"] == "" {
+		return WriteJSON(w, http.StatusBadRequest, "User id not provided") // 400
+	}
+
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		return WriteJSON(w, http.StatusBadRequest, "User id not provided") // 400
+	}
+
+	if err := s.authorize(r, id); err != nil {
+		return writeAuthError(w, err)
+	}
+
+	if wish.Type == "ADD" {
+
+		version, err := s.storeFor(r).AddToWishlist(id, wish.MediaID, wish.MediaType, actorID(r, id), ifMatch(r))
+		if err != nil {
+			return writePreconditionError(w, err)
+		}
+
+		w.Header().Set("ETag", userTag(version))
+
+		return WriteJSON(w, http.StatusCreated, "Media added to user wishlist") // 201
+
+	} else if wish.Type == "RMV" {
+
+		version, err := s.storeFor(r).RemoveFromWishlist(id, wish.MediaID, wish.MediaType, actorID(r, id), ifMatch(r))
+		if err != nil {
+			return writePreconditionError(w, err)
+		}
+
+		w.Header().Set("ETag", userTag(version))
+
+		return WriteJSON(w, http.StatusCreated, "Media removed to user wishlist") // 201
+
+	} else {
+		return WriteJSON(w, http.StatusBadRequest, "Action type not allowed") // 400
+	}
+}
+
+// /likes/reviews Functions
+
+func (s *APIServer) handleReviews(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return fmt.Errorf("method not allowed %s", r.Method)
+	}
+
+	params := mux.Vars(r)
+
+	if params["id"] == "" {
+		return WriteJSON(w, http.StatusBadRequest, "Media id not provided") // 400
+	}
+
+	if params["media_type"] == "" {
+		return WriteJSON(w, http.StatusBadRequest, "Media type not provided") // 400
+	}
+
+	result, err := s.storeFor(r).GetReviews(params["id"], params["media_type"], callerID(r))
+
+	if err != nil {
+		return WriteJSON(w, http.StatusInternalServerError, err) // 500
+	}
+
+	return WriteJSON(w, http.StatusOK, result)
+}
+
+func (s *APIServer) handleReportReview(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return fmt.Errorf("method not allowed %s", r.Method)
+	}
+
+	report := new(ReportReview)
+
+	if err := json.NewDecoder(r.Body).Decode(report); err != nil {
+		return WriteJSON(w, http.StatusBadRequest, "Guard failed") // 400
+	}
+
+	if err := s.authorize(r, report.ReporterID); err != nil {
+		return writeAuthError(w, err)
+	}
+
+	params := mux.Vars(r)
+
+	if params["id"] == "" {
+		return WriteJSON(w, http.StatusBadRequest, "Media id not provided") // 400
+	}
+
+	if params["media_type"] == "" {
+		return WriteJSON(w, http.StatusBadRequest, "Media type not provided") // 400
+	}
+
+	user_id, err := strconv.Atoi(params["user_id"])
+	if err != nil {
+		return WriteJSON(w, http.StatusBadRequest, "User id not provided") // 400
+	}
+
+	if err := s.storeFor(r).ReportReview(user_id, params["id"], params["media_type"], report); err != nil {
+		return WriteJSON(w, http.StatusNotFound, err.Error()) // 404
+	}
+
+	return WriteJSON(w, http.StatusCreated, "Review reported") // 201
+}
+
+// /likes/admin/reviews Functions
+
+func (s *APIServer) handleFlaggedReviews(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return fmt.Errorf("method not allowed %s", r.Method)
+	}
+
+	if err := s.authorizeAdmin(r); err != nil {
+		return writeAuthError(w, err)
+	}
+
+	result, err := s.storeFor(r).GetFlaggedReviews()
+
+	if err != nil {
+		return WriteJSON(w, http.StatusInternalServerError, err) // 500
+	}
+
+	return WriteJSON(w, http.StatusOK, result)
+}
+
+func (s *APIServer) handleModerationAudit(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return fmt.Errorf("method not allowed %s", r.Method)
+	}
+
+	if err := s.authorizeAdmin(r); err != nil {
+		return writeAuthError(w, err)
+	}
+
+	result, err := s.storeFor(r).GetModerationAudit()
+
+	if err != nil {
+		return WriteJSON(w, http.StatusInternalServerError, err) // 500
+	}
+
+	return WriteJSON(w, http.StatusOK, result)
+}
+
+func (s *APIServer) handleModerateReview(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return fmt.Errorf("method not allowed %s", r.Method)
+	}
+
+	if err := s.authorizeAdmin(r); err != nil {
+		return writeAuthError(w, err)
+	}
+
+	moderate := new(ModerateReview)
+
+	if err := json.NewDecoder(r.Body).Decode(moderate); err != nil {
+		return WriteJSON(w, http.StatusBadRequest, "Guard failed") // 400
+	}
+
+	if moderate.Action != "APR" && moderate.Action != "RMV" && moderate.Action != "BAN" {
+		return WriteJSON(w, http.StatusBadRequest, "Action type not allowed") // 400
+	}
+
+	// The audit records the authenticated admin, authorizeAdmin only lets
+	// verified callers through. The subject of a service is its X-Actor-ID,
+	// so services are recorded by their key.
+	claims, _ := ClaimsFromContext(r.Context())
+	moderate.AdminID = claims.Subject
+	if claims.APIKey != "" {
+		moderate.AdminID = "key:" + claims.APIKey
+	}
+
+	params := mux.Vars(r)
+
+	if params["id"] == "" {
+		return WriteJSON(w, http.StatusBadRequest, "Media id not provided") // 400
+	}
+
+	if params["media_type"] == "" {
+		return WriteJSON(w, http.StatusBadRequest, "Media type not provided") // 400
+	}
+
+	user_id, err := strconv.Atoi(params["user_id"])
+	if err != nil {
+		return WriteJSON(w, http.StatusBadRequest, "User id not provided") // 400
+	}
+
+	if err := s.storeFor(r).ModerateReview(user_id, params["id"], params["media_type"], moderate); err != nil {
+		return WriteJSON(w, http.StatusNotFound, err.Error()) // 404
+	}
+
+	return WriteJSON(w, http.StatusOK, "Review moderated")
+}
+
+// /likes/webhooks Functions
+
+func (s *APIServer) handleWebhooks(w http.ResponseWriter, r *http.Request) error {
+	if err := s.authorizeAdmin(r); err != nil {
+		return writeAuthError(w, err)
+	}
+
+	if r.Method == "POST" {
+		return s.handleCreateWebhook(w, r)
+	}
+	if r.Method == "GET" {
+		return s.handleGetWebhooks(w, r)
+	}
+
+	return fmt.Errorf("method not allowed %s", r.Method)
+}
+
+func (s *APIServer) handleWebhook(w http.ResponseWriter, r *http.Request) error {
+	if err := s.authorizeAdmin(r); err != nil {
+		return writeAuthError(w, err)
+	}
+
+	if r.Method == "GET" {
+		return s.handleGetWebhook(w, r)
+	}
+	if r.Method == "PUT" {
+		return s.handleUpdateWebhook(w, r)
+	}
+	if r.Method == "DELETE" {
+		return s.handleDeleteWebhook(w, r)
+	}
+
+	return fmt.Errorf("method not allowed %s", r.Method)
+}
+
+func (s *APIServer) handleCreateWebhook(w http.ResponseWriter, r *http.Request) error {
+	webhook := new(Webhook)
+
+	if err := json.NewDecoder(r.Body).Decode(webhook); err != nil {
+		return WriteJSON(w, http.StatusBadRequest, "Guard failed") // 400
+	}
+
+	if err := s.webhooks.ValidateURL(r.Context(), webhook.URL); err != nil {
+		return WriteJSON(w, http.StatusBadRequest, "Invalid webhook url: "+err.Error()) // 400
+	}
+
+	if webhook.EventTypes == nil {
+		webhook.EventTypes = []string{}
+	}
+
+	if webhook.MediaTypes == nil {
+		webhook.MediaTypes = []string{}
+	}
+
+	webhook.ID = newID()
+	webhook.Secret = newSecret()
+	webhook.CreatedAt = time.Now().UTC()
+
+	if err := s.storeFor(r).CreateWebhook(webhook); err != nil {
+		return WriteJSON(w, http.StatusInternalServerError, err) // 500
+	}
+
+	// The secret is only shown once, receivers need it to check signatures
+	return WriteJSON(w, http.StatusCreated, webhook) // 201
+}
+
+func (s *APIServer) handleGetWebhooks(w http.ResponseWriter, r *http.Request) error {
+	result, err := s.storeFor(r).GetWebhooks()
+
+	if err != nil {
+		return WriteJSON(w, http.StatusInternalServerError, err) // 500
+	}
+
+	for i := 0; i < len(result); i++ {
+		result[i].Secret = ""
+	}
+
+	return WriteJSON(w, http.StatusOK, result)
+}
+
+func (s *APIServer) handleGetWebhook(w http.ResponseWriter, r *http.Request) error {
+	params := mux.Vars(r)
+
+	result, err := s.storeFor(r).GetWebhook(params["id"])
+
+	if err != nil {
+		return WriteJSON(w, http.StatusNotFound, err.Error()) // 404
+	}
+
+	result.Secret = ""
+
+	return WriteJSON(w, http.StatusOK, result)
+}
+
+func (s *APIServer) handleUpdateWebhook(w http.ResponseWriter, r *http.Request) error {
+	webhook := new(Webhook)
+
+	if err := json.NewDecoder(r.Body).Decode(webhook); err != nil {
+		return WriteJSON(w, http.StatusBadRequest, "Guard failed") // 400
+	}
+
+	if err := s.webhooks.ValidateURL(r.Context(), webhook.URL); err != nil {
+		return WriteJSON(w, http.StatusBadRequest, "Invalid webhook url: "+err.Error()) // 400
+	}
+
+	if webhook.EventTypes == nil {
+		webhook.EventTypes = []string{}
+	}
+
+	if webhook.MediaTypes == nil {
+		webhook.MediaTypes = []string{}
+	}
+
+	params := mux.Vars(r)
+	webhook.ID = params["id"]
+
+	if err := s.storeFor(r).UpdateWebhook(webhook); err != nil {
+		return WriteJSON(w, http.StatusNotFound, err.Error()) // 404
+	}
+
+	return WriteJSON(w, http.StatusOK, "Webhook updated")
+}
+
+func (s *APIServer) handleDeleteWebhook(w http.ResponseWriter, r *http.Request) error {
+	params := mux.Vars(r)
+
+	if err := s.storeFor(r).DeleteWebhook(params["id"]); err != nil {
+		return WriteJSON(w, http.StatusInternalServerError, err) // 500
+	}
+
+	return WriteJSON(w, http.StatusNoContent, "")
+}
+
+// handleWebhookTest sends a single test event to a webhook, without retries,
+// and reports how it answered.
+func (s *APIServer) handleWebhookTest(w http.ResponseWriter, r *http.Request) error {
+	if err := s.authorizeAdmin(r); err != nil {
+		return writeAuthError(w, err)
+	}
+
+	if r.Method != "POST" {
+		return fmt.Errorf("method not allowed %s", r.Method)
+	}
+
+	params := mux.Vars(r)
+
+	webhook, err := s.storeFor(r).GetWebhook(params["id"])
+	if err != nil {
+		return WriteJSON(w, http.StatusNotFound, err.Error()) // 404
+	}
+
+	result := &WebhookTestResult{}
+	result.Status, err = s.webhooks.Send(r.Context(), webhook, NewEvent(EventWebhookTest))
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	return WriteJSON(w, http.StatusOK, result)
+}
+
+func (s *APIServer) handleDeadLetters(w http.ResponseWriter, r *http.Request) error {
+	if err := s.authorizeAdmin(r); err != nil {
+		return writeAuthError(w, err)
+	}
+
+	if r.Method != "GET" {
+		return fmt.Errorf("method not allowed %s", r.Method)
+	}
+
+	params := mux.Vars(r)
+
+	result, err := s.storeFor(r).GetDeadLetters(params["id"])
+
+	if err != nil {
+		return WriteJSON(w, http.StatusInternalServerError, err) // 500
+	}
+
+	return WriteJSON(w, http.StatusOK, result)
+}
+
+// /likes/admin/api-keys Functions
+
+func (s *APIServer) handleAPIKeys(w http.ResponseWriter, r *http.Request) error {
+	if err := s.authorizeAdmin(r); err != nil {
+		return writeAuthError(w, err)
+	}
+
+	if r.Method == "POST" {
+		create := new(CreateAPIKey)
+
+		if err := json.NewDecoder(r.Body).Decode(create); err != nil {
+			return WriteJSON(w, http.StatusBadRequest, "Guard failed") // 400
+		}
+
+		key, err := s.apiKeys.Create(create)
+		if err != nil {
+			return WriteJSON(w, http.StatusBadRequest, err.Error()) // 400
+		}
+
+		return WriteJSON(w, http.StatusCreated, key) // 201
+	}
+	if r.Method == "GET" {
+		result, err := s.apiKeys.Keys()
+
+		if err != nil {
+			return WriteJSON(w, http.StatusInternalServerError, err) // 500
+		}
+
+		return WriteJSON(w, http.StatusOK, result)
+	}
+
+	return fmt.Errorf("method not allowed %s", r.Method)
+}
+
+func (s *APIServer) handleRevokeAPIKey(w http.ResponseWriter, r *http.Request) error {
+	if err := s.authorizeAdmin(r); err != nil {
+		return writeAuthError(w, err)
+	}
+
+	if r.Method != "DELETE" {
+		return fmt.Errorf("method not allowed %s", r.Method)
+	}
+
+	params := mux.Vars(r)
+
+	if err := s.apiKeys.Revoke(params["id"]); err != nil {
+		return WriteJSON(w, http.StatusNotFound, err.Error()) // 404
+	}
+
+	return WriteJSON(w, http.StatusNoContent, "")
+}
+
+func (s *APIServer) handleRotateAPIKey(w http.ResponseWriter, r *http.Request) error {
+	if err := s.authorizeAdmin(r); err != nil {
+		return writeAuthError(w, err)
+	}
+
+	if r.Method != "POST" {
+		return fmt.Errorf("method not allowed %s", r.Method)
+	}
+
+	// The body is optional
+	rotate := new(RotateAPIKey)
+	if err := json.NewDecoder(r.Body).Decode(rotate); err != nil && err != io.EOF {
+		return WriteJSON(w, http.StatusBadRequest, "Guard failed") // 400
+	}
+
+	var grace time.Duration
+	if rotate.GracePeriod != "" {
+		var err error
+		if grace, err = time.ParseDuration(rotate.GracePeriod); err != nil || grace < 0 {
+			return WriteJSON(w, http.StatusBadRequest, "Invalid grace period") // 400
+		}
+	}
+
+	params := mux.Vars(r)
+
+	key, err := s.apiKeys.Rotate(params["id"], grace)
+	if err != nil {
+		return WriteJSON(w, http.StatusNotFound, err.Error()) // 404
+	}
+
+	return WriteJSON(w, http.StatusOK, key)
 }
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ScopeReadLikes  = "read:likes"
+	ScopeWriteLikes = "write:likes"
+	ScopeAdmin      = "admin"
+)
+
+var errInvalidAPIKey = errors.New("invalid API key")
+
+// errAPIKeyNotFound is returned by the store for a key id which does not
+// exist, telling a bad key apart from a store which is down.
+var errAPIKeyNotFound = errors.New("not found")
+
+type APIKey struct {
+	ID     string   `json:"id"`
+	Name   string   `json:"name"`
+	Key    string   `json:"key,omitempty"` // Only returned on creation and rotation
+	Scopes []string `json:"scopes"`
+
+	// Hashes of the current secret and of the one replaced by the last
+	// rotation, which stays valid until PreviousExpiresAt.
+	Hash              string     `json:"-"`
+	PreviousHash      string     `json:"-"`
+	PreviousExpiresAt *time.Time `json:"previous_expires_at,omitempty"`
+
+	Usage      int64      `json:"usage"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+	RotatedAt  *time.Time `json:"rotated_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+type CreateAPIKey struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+type RotateAPIKey struct {
+	GracePeriod string `json:"grace_period"` // Go duration, API_KEY_ROTATION_GRACE by default
+}
+
+func NewAPIKey(props map[string]any) *APIKey {
+	createdAt, _ := props["created_at"].(int64)
+
+	key := &APIKey{
+		ID:        props["id"].(string),
+		Scopes:    stringList(props["scopes"]),
+		CreatedAt: time.UnixMilli(createdAt),
+	}
+
+	key.Name, _ = props["name"].(string)
+	key.Hash, _ = props["hash"].(string)
+	key.PreviousHash, _ = props["previous_hash"].(string)
+	key.Usage, _ = props["usage"].(int64)
+	key.PreviousExpiresAt = optionalTime(props["previous_expires_at"])
+	key.LastUsedAt = optionalTime(props["last_used_at"])
+	key.RotatedAt = optionalTime(props["rotated_at"])
+	key.RevokedAt = optionalTime(props["revoked_at"])
+
+	return key
+}
+
+// optionalTime converts an epoch milliseconds property which may be missing.
+func optionalTime(value any) *time.Time {
+	millis, ok := value.(int64)
+	if !ok {
+		return nil
+	}
+
+	t := time.UnixMilli(millis)
+	return &t
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func validScope(scope string) bool {
+	return scope == ScopeReadLikes || scope == ScopeWriteLikes || scope == ScopeAdmin
+}
+
+// HasScope reports whether the key grants a scope, admin granting every one.
+// A key without scopes grants none.
+func (k *APIKey) HasScope(scope string) bool {
+	return slices.Contains(k.Scopes, scope) || slices.Contains(k.Scopes, ScopeAdmin)
+}
+
+// methodScope returns the scope a key needs for a method: reads need
+// read:likes and everything else write:likes.
+func methodScope(method string) string {
+	if method == "GET" || method == "HEAD" || method == "OPTIONS" {
+		return ScopeReadLikes
+	}
+
+	return ScopeWriteLikes
+}
+
+// Allows reports whether the key may call a route with a method.
+func (k *APIKey) Allows(method string) bool {
+	return k.HasScope(methodScope(method))
+}
+
+// Claims returns the identity of a service calling with the key. Services act
+// on behalf of the user given in X-Actor-ID, if any.
+func (k *APIKey) Claims(r *http.Request, adminScope string) *Claims {
+	scopes := make([]string, len(k.Scopes))
+	for i, scope := range k.Scopes {
+		if scope == ScopeAdmin {
+			scope = adminScope
+		}
+		scopes[i] = scope
+	}
+
+	subject := r.Header.Get("X-Actor-ID")
+	if subject == "" {
+		subject = "key:" + k.ID
+	}
+
+	return &Claims{
+		Subject:  subject,
+		Scope:    strings.Join(scopes, " "),
+		Verified: true,
+		APIKey:   k.ID,
+	}
+}
+
+// APIKeyManager issues and verifies API keys, of the form pk_<id>_<secret>,
+// and counts their usage in memory until it is flushed to the store. Keys read
+// from the store are cached for cacheTTL, so a key revoked or rotated on
+// another instance keeps working there until its entry expires.
+type APIKeyManager struct {
+	store     Storage
+	bootstrap string
+	grace     time.Duration
+	cacheTTL  time.Duration
+
+	mu       sync.Mutex
+	usage    map[string]int64
+	lastUsed map[string]time.Time
+	cache    map[string]cachedAPIKey
+}
+
+type cachedAPIKey struct {
+	key     *APIKey
+	expires time.Time
+}
+
+// NewAPIKeyManager accepts the bootstrap key, when set, as an admin key which
+// is not stored, to create the first keys. A zero cacheTTL reads every key
+// from the store.
+func NewAPIKeyManager(store Storage, bootstrap string, grace time.Duration, cacheTTL time.Duration) *APIKeyManager {
+	return &APIKeyManager{
+		store:     store,
+		bootstrap: bootstrap,
+		grace:     grace,
+		cacheTTL:  cacheTTL,
+		usage:     map[string]int64{},
+		lastUsed:  map[string]time.Time{},
+		cache:     map[string]cachedAPIKey{},
+	}
+}
+
+func newRawKey(id string) (string, string) {
+	secret := newSecret()
+	return "pk_" + id + "_" + secret, hashSecret(secret)
+}
+
+func (m *APIKeyManager) Create(create *CreateAPIKey) (*APIKey, error) {
+	if len(create.Scopes) == 0 {
+		return nil, errors.New("at least one scope is required")
+	}
+
+	for _, scope := range create.Scopes {
+		if !validScope(scope) {
+			return nil, fmt.Errorf("scope %s not allowed", scope)
+		}
+	}
+
+	key := &APIKey{
+		ID:        newID(),
+		Name:      create.Name,
+		Scopes:    create.Scopes,
+		CreatedAt: time.Now().UTC(),
+	}
+	key.Key, key.Hash = newRawKey(key.ID)
+
+	if err := m.store.CreateAPIKey(key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// Rotate replaces the secret of a key, the old one staying valid for the
+// grace period, or the default one when zero.
+func (m *APIKeyManager) Rotate(id string, grace time.Duration) (*APIKey, error) {
+	if grace == 0 {
+		grace = m.grace
+	}
+
+	raw, hash := newRawKey(id)
+	key, err := m.store.RotateAPIKey(id, hash, time.Now().Add(grace))
+	if err != nil {
+		return nil, err
+	}
+	m.Forget(id)
+
+	key.Key = raw
+	return key, nil
+}
+
+// Revoke revokes a key, which stops working at once on this instance.
+func (m *APIKeyManager) Revoke(id string) error {
+	if err := m.store.RevokeAPIKey(id); err != nil {
+		return err
+	}
+	m.Forget(id)
+
+	return nil
+}
+
+// Forget drops a key from the cache.
+func (m *APIKeyManager) Forget(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.cache, id)
+}
+
+// storedKey returns a key from the cache, or from the store when it is
+// missing or expired.
+func (m *APIKeyManager) storedKey(id string) (*APIKey, error) {
+	now := time.Now()
+
+	m.mu.Lock()
+	cached, ok := m.cache[id]
+	m.mu.Unlock()
+
+	if ok && now.Before(cached.expires) {
+		return cached.key, nil
+	}
+
+	key, err := m.store.GetAPIKey(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.cacheTTL > 0 {
+		m.mu.Lock()
+		m.cache[id] = cachedAPIKey{key: key, expires: now.Add(m.cacheTTL)}
+		m.mu.Unlock()
+	}
+
+	return key, nil
+}
+
+// Keys returns the stored keys with the usage not flushed yet.
+func (m *APIKeyManager) Keys() ([]APIKey, error) {
+	keys, err := m.store.GetAPIKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range keys {
+		keys[i].Usage += m.usage[keys[i].ID]
+		if last, ok := m.lastUsed[keys[i].ID]; ok {
+			keys[i].LastUsedAt = &last
+		}
+	}
+
+	return keys, nil
+}
+
+// Verify returns the key of a raw API key and counts its use.
+func (m *APIKeyManager) Verify(raw string) (*APIKey, error) {
+	if m.bootstrap != "" && subtle.ConstantTimeCompare([]byte(raw), []byte(m.bootstrap)) == 1 {
+		return &APIKey{ID: "bootstrap", Name: "bootstrap", Scopes: []string{ScopeAdmin}}, nil
+	}
+
+	parts := strings.SplitN(raw, "_", 3)
+	if len(parts) != 3 || parts[0] != "pk" {
+		return nil, errInvalidAPIKey
+	}
+
+	key, err := m.storedKey(parts[1])
+	if errors.Is(err, errAPIKeyNotFound) {
+		return nil, errInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if key.RevokedAt != nil {
+		return nil, errInvalidAPIKey
+	}
+
+	hash := hashSecret(parts[2])
+	current := subtle.ConstantTimeCompare([]byte(hash), []byte(key.Hash)) == 1
+	previous := key.PreviousHash != "" && key.PreviousExpiresAt != nil && time.Now().Before(*key.PreviousExpiresAt) &&
+		subtle.ConstantTimeCompare([]byte(hash), []byte(key.PreviousHash)) == 1
+
+	if !current && !previous {
+		return nil, errInvalidAPIKey
+	}
+
+	m.mu.Lock()
+	m.usage[key.ID]++
+	m.lastUsed[key.ID] = time.Now()
+	m.mu.Unlock()
+
+	return key, nil
+}
+
+// Flush adds the usage counted since the last flush to the store.
+func (m *APIKeyManager) Flush() {
+	m.mu.Lock()
+	usage, lastUsed := m.usage, m.lastUsed
+	m.usage, m.lastUsed = map[string]int64{}, map[string]time.Time{}
+	m.mu.Unlock()
+
+	for id, count := range usage {
+		if err := m.store.AddAPIKeyUsage(id, count, lastUsed[id]); err != nil {
+			slog.Error("Flush of API key usage failed", "api_key_id", id, "error", err)
+		}
+	}
+}
+
+// RunAPIKeyUsage flushes the usage of the API keys every interval.
+func RunAPIKeyUsage(ctx context.Context, m *APIKeyManager, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		m.Flush()
+	}
+}
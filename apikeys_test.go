@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// keyStore holds a single API key and counts its reads. Other Storage methods
+// are not implemented.
+type keyStore struct {
+	Storage
+	key   *APIKey
+	reads int
+	err   error // Returned by GetAPIKey when the store is down
+}
+
+func (s *keyStore) GetAPIKey(id string) (*APIKey, error) {
+	s.reads++
+	if s.err != nil {
+		return nil, s.err
+	}
+	if s.key == nil || s.key.ID != id {
+		return nil, fmt.Errorf("API key %s %w", id, errAPIKeyNotFound)
+	}
+
+	key := *s.key
+	return &key, nil
+}
+
+func (s *keyStore) RevokeAPIKey(id string) error {
+	now := time.Now()
+	s.key.RevokedAt = &now
+
+	return nil
+}
+
+func TestAPIKeyCache(t *testing.T) {
+	raw, hash := newRawKey("k")
+	store := &keyStore{key: &APIKey{ID: "k", Hash: hash, Scopes: []string{ScopeReadLikes}}}
+	manager := NewAPIKeyManager(store, "", time.Hour, 20*time.Millisecond)
+
+	verify := func(valid bool, reads int) {
+		t.Helper()
+
+		if _, err := manager.Verify(raw); (err == nil) != valid {
+			t.Errorf("Verify = %v, want valid %v", err, valid)
+		}
+		if store.reads != reads {
+			t.Errorf("key read %d times, want %d", store.reads, reads)
+		}
+	}
+
+	verify(true, 1)
+	verify(true, 1)
+
+	// Revoked elsewhere, the cached key works until it expires
+	now := time.Now()
+	store.key.RevokedAt = &now
+	verify(true, 1)
+
+	time.Sleep(30 * time.Millisecond)
+	verify(false, 2)
+
+	// Revoked here, it stops working at once
+	store.key.RevokedAt = nil
+	time.Sleep(30 * time.Millisecond)
+	verify(true, 3)
+
+	if err := manager.Revoke("k"); err != nil {
+		t.Fatal(err)
+	}
+	verify(false, 4)
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	tests := []struct {
+		name   string
+		scopes []string
+		read   bool
+		write  bool
+	}{
+		{"no scope", nil, false, false},
+		{"empty scopes", []string{}, false, false},
+		{"read", []string{ScopeReadLikes}, true, false},
+		{"write", []string{ScopeWriteLikes}, false, true},
+		{"admin", []string{ScopeAdmin}, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := &APIKey{ID: "k", Scopes: tt.scopes}
+
+			if got := key.Allows("GET"); got != tt.read {
+				t.Errorf("Allows(GET) = %v, want %v", got, tt.read)
+			}
+			if got := key.Allows("POST"); got != tt.write {
+				t.Errorf("Allows(POST) = %v, want %v", got, tt.write)
+			}
+		})
+	}
+}
+
+func TestAuthenticateAPIKeyErrors(t *testing.T) {
+	raw, hash := newRawKey("k")
+	unknown, _ := newRawKey("other")
+
+	tests := []struct {
+		name   string
+		raw    string
+		err    error
+		status int
+	}{
+		{"valid key", raw, nil, http.StatusOK},
+		{"unknown key", unknown, nil, http.StatusUnauthorized},
+		{"malformed key", "nope", nil, http.StatusUnauthorized},
+		{"store down", raw, errors.New("connection refused"), http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &keyStore{key: &APIKey{ID: "k", Hash: hash, Scopes: []string{ScopeReadLikes}}, err: tt.err}
+			s := &APIServer{config: &Config{}, apiKeys: NewAPIKeyManager(store, "", time.Hour, 0)}
+
+			handler := s.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			r := httptest.NewRequest("GET", "/likes/user/1", nil)
+			r.Header.Set("X-API-Key", tt.raw)
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
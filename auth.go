@@ -0,0 +1,440 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errUnauthenticated = errors.New("authentication required")
+	errForbidden       = errors.New("not allowed to act on this resource")
+)
+
+type contextKey string
+
+const claimsKey contextKey = "claims"
+
+type Claims struct {
+	Subject   string `json:"sub"`
+	Issuer    string `json:"iss"`
+	Audience  any    `json:"aud"` // A string or a list of strings
+	Expiry    int64  `json:"exp"`
+	NotBefore int64  `json:"nbf"`
+	Scope     string `json:"scope"` // Space separated scopes
+
+	// Verified is false for the identity taken from X-Actor-ID when
+	// authentication is disabled.
+	Verified bool `json:"-"`
+
+	// APIKey is the id of the key of a calling service
+	APIKey string `json:"-"`
+}
+
+// HasScope reports whether the claims grant a scope.
+func (c *Claims) HasScope(scope string) bool {
+	for _, s := range strings.Fields(c.Scope) {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *Claims) hasAudience(audience string) bool {
+	if aud, ok := c.Audience.(string); ok {
+		return aud == audience
+	}
+
+	if auds, ok := c.Audience.([]any); ok {
+		for _, aud := range auds {
+			if aud == audience {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// ClaimsFromContext returns the identity of the caller of a request.
+func ClaimsFromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(claimsKey).(*Claims)
+	return claims, ok
+}
+
+// Authenticator verifies HS256 tokens signed with a shared secret and RS256
+// tokens signed with a key of a JWKS, read from a file or an URL.
+type Authenticator struct {
+	secret     []byte
+	issuer     string
+	audience   string
+	adminScope string
+
+	jwksFile string
+	jwksURL  string
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+}
+
+// NewAuthenticator returns nil when no secret nor JWKS is configured, which
+// disables authentication.
+func NewAuthenticator(config *Config) (*Authenticator, error) {
+	if config.JWTSecret == "" && config.JWKSFile == "" && config.JWKSURL == "" {
+		return nil, nil
+	}
+
+	a := &Authenticator{
+		secret:     []byte(config.JWTSecret),
+		issuer:     config.JWTIssuer,
+		audience:   config.JWTAudience,
+		adminScope: config.AdminScope,
+		jwksFile:   config.JWKSFile,
+		jwksURL:    config.JWKSURL,
+		keys:       map[string]*rsa.PublicKey{},
+	}
+
+	if a.jwksFile != "" || a.jwksURL != "" {
+		if err := a.loadKeys(); err != nil {
+			return nil, err
+		}
+	}
+
+	return a, nil
+}
+
+type jwks struct {
+	Keys []struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	} `json:"keys"`
+}
+
+// loadKeys reads the RSA keys of the JWKS. It must be called with the lock
+// held, except from the constructor.
+func (a *Authenticator) loadKeys() error {
+	var body []byte
+	var err error
+
+	if a.jwksFile != "" {
+		body, err = os.ReadFile(a.jwksFile)
+	} else {
+		var resp *http.Response
+		client := &http.Client{Timeout: 10 * time.Second}
+		if resp, err = client.Get(a.jwksURL); err == nil {
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("JWKS answered %d", resp.StatusCode)
+			}
+			body, err = io.ReadAll(resp.Body)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	set := new(jwks)
+	if err := json.Unmarshal(body, set); err != nil {
+		return fmt.Errorf("invalid JWKS: %w", err)
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, key := range set.Keys {
+		if key.Kty != "RSA" {
+			continue
+		}
+
+		n, errN := base64.RawURLEncoding.DecodeString(key.N)
+		e, errE := base64.RawURLEncoding.DecodeString(key.E)
+		if errN != nil || errE != nil {
+			return fmt.Errorf("invalid JWKS key %s", key.Kid)
+		}
+
+		keys[key.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	a.keys = keys
+	a.fetchedAt = time.Now()
+
+	return nil
+}
+
+// key returns the RSA key of a kid, refreshing a JWKS URL at most once a
+// minute when the kid is unknown.
+func (a *Authenticator) key(kid string) (*rsa.PublicKey, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if key, ok := a.keys[kid]; ok {
+		return key, nil
+	}
+
+	if a.jwksURL != "" && time.Since(a.fetchedAt) > time.Minute {
+		if err := a.loadKeys(); err != nil {
+			return nil, err
+		}
+
+		if key, ok := a.keys[kid]; ok {
+			return key, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown key %s", kid)
+}
+
+// Verify checks the signature and the validity of a token and returns its
+// claims.
+func (a *Authenticator) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	digest := sha256.Sum256(signed)
+
+	if header.Alg == "HS256" && len(a.secret) > 0 {
+		mac := hmac.New(sha256.New, a.secret)
+		mac.Write(signed)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return nil, errors.New("invalid signature")
+		}
+	} else if header.Alg == "RS256" && (a.jwksFile != "" || a.jwksURL != "") {
+		key, err := a.key(header.Kid)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+			return nil, errors.New("invalid signature")
+		}
+	} else {
+		return nil, fmt.Errorf("algorithm %s not allowed", header.Alg)
+	}
+
+	claims := new(Claims)
+	if err := decodeSegment(parts[1], claims); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	if claims.Expiry == 0 || now >= claims.Expiry {
+		return nil, errors.New("token expired")
+	}
+
+	if claims.NotBefore != 0 && now < claims.NotBefore {
+		return nil, errors.New("token not valid yet")
+	}
+
+	if a.issuer != "" && claims.Issuer != a.issuer {
+		return nil, errors.New("invalid issuer")
+	}
+
+	if a.audience != "" && !claims.hasAudience(a.audience) {
+		return nil, errors.New("invalid audience")
+	}
+
+	if claims.Subject == "" {
+		return nil, errors.New("token without subject")
+	}
+
+	claims.Verified = true
+
+	return claims, nil
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.New("malformed token")
+	}
+
+	return nil
+}
+
+// authenticate puts the identity of the caller in the request context. It
+// comes from the X-API-Key header for services, or from the bearer token with
+// authentication enabled. Credentials are optional on reads unless they are
+// required by API_KEYS_REQUIRED. Without authentication the identity is taken
+// from the X-Actor-ID header.
+func (s *APIServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var claims *Claims
+
+		if raw := r.Header.Get("X-API-Key"); raw != "" {
+			key, err := s.apiKeys.Verify(raw)
+			if errors.Is(err, errInvalidAPIKey) {
+				s.rejectCredentials(w, r, err)
+				return
+			}
+			if err != nil {
+				slog.ErrorContext(r.Context(), "Verification of API key failed", "error", err)
+				WriteJSON(w, http.StatusServiceUnavailable, ApiError{Error: "API keys can not be verified"})
+				return
+			}
+
+			if !key.Allows(r.Method) {
+				WriteJSON(w, http.StatusForbidden, ApiError{Error: "API key lacks the scope of this route"})
+				return
+			}
+			claims = key.Claims(r, s.config.AdminScope)
+		} else if !s.authEnabled() {
+			if actor := r.Header.Get("X-Actor-ID"); actor != "" {
+				claims = &Claims{Subject: actor}
+			}
+		} else if header := r.Header.Get("Authorization"); header != "" && s.auth != nil {
+			token, found := strings.CutPrefix(header, "Bearer ")
+			if !found {
+				s.rejectCredentials(w, r, errors.New("Bearer token required"))
+				return
+			}
+
+			verified, err := s.auth.Verify(token)
+			if err != nil {
+				s.rejectCredentials(w, r, err)
+				return
+			}
+			claims = verified
+		} else if s.config.RequireCredentials {
+			s.rejectCredentials(w, r, errUnauthenticated)
+			return
+		}
+
+		if claims != nil {
+			r = r.WithContext(context.WithValue(r.Context(), claimsKey, claims))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rejectCredentials answers 401, after charging the request to the budget of
+// the client IP: rateLimit never sees it, and guessing keys or tokens would
+// not be limited otherwise. Once the budget is spent it answers 429.
+func (s *APIServer) rejectCredentials(w http.ResponseWriter, r *http.Request, err error) {
+	if s.takeToken(w, r, clientIPKey(r)) {
+		WriteJSON(w, http.StatusUnauthorized, ApiError{Error: err.Error()})
+	}
+}
+
+// authEnabled reports whether callers have to prove who they are.
+func (s *APIServer) authEnabled() bool {
+	return s.auth != nil || s.config.RequireCredentials
+}
+
+// authorize checks that the caller acts on its own data or has the admin
+// scope. Services act on behalf of any user, as long as their key grants the
+// scope of the route method. Everything is allowed when authentication is
+// disabled.
+func (s *APIServer) authorize(r *http.Request, user int) error {
+	if !s.authEnabled() {
+		return nil
+	}
+
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		return errUnauthenticated
+	}
+
+	if claims.HasScope(s.config.AdminScope) {
+		return nil
+	}
+
+	if claims.APIKey != "" {
+		if claims.HasScope(methodScope(r.Method)) {
+			return nil
+		}
+		return errForbidden
+	}
+
+	if claims.Subject == strconv.Itoa(user) {
+		return nil
+	}
+
+	return errForbidden
+}
+
+// authorizeSubject guards the data subject routes, exporting or erasing all
+// the data of a user. Like authorizeAdmin it fails closed, and only the user
+// itself, with a token, or an admin may call them: services can not, whatever
+// X-Actor-ID they send.
+func (s *APIServer) authorizeSubject(r *http.Request, user int) error {
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok || !claims.Verified {
+		return errUnauthenticated
+	}
+
+	if claims.HasScope(s.config.AdminScope) {
+		return nil
+	}
+
+	if claims.APIKey == "" && claims.Subject == strconv.Itoa(user) {
+		return nil
+	}
+
+	return errForbidden
+}
+
+// authorizeAdmin checks that the caller has the admin scope. It fails closed:
+// without authentication the admin routes stay closed, X-Actor-ID being
+// enough for nobody.
+func (s *APIServer) authorizeAdmin(r *http.Request) error {
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok || !claims.Verified {
+		return errUnauthenticated
+	}
+
+	if claims.HasScope(s.config.AdminScope) {
+		return nil
+	}
+
+	return errForbidden
+}
+
+func writeAuthError(w http.ResponseWriter, err error) error {
+	if errors.Is(err, errUnauthenticated) {
+		return WriteJSON(w, http.StatusUnauthorized, err.Error()) // 401
+	}
+
+	return WriteJSON(w, http.StatusForbidden, err.Error()) // 403
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testSecret = "test-secret"
+
+func encodeSegment(t *testing.T, v any) string {
+	t.Helper()
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// hmacToken signs claims with HS256, or with the alg of the header when given.
+func hmacToken(t *testing.T, secret string, header map[string]any, claims map[string]any) string {
+	t.Helper()
+
+	if header == nil {
+		header = map[string]any{"alg": "HS256", "typ": "JWT"}
+	}
+
+	signed := encodeSegment(t, header) + "." + encodeSegment(t, claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func rsaToken(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]any) string {
+	t.Helper()
+
+	signed := encodeSegment(t, map[string]any{"alg": "RS256", "typ": "JWT", "kid": kid}) + "." + encodeSegment(t, claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func newRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+// jwksDocument returns the JWKS of public keys by kid.
+func jwksDocument(keys map[string]*rsa.PublicKey) []byte {
+	set := map[string][]map[string]string{"keys": {}}
+	for kid, key := range keys {
+		set["keys"] = append(set["keys"], map[string]string{
+			"kty": "RSA",
+			"kid": kid,
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+
+	data, _ := json.Marshal(set)
+	return data
+}
+
+// validClaims returns claims accepted by the authenticators of the tests,
+// changed by the given values. Nil values remove a claim.
+func validClaims(changes map[string]any) map[string]any {
+	claims := map[string]any{
+		"sub": "42",
+		"iss": "accounts",
+		"aud": "likes",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+
+	for name, value := range changes {
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+	}
+
+	return claims
+}
+
+func TestVerify(t *testing.T) {
+	key := newRSAKey(t)
+	other := newRSAKey(t)
+
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(jwksFile, jwksDocument(map[string]*rsa.PublicKey{"k1": &key.PublicKey}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	auth, err := NewAuthenticator(&Config{JWTSecret: testSecret, JWKSFile: jwksFile, JWTIssuer: "accounts", JWTAudience: "likes"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"HS256", hmacToken(t, testSecret, nil, validClaims(nil)), true},
+		{"HS256 other secret", hmacToken(t, "other-secret", nil, validClaims(nil)), false},
+		{"RS256", rsaToken(t, key, "k1", validClaims(nil)), true},
+		{"RS256 other key", rsaToken(t, other, "k1", validClaims(nil)), false},
+		{"RS256 unknown kid", rsaToken(t, key, "k2", validClaims(nil)), false},
+		{"alg none", encodeSegment(t, map[string]any{"alg": "none"}) + "." + encodeSegment(t, validClaims(nil)) + ".", false},
+		{"alg HS512", hmacToken(t, testSecret, map[string]any{"alg": "HS512"}, validClaims(nil)), false},
+		{"malformed", "not.a-token", false},
+		{"expired", hmacToken(t, testSecret, nil, validClaims(map[string]any{"exp": now.Add(-time.Minute).Unix()})), false},
+		{"without exp", hmacToken(t, testSecret, nil, validClaims(map[string]any{"exp": nil})), false},
+		{"nbf in the future", hmacToken(t, testSecret, nil, validClaims(map[string]any{"nbf": now.Add(time.Hour).Unix()})), false},
+		{"nbf in the past", hmacToken(t, testSecret, nil, validClaims(map[string]any{"nbf": now.Add(-time.Minute).Unix()})), true},
+		{"other issuer", hmacToken(t, testSecret, nil, validClaims(map[string]any{"iss": "elsewhere"})), false},
+		{"without issuer", hmacToken(t, testSecret, nil, validClaims(map[string]any{"iss": nil})), false},
+		{"audience list", hmacToken(t, testSecret, nil, validClaims(map[string]any{"aud": []string{"search", "likes"}})), true},
+		{"other audience", hmacToken(t, testSecret, nil, validClaims(map[string]any{"aud": "search"})), false},
+		{"audience list without likes", hmacToken(t, testSecret, nil, validClaims(map[string]any{"aud": []string{"search"}})), false},
+		{"without subject", hmacToken(t, testSecret, nil, validClaims(map[string]any{"sub": nil})), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := auth.Verify(tt.token)
+			if (err == nil) != tt.valid {
+				t.Fatalf("Verify = %v, want valid %v", err, tt.valid)
+			}
+
+			if tt.valid && (claims.Subject != "42" || !claims.Verified) {
+				t.Errorf("claims %+v, want verified subject 42", claims)
+			}
+		})
+	}
+}
+
+func TestVerifyAlgorithmNotConfigured(t *testing.T) {
+	key := newRSAKey(t)
+
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(jwksFile, jwksDocument(map[string]*rsa.PublicKey{"k1": &key.PublicKey}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	hmacOnly, err := NewAuthenticator(&Config{JWTSecret: testSecret})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsaOnly, err := NewAuthenticator(&Config{JWKSFile: jwksFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		auth  *Authenticator
+		token string
+	}{
+		{"RS256 without JWKS", hmacOnly, rsaToken(t, key, "k1", validClaims(nil))},
+		{"HS256 without secret", rsaOnly, hmacToken(t, "", nil, validClaims(nil))},
+		{"HS256 signed with the public key", rsaOnly, hmacToken(t, string(key.PublicKey.N.Bytes()), nil, validClaims(nil))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.auth.Verify(tt.token); err == nil {
+				t.Error("token accepted")
+			}
+		})
+	}
+}
+
+// jwksServer serves a JWKS which can be replaced, counting the fetches.
+type jwksServer struct {
+	mu      sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	fetches int
+}
+
+func (s *jwksServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.fetches++
+	w.Write(jwksDocument(s.keys))
+}
+
+func TestVerifyJWKSRefresh(t *testing.T) {
+	first, second := newRSAKey(t), newRSAKey(t)
+
+	jwks := &jwksServer{keys: map[string]*rsa.PublicKey{"k1": &first.PublicKey}}
+	server := httptest.NewServer(jwks)
+	defer server.Close()
+
+	auth, err := NewAuthenticator(&Config{JWKSURL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The issuer rotates to k2
+	jwks.mu.Lock()
+	jwks.keys = map[string]*rsa.PublicKey{"k1": &first.PublicKey, "k2": &second.PublicKey}
+	jwks.mu.Unlock()
+
+	rotated := rsaToken(t, second, "k2", validClaims(nil))
+
+	tests := []struct {
+		name    string
+		token   string
+		age     time.Duration // Age of the JWKS when verifying
+		valid   bool
+		fetches int
+	}{
+		{"known kid", rsaToken(t, first, "k1", validClaims(nil)), 0, true, 1},
+		{"new kid within a minute", rotated, 0, false, 1},
+		{"new kid after a minute", rotated, 2 * time.Minute, true, 2},
+		{"unknown kid after the refresh", rsaToken(t, second, "k3", validClaims(nil)), 0, false, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth.mu.Lock()
+			if tt.age > 0 {
+				auth.fetchedAt = time.Now().Add(-tt.age)
+			}
+			auth.mu.Unlock()
+
+			if _, err := auth.Verify(tt.token); (err == nil) != tt.valid {
+				t.Errorf("Verify = %v, want valid %v", err, tt.valid)
+			}
+
+			jwks.mu.Lock()
+			defer jwks.mu.Unlock()
+			if jwks.fetches != tt.fetches {
+				t.Errorf("JWKS fetched %d times, want %d", jwks.fetches, tt.fetches)
+			}
+		})
+	}
+}
+
+func TestAuthorizeAdmin(t *testing.T) {
+	enabled, err := NewAuthenticator(&Config{JWTSecret: testSecret})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		auth   *Authenticator
+		claims *Claims
+		err    error
+	}{
+		{"auth disabled without credentials", nil, nil, errUnauthenticated},
+		{"auth disabled with X-Actor-ID", nil, &Claims{Subject: "1"}, errUnauthenticated},
+		{"token without the admin scope", enabled, &Claims{Subject: "1", Verified: true}, errForbidden},
+		{"token with the admin scope", enabled, &Claims{Subject: "1", Scope: "read admin", Verified: true}, nil},
+		{"write key", nil, (&APIKey{ID: "k", Scopes: []string{ScopeWriteLikes}}).Claims(httptest.NewRequest("GET", "/", nil), "admin"), errForbidden},
+		{"admin key with auth disabled", nil, (&APIKey{ID: "k", Scopes: []string{ScopeAdmin}}).Claims(httptest.NewRequest("GET", "/", nil), "admin"), nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &APIServer{config: &Config{AdminScope: "admin"}, auth: tt.auth}
+
+			r := httptest.NewRequest("DELETE", "/likes/media/1", nil)
+			if tt.claims != nil {
+				r = r.WithContext(context.WithValue(r.Context(), claimsKey, tt.claims))
+			}
+
+			if err := s.authorizeAdmin(r); !errors.Is(err, tt.err) {
+				t.Errorf("authorizeAdmin = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestAuthorizeAPIKeys(t *testing.T) {
+	enabled, err := NewAuthenticator(&Config{JWTSecret: testSecret})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &APIServer{config: &Config{AdminScope: "admin"}, auth: enabled}
+
+	keyClaims := func(actor string, scopes ...string) *Claims {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Actor-ID", actor)
+		return (&APIKey{ID: "k", Scopes: scopes}).Claims(r, "admin")
+	}
+
+	tests := []struct {
+		name        string
+		method      string
+		claims      *Claims
+		data        error // Error of authorize on the likes of user 1
+		dataSubject error // Error of authorizeSubject on user 1
+	}{
+		{"read key reading", "GET", keyClaims("2", ScopeReadLikes), nil, errForbidden},
+		{"read key writing", "POST", keyClaims("2", ScopeReadLikes), errForbidden, errForbidden},
+		{"write key writing", "POST", keyClaims("2", ScopeWriteLikes), nil, errForbidden},
+		{"write key as the user", "POST", keyClaims("1", ScopeWriteLikes), nil, errForbidden},
+		{"admin key", "POST", keyClaims("2", ScopeAdmin), nil, nil},
+		{"token of the user", "POST", &Claims{Subject: "1", Verified: true}, nil, nil},
+		{"token of another user", "POST", &Claims{Subject: "2", Verified: true}, errForbidden, errForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/likes/user/1", nil)
+			r = r.WithContext(context.WithValue(r.Context(), claimsKey, tt.claims))
+
+			if err := s.authorize(r, 1); !errors.Is(err, tt.data) {
+				t.Errorf("authorize = %v, want %v", err, tt.data)
+			}
+
+			if err := s.authorizeSubject(r, 1); !errors.Is(err, tt.dataSubject) {
+				t.Errorf("authorizeSubject = %v, want %v", err, tt.dataSubject)
+			}
+		})
+	}
+}
+
+func TestRejectedCredentialsRateLimited(t *testing.T) {
+	auth, err := NewAuthenticator(&Config{JWTSecret: testSecret})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &APIServer{
+		config: &Config{AdminScope: "admin", ReadLimit: Limit{PerMinute: 1, Burst: 2}},
+		auth:   auth,
+		limits: NewMemoryLimitBackend(),
+	}
+	handler := s.authenticate(s.rateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	request := func(remote string, token string) int {
+		r := httptest.NewRequest("GET", "/likes/user/42", nil)
+		r.RemoteAddr = remote
+		r.Header.Set("Authorization", "Bearer "+token)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		return w.Code
+	}
+
+	forged := hmacToken(t, "guessed-secret", nil, validClaims(nil))
+	valid := hmacToken(t, testSecret, nil, validClaims(nil))
+
+	tests := []struct {
+		name   string
+		remote string
+		token  string
+		status int
+	}{
+		{"first guess", "203.0.113.7:4000", forged, http.StatusUnauthorized},
+		{"second guess", "203.0.113.7:4001", forged, http.StatusUnauthorized},
+		{"budget spent", "203.0.113.7:4002", forged, http.StatusTooManyRequests},
+		{"other client", "203.0.113.8:4000", forged, http.StatusUnauthorized},
+		{"valid token has its own budget", "203.0.113.7:4003", valid, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		if status := request(tt.remote, tt.token); status != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, status, tt.status)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// errDrift and errIntegrity make a command exit with status 1 after printing
+// its report.
+var (
+	errDrift     = errors.New("schema drift found")
+	errIntegrity = errors.New("integrity issues found")
+)
+
+const commandUsage = "schema apply | schema check | migrate up [version] | migrate down [version] | migrate status | integrity check | integrity repair [check...]"
+
+// runCommand runs a maintenance command, given as the program arguments,
+// instead of the server. Reports are printed as JSON.
+func runCommand(ctx context.Context, store Storage, config *Config, args []string) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+
+	command := strings.Join(args, " ")
+
+	// migrate up and down take an optional target version
+	target := int64(-1)
+	if len(args) == 3 && args[0] == "migrate" {
+		version, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil || version < 0 {
+			return fmt.Errorf("invalid version %s", args[2])
+		}
+		target = version
+		command = strings.Join(args[:2], " ")
+	}
+
+	// integrity repair takes the checks to repair
+	var checks []string
+	if len(args) > 2 && args[0] == "integrity" && args[1] == "repair" {
+		checks = args[2:]
+		command = "integrity repair"
+	}
+
+	switch command {
+	case "schema apply":
+		report, err := ApplySchema(ctx, store)
+		if err != nil {
+			return err
+		}
+
+		if err := encoder.Encode(report); err != nil {
+			return err
+		}
+
+		if len(report.Errors) > 0 {
+			return errDrift
+		}
+	case "schema check":
+		report, err := CheckSchema(ctx, store)
+		if err != nil {
+			return err
+		}
+
+		if err := encoder.Encode(report); err != nil {
+			return err
+		}
+
+		if !report.InSync {
+			return errDrift
+		}
+	case "migrate up":
+		if target < 0 {
+			target = 0 // Every pending migration
+		}
+
+		statuses, err := MigrateUp(ctx, store, target, config.MigrationBatchSize)
+		if err != nil {
+			return err
+		}
+
+		return encoder.Encode(statuses)
+	case "migrate down":
+		statuses, err := MigrateDown(ctx, store, target, config.MigrationBatchSize)
+		if err != nil {
+			return err
+		}
+
+		return encoder.Encode(statuses)
+	case "migrate status":
+		if len(args) != 2 {
+			return fmt.Errorf("unknown command %q, expected: %s", strings.Join(args, " "), commandUsage)
+		}
+
+		statuses, err := MigrationStatuses(ctx, store)
+		if err != nil {
+			return err
+		}
+
+		return encoder.Encode(statuses)
+	case "integrity check":
+		report, err := CheckIntegrity(ctx, store)
+		if err != nil {
+			return err
+		}
+
+		if err := encoder.Encode(report); err != nil {
+			return err
+		}
+
+		if !report.Clean {
+			return errIntegrity
+		}
+	case "integrity repair":
+		for _, name := range checks {
+			if findIntegrityCheck(name) == nil {
+				return fmt.Errorf("unknown integrity check %s, expected: %s", name, integrityCheckNames())
+			}
+		}
+
+		report, err := RepairIntegrityIssues(ctx, store, checks, config.MigrationBatchSize)
+		if err != nil {
+			return err
+		}
+
+		if err := encoder.Encode(report); err != nil {
+			return err
+		}
+
+		if !report.Clean {
+			return errIntegrity
+		}
+	default:
+		return fmt.Errorf("unknown command %q, expected: %s", strings.Join(args, " "), commandUsage)
+	}
+
+	return nil
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+type Reaction struct {
+	Code   string  `json:"code"`
+	Name   string  `json:"name"`
+	Weight float64 `json:"weight"`
+	Legacy string  `json:"legacy"` // 'LK' | 'DLK' value kept on PREF edges for older clients
+}
+
+type Config struct {
+	Reactions []Reaction
+
+	// Soft deleted users and media can be restored during Retention and are
+	// purged by a background job running every PurgeInterval.
+	Retention     time.Duration
+	PurgeInterval time.Duration
+
+	// Nodes deleted by each transaction of the purge
+	PurgeBatchSize int64
+
+	// Events publisher: 'memory' | 'file' | 'nats'
+	Publisher     string
+	EventsFile    string
+	NATSURL       string
+	EventsSubject string
+	RelayInterval time.Duration
+
+	// Outbox events failing RelayMaxAttempts times are marked dead
+	RelayMaxAttempts int64
+
+	// Webhook deliveries are attempted WebhookMaxAttempts times, waiting
+	// WebhookBackoff after the first failure and twice as long after each
+	// following one.
+	WebhookMaxAttempts int64
+	WebhookBackoff     time.Duration
+
+	// Allow webhooks on loopback, link-local and private addresses, which
+	// are refused by default
+	WebhookAllowPrivate bool
+
+	// Interval of the comments keeping media streams alive, and time the
+	// updates of a media are kept after its last stream ends
+	StreamHeartbeat  time.Duration
+	StreamBacklogTTL time.Duration
+
+	// Key signing GDPR erasure receipts. A random key is used when
+	// ERASURE_SIGNING_KEY is not set, so receipts can only be checked until
+	// the service restarts.
+	ErasureKey []byte
+
+	// Authentication is enabled when JWTSecret (HS256) or a JWKS (RS256) is
+	// set. Tokens with AdminScope may act on any user.
+	JWTSecret   string
+	JWKSFile    string
+	JWKSURL     string
+	JWTIssuer   string
+	JWTAudience string
+	AdminScope  string
+
+	// API keys of other services. When RequireCredentials is set every
+	// request needs an API key or a token, even without JWT keys. The
+	// bootstrap key is an admin key which is not stored. Verified keys are
+	// cached for APIKeyCacheTTL.
+	RequireCredentials bool
+	BootstrapAPIKey    string
+	APIKeyGrace        time.Duration
+	APIKeyUsageFlush   time.Duration
+	APIKeyCacheTTL     time.Duration
+
+	// Token buckets of each caller for reads and for writes. A zero rate
+	// disables the limit.
+	ReadLimit  Limit
+	WriteLimit Limit
+
+	// HTTP server limits. On shutdown in-flight requests get ShutdownTimeout
+	// to finish.
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int64
+	MaxBodyBytes      int64
+	ShutdownTimeout   time.Duration
+
+	// Time /readyz waits for the dependency checks
+	ReadinessTimeout time.Duration
+
+	// Maximum number of connections to Neo4j
+	Neo4jPoolSize int64
+
+	// Spans are exported with TracingExporter: none, otlp, stdout or file
+	TracingExporter    string
+	TracingFile        string
+	TracingSampleRatio float64
+
+	// Initial level of the logs, changed while running by the admin endpoint
+	LogLevel string
+
+	// Create the missing constraints and indexes when starting
+	SchemaOnStartup bool
+
+	// Rows changed by each transaction of a batched migration
+	MigrationBatchSize int64
+
+	// Relation kept when merged users or media both have one: newest_wins,
+	// keep_target or prefer_like
+	MergePolicy string
+
+	// Responses to requests with an Idempotency-Key are kept for
+	// IdempotencyTTL in IdempotencyBackend: memory or neo4j
+	IdempotencyBackend string
+	IdempotencyTTL     time.Duration
+}
+
+// Reactions available when REACTIONS_CONFIG is not set. LK and DLK keep their
+// historical meaning so existing PREF edges need no migration.
+var defaultReactions = []Reaction{
+	{Code: "LK", Name: "like", Weight: 1, Legacy: "LK"},
+	{Code: "DLK", Name: "dislike", Weight: -1, Legacy: "DLK"},
+	{Code: "LOV", Name: "love", Weight: 2, Legacy: "LK"},
+	{Code: "GPL", Name: "guilty pleasure", Weight: 0.5, Legacy: "LK"},
+	{Code: "MEH", Name: "meh", Weight: 0, Legacy: "DLK"},
+	{Code: "NFM", Name: "not for me", Weight: -0.5, Legacy: "DLK"},
+}
+
+func LoadConfig() (*Config, error) {
+	config := &Config{
+		Reactions:      defaultReactions,
+		Retention:      30 * 24 * time.Hour,
+		PurgeInterval:  time.Hour,
+		PurgeBatchSize: 10000,
+		Publisher:      stringEnv("EVENTS_PUBLISHER", "memory"),
+		EventsFile:     stringEnv("EVENTS_FILE", "events.jsonl"),
+		NATSURL:        stringEnv("EVENTS_NATS_URL", "nats://nats:4222"),
+		EventsSubject:  stringEnv("EVENTS_SUBJECT", "likes"),
+		RelayInterval:  time.Second,
+
+		RelayMaxAttempts: 10,
+
+		WebhookMaxAttempts: 5,
+		WebhookBackoff:     time.Second,
+
+		WebhookAllowPrivate: os.Getenv("WEBHOOK_ALLOW_PRIVATE_TARGETS") == "true",
+
+		StreamHeartbeat:  15 * time.Second,
+		StreamBacklogTTL: 5 * time.Minute,
+
+		JWTSecret:   os.Getenv("JWT_HS256_SECRET"),
+		JWKSFile:    os.Getenv("JWT_JWKS_FILE"),
+		JWKSURL:     os.Getenv("JWT_JWKS_URL"),
+		JWTIssuer:   os.Getenv("JWT_ISSUER"),
+		JWTAudience: os.Getenv("JWT_AUDIENCE"),
+		AdminScope:  stringEnv("JWT_ADMIN_SCOPE", "admin"),
+
+		RequireCredentials: os.Getenv("API_KEYS_REQUIRED") == "true",
+		BootstrapAPIKey:    os.Getenv("ADMIN_API_KEY"),
+		APIKeyGrace:        24 * time.Hour,
+		APIKeyUsageFlush:   10 * time.Second,
+		APIKeyCacheTTL:     30 * time.Second,
+
+		ReadLimit:  Limit{PerMinute: 600, Burst: 100},
+		WriteLimit: Limit{PerMinute: 120, Burst: 20},
+
+		ReadTimeout:       15 * time.Second,
+		ReadHeaderTimeout: 5 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+		MaxHeaderBytes:    1 << 20,
+		MaxBodyBytes:      1 << 20,
+		ShutdownTimeout:   30 * time.Second,
+
+		ReadinessTimeout: 2 * time.Second,
+
+		Neo4jPoolSize: 100,
+
+		TracingExporter:    stringEnv("TRACING_EXPORTER", "none"),
+		TracingFile:        stringEnv("TRACING_FILE", "traces.jsonl"),
+		TracingSampleRatio: 1,
+
+		LogLevel: stringEnv("LOG_LEVEL", "INFO"),
+
+		SchemaOnStartup: stringEnv("SCHEMA_ON_STARTUP", "true") == "true",
+
+		MigrationBatchSize: 10000,
+
+		MergePolicy: stringEnv("MERGE_CONFLICT_POLICY", MergeKeepTarget),
+
+		IdempotencyBackend: stringEnv("IDEMPOTENCY_BACKEND", "memory"),
+		IdempotencyTTL:     24 * time.Hour,
+	}
+
+	if err := durationEnv("SOFT_DELETE_RETENTION", &config.Retention); err != nil {
+		return nil, err
+	}
+
+	if err := durationEnv("PURGE_INTERVAL", &config.PurgeInterval); err != nil {
+		return nil, err
+	}
+
+	if err := intEnv("PURGE_BATCH_SIZE", &config.PurgeBatchSize); err != nil {
+		return nil, err
+	}
+
+	if err := durationEnv("EVENTS_RELAY_INTERVAL", &config.RelayInterval); err != nil {
+		return nil, err
+	}
+
+	if err := intEnv("EVENTS_MAX_ATTEMPTS", &config.RelayMaxAttempts); err != nil {
+		return nil, err
+	}
+
+	if err := intEnv("WEBHOOK_MAX_ATTEMPTS", &config.WebhookMaxAttempts); err != nil {
+		return nil, err
+	}
+
+	if config.RelayMaxAttempts < 1 || config.WebhookMaxAttempts < 1 {
+		return nil, fmt.Errorf("EVENTS_MAX_ATTEMPTS and WEBHOOK_MAX_ATTEMPTS must be at least 1")
+	}
+
+	if err := durationEnv("WEBHOOK_BACKOFF", &config.WebhookBackoff); err != nil {
+		return nil, err
+	}
+
+	if err := durationEnv("STREAM_HEARTBEAT", &config.StreamHeartbeat); err != nil {
+		return nil, err
+	}
+
+	if err := durationEnv("STREAM_BACKLOG_TTL", &config.StreamBacklogTTL); err != nil {
+		return nil, err
+	}
+
+	if err := durationEnv("API_KEY_ROTATION_GRACE", &config.APIKeyGrace); err != nil {
+		return nil, err
+	}
+
+	if err := durationEnv("API_KEY_USAGE_FLUSH", &config.APIKeyUsageFlush); err != nil {
+		return nil, err
+	}
+
+	if err := durationEnv("API_KEY_CACHE_TTL", &config.APIKeyCacheTTL); err != nil {
+		return nil, err
+	}
+
+	if err := durationEnv("IDEMPOTENCY_TTL", &config.IdempotencyTTL); err != nil {
+		return nil, err
+	}
+
+	if err := intEnv("RATE_LIMIT_READ_PER_MINUTE", &config.ReadLimit.PerMinute); err != nil {
+		return nil, err
+	}
+
+	if err := intEnv("RATE_LIMIT_READ_BURST", &config.ReadLimit.Burst); err != nil {
+		return nil, err
+	}
+
+	if err := intEnv("RATE_LIMIT_WRITE_PER_MINUTE", &config.WriteLimit.PerMinute); err != nil {
+		return nil, err
+	}
+
+	if err := intEnv("RATE_LIMIT_WRITE_BURST", &config.WriteLimit.Burst); err != nil {
+		return nil, err
+	}
+
+	// Tickers panic on intervals which are not positive, and a zero backoff or
+	// TTL would retry or expire right away
+	for name, value := range map[string]time.Duration{
+		"PURGE_INTERVAL":        config.PurgeInterval,
+		"EVENTS_RELAY_INTERVAL": config.RelayInterval,
+		"WEBHOOK_BACKOFF":       config.WebhookBackoff,
+		"STREAM_HEARTBEAT":      config.StreamHeartbeat,
+		"API_KEY_USAGE_FLUSH":   config.APIKeyUsageFlush,
+		"IDEMPOTENCY_TTL":       config.IdempotencyTTL,
+	} {
+		if value <= 0 {
+			return nil, fmt.Errorf("%s must be positive", name)
+		}
+	}
+
+	if config.Retention < 0 || config.APIKeyGrace < 0 || config.StreamBacklogTTL < 0 || config.APIKeyCacheTTL < 0 {
+		return nil, fmt.Errorf("SOFT_DELETE_RETENTION, API_KEY_ROTATION_GRACE, STREAM_BACKLOG_TTL and API_KEY_CACHE_TTL can not be negative")
+	}
+
+	// A batch size below 1 would never delete a node, batches would run forever
+	if config.PurgeBatchSize < 1 {
+		return nil, fmt.Errorf("PURGE_BATCH_SIZE must be at least 1")
+	}
+
+	if (config.ReadLimit.PerMinute > 0 && config.ReadLimit.Burst < 1) || (config.WriteLimit.PerMinute > 0 && config.WriteLimit.Burst < 1) {
+		return nil, fmt.Errorf("rate limit bursts must be at least 1")
+	}
+
+	for name, value := range map[string]*time.Duration{
+		"HTTP_READ_TIMEOUT":        &config.ReadTimeout,
+		"HTTP_READ_HEADER_TIMEOUT": &config.ReadHeaderTimeout,
+		"HTTP_WRITE_TIMEOUT":       &config.WriteTimeout,
+		"HTTP_IDLE_TIMEOUT":        &config.IdleTimeout,
+		"SHUTDOWN_TIMEOUT":         &config.ShutdownTimeout,
+		"READINESS_TIMEOUT":        &config.ReadinessTimeout,
+	} {
+		if err := durationEnv(name, value); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := intEnv("HTTP_MAX_HEADER_BYTES", &config.MaxHeaderBytes); err != nil {
+		return nil, err
+	}
+
+	if err := intEnv("HTTP_MAX_BODY_BYTES", &config.MaxBodyBytes); err != nil {
+		return nil, err
+	}
+
+	if err := intEnv("NEO4J_MAX_POOL_SIZE", &config.Neo4jPoolSize); err != nil {
+		return nil, err
+	}
+
+	if err := intEnv("MIGRATION_BATCH_SIZE", &config.MigrationBatchSize); err != nil {
+		return nil, err
+	}
+
+	// A batch size below 1 would never change a row, batches would run forever
+	if config.MigrationBatchSize < 1 {
+		return nil, fmt.Errorf("MIGRATION_BATCH_SIZE must be at least 1")
+	}
+
+	if _, ok := mergePolicies[config.MergePolicy]; !ok {
+		return nil, fmt.Errorf("invalid MERGE_CONFLICT_POLICY: %s", config.MergePolicy)
+	}
+
+	if ratio := os.Getenv("TRACING_SAMPLE_RATIO"); ratio != "" {
+		value, err := strconv.ParseFloat(ratio, 64)
+		if err != nil || value < 0 || value > 1 {
+			return nil, fmt.Errorf("invalid TRACING_SAMPLE_RATIO: %s", ratio)
+		}
+		config.TracingSampleRatio = value
+	}
+
+	config.ErasureKey = []byte(os.Getenv("ERASURE_SIGNING_KEY"))
+	if len(config.ErasureKey) == 0 {
+		config.ErasureKey = make([]byte, 32)
+		if _, err := rand.Read(config.ErasureKey); err != nil {
+			return nil, err
+		}
+	}
+
+	if path := os.Getenv("REACTIONS_CONFIG"); path != "" {
+		file, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		var reactions []Reaction
+		if err := json.Unmarshal(file, &reactions); err != nil {
+			return nil, fmt.Errorf("invalid reactions config %s: %w", path, err)
+		}
+
+		config.Reactions = reactions
+	}
+
+	codes := map[string]bool{}
+	for r := 0; r < len(config.Reactions); r++ {
+		reaction := &config.Reactions[r]
+
+		if reaction.Code == "" {
+			return nil, fmt.Errorf("reaction %d has no code", r)
+		}
+
+		if codes[reaction.Code] {
+			return nil, fmt.Errorf("reaction %s is defined twice", reaction.Code)
+		}
+		codes[reaction.Code] = true
+
+		if reaction.Legacy == "" {
+			reaction.Legacy = "DLK"
+			if reaction.Weight > 0 {
+				reaction.Legacy = "LK"
+			}
+		}
+
+		if reaction.Legacy != "LK" && reaction.Legacy != "DLK" {
+			return nil, fmt.Errorf("reaction %s has invalid legacy type %s", reaction.Code, reaction.Legacy)
+		}
+	}
+
+	// Older clients and PREF edges written before reactions only know these
+	for _, legacy := range []string{"LK", "DLK"} {
+		if reaction, ok := config.Reaction(legacy); !ok || reaction.Legacy != legacy {
+			return nil, fmt.Errorf("reaction %s is required with legacy type %s", legacy, legacy)
+		}
+	}
+
+	return config, nil
+}
+
+// stringEnv returns the value of an environment variable or a fallback.
+func stringEnv(name string, fallback string) string {
+	if env := os.Getenv(name); env != "" {
+		return env
+	}
+
+	return fallback
+}
+
+// durationEnv overrides a duration with the value of an environment variable.
+func durationEnv(name string, value *time.Duration) error {
+	env := os.Getenv(name)
+	if env == "" {
+		return nil
+	}
+
+	duration, err := time.ParseDuration(env)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", name, err)
+	}
+
+	*value = duration
+
+	return nil
+}
+
+// intEnv overrides an integer with the value of an environment variable.
+func intEnv(name string, value *int64) error {
+	env := os.Getenv(name)
+	if env == "" {
+		return nil
+	}
+
+	number, err := strconv.ParseInt(env, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", name, err)
+	}
+
+	*value = number
+
+	return nil
+}
+
+// Reaction looks up a reaction by its code.
+func (c *Config) Reaction(code string) (*Reaction, bool) {
+	for r := 0; r < len(c.Reactions); r++ {
+		if c.Reactions[r].Code == code {
+			return &c.Reactions[r], true
+		}
+	}
+
+	return nil, false
+}
+
+// Weight returns the weight of a reaction code, or 0 when it is unknown.
+func (c *Config) Weight(code any) float64 {
+	if code, ok := code.(string); ok {
+		if reaction, ok := c.Reaction(code); ok {
+			return reaction.Weight
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfigReactions(t *testing.T) {
+	tests := []struct {
+		name      string
+		reactions string // REACTIONS_CONFIG content, unset when empty
+		valid     bool
+	}{
+		{"default reactions", "", true},
+		{"custom reactions", `[{"code": "LK", "weight": 1}, {"code": "DLK", "weight": -1}, {"code": "WOW", "weight": 3}]`, true},
+		{"invalid json", `[{"code": "LK"`, false},
+		{"reaction without code", `[{"code": "LK", "weight": 1}, {"code": "DLK", "weight": -1}, {"weight": 2}]`, false},
+		{"code defined twice", `[{"code": "LK", "weight": 1}, {"code": "DLK", "weight": -1}, {"code": "LK", "weight": 2}]`, false},
+		{"invalid legacy type", `[{"code": "LK", "weight": 1}, {"code": "DLK", "weight": -1}, {"code": "WOW", "legacy": "LOV"}]`, false},
+		{"LK missing", `[{"code": "DLK", "weight": -1}, {"code": "WOW", "weight": 3}]`, false},
+		{"DLK missing", `[{"code": "LK", "weight": 1}]`, false},
+		{"LK with another legacy type", `[{"code": "LK", "legacy": "DLK"}, {"code": "DLK", "weight": -1}]`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("REACTIONS_CONFIG", "")
+			if tt.reactions != "" {
+				path := filepath.Join(t.TempDir(), "reactions.json")
+				if err := os.WriteFile(path, []byte(tt.reactions), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				t.Setenv("REACTIONS_CONFIG", path)
+			}
+
+			_, err := LoadConfig()
+			if (err == nil) != tt.valid {
+				t.Errorf("LoadConfig() = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestResolveReaction(t *testing.T) {
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &APIServer{config: config}
+
+	tests := []struct {
+		likeType string
+		reaction string
+		want     string // Like type kept for older clients, empty when refused
+	}{
+		{"LK", "", "LK"},
+		{"DLK", "", "DLK"},
+		{"", "LOV", "LK"},
+		{"DLK", "GPL", "LK"},
+		{"", "NFM", "DLK"},
+		{"", "WOW", ""},
+	}
+
+	for _, tt := range tests {
+		like := &Like{LikeType: tt.likeType, Reaction: tt.reaction}
+
+		err := s.resolveReaction(like)
+		if (err == nil) != (tt.want != "") {
+			t.Errorf("resolveReaction(%s, %s) = %v", tt.likeType, tt.reaction, err)
+			continue
+		}
+
+		if tt.want != "" && like.LikeType != tt.want {
+			t.Errorf("resolveReaction(%s, %s) kept like type %s, want %s", tt.likeType, tt.reaction, like.LikeType, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigPurge(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   map[string]string
+		valid bool
+	}{
+		{"defaults", nil, true},
+		{"custom values", map[string]string{"SOFT_DELETE_RETENTION": "24h", "PURGE_INTERVAL": "5m", "PURGE_BATCH_SIZE": "500"}, true},
+		{"no retention", map[string]string{"SOFT_DELETE_RETENTION": "0s"}, true},
+		{"negative retention", map[string]string{"SOFT_DELETE_RETENTION": "-1h"}, false},
+		{"zero interval", map[string]string{"PURGE_INTERVAL": "0s"}, false},
+		{"negative interval", map[string]string{"PURGE_INTERVAL": "-1m"}, false},
+		{"zero batch size", map[string]string{"PURGE_BATCH_SIZE": "0"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"SOFT_DELETE_RETENTION", "PURGE_INTERVAL", "PURGE_BATCH_SIZE"} {
+				t.Setenv(key, tt.env[key])
+			}
+
+			_, err := LoadConfig()
+			if (err == nil) != tt.valid {
+				t.Errorf("LoadConfig() = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var errPreconditionFailed = errors.New("resource changed since it was read")
+
+// userETag identifies the likes and wishlist of a user as they are now, from
+// the version of the user. Follows touch the user, so what a follower sees is
+// covered too.
+func (s *APIServer) userETag(r *http.Request, user int) (string, error) {
+	version, err := s.storeFor(r).GetUserVersion(user)
+	if err != nil {
+		return "", err
+	}
+
+	return userTag(version), nil
+}
+
+func userTag(version int64) string {
+	return fmt.Sprintf(`"u%d"`, version)
+}
+
+// mediaETag identifies the likes of a media as they are now. What the caller
+// sees depends on whom they follow, so their own version is part of it.
+func (s *APIServer) mediaETag(r *http.Request, media string, mediaType string) (string, error) {
+	version, err := s.storeFor(r).GetMediaVersion(media, mediaType)
+	if err != nil {
+		return "", err
+	}
+
+	caller := callerID(r)
+	if caller == -1 {
+		return fmt.Sprintf(`"m%d"`, version), nil
+	}
+
+	callerVersion, err := s.storeFor(r).GetUserVersion(caller)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf(`"m%d.%d"`, version, callerVersion), nil
+}
+
+// etagMatches tells whether an If-None-Match header lists an ETag, comparing
+// weak tags too.
+func etagMatches(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// notModified sets the ETag of a response, and answers 304 when the caller
+// already has it.
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	// Visibility depends on the caller
+	w.Header().Set("Vary", "Authorization, X-API-Key, X-Actor-ID")
+
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+
+	return false
+}
+
+// IfMatch lists the versions of a user a change to its relations is
+// conditional on. A nil IfMatch accepts any version.
+type IfMatch []int64
+
+func (m IfMatch) Accepts(version int64) bool {
+	return m == nil || slices.Contains(m, version)
+}
+
+// ifMatch reads the user ETags of the If-Match header of a request. Other
+// tags never match, so a header listing only those fails the change.
+func ifMatch(r *http.Request) IfMatch {
+	header := r.Header.Get("If-Match")
+	if header == "" || strings.TrimSpace(header) == "*" {
+		return nil
+	}
+
+	versions := IfMatch{}
+	for _, candidate := range strings.Split(header, ",") {
+		tag := strings.TrimSpace(candidate)
+		if !strings.HasPrefix(tag, `"u`) || !strings.HasSuffix(tag, `"`) {
+			continue
+		}
+
+		version, err := strconv.ParseInt(tag[2:len(tag)-1], 10, 64)
+		if err == nil {
+			versions = append(versions, version)
+		}
+	}
+
+	return versions
+}
+
+// writePreconditionError answers a failed If-Match check.
+func writePreconditionError(w http.ResponseWriter, err error) error {
+	if errors.Is(err, errPreconditionFailed) {
+		return WriteJSON(w, http.StatusPreconditionFailed, ApiError{Error: err.Error()}) // 412
+	}
+
+	return WriteJSON(w, http.StatusInternalServerError, ApiError{Error: err.Error()}) // 500
+}
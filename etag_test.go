@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIfMatch(t *testing.T) {
+	tests := []struct {
+		header   string
+		accepted []int64
+		rejected []int64
+	}{
+		{"", []int64{0, 7}, nil},
+		{"*", []int64{0, 7}, nil},
+		{`"u7"`, []int64{7}, []int64{0, 6, 8}},
+		{`"u3", "u7"`, []int64{3, 7}, []int64{5}},
+		{`W/"u7"`, nil, []int64{7}},
+		{`"m7"`, nil, []int64{0, 7}},
+		{`"u"`, nil, []int64{0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			r := httptest.NewRequest("PUT", "/likes", nil)
+			if tt.header != "" {
+				r.Header.Set("If-Match", tt.header)
+			}
+
+			versions := ifMatch(r)
+			for _, version := range tt.accepted {
+				if !versions.Accepts(version) {
+					t.Errorf("version %d rejected", version)
+				}
+			}
+			for _, version := range tt.rejected {
+				if versions.Accepts(version) {
+					t.Errorf("version %d accepted", version)
+				}
+			}
+		})
+	}
+}
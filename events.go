@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// Event types emitted for every preference mutation
+const (
+	EventLikeCreated     = "like.created"
+	EventLikeUpdated     = "like.updated"
+	EventLikeDeleted     = "like.deleted"
+	EventRatingCreated   = "rating.created"
+	EventRatingUpdated   = "rating.updated"
+	EventWishlistAdded   = "wishlist.added"
+	EventWishlistRemoved = "wishlist.removed"
+	EventUserDeleted     = "user.deleted"
+	EventMediaDeleted    = "media.deleted"
+	EventUserMerged      = "user.merged"
+	EventMediaRekeyed    = "media.rekeyed"
+)
+
+type Event struct {
+	ID         string    `json:"id"`
+	Type       string    `json:"type"`
+	UserID     any       `json:"user_id,omitempty"`
+	MediaID    any       `json:"media_id,omitempty"`
+	MediaType  any       `json:"media_type,omitempty"` // 'MOV' | 'BOO' | 'SON'
+	OldValue   any       `json:"old_value,omitempty"`
+	NewValue   any       `json:"new_value,omitempty"`
+	Actor      any       `json:"actor,omitempty"`
+	OccurredAt time.Time `json:"occurred_at"`
+}
+
+// Publisher delivers events to downstream services. Publish is called by the
+// outbox relay, once the mutation is committed.
+type Publisher interface {
+	Publish(*Event) error
+	Close() error
+}
+
+// newID returns a random 128 bits identifier.
+func newID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
+
+func NewEvent(tp string) *Event {
+	return &Event{
+		ID:         newID(),
+		Type:       tp,
+		OccurredAt: time.Now().UTC(),
+	}
+}
+
+// NewChangeEvent builds the event of a preference change, or nil when the
+// change left the relation as it was.
+func NewChangeEvent(change *PreferenceChange) *Event {
+	if change.IsNoop() {
+		return nil
+	}
+
+	tp := ""
+	if change.Kind == "PREF" {
+		tp = EventLikeUpdated
+		if change.OldValue == nil {
+			tp = EventLikeCreated
+		} else if change.NewValue == nil {
+			tp = EventLikeDeleted
+		}
+	} else if change.Kind == "RTE" {
+		tp = EventRatingUpdated
+		if change.OldValue == nil {
+			tp = EventRatingCreated
+		}
+	} else if change.Kind == "WSH" {
+		tp = EventWishlistRemoved
+		if change.NewValue == true {
+			tp = EventWishlistAdded
+		}
+	}
+
+	event := NewEvent(tp)
+	event.UserID = change.UserID
+	event.MediaID = change.MediaID
+	event.MediaType = change.MediaType
+	event.OldValue = change.OldValue
+	event.NewValue = change.NewValue
+	event.Actor = change.Actor
+
+	return event
+}
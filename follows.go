@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Follow struct {
+	UserID any       `json:"user_id"`
+	Since  time.Time `json:"since"`
+}
+
+type GetFollows struct {
+	UserID int      `json:"id"`
+	Users  []Follow `json:"users"`
+}
+
+type FeedFilter struct {
+	MediaType string
+	Before    time.Time
+	BeforeID  string // Id of the last change of the previous page, changes of the same millisecond are after it
+	Limit     int
+}
+
+type GetFeed struct {
+	UserID int                `json:"id"`
+	Items  []PreferenceChange `json:"items"`          // Likes, ratings and wishlist additions of followed users, newest first
+	Next   string             `json:"next,omitempty"` // Value of the cursor parameter for the next page
+}
+
+func NewFollow(id any, since any) *Follow {
+	createdAt, _ := since.(int64)
+
+	return &Follow{
+		UserID: id,
+		Since:  time.UnixMilli(createdAt),
+	}
+}
+
+// NewFeedCursor returns the cursor of the page after a change. The change id
+// breaks the ties between changes made during the same millisecond.
+func NewFeedCursor(c *PreferenceChange) string {
+	return strconv.FormatInt(c.CreatedAt.UnixMilli(), 10) + "_" + c.ID
+}
+
+// ParseFeedCursor sets the position of a filter from a cursor.
+func (f *FeedFilter) ParseFeedCursor(cursor string) error {
+	millis, id, found := strings.Cut(cursor, "_")
+	if !found {
+		return errors.New("invalid cursor")
+	}
+
+	created, err := strconv.ParseInt(millis, 10, 64)
+	if err != nil || created <= 0 {
+		return errors.New("invalid cursor")
+	}
+
+	f.Before = time.UnixMilli(created)
+	f.BeforeID = id
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// feedStore keeps the last feed filter. Other Storage methods are not
+// implemented.
+type feedStore struct {
+	Storage
+	filter *FeedFilter
+}
+
+func (s *feedStore) GetFeed(i int, filter *FeedFilter) (*GetFeed, error) {
+	s.filter = filter
+	return &GetFeed{UserID: i, Items: []PreferenceChange{}}, nil
+}
+
+func TestFeedCursor(t *testing.T) {
+	created := time.UnixMilli(1704067200123)
+	change := &PreferenceChange{ID: "b2f0_1", CreatedAt: created}
+
+	filter := &FeedFilter{}
+	if err := filter.ParseFeedCursor(NewFeedCursor(change)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ids may contain the separator, only the first one splits the cursor
+	if !filter.Before.Equal(created) || filter.BeforeID != change.ID {
+		t.Errorf("cursor of %v %q parsed as %v %q", created, change.ID, filter.Before, filter.BeforeID)
+	}
+
+	for _, cursor := range []string{"1704067200123", "yesterday_b2f0", "0_b2f0", "-5_b2f0", "_b2f0"} {
+		if err := (&FeedFilter{}).ParseFeedCursor(cursor); err == nil {
+			t.Errorf("cursor %q accepted", cursor)
+		}
+	}
+}
+
+func TestFeedFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		filter *FeedFilter
+	}{
+		{"first page", "", http.StatusOK, &FeedFilter{Limit: 20}},
+		{"media and limit", "?media_type=MOV&limit=5", http.StatusOK, &FeedFilter{MediaType: "MOV", Limit: 5}},
+		{"cursor", "?cursor=1704067200123_b2f0", http.StatusOK, &FeedFilter{Before: time.UnixMilli(1704067200123), BeforeID: "b2f0", Limit: 20}},
+		{"invalid cursor", "?cursor=b2f0", http.StatusBadRequest, nil},
+		{"limit too large", "?limit=101", http.StatusBadRequest, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &feedStore{}
+			s := &APIServer{store: store, config: &Config{}}
+
+			r := httptest.NewRequest("GET", "/likes/user/5/feed"+tt.query, nil)
+			r = mux.SetURLVars(r, map[string]string{"id": "5"})
+
+			w := httptest.NewRecorder()
+			if err := s.handleFeed(w, r); err != nil {
+				t.Fatal(err)
+			}
+
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d", w.Code, tt.status)
+			}
+
+			if !reflect.DeepEqual(store.filter, tt.filter) {
+				t.Errorf("filter %+v, want %+v", store.filter, tt.filter)
+			}
+		})
+	}
+}
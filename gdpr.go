@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+type WishlistEntry struct {
+	MediaID   any `json:"media_id"`
+	MediaType any `json:"media_type"` // 'MOV' | 'BOO' | 'SON'
+}
+
+// ReportEntry is a report made by a user on the review of another one.
+type ReportEntry struct {
+	MediaID   any `json:"media_id"`
+	MediaType any `json:"media_type"` // 'MOV' | 'BOO' | 'SON'
+	Reason    any `json:"reason"`
+}
+
+type GDPRExport struct {
+	UserID      int                `json:"id"`
+	GeneratedAt time.Time          `json:"generated_at"`
+	User        map[string]any     `json:"user"` // User node properties, empty when the node does not exist
+	Likes       []LikeRelation     `json:"likes"`
+	Ratings     []Review           `json:"ratings"` // Ratings along with their review body
+	Wishlist    []WishlistEntry    `json:"wishlist"`
+	History     []PreferenceChange `json:"history"`
+	Following   []Follow           `json:"following"`  // Users followed by this user
+	Followers   []Follow           `json:"followers"`  // Users following this user
+	Reported    []ReportEntry      `json:"reported"`   // Reports made by this user, without the reviews of other users
+	Moderation  []ModerationAudit  `json:"moderation"` // Moderation actions taken on this user's reviews
+}
+
+// ErasureReceipt records what was erased for a user and what is left of it.
+// Verified is only true when nothing is left.
+type ErasureReceipt struct {
+	UserID    int              `json:"user_id"`
+	CheckedAt time.Time        `json:"checked_at"`
+	Erased    map[string]int64 `json:"erased,omitempty"`
+	Remaining map[string]int64 `json:"remaining"`
+	Verified  bool             `json:"verified"`
+	Signature string           `json:"signature"`
+}
+
+// Sign sets the HMAC-SHA256 signature of the receipt, computed over its JSON
+// encoding without signature.
+func (e *ErasureReceipt) Sign(key []byte) error {
+	e.Signature = ""
+
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	e.Signature = hex.EncodeToString(mac.Sum(nil))
+
+	return nil
+}
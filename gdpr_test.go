@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// gdprStore answers exports and erasures for a single user, erased or not.
+// Other Storage methods are not implemented.
+type gdprStore struct {
+	Storage
+	erased bool
+}
+
+func (s *gdprStore) GetUserExport(i int) (*GDPRExport, error) {
+	return &GDPRExport{UserID: i, Likes: []LikeRelation{{UserID: i, MediaID: "7", MediaType: "MOV", LikeType: "LK", Reaction: "LK", Weight: 1}}}, nil
+}
+
+func (s *gdprStore) EraseUser(i int) (*ErasureReceipt, error) {
+	s.erased = true
+	receipt, err := s.VerifyErasure(i)
+	receipt.Erased = map[string]int64{"likes": 1}
+	return receipt, err
+}
+
+func (s *gdprStore) VerifyErasure(i int) (*ErasureReceipt, error) {
+	remaining := map[string]int64{"likes": 1}
+	if s.erased {
+		remaining["likes"] = 0
+	}
+	return &ErasureReceipt{UserID: i, Remaining: remaining, Verified: s.erased}, nil
+}
+
+func TestUserExport(t *testing.T) {
+	s := &APIServer{store: &gdprStore{}, config: &Config{}}
+
+	r := httptest.NewRequest("GET", "/likes/user/5/gdpr-export", nil)
+	r = mux.SetURLVars(r, map[string]string{"id": "5"})
+	r = r.WithContext(context.WithValue(r.Context(), claimsKey, &Claims{Subject: "5", Verified: true}))
+
+	w := httptest.NewRecorder()
+	if err := s.handleUserExport(w, r); err != nil {
+		t.Fatal(err)
+	}
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusOK)
+	}
+
+	if got := w.Header().Get("Content-Disposition"); got != `attachment; filename="user-5-export.json"` {
+		t.Errorf("Content-Disposition %q", got)
+	}
+
+	var export GDPRExport
+	if err := json.NewDecoder(w.Body).Decode(&export); err != nil {
+		t.Fatal(err)
+	}
+
+	if export.UserID != 5 || len(export.Likes) != 1 {
+		t.Errorf("export %+v, want user 5 with its like", export)
+	}
+}
+
+func TestUserErasure(t *testing.T) {
+	key := []byte("secret")
+	s := &APIServer{store: &gdprStore{}, config: &Config{ErasureKey: key}}
+
+	steps := []struct {
+		method   string
+		status   int
+		verified bool
+	}{
+		{"GET", http.StatusOK, false},
+		{"POST", http.StatusCreated, true},
+		{"GET", http.StatusOK, true},
+	}
+
+	for i, step := range steps {
+		r := httptest.NewRequest(step.method, "/likes/user/5/gdpr-erasure", nil)
+		r = mux.SetURLVars(r, map[string]string{"id": "5"})
+		r = r.WithContext(context.WithValue(r.Context(), claimsKey, &Claims{Subject: "5", Verified: true}))
+
+		w := httptest.NewRecorder()
+		if err := s.handleUserErasure(w, r); err != nil {
+			t.Fatal(err)
+		}
+
+		var receipt ErasureReceipt
+		if err := json.NewDecoder(w.Body).Decode(&receipt); err != nil {
+			t.Fatal(err)
+		}
+
+		if w.Code != step.status || receipt.Verified != step.verified {
+			t.Errorf("step %d %s: status %d verified %v, want %d %v", i, step.method, w.Code, receipt.Verified, step.status, step.verified)
+		}
+
+		signature := receipt.Signature
+		if err := receipt.Sign(key); err != nil {
+			t.Fatal(err)
+		}
+		if receipt.Signature != signature {
+			t.Errorf("step %d %s: signature %s does not match the receipt", i, step.method, signature)
+		}
+
+		receipt.Verified = !receipt.Verified
+		if err := receipt.Sign(key); err != nil {
+			t.Fatal(err)
+		}
+		if receipt.Signature == signature {
+			t.Errorf("step %d %s: signature does not cover the verification", i, step.method)
+		}
+	}
+}
+
+func TestUserExportCaller(t *testing.T) {
+	s := &APIServer{store: &gdprStore{}, config: &Config{AdminScope: ScopeAdmin}}
+
+	tests := []struct {
+		name   string
+		claims *Claims
+		status int
+	}{
+		{"no caller", nil, http.StatusUnauthorized},
+		{"unverified subject", &Claims{Subject: "5"}, http.StatusUnauthorized},
+		{"another user", &Claims{Subject: "6", Verified: true}, http.StatusForbidden},
+		{"service key", &Claims{Subject: "5", APIKey: "k1", Scope: ScopeReadLikes, Verified: true}, http.StatusForbidden},
+		{"admin", &Claims{Subject: "1", Scope: ScopeAdmin, Verified: true}, http.StatusOK},
+		{"the user", &Claims{Subject: "5", Verified: true}, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/likes/user/5/gdpr-export", nil)
+			r = mux.SetURLVars(r, map[string]string{"id": "5"})
+			if tt.claims != nil {
+				r = r.WithContext(context.WithValue(r.Context(), claimsKey, tt.claims))
+			}
+
+			w := httptest.NewRecorder()
+			makeHTTPHandleFunc(s.handleUserExport)(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
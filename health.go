@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	StatusUp       = "up"
+	StatusDown     = "down"
+	StatusDegraded = "degraded"
+)
+
+type DependencyStatus struct {
+	Name      string   `json:"name"`
+	Status    string   `json:"status"` // 'up' | 'down' | 'degraded'
+	LatencyMs float64  `json:"latency_ms"`
+	Error     string   `json:"error,omitempty"`
+	Missing   []string `json:"missing,omitempty"` // Names of the missing schema items
+}
+
+type Readiness struct {
+	Status       string             `json:"status"` // 'up' | 'down' | 'degraded'
+	Dependencies []DependencyStatus `json:"dependencies"`
+	CheckedAt    time.Time          `json:"checked_at"`
+}
+
+// checkDependency times a check of a dependency.
+func checkDependency(name string, check func() error) DependencyStatus {
+	start := time.Now()
+	err := check()
+
+	status := DependencyStatus{
+		Name:      name,
+		Status:    StatusUp,
+		LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+	}
+
+	if err != nil {
+		status.Status = StatusDown
+		status.Error = err.Error()
+	}
+
+	return status
+}
+
+// CheckReadiness checks Neo4j and its schema. Neo4j being down makes the
+// service not ready, missing constraints or indexes only degrade it.
+func CheckReadiness(ctx context.Context, store Storage) *Readiness {
+	readiness := &Readiness{Status: StatusUp, CheckedAt: time.Now().UTC()}
+
+	neo4j := checkDependency("neo4j", func() error {
+		return store.VerifyConnectivity(ctx)
+	})
+	readiness.Dependencies = append(readiness.Dependencies, neo4j)
+
+	if neo4j.Status != StatusUp {
+		readiness.Status = StatusDown
+		readiness.Dependencies = append(readiness.Dependencies, DependencyStatus{
+			Name:   "schema",
+			Status: StatusDown,
+			Error:  "neo4j unavailable",
+		})
+		return readiness
+	}
+
+	var missing []string
+	schema := checkDependency("schema", func() error {
+		report, err := CheckSchema(ctx, store)
+		if err != nil {
+			return err
+		}
+
+		for _, item := range report.Missing {
+			missing = append(missing, item.Name)
+		}
+
+		return nil
+	})
+
+	if schema.Status == StatusUp && len(missing) > 0 {
+		schema.Status = StatusDegraded
+		schema.Error = fmt.Sprintf("%d constraints or indexes missing", len(missing))
+		schema.Missing = missing
+	}
+
+	if schema.Status != StatusUp {
+		readiness.Status = StatusDegraded
+	}
+	readiness.Dependencies = append(readiness.Dependencies, schema)
+
+	return readiness
+}
+
+// handleHealthz only tells the process is up and serving.
+func (s *APIServer) handleHealthz(w http.ResponseWriter, r *http.Request) error {
+	return WriteJSON(w, http.StatusOK, map[string]string{"status": StatusUp})
+}
+
+// handleReadyz answers 503 while the service can not serve traffic, and from
+// the start of the shutdown so load balancers stop sending requests.
+func (s *APIServer) handleReadyz(w http.ResponseWriter, r *http.Request) error {
+	select {
+	case <-s.done:
+	case <-s.stopping:
+	default:
+		return s.checkReadyz(w, r)
+	}
+
+	return WriteJSON(w, http.StatusServiceUnavailable, &Readiness{ // 503
+		Status:       StatusDown,
+		Dependencies: []DependencyStatus{{Name: "server", Status: StatusDown, Error: "shutting down"}},
+		CheckedAt:    time.Now().UTC(),
+	})
+}
+
+func (s *APIServer) checkReadyz(w http.ResponseWriter, r *http.Request) error {
+	ctx, cancel := context.WithTimeout(r.Context(), s.config.ReadinessTimeout)
+	defer cancel()
+
+	readiness := CheckReadiness(ctx, s.storeFor(r))
+
+	if readiness.Status == StatusDown {
+		return WriteJSON(w, http.StatusServiceUnavailable, readiness) // 503
+	}
+
+	return WriteJSON(w, http.StatusOK, readiness)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadyzShuttingDown(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(s *APIServer)
+	}{
+		{"shutdown context cancelled", func(s *APIServer) {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			s.stopping = ctx.Done()
+		}},
+		{"server shut down", func(s *APIServer) { close(s.done) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Without a store, checking Neo4j would panic
+			s := &APIServer{config: &Config{}, done: make(chan struct{})}
+			tt.setup(s)
+
+			w := httptest.NewRecorder()
+			if err := s.handleReadyz(w, httptest.NewRequest("GET", "/readyz", nil)); err != nil {
+				t.Fatal(err)
+			}
+
+			if w.Code != http.StatusServiceUnavailable {
+				t.Errorf("status %d, want %d", w.Code, http.StatusServiceUnavailable)
+			}
+
+			readiness := new(Readiness)
+			if err := json.NewDecoder(w.Body).Decode(readiness); err != nil {
+				t.Fatal(err)
+			}
+			if readiness.Status != StatusDown {
+				t.Errorf("readiness %s, want %s", readiness.Status, StatusDown)
+			}
+		})
+	}
+}
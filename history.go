@@ -0,0 +1,62 @@
+package main
+
+import "time"
+
+type PreferenceChange struct {
+	ID        string    `json:"id"`
+	UserID    any       `json:"user_id"`
+	MediaID   any       `json:"media_id"`
+	MediaType any       `json:"media_type"` // 'MOV' | 'BOO' | 'SON'
+	Kind      any       `json:"kind"`       // 'PREF' | 'RTE' | 'WSH'
+	OldValue  any       `json:"old_value"`  // Reaction code, rating or wishlist membership before the change
+	NewValue  any       `json:"new_value"`  // Reaction code, rating or wishlist membership after the change
+	Actor     any       `json:"actor"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type HistoryFilter struct {
+	MediaID   string
+	MediaType string
+	From      time.Time
+	To        time.Time
+}
+
+type GetHistory struct {
+	UserID  int                `json:"id"`
+	Changes []PreferenceChange `json:"changes"`
+}
+
+func NewPreferenceChange(id int, media string, mtype string, kind string, old any, new any, actor string) *PreferenceChange {
+	return &PreferenceChange{
+		ID:        newID(),
+		UserID:    id,
+		MediaID:   media,
+		MediaType: mtype,
+		Kind:      kind,
+		OldValue:  old,
+		NewValue:  new,
+		Actor:     actor,
+	}
+}
+
+// IsNoop reports whether the change left the relation as it was.
+func (c *PreferenceChange) IsNoop() bool {
+	return c.OldValue == c.NewValue
+}
+
+func NewPreferenceChangeFromProps(props map[string]any) *PreferenceChange {
+	createdAt, _ := props["created_at"].(int64)
+	id, _ := props["id"].(string)
+
+	return &PreferenceChange{
+		ID:        id,
+		UserID:    props["user_id"],
+		MediaID:   props["media_id"],
+		MediaType: props["media_type"],
+		Kind:      props["kind"],
+		OldValue:  props["old_value"],
+		NewValue:  props["new_value"],
+		Actor:     props["actor"],
+		CreatedAt: time.UnixMilli(createdAt),
+	}
+}
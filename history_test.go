@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// historyStore keeps the actor of the last like and the last history filter.
+// Other Storage methods are not implemented.
+type historyStore struct {
+	Storage
+	actor  string
+	filter *HistoryFilter
+}
+
+func (s *historyStore) SetLike(l *Like, actor string, ifMatch IfMatch) (int64, error) {
+	s.actor = actor
+	return 1, nil
+}
+
+func (s *historyStore) GetHistory(i int, filter *HistoryFilter) (*GetHistory, error) {
+	s.filter = filter
+	return &GetHistory{UserID: i, Changes: []PreferenceChange{}}, nil
+}
+
+func TestLikeActor(t *testing.T) {
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		actor string // X-Actor-ID
+		want  string
+	}{
+		{"user itself", "", "5"},
+		{"on behalf of the user", "admin-1", "admin-1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &historyStore{}
+			s := &APIServer{store: store, config: config}
+
+			r := httptest.NewRequest("POST", "/likes", strings.NewReader(`{"user_id": 5, "media_id": "7", "media_type": "MOV", "reaction": "LOV"}`))
+			if tt.actor != "" {
+				r.Header.Set("X-Actor-ID", tt.actor)
+			}
+
+			w := httptest.NewRecorder()
+			s.authenticate(makeHTTPHandleFunc(s.handleCreateLike)).ServeHTTP(w, r)
+
+			if w.Code != http.StatusCreated || store.actor != tt.want {
+				t.Errorf("status %d recorded for %q, want %d for %q", w.Code, store.actor, http.StatusCreated, tt.want)
+			}
+		})
+	}
+}
+
+func TestHistoryFilter(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		filter *HistoryFilter
+	}{
+		{"no filter", "", http.StatusOK, &HistoryFilter{}},
+		{"media", "?media_id=7&media_type=MOV", http.StatusOK, &HistoryFilter{MediaID: "7", MediaType: "MOV"}},
+		{"period", "?from=2024-01-01T00:00:00Z&to=2024-01-02T00:00:00Z", http.StatusOK, &HistoryFilter{From: from, To: from.Add(24 * time.Hour)}},
+		{"invalid from", "?from=yesterday", http.StatusBadRequest, nil},
+		{"invalid to", "?to=2024-01-02", http.StatusBadRequest, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &historyStore{}
+			s := &APIServer{store: store, config: &Config{}}
+
+			r := httptest.NewRequest("GET", "/likes/user/5/history"+tt.query, nil)
+			r = mux.SetURLVars(r, map[string]string{"id": "5"})
+
+			w := httptest.NewRecorder()
+			if err := s.handleHistory(w, r); err != nil {
+				t.Fatal(err)
+			}
+
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d", w.Code, tt.status)
+			}
+
+			if tt.filter == nil {
+				if store.filter != nil {
+					t.Errorf("history read with an invalid filter")
+				}
+				return
+			}
+
+			if store.filter.MediaID != tt.filter.MediaID || store.filter.MediaType != tt.filter.MediaType ||
+				!store.filter.From.Equal(tt.filter.From) || !store.filter.To.Equal(tt.filter.To) {
+				t.Errorf("filter %+v, want %+v", store.filter, tt.filter)
+			}
+		})
+	}
+}
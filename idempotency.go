@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxIdempotencyKey is the longest Idempotency-Key accepted.
+const maxIdempotencyKey = 255
+
+// IdempotentResponse is the first response to a request with an
+// Idempotency-Key. Status is 0 while that request is in progress.
+type IdempotentResponse struct {
+	Key         string
+	Fingerprint string // Hash of the method, path and body of the request
+	Token       string // Identifies the request holding the key
+	Status      int
+	ContentType string
+	ETag        string
+	Location    string
+	Body        []byte
+	ExpiresAt   time.Time
+}
+
+// IdempotencyBackend stores the responses. Responses kept in memory are only
+// replayed by the instance which served the first request, so instances behind
+// a load balancer share the Neo4j backend.
+type IdempotencyBackend interface {
+	// Reserve holds a key for a request. It returns the response stored under
+	// the key, which holds the token of the request it belongs to.
+	Reserve(r *IdempotentResponse) (*IdempotentResponse, error)
+	// Save stores the response of the request holding the key.
+	Save(r *IdempotentResponse) error
+	// Release frees a key whose request failed, so it can be retried.
+	Release(key string, token string) error
+}
+
+func NewIdempotencyBackend(config *Config, store Storage) (IdempotencyBackend, error) {
+	if config.IdempotencyBackend == "neo4j" {
+		return &Neo4jIdempotencyBackend{store: store}, nil
+	} else if config.IdempotencyBackend != "memory" {
+		return nil, fmt.Errorf("unknown idempotency backend %s", config.IdempotencyBackend)
+	}
+
+	return NewMemoryIdempotencyBackend(), nil
+}
+
+type MemoryIdempotencyBackend struct {
+	mu        sync.Mutex
+	responses map[string]*IdempotentResponse
+}
+
+func NewMemoryIdempotencyBackend() *MemoryIdempotencyBackend {
+	return &MemoryIdempotencyBackend{responses: map[string]*IdempotentResponse{}}
+}
+
+func (b *MemoryIdempotencyBackend) Reserve(r *IdempotentResponse) (*IdempotentResponse, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if stored, ok := b.responses[r.Key]; ok && stored.ExpiresAt.After(time.Now()) {
+		found := *stored
+		return &found, nil
+	}
+
+	reserved := *r
+	b.responses[r.Key] = &reserved
+
+	return r, nil
+}
+
+func (b *MemoryIdempotencyBackend) Save(r *IdempotentResponse) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if stored, ok := b.responses[r.Key]; ok && stored.Token == r.Token {
+		saved := *r
+		b.responses[r.Key] = &saved
+	}
+
+	return nil
+}
+
+func (b *MemoryIdempotencyBackend) Release(key string, token string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if stored, ok := b.responses[key]; ok && stored.Token == token {
+		delete(b.responses, key)
+	}
+
+	return nil
+}
+
+// Sweep forgets the expired responses.
+func (b *MemoryIdempotencyBackend) Sweep() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	for key, stored := range b.responses {
+		if !stored.ExpiresAt.After(now) {
+			delete(b.responses, key)
+		}
+	}
+}
+
+// RunIdempotencySweep sweeps the memory responses every interval.
+func RunIdempotencySweep(ctx context.Context, b *MemoryIdempotencyBackend, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		b.Sweep()
+	}
+}
+
+// Neo4jIdempotencyBackend stores the responses as IdempotencyKey nodes, which
+// PurgeDeleted removes once expired.
+type Neo4jIdempotencyBackend struct {
+	store Storage
+}
+
+func (b *Neo4jIdempotencyBackend) Reserve(r *IdempotentResponse) (*IdempotentResponse, error) {
+	return b.store.ReserveIdempotencyKey(r)
+}
+
+func (b *Neo4jIdempotencyBackend) Save(r *IdempotentResponse) error {
+	return b.store.SaveIdempotentResponse(r)
+}
+
+func (b *Neo4jIdempotencyBackend) Release(key string, token string) error {
+	return b.store.ReleaseIdempotencyKey(key, token)
+}
+
+// responseRecorder keeps a copy of the response it writes.
+type responseRecorder struct {
+	http.ResponseWriter
+	status  int
+	written bool
+	body    bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.written = true
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.written = true
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// idempotencyFingerprint hashes what makes two requests the same.
+func idempotencyFingerprint(r *http.Request, body []byte) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s %s\n", r.Method, r.URL.RequestURI())
+	hash.Write(body)
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// idempotencyScope keeps the keys of different callers apart. Callers not
+// verified, whose X-Actor-ID anyone can send, are told apart by their address.
+func idempotencyScope(r *http.Request) string {
+	if claims, ok := ClaimsFromContext(r.Context()); ok && claims.Verified {
+		if claims.APIKey != "" {
+			return "key:" + claims.APIKey
+		}
+
+		return "user:" + claims.Subject
+	}
+
+	return clientIPKey(r)
+}
+
+// idempotent replays the stored response of a mutation sent again with the
+// same Idempotency-Key and body. Server errors are not stored, nor requests
+// which panicked or answered nothing, so the request can be retried. It must
+// run after authenticate.
+func (s *APIServer) idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" || s.idempotency == nil || r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(key) > maxIdempotencyKey {
+			WriteJSON(w, http.StatusBadRequest, ApiError{Error: "invalid idempotency key"})
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			WriteJSON(w, http.StatusRequestEntityTooLarge, ApiError{Error: "request body too large"})
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		token := make([]byte, 16)
+		if _, err := rand.Read(token); err != nil {
+			WriteJSON(w, http.StatusInternalServerError, ApiError{Error: err.Error()})
+			return
+		}
+
+		reserved := &IdempotentResponse{
+			Key:         idempotencyScope(r) + ":" + key,
+			Fingerprint: idempotencyFingerprint(r, body),
+			Token:       hex.EncodeToString(token),
+			ExpiresAt:   time.Now().Add(s.config.IdempotencyTTL),
+		}
+
+		stored, err := s.idempotency.Reserve(reserved)
+		if err != nil {
+			// Served like a request without a key rather than refused, the
+			// client retrying on the 5xx would not be safer
+			slog.ErrorContext(r.Context(), "Idempotency backend failed", "error", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if stored.Token != reserved.Token {
+			if stored.Fingerprint != reserved.Fingerprint {
+				WriteJSON(w, http.StatusUnprocessableEntity, ApiError{Error: "idempotency key already used for another request"})
+				return
+			}
+
+			if stored.Status == 0 {
+				WriteJSON(w, http.StatusConflict, ApiError{Error: "request with this idempotency key in progress"})
+				return
+			}
+
+			w.Header().Set("Idempotent-Replayed", "true")
+			for header, value := range map[string]string{
+				"Content-Type": stored.ContentType,
+				"ETag":         stored.ETag,
+				"Location":     stored.Location,
+			} {
+				if value != "" {
+					w.Header().Set(header, value)
+				}
+			}
+			w.WriteHeader(stored.Status)
+			w.Write(stored.Body)
+			return
+		}
+
+		// Released on every way out but a saved response, panics included,
+		// or the key would stay in progress until it expires
+		saved := false
+		defer func() {
+			if saved {
+				return
+			}
+
+			if err := s.idempotency.Release(reserved.Key, reserved.Token); err != nil {
+				slog.ErrorContext(r.Context(), "Idempotency backend failed", "error", err)
+			}
+		}()
+
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		if !recorder.written || recorder.status >= http.StatusInternalServerError {
+			return
+		}
+
+		reserved.Status = recorder.status
+		reserved.ContentType = recorder.Header().Get("Content-Type")
+		reserved.ETag = recorder.Header().Get("ETag")
+		reserved.Location = recorder.Header().Get("Location")
+		reserved.Body = recorder.body.Bytes()
+
+		if err := s.idempotency.Save(reserved); err != nil {
+			slog.ErrorContext(r.Context(), "Idempotency backend failed", "error", err)
+			return
+		}
+		saved = true
+	})
+}
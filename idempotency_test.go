@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countingHandler answers the statuses in order, then 201, with the number
+// of the call as body. Calls with a status of -1 panic.
+type countingHandler struct {
+	statuses []int
+	calls    int
+}
+
+func (h *countingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.calls++
+
+	status := http.StatusCreated
+	if h.calls <= len(h.statuses) {
+		status = h.statuses[h.calls-1]
+	}
+
+	if status == -1 {
+		panic("handler failed")
+	}
+
+	WriteJSON(w, status, h.calls)
+}
+
+func newIdempotentServer(ttl time.Duration, handler http.Handler) (*APIServer, http.Handler) {
+	s := &APIServer{config: &Config{IdempotencyTTL: ttl}, idempotency: NewMemoryIdempotencyBackend()}
+	return s, s.idempotent(handler)
+}
+
+// sendIdempotent sends a POST with a key, recovering the panics of the
+// handler like net/http does.
+func sendIdempotent(handler http.Handler, key string, body string) (w *httptest.ResponseRecorder) {
+	r := httptest.NewRequest("POST", "/likes", strings.NewReader(body))
+	r.Header.Set("Idempotency-Key", key)
+
+	w = httptest.NewRecorder()
+	defer func() {
+		if recover() != nil {
+			w.Code = http.StatusInternalServerError
+		}
+	}()
+
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestIdempotentReplay(t *testing.T) {
+	handler := &countingHandler{}
+	_, idempotent := newIdempotentServer(time.Hour, handler)
+
+	first := sendIdempotent(idempotent, "k1", `{"media_id": 1}`)
+	replay := sendIdempotent(idempotent, "k1", `{"media_id": 1}`)
+
+	if handler.calls != 1 {
+		t.Fatalf("handler called %d times, want 1", handler.calls)
+	}
+
+	if replay.Code != first.Code || replay.Body.String() != first.Body.String() {
+		t.Errorf("replayed %d %q, want %d %q", replay.Code, replay.Body.String(), first.Code, first.Body.String())
+	}
+	if replay.Header().Get("Idempotent-Replayed") != "true" || first.Header().Get("Idempotent-Replayed") != "" {
+		t.Error("replay not flagged")
+	}
+	if replay.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("replayed content type %q", replay.Header().Get("Content-Type"))
+	}
+
+	// Keys are only compared with the same key
+	if sendIdempotent(idempotent, "k2", `{"media_id": 1}`); handler.calls != 2 {
+		t.Errorf("handler called %d times for another key, want 2", handler.calls)
+	}
+}
+
+func TestIdempotentOtherBody(t *testing.T) {
+	handler := &countingHandler{}
+	_, idempotent := newIdempotentServer(time.Hour, handler)
+
+	sendIdempotent(idempotent, "k1", `{"media_id": 1}`)
+	w := sendIdempotent(idempotent, "k1", `{"media_id": 2}`)
+
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("status %d, want %d", w.Code, http.StatusUnprocessableEntity)
+	}
+	if handler.calls != 1 {
+		t.Errorf("handler called %d times, want 1", handler.calls)
+	}
+}
+
+func TestIdempotentTTL(t *testing.T) {
+	handler := &countingHandler{}
+	_, idempotent := newIdempotentServer(20*time.Millisecond, handler)
+
+	sendIdempotent(idempotent, "k1", `{"media_id": 1}`)
+	time.Sleep(30 * time.Millisecond)
+
+	w := sendIdempotent(idempotent, "k1", `{"media_id": 2}`)
+	if w.Code != http.StatusCreated || w.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("expired key answered %d, replayed %q", w.Code, w.Header().Get("Idempotent-Replayed"))
+	}
+	if handler.calls != 2 {
+		t.Errorf("handler called %d times, want 2", handler.calls)
+	}
+}
+
+func TestIdempotentRetryAfterFailure(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+	}{
+		{"server error", http.StatusServiceUnavailable},
+		{"panic", -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := &countingHandler{statuses: []int{tt.status}}
+			_, idempotent := newIdempotentServer(time.Hour, handler)
+
+			sendIdempotent(idempotent, "k1", `{"media_id": 1}`)
+
+			// The key is free again, not held as in progress
+			w := sendIdempotent(idempotent, "k1", `{"media_id": 1}`)
+			if w.Code != http.StatusCreated || handler.calls != 2 {
+				t.Errorf("retry answered %d after %d calls, want %d after 2", w.Code, handler.calls, http.StatusCreated)
+			}
+		})
+	}
+}
+
+func TestIdempotentReplayHeaders(t *testing.T) {
+	calls := 0
+	_, idempotent := newIdempotentServer(time.Hour, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("ETag", `"3"`)
+		w.Header().Set("Location", "/likes/review/7")
+		WriteJSON(w, http.StatusCreated, calls)
+	}))
+
+	sendIdempotent(idempotent, "k1", `{"media_id": 1}`)
+	replay := sendIdempotent(idempotent, "k1", `{"media_id": 1}`)
+
+	if calls != 1 {
+		t.Fatalf("handler called %d times, want 1", calls)
+	}
+	if replay.Header().Get("ETag") != `"3"` || replay.Header().Get("Location") != "/likes/review/7" {
+		t.Errorf("replayed ETag %q and Location %q", replay.Header().Get("ETag"), replay.Header().Get("Location"))
+	}
+}
+
+func TestIdempotentScope(t *testing.T) {
+	tests := []struct {
+		name   string
+		first  *Claims
+		second *Claims
+		calls  int
+	}{
+		{"same verified user", &Claims{Subject: "5", Verified: true}, &Claims{Subject: "5", Verified: true}, 1},
+		{"other verified user", &Claims{Subject: "5", Verified: true}, &Claims{Subject: "6", Verified: true}, 2},
+		{"same API key", &Claims{APIKey: "k1", Verified: true}, &Claims{APIKey: "k1", Verified: true}, 1},
+		{"forged X-Actor-ID", &Claims{Subject: "5", Verified: true}, &Claims{Subject: "5"}, 2},
+		{"anonymous", nil, nil, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := &countingHandler{}
+			_, idempotent := newIdempotentServer(time.Hour, handler)
+
+			// Each request from its own address
+			for i, claims := range []*Claims{tt.first, tt.second} {
+				r := httptest.NewRequest("POST", "/likes", strings.NewReader(`{"media_id": 1}`))
+				r.Header.Set("Idempotency-Key", "k1")
+				r.RemoteAddr = fmt.Sprintf("10.0.0.%d:1234", i+1)
+				if claims != nil {
+					r = r.WithContext(context.WithValue(r.Context(), claimsKey, claims))
+				}
+
+				idempotent.ServeHTTP(httptest.NewRecorder(), r)
+			}
+
+			if handler.calls != tt.calls {
+				t.Errorf("handler called %d times, want %d", handler.calls, tt.calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,612 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"reflect"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// InstrumentedStore records metrics and a span for every call to a Storage.
+// Spans are children of the span in the context the store is bound to.
+type InstrumentedStore struct {
+	Storage
+	ctx context.Context
+}
+
+func NewInstrumentedStore(store Storage) *InstrumentedStore {
+	return &InstrumentedStore{Storage: store, ctx: context.Background()}
+}
+
+// WithContext returns the store bound to the context of a request.
+func (m *InstrumentedStore) WithContext(ctx context.Context) Storage {
+	return &InstrumentedStore{Storage: m.Storage, ctx: ctx}
+}
+
+type storeCall struct {
+	ctx       context.Context
+	method    string
+	mediaType string
+	start     time.Time
+	span      trace.Span
+}
+
+func (m *InstrumentedStore) begin(method string, mediaType string) *storeCall {
+	storageInFlight.Inc()
+
+	ctx, span := tracer.Start(m.ctx, "Storage."+method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "neo4j"),
+			attribute.String("db.operation.name", method),
+		))
+
+	if mediaType != "" {
+		span.SetAttributes(attribute.String("likes.media_type", mediaType))
+	}
+
+	return &storeCall{ctx: ctx, method: method, mediaType: mediaType, start: time.Now(), span: span}
+}
+
+// end records the outcome of a call. result points to the value returned, if
+// any, to count its rows.
+func (c *storeCall) end(err *error, result any) {
+	storageInFlight.Dec()
+	storageCalls.WithLabelValues(c.method).Inc()
+	elapsed := time.Since(c.start)
+	storageDuration.WithLabelValues(c.method).Observe(elapsed.Seconds())
+
+	if result != nil {
+		if rows, ok := rowCount(result); ok {
+			c.span.SetAttributes(attribute.Int("db.response.returned_rows", rows))
+		}
+	}
+
+	if *err != nil {
+		storageErrors.WithLabelValues(c.method).Inc()
+		if acquisitionError(*err) {
+			neo4jAcquisitionErrors.WithLabelValues(c.method).Inc()
+		}
+		slog.ErrorContext(c.ctx, "storage call failed",
+			"method", c.method,
+			"media_type", c.mediaType,
+			"duration_ms", float64(elapsed.Microseconds())/1000,
+			"error", *err,
+		)
+		c.span.RecordError(*err)
+		c.span.SetStatus(codes.Error, (*err).Error())
+	}
+
+	c.span.End()
+}
+
+// rowCount counts the items of a slice, or of the slices of a struct.
+func rowCount(result any) (int, bool) {
+	value := reflect.ValueOf(result).Elem()
+	if value.Kind() == reflect.Pointer {
+		if value.IsNil() {
+			return 0, false
+		}
+		value = value.Elem()
+	}
+
+	if value.Kind() == reflect.Slice {
+		return value.Len(), true
+	}
+
+	if value.Kind() != reflect.Struct {
+		return 0, false
+	}
+
+	rows, found := 0, false
+	for i := 0; i < value.NumField(); i++ {
+		if value.Field(i).Kind() == reflect.Slice {
+			rows += value.Field(i).Len()
+			found = true
+		}
+	}
+
+	return rows, found
+}
+
+func (m *InstrumentedStore) CreateUser(user int) (err error) {
+	call := m.begin("CreateUser", "")
+	defer call.end(&err, nil)
+
+	return m.Storage.CreateUser(user)
+}
+
+func (m *InstrumentedStore) CreateMedia(media, mediaType string) (err error) {
+	call := m.begin("CreateMedia", mediaType)
+	defer call.end(&err, nil)
+
+	return m.Storage.CreateMedia(media, mediaType)
+}
+
+func (m *InstrumentedStore) SetLike(like *Like, actor string, ifMatch IfMatch) (result int64, err error) {
+	call := m.begin("SetLike", like.MediaType)
+	defer call.end(&err, nil)
+
+	if result, err = m.Storage.SetLike(like, actor, ifMatch); err == nil {
+		likesWritten.WithLabelValues(like.Reaction, like.MediaType).Inc()
+	}
+
+	return result, err
+}
+
+func (m *InstrumentedStore) AddToWishlist(user int, media, mediaType, actor string, ifMatch IfMatch) (result int64, err error) {
+	call := m.begin("AddToWishlist", mediaType)
+	defer call.end(&err, nil)
+
+	return m.Storage.AddToWishlist(user, media, mediaType, actor, ifMatch)
+}
+
+func (m *InstrumentedStore) SetAverage(user int, media, mediaType string, rating *Rate, actor string, ifMatch IfMatch) (result int64, err error) {
+	call := m.begin("SetAverage", mediaType)
+	defer call.end(&err, nil)
+
+	if result, err = m.Storage.SetAverage(user, media, mediaType, rating, actor, ifMatch); err == nil {
+		ratingsWritten.WithLabelValues(mediaType).Inc()
+	}
+
+	return result, err
+}
+
+func (m *InstrumentedStore) GetUserLikes(user int, mediaType, preference string) (result *GetUserLikes, err error) {
+	call := m.begin("GetUserLikes", mediaType)
+	defer call.end(&err, &result)
+
+	return m.Storage.GetUserLikes(user, mediaType, preference)
+}
+
+func (m *InstrumentedStore) GetMediaLikes(media, mediaType, preference string, viewer int) (result *GetMediaLikes, err error) {
+	call := m.begin("GetMediaLikes", mediaType)
+	defer call.end(&err, &result)
+
+	return m.Storage.GetMediaLikes(media, mediaType, preference, viewer)
+}
+
+func (m *InstrumentedStore) GetSpecificLike(user int, media, mediaType string) (result *LikeRelation, err error) {
+	call := m.begin("GetSpecificLike", mediaType)
+	defer call.end(&err, &result)
+
+	return m.Storage.GetSpecificLike(user, media, mediaType)
+}
+
+func (m *InstrumentedStore) GetAverage(media, mediaType string) (result float64, err error) {
+	call := m.begin("GetAverage", mediaType)
+	defer call.end(&err, &result)
+
+	return m.Storage.GetAverage(media, mediaType)
+}
+
+func (m *InstrumentedStore) GetRating(media, mediaType string, user int) (result float64, err error) {
+	call := m.begin("GetRating", mediaType)
+	defer call.end(&err, &result)
+
+	return m.Storage.GetRating(media, mediaType, user)
+}
+
+func (m *InstrumentedStore) GetWishlist(user int, mediaType string) (result *GetWishlist, err error) {
+	call := m.begin("GetWishlist", mediaType)
+	defer call.end(&err, &result)
+
+	return m.Storage.GetWishlist(user, mediaType)
+}
+
+func (m *InstrumentedStore) GetMediaCounts(media, mediaType string) (result *MediaCounts, err error) {
+	call := m.begin("GetMediaCounts", mediaType)
+	defer call.end(&err, &result)
+
+	return m.Storage.GetMediaCounts(media, mediaType)
+}
+
+func (m *InstrumentedStore) DeleteUser(user int) (err error) {
+	call := m.begin("DeleteUser", "")
+	defer call.end(&err, nil)
+
+	return m.Storage.DeleteUser(user)
+}
+
+func (m *InstrumentedStore) DeleteMedia(media, mediaType string) (err error) {
+	call := m.begin("DeleteMedia", mediaType)
+	defer call.end(&err, nil)
+
+	return m.Storage.DeleteMedia(media, mediaType)
+}
+
+func (m *InstrumentedStore) DeleteLike(user int, media, mediaType, actor string, ifMatch IfMatch) (result int64, err error) {
+	call := m.begin("DeleteLike", mediaType)
+	defer call.end(&err, nil)
+
+	return m.Storage.DeleteLike(user, media, mediaType, actor, ifMatch)
+}
+
+func (m *InstrumentedStore) RestoreUser(user int) (err error) {
+	call := m.begin("RestoreUser", "")
+	defer call.end(&err, nil)
+
+	return m.Storage.RestoreUser(user)
+}
+
+func (m *InstrumentedStore) RestoreMedia(media, mediaType string) (err error) {
+	call := m.begin("RestoreMedia", mediaType)
+	defer call.end(&err, nil)
+
+	return m.Storage.RestoreMedia(media, mediaType)
+}
+
+func (m *InstrumentedStore) PurgeDeleted() (result int64, err error) {
+	call := m.begin("PurgeDeleted", "")
+	defer call.end(&err, &result)
+
+	return m.Storage.PurgeDeleted()
+}
+
+func (m *InstrumentedStore) RemoveFromWishlist(user int, media, mediaType, actor string, ifMatch IfMatch) (result int64, err error) {
+	call := m.begin("RemoveFromWishlist", mediaType)
+	defer call.end(&err, nil)
+
+	return m.Storage.RemoveFromWishlist(user, media, mediaType, actor, ifMatch)
+}
+
+func (m *InstrumentedStore) GetReviews(media, mediaType string, viewer int) (result *GetReviews, err error) {
+	call := m.begin("GetReviews", mediaType)
+	defer call.end(&err, &result)
+
+	return m.Storage.GetReviews(media, mediaType, viewer)
+}
+
+func (m *InstrumentedStore) ReportReview(user int, media, mediaType string, report *ReportReview) (err error) {
+	call := m.begin("ReportReview", mediaType)
+	defer call.end(&err, nil)
+
+	return m.Storage.ReportReview(user, media, mediaType, report)
+}
+
+func (m *InstrumentedStore) GetFlaggedReviews() (result []FlaggedReview, err error) {
+	call := m.begin("GetFlaggedReviews", "")
+	defer call.end(&err, &result)
+
+	return m.Storage.GetFlaggedReviews()
+}
+
+func (m *InstrumentedStore) ModerateReview(user int, media, mediaType string, moderate *ModerateReview) (err error) {
+	call := m.begin("ModerateReview", mediaType)
+	defer call.end(&err, nil)
+
+	return m.Storage.ModerateReview(user, media, mediaType, moderate)
+}
+
+func (m *InstrumentedStore) GetModerationAudit() (result []ModerationAudit, err error) {
+	call := m.begin("GetModerationAudit", "")
+	defer call.end(&err, &result)
+
+	return m.Storage.GetModerationAudit()
+}
+
+func (m *InstrumentedStore) GetHistory(user int, filter *HistoryFilter) (result *GetHistory, err error) {
+	call := m.begin("GetHistory", "")
+	defer call.end(&err, &result)
+
+	return m.Storage.GetHistory(user, filter)
+}
+
+func (m *InstrumentedStore) Follow(user, target int) (err error) {
+	call := m.begin("Follow", "")
+	defer call.end(&err, nil)
+
+	return m.Storage.Follow(user, target)
+}
+
+func (m *InstrumentedStore) Unfollow(user, target int) (err error) {
+	call := m.begin("Unfollow", "")
+	defer call.end(&err, nil)
+
+	return m.Storage.Unfollow(user, target)
+}
+
+func (m *InstrumentedStore) GetFollowers(user int) (result *GetFollows, err error) {
+	call := m.begin("GetFollowers", "")
+	defer call.end(&err, &result)
+
+	return m.Storage.GetFollowers(user)
+}
+
+func (m *InstrumentedStore) GetFollowing(user int) (result *GetFollows, err error) {
+	call := m.begin("GetFollowing", "")
+	defer call.end(&err, &result)
+
+	return m.Storage.GetFollowing(user)
+}
+
+func (m *InstrumentedStore) GetFeed(user int, filter *FeedFilter) (result *GetFeed, err error) {
+	call := m.begin("GetFeed", "")
+	defer call.end(&err, &result)
+
+	return m.Storage.GetFeed(user, filter)
+}
+
+func (m *InstrumentedStore) IsFollowing(user, target int) (result bool, err error) {
+	call := m.begin("IsFollowing", "")
+	defer call.end(&err, &result)
+
+	return m.Storage.IsFollowing(user, target)
+}
+
+func (m *InstrumentedStore) GetUserVersion(user int) (result int64, err error) {
+	call := m.begin("GetUserVersion", "")
+	defer call.end(&err, nil)
+
+	return m.Storage.GetUserVersion(user)
+}
+
+func (m *InstrumentedStore) GetMediaVersion(media string, mediaType string) (result int64, err error) {
+	call := m.begin("GetMediaVersion", mediaType)
+	defer call.end(&err, nil)
+
+	return m.Storage.GetMediaVersion(media, mediaType)
+}
+
+func (m *InstrumentedStore) GetPrivacy(user int) (result *PrivacySettings, err error) {
+	call := m.begin("GetPrivacy", "")
+	defer call.end(&err, &result)
+
+	return m.Storage.GetPrivacy(user)
+}
+
+func (m *InstrumentedStore) SetPrivacy(user int, settings *PrivacySettings) (err error) {
+	call := m.begin("SetPrivacy", "")
+	defer call.end(&err, nil)
+
+	return m.Storage.SetPrivacy(user, settings)
+}
+
+func (m *InstrumentedStore) GetPendingEvents(limit int) (result []OutboxEvent, err error) {
+	call := m.begin("GetPendingEvents", "")
+	defer call.end(&err, &result)
+
+	return m.Storage.GetPendingEvents(limit)
+}
+
+func (m *InstrumentedStore) MarkEventSent(id string) (err error) {
+	call := m.begin("MarkEventSent", "")
+	defer call.end(&err, nil)
+
+	return m.Storage.MarkEventSent(id)
+}
+
+func (m *InstrumentedStore) MarkEventFailed(id string, next time.Time, reason string) (err error) {
+	call := m.begin("MarkEventFailed", "")
+	defer call.end(&err, nil)
+
+	return m.Storage.MarkEventFailed(id, next, reason)
+}
+
+func (m *InstrumentedStore) MarkEventDead(id string, reason string) (err error) {
+	call := m.begin("MarkEventDead", "")
+	defer call.end(&err, nil)
+
+	return m.Storage.MarkEventDead(id, reason)
+}
+
+func (m *InstrumentedStore) CreateWebhook(webhook *Webhook) (err error) {
+	call := m.begin("CreateWebhook", "")
+	defer call.end(&err, nil)
+
+	return m.Storage.CreateWebhook(webhook)
+}
+
+func (m *InstrumentedStore) GetWebhooks() (result []Webhook, err error) {
+	call := m.begin("GetWebhooks", "")
+	defer call.end(&err, &result)
+
+	return m.Storage.GetWebhooks()
+}
+
+func (m *InstrumentedStore) GetWebhook(id string) (result *Webhook, err error) {
+	call := m.begin("GetWebhook", "")
+	defer call.end(&err, &result)
+
+	return m.Storage.GetWebhook(id)
+}
+
+func (m *InstrumentedStore) UpdateWebhook(webhook *Webhook) (err error) {
+	call := m.begin("UpdateWebhook", "")
+	defer call.end(&err, nil)
+
+	return m.Storage.UpdateWebhook(webhook)
+}
+
+func (m *InstrumentedStore) DeleteWebhook(id string) (err error) {
+	call := m.begin("DeleteWebhook", "")
+	defer call.end(&err, nil)
+
+	return m.Storage.DeleteWebhook(id)
+}
+
+func (m *InstrumentedStore) AddDeadLetter(letter *DeadLetter) (err error) {
+	call := m.begin("AddDeadLetter", "")
+	defer call.end(&err, nil)
+
+	return m.Storage.AddDeadLetter(letter)
+}
+
+func (m *InstrumentedStore) GetDeadLetters(id string) (result []DeadLetter, err error) {
+	call := m.begin("GetDeadLetters", "")
+	defer call.end(&err, &result)
+
+	return m.Storage.GetDeadLetters(id)
+}
+
+func (m *InstrumentedStore) EnqueueDeliveries(e *Event, webhooks []string) (err error) {
+	call := m.begin("EnqueueDeliveries", "")
+	defer call.end(&err, nil)
+
+	return m.Storage.EnqueueDeliveries(e, webhooks)
+}
+
+func (m *InstrumentedStore) GetPendingDeliveries(limit int) (result []WebhookDelivery, err error) {
+	call := m.begin("GetPendingDeliveries", "")
+	defer call.end(&err, &result)
+
+	return m.Storage.GetPendingDeliveries(limit)
+}
+
+func (m *InstrumentedStore) MarkDeliveryFailed(id string, next time.Time, reason string) (err error) {
+	call := m.begin("MarkDeliveryFailed", "")
+	defer call.end(&err, nil)
+
+	return m.Storage.MarkDeliveryFailed(id, next, reason)
+}
+
+func (m *InstrumentedStore) DeleteDelivery(id string) (err error) {
+	call := m.begin("DeleteDelivery", "")
+	defer call.end(&err, nil)
+
+	return m.Storage.DeleteDelivery(id)
+}
+
+func (m *InstrumentedStore) CreateAPIKey(key *APIKey) (err error) {
+	call := m.begin("CreateAPIKey", "")
+	defer call.end(&err, nil)
+
+	return m.Storage.CreateAPIKey(key)
+}
+
+func (m *InstrumentedStore) GetAPIKeys() (result []APIKey, err error) {
+	call := m.begin("GetAPIKeys", "")
+	defer call.end(&err, &result)
+
+	return m.Storage.GetAPIKeys()
+}
+
+func (m *InstrumentedStore) GetAPIKey(id string) (result *APIKey, err error) {
+	call := m.begin("GetAPIKey", "")
+	defer call.end(&err, &result)
+
+	return m.Storage.GetAPIKey(id)
+}
+
+func (m *InstrumentedStore) RotateAPIKey(id, hash string, until time.Time) (result *APIKey, err error) {
+	call := m.begin("RotateAPIKey", "")
+	defer call.end(&err, &result)
+
+	return m.Storage.RotateAPIKey(id, hash, until)
+}
+
+func (m *InstrumentedStore) RevokeAPIKey(id string) (err error) {
+	call := m.begin("RevokeAPIKey", "")
+	defer call.end(&err, nil)
+
+	return m.Storage.RevokeAPIKey(id)
+}
+
+func (m *InstrumentedStore) AddAPIKeyUsage(id string, count int64, lastUsed time.Time) (err error) {
+	call := m.begin("AddAPIKeyUsage", "")
+	defer call.end(&err, nil)
+
+	return m.Storage.AddAPIKeyUsage(id, count, lastUsed)
+}
+
+func (m *InstrumentedStore) ReserveIdempotencyKey(r *IdempotentResponse) (result *IdempotentResponse, err error) {
+	call := m.begin("ReserveIdempotencyKey", "")
+	defer call.end(&err, nil)
+
+	return m.Storage.ReserveIdempotencyKey(r)
+}
+
+func (m *InstrumentedStore) SaveIdempotentResponse(r *IdempotentResponse) (err error) {
+	call := m.begin("SaveIdempotentResponse", "")
+	defer call.end(&err, nil)
+
+	return m.Storage.SaveIdempotentResponse(r)
+}
+
+func (m *InstrumentedStore) ReleaseIdempotencyKey(key string, token string) (err error) {
+	call := m.begin("ReleaseIdempotencyKey", "")
+	defer call.end(&err, nil)
+
+	return m.Storage.ReleaseIdempotencyKey(key, token)
+}
+
+func (m *InstrumentedStore) GetUserExport(user int) (result *GDPRExport, err error) {
+	call := m.begin("GetUserExport", "")
+	defer call.end(&err, &result)
+
+	return m.Storage.GetUserExport(user)
+}
+
+func (m *InstrumentedStore) EraseUser(user int) (result *ErasureReceipt, err error) {
+	call := m.begin("EraseUser", "")
+	defer call.end(&err, &result)
+
+	return m.Storage.EraseUser(user)
+}
+
+func (m *InstrumentedStore) VerifyErasure(user int) (result *ErasureReceipt, err error) {
+	call := m.begin("VerifyErasure", "")
+	defer call.end(&err, &result)
+
+	return m.Storage.VerifyErasure(user)
+}
+
+func (m *InstrumentedStore) VerifyConnectivity(ctx context.Context) (err error) {
+	call := m.begin("VerifyConnectivity", "")
+	defer call.end(&err, nil)
+
+	return m.Storage.VerifyConnectivity(ctx)
+}
+
+func (m *InstrumentedStore) GetSchema(ctx context.Context) (result []SchemaItem, err error) {
+	call := m.begin("GetSchema", "")
+	defer call.end(&err, &result)
+
+	return m.Storage.GetSchema(ctx)
+}
+
+func (m *InstrumentedStore) ApplySchema(ctx context.Context, statement string) (err error) {
+	call := m.begin("ApplySchema", "")
+	defer call.end(&err, nil)
+
+	return m.Storage.ApplySchema(ctx, statement)
+}
+
+func (m *InstrumentedStore) GetAppliedMigrations(ctx context.Context) (result []AppliedMigration, err error) {
+	call := m.begin("GetAppliedMigrations", "")
+	defer call.end(&err, &result)
+
+	return m.Storage.GetAppliedMigrations(ctx)
+}
+
+func (m *InstrumentedStore) ApplyMigration(ctx context.Context, migration *Migration, up bool, batchSize int64) (err error) {
+	call := m.begin("ApplyMigration", "")
+	defer call.end(&err, nil)
+
+	return m.Storage.ApplyMigration(ctx, migration, up, batchSize)
+}
+
+func (m *InstrumentedStore) FindIntegrityIssues(ctx context.Context, check *IntegrityCheck, sampleSize int64) (result *IntegrityResult, err error) {
+	call := m.begin("FindIntegrityIssues", "")
+	defer call.end(&err, &result)
+
+	return m.Storage.FindIntegrityIssues(ctx, check, sampleSize)
+}
+
+func (m *InstrumentedStore) RepairIntegrity(ctx context.Context, check *IntegrityCheck, batchSize int64) (result int64, err error) {
+	call := m.begin("RepairIntegrity", "")
+	defer call.end(&err, nil)
+
+	return m.Storage.RepairIntegrity(ctx, check, batchSize)
+}
+
+func (m *InstrumentedStore) MergeNodes(ctx context.Context, merge *NodeMerge, batchSize int64) (result map[string]int64, err error) {
+	call := m.begin("MergeNodes", "")
+	defer call.end(&err, nil)
+
+	return m.Storage.MergeNodes(ctx, merge, batchSize)
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// integritySampleSize is how many issues of each check a report shows.
+const integritySampleSize = 10
+
+// IntegrityCheck finds inconsistencies in the graph. Find returns one row per
+// issue, with an "issue" column describing it. Repair fixes at most
+// $batch_size issues at once and returns how many in its "changed" column,
+// it runs until that is 0 so it must only match issues it fixes. Checks
+// without Repair are only reported. Informational ones find rows which may
+// be fine, they leave the report clean.
+type IntegrityCheck struct {
+	Name          string
+	Description   string
+	Find          string
+	Repair        string
+	Informational bool
+}
+
+type IntegrityResult struct {
+	Check         string           `json:"check"`
+	Description   string           `json:"description"`
+	Count         int64            `json:"count"`
+	Samples       []map[string]any `json:"samples"`
+	Repairable    bool             `json:"repairable"`
+	Informational bool             `json:"informational"`
+	Repaired      int64            `json:"repaired,omitempty"`
+}
+
+type IntegrityReport struct {
+	Clean     bool              `json:"clean"`
+	Checks    []IntegrityResult `json:"checks"`
+	CheckedAt time.Time         `json:"checked_at"`
+}
+
+type RepairIntegrity struct {
+	Checks []string `json:"checks"` // Every repairable check when empty
+}
+
+// duplicateCheck finds nodes sharing an id, which the uniqueness constraints
+// prevent once applied. The repair keeps the active node created first, moves
+// the relations of the others to it, then deletes them. Relations and
+// properties the kept node already has win.
+func duplicateCheck(name string, label string, key string, user bool) IntegrityCheck {
+	moves := []string{
+		"MATCH (dup)-[r:PREF]->(m) MERGE (keep)-[k:PREF]->(m) ON CREATE SET k = properties(r)",
+		"MATCH (dup)-[r:RTE]->(m) MERGE (keep)-[k:RTE]->(m) ON CREATE SET k = properties(r)",
+		"MATCH (dup)-[r:WSH]->(m) MERGE (keep)-[k:WSH]->(m) ON CREATE SET k = properties(r)",
+		"MATCH (dup)-[r:FOLLOWS]->(f) WHERE NOT f IN nodes MERGE (keep)-[k:FOLLOWS]->(f) ON CREATE SET k = properties(r)",
+		"MATCH (f)-[r:FOLLOWS]->(dup) WHERE NOT f IN nodes MERGE (f)-[k:FOLLOWS]->(keep) ON CREATE SET k = properties(r)",
+	}
+
+	if !user {
+		moves = []string{
+			"MATCH (dup)<-[r:PREF]-(u) MERGE (keep)<-[k:PREF]-(u) ON CREATE SET k = properties(r)",
+			"MATCH (dup)<-[r:RTE]-(u) MERGE (keep)<-[k:RTE]-(u) ON CREATE SET k = properties(r)",
+			"MATCH (dup)<-[r:WSH]-(u) MERGE (keep)<-[k:WSH]-(u) ON CREATE SET k = properties(r)",
+		}
+	}
+
+	repair := fmt.Sprintf(`
+	MATCH (n:%s)
+	WHERE n.%s IS NOT NULL
+	WITH n ORDER BY n.deleted_at IS NOT NULL, id(n)
+	WITH n.%s as id, collect(n) as nodes
+	WHERE size(nodes) > 1
+	WITH nodes LIMIT $batch_size
+	WITH nodes, nodes[0] as keep
+	UNWIND nodes[1..] as dup
+	`, label, key, key)
+
+	for i, move := range moves {
+		repair += fmt.Sprintf("CALL { WITH keep, dup, nodes %s RETURN count(r) as moved%d }\n", move, i)
+	}
+
+	repair += `
+	WITH keep, dup, properties(keep) as kept
+	SET keep += properties(dup)
+	SET keep += kept
+	SET keep.deleted_at = kept.deleted_at
+	DETACH DELETE dup
+	RETURN count(dup) as changed
+	`
+
+	return IntegrityCheck{
+		Name:        name,
+		Description: fmt.Sprintf("%s nodes sharing their %s", label, key),
+		Find: fmt.Sprintf(`
+		MATCH (n:%s)
+		WHERE n.%s IS NOT NULL
+		WITH n.%s as id, count(n) as nodes
+		WHERE nodes > 1
+		RETURN {id: id, nodes: nodes} as issue
+		`, label, key, key),
+		Repair: repair,
+	}
+}
+
+// integrityChecks run in order, duplicates first as the other repairs are
+// simpler once each id has a single node.
+var integrityChecks = []IntegrityCheck{
+	duplicateCheck("duplicate_users", "User", "id_user", true),
+	duplicateCheck("duplicate_movies", "Movie", "id_movie", false),
+	duplicateCheck("duplicate_songs", "Song", "id_song", false),
+	duplicateCheck("duplicate_books", "Book", "id_book", false),
+	{
+		Name:        "edge_media_type_mismatch",
+		Description: "Likes, ratings and wishlist entries whose media_type disagrees with the label of their media",
+		Find: `
+		MATCH ()-[r:PREF|RTE|WSH]->(m)
+		WITH r, CASE WHEN m:Movie THEN "MOV" WHEN m:Song THEN "SON" WHEN m:Book THEN "BOO" END as media_type
+		WHERE media_type IS NOT NULL AND (r.media_type IS NULL OR r.media_type <> media_type)
+		RETURN {type: type(r), user_id: r.user_id, media_id: r.media_id, media_type: r.media_type, expected: media_type} as issue
+		`,
+		Repair: `
+		MATCH ()-[r:PREF|RTE|WSH]->(m)
+		WITH r, CASE WHEN m:Movie THEN "MOV" WHEN m:Song THEN "SON" WHEN m:Book THEN "BOO" END as media_type
+		WHERE media_type IS NOT NULL AND (r.media_type IS NULL OR r.media_type <> media_type)
+		WITH r, media_type LIMIT $batch_size
+		SET r.media_type = media_type
+		RETURN count(r) as changed
+		`,
+	},
+	{
+		Name:        "edge_media_id_mismatch",
+		Description: "Likes, ratings and wishlist entries whose media_id differs from the id of their media",
+		Find: `
+		MATCH ()-[r:PREF|RTE|WSH]->(m)
+		WITH r, coalesce(m.id_movie, m.id_song, m.id_book) as media_id
+		WHERE media_id IS NOT NULL AND (r.media_id IS NULL OR r.media_id <> media_id)
+		RETURN {type: type(r), user_id: r.user_id, media_id: r.media_id, expected: media_id} as issue
+		`,
+		Repair: `
+		MATCH ()-[r:PREF|RTE|WSH]->(m)
+		WITH r, coalesce(m.id_movie, m.id_song, m.id_book) as media_id
+		WHERE media_id IS NOT NULL AND (r.media_id IS NULL OR r.media_id <> media_id)
+		WITH r, media_id LIMIT $batch_size
+		SET r.media_id = media_id
+		RETURN count(r) as changed
+		`,
+	},
+	{
+		Name:        "edge_user_id_mismatch",
+		Description: "Relations whose user_id differs from the id of their user",
+		Find: `
+		MATCH (u:User)-[r:PREF|RTE|WSH|FOLLOWS]->()
+		WHERE u.id_user IS NOT NULL AND (r.user_id IS NULL OR r.user_id <> u.id_user)
+		RETURN {type: type(r), user_id: r.user_id, media_id: r.media_id, expected: u.id_user} as issue
+		`,
+		Repair: `
+		MATCH (u:User)-[r:PREF|RTE|WSH|FOLLOWS]->()
+		WHERE u.id_user IS NOT NULL AND (r.user_id IS NULL OR r.user_id <> u.id_user)
+		WITH u, r LIMIT $batch_size
+		SET r.user_id = u.id_user
+		RETURN count(r) as changed
+		`,
+	},
+	{
+		// A rating can not be guessed: only the ones without a review, which
+		// are empty, are removed.
+		Name:        "rte_without_rating",
+		Description: "Ratings without a rating value",
+		Find: `
+		MATCH ()-[r:RTE]->()
+		WHERE r.rating IS NULL
+		RETURN {user_id: r.user_id, media_id: r.media_id, media_type: r.media_type, review: r.review IS NOT NULL} as issue
+		`,
+		Repair: `
+		MATCH ()-[r:RTE]->()
+		WHERE r.rating IS NULL AND r.review IS NULL
+		WITH r LIMIT $batch_size
+		DELETE r
+		RETURN count(r) as changed
+		`,
+	},
+	{
+		// Media are created before anyone likes them, so orphans are normal
+		// in a healthy graph: they are listed, never deleted.
+		Name:        "orphan_media",
+		Description: "Active media without any relation",
+		Find: `
+		MATCH (m)
+		WHERE (m:Movie OR m:Song OR m:Book) AND m.deleted_at IS NULL AND NOT (m)--()
+		RETURN {label: labels(m)[0], id: coalesce(m.id_movie, m.id_song, m.id_book)} as issue
+		`,
+		Informational: true,
+	},
+}
+
+func findIntegrityCheck(name string) *IntegrityCheck {
+	for i := range integrityChecks {
+		if integrityChecks[i].Name == name {
+			return &integrityChecks[i]
+		}
+	}
+
+	return nil
+}
+
+// CheckIntegrity runs every check and reports the issues found.
+func CheckIntegrity(ctx context.Context, store Storage) (*IntegrityReport, error) {
+	report := &IntegrityReport{Clean: true, Checks: []IntegrityResult{}, CheckedAt: time.Now().UTC()}
+
+	for i := range integrityChecks {
+		result, err := store.FindIntegrityIssues(ctx, &integrityChecks[i], integritySampleSize)
+		if err != nil {
+			return nil, fmt.Errorf("integrity check %s: %w", integrityChecks[i].Name, err)
+		}
+
+		result.Informational = integrityChecks[i].Informational
+		if result.Count > 0 && !result.Informational {
+			report.Clean = false
+		}
+
+		report.Checks = append(report.Checks, *result)
+	}
+
+	return report, nil
+}
+
+// RepairIntegrityIssues repairs the issues of the given checks, or of every
+// repairable check when none is given, then reports what is left.
+func RepairIntegrityIssues(ctx context.Context, store Storage, names []string, batchSize int64) (*IntegrityReport, error) {
+	checks := []*IntegrityCheck{}
+	for _, name := range names {
+		check := findIntegrityCheck(name)
+		if check == nil {
+			return nil, fmt.Errorf("unknown integrity check %s", name)
+		}
+		if check.Repair == "" {
+			return nil, fmt.Errorf("integrity check %s can not be repaired", name)
+		}
+		checks = append(checks, check)
+	}
+
+	if len(names) == 0 {
+		for i := range integrityChecks {
+			if integrityChecks[i].Repair != "" {
+				checks = append(checks, &integrityChecks[i])
+			}
+		}
+	}
+
+	repaired := map[string]int64{}
+	for _, check := range checks {
+		changed, err := store.RepairIntegrity(ctx, check, batchSize)
+		if err != nil {
+			return nil, fmt.Errorf("integrity repair %s: %w", check.Name, err)
+		}
+
+		slog.InfoContext(ctx, "Integrity repaired", "check", check.Name, "changed", changed)
+		repaired[check.Name] = changed
+	}
+
+	report, err := CheckIntegrity(ctx, store)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range report.Checks {
+		report.Checks[i].Repaired = repaired[report.Checks[i].Check]
+	}
+
+	return report, nil
+}
+
+func (s *APIServer) handleIntegrity(w http.ResponseWriter, r *http.Request) error {
+	if err := s.authorizeAdmin(r); err != nil {
+		return writeAuthError(w, err)
+	}
+
+	if r.Method != "GET" {
+		return fmt.Errorf("method not allowed %s", r.Method)
+	}
+
+	report, err := CheckIntegrity(r.Context(), s.storeFor(r))
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, report)
+}
+
+func (s *APIServer) handleRepairIntegrity(w http.ResponseWriter, r *http.Request) error {
+	if err := s.authorizeAdmin(r); err != nil {
+		return writeAuthError(w, err)
+	}
+
+	if r.Method != "POST" {
+		return fmt.Errorf("method not allowed %s", r.Method)
+	}
+
+	// The body is optional
+	repair := new(RepairIntegrity)
+	if err := json.NewDecoder(r.Body).Decode(repair); err != nil && err != io.EOF {
+		return WriteJSON(w, http.StatusBadRequest, "Guard failed") // 400
+	}
+
+	for _, name := range repair.Checks {
+		if check := findIntegrityCheck(name); check == nil || check.Repair == "" {
+			return WriteJSON(w, http.StatusBadRequest, "Invalid check "+name) // 400
+		}
+	}
+
+	report, err := RepairIntegrityIssues(r.Context(), s.storeFor(r), repair.Checks, s.config.MigrationBatchSize)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, report)
+}
+
+// integrityCheckNames lists the checks, for usage messages.
+func integrityCheckNames() string {
+	names := []string{}
+	for _, check := range integrityChecks {
+		names = append(names, check.Name)
+	}
+
+	return strings.Join(names, ", ")
+}
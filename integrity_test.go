@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+// integrityStore finds the given number of issues for each check and records
+// the repairs. Other Storage methods are not implemented.
+type integrityStore struct {
+	Storage
+	issues   map[string]int64
+	repaired []string
+}
+
+func (s *integrityStore) FindIntegrityIssues(ctx context.Context, check *IntegrityCheck, sampleSize int64) (*IntegrityResult, error) {
+	return &IntegrityResult{Check: check.Name, Count: s.issues[check.Name], Repairable: check.Repair != ""}, nil
+}
+
+func (s *integrityStore) RepairIntegrity(ctx context.Context, check *IntegrityCheck, batchSize int64) (int64, error) {
+	s.repaired = append(s.repaired, check.Name)
+	s.issues[check.Name] = 0
+
+	return 0, nil
+}
+
+func TestCheckIntegrityClean(t *testing.T) {
+	tests := []struct {
+		name   string
+		issues map[string]int64
+		clean  bool
+	}{
+		{"no issues", map[string]int64{}, true},
+		{"only orphan media", map[string]int64{"orphan_media": 3}, true},
+		{"duplicates", map[string]int64{"duplicate_users": 1, "orphan_media": 3}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report, err := CheckIntegrity(context.Background(), &integrityStore{issues: tt.issues})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if report.Clean != tt.clean {
+				t.Errorf("clean = %v, want %v", report.Clean, tt.clean)
+			}
+		})
+	}
+}
+
+func TestRepairIntegrityDefaultChecks(t *testing.T) {
+	store := &integrityStore{issues: map[string]int64{"orphan_media": 3}}
+
+	if _, err := RepairIntegrityIssues(context.Background(), store, nil, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range store.repaired {
+		if name == "orphan_media" {
+			t.Error("orphan media repaired by default")
+		}
+	}
+
+	if _, err := RepairIntegrityIssues(context.Background(), store, []string{"orphan_media"}, 100); err == nil {
+		t.Error("orphan media repaired on request")
+	}
+}
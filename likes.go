@@ -5,6 +5,7 @@ type Like struct {
 	MediaID   string `json:"media_id"`
 	MediaType string `json:"media_type"` // 'MOV' | 'BOO' | 'SON'
 	LikeType  string `json:"like_type"`  // 'LK' | 'DLK'
+	Reaction  string `json:"reaction"`   // Any code of the reactions vocabulary, defaults to like_type
 }
 
 type LikeExtended struct {
@@ -20,6 +21,9 @@ type LikeExtended struct {
 
 type Rate struct {
 	Rating float64 `json:"rating"`
+
+	//Optional Attributes
+	Review string `json:"review"`
 }
 
 type ChangeWishlist struct {
@@ -35,11 +39,12 @@ type GetWishlist struct {
 	Books  []string `json:"books"`
 }
 
-func NewLike(id int, media string, mtype string, ltype string) *Like {
+func NewLike(id int, media string, mtype string, ltype string, reaction string) *Like {
 	return &Like{
 		UserID:    id,
 		MediaID:   media,
 		MediaType: mtype,
 		LikeType:  ltype,
+		Reaction:  reaction,
 	}
 }
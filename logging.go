@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+const requestIDKey contextKey = "request_id"
+
+// logLevel can be changed while running through /likes/admin/log-level
+var logLevel = new(slog.LevelVar)
+
+// Attributes never written as is
+var redactedKeys = map[string]bool{
+	"authorization": true,
+	"x-api-key":     true,
+	"api_key":       true,
+	"key":           true,
+	"password":      true,
+	"secret":        true,
+	"token":         true,
+	"cookie":        true,
+}
+
+type LogLevel struct {
+	Level string `json:"level"` // 'DEBUG' | 'INFO' | 'WARN' | 'ERROR'
+}
+
+// contextHandler adds the request and trace ids of the context to records.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id, ok := ctx.Value(requestIDKey).(string); ok {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+
+	if span := trace.SpanContextFromContext(ctx); span.HasTraceID() {
+		record.AddAttrs(slog.String("trace_id", span.TraceID().String()))
+	}
+
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// redact hides credentials, by attribute name or by their look.
+func redact(groups []string, attr slog.Attr) slog.Attr {
+	if redactedKeys[strings.ToLower(attr.Key)] {
+		return slog.String(attr.Key, "[REDACTED]")
+	}
+
+	if attr.Value.Kind() == slog.KindString {
+		value := attr.Value.String()
+		if strings.HasPrefix(value, "Bearer ") || strings.HasPrefix(value, "pk_") {
+			return slog.String(attr.Key, "[REDACTED]")
+		}
+	}
+
+	return attr
+}
+
+// SetupLogging makes slog, and the log package through it, write JSON lines.
+func SetupLogging(config *Config) error {
+	if err := logLevel.UnmarshalText([]byte(config.LogLevel)); err != nil {
+		return err
+	}
+
+	handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level:       logLevel,
+		ReplaceAttr: redact,
+	})
+	slog.SetDefault(slog.New(contextHandler{handler}))
+
+	return nil
+}
+
+// validRequestID accepts the ids of callers when they are short and printable.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+
+	return true
+}
+
+// logRequests gives each request an id, taken from X-Request-ID or generated,
+// echoes it in the response and writes an access log once it is served.
+func (s *APIServer) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newID()
+		}
+		w.Header().Set("X-Request-ID", id)
+
+		ctx := context.WithValue(r.Context(), requestIDKey, id)
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		level := slog.LevelInfo
+		if recorder.status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+
+		slog.Log(ctx, level, "request served",
+			"method", r.Method,
+			"route", routeTemplate(r),
+			"path", r.URL.Path,
+			"status", recorder.status,
+			"duration_ms", float64(time.Since(start).Microseconds())/1000,
+			"remote_addr", r.RemoteAddr,
+		)
+	})
+}
+
+func (s *APIServer) handleLogLevel(w http.ResponseWriter, r *http.Request) error {
+	if err := s.authorizeAdmin(r); err != nil {
+		return writeAuthError(w, err)
+	}
+
+	if r.Method == "PUT" {
+		level := new(LogLevel)
+
+		if err := json.NewDecoder(r.Body).Decode(level); err != nil {
+			return WriteJSON(w, http.StatusBadRequest, "Guard failed") // 400
+		}
+
+		if err := logLevel.UnmarshalText([]byte(level.Level)); err != nil {
+			return WriteJSON(w, http.StatusBadRequest, "Invalid level") // 400
+		}
+
+		slog.InfoContext(r.Context(), "log level changed", "level", logLevel.Level().String())
+	} else if r.Method != "GET" {
+		return fmt.Errorf("method not allowed %s", r.Method)
+	}
+
+	return WriteJSON(w, http.StatusOK, LogLevel{Level: logLevel.Level().String()})
+}
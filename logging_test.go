@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// captureLogs makes slog write JSON records to a buffer, as SetupLogging
+// does to stdout, until the end of the test.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	handler := slog.NewJSONHandler(&buf, &slog.HandlerOptions{ReplaceAttr: redact})
+
+	previous := slog.Default()
+	slog.SetDefault(slog.New(contextHandler{handler}))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	return &buf
+}
+
+func logRecords(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+
+	var records []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+
+		record := map[string]any{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("log line %q is not JSON: %v", line, err)
+		}
+		records = append(records, record)
+	}
+
+	return records
+}
+
+func TestLogRequestsID(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		keep   bool
+	}{
+		{"id of the caller", "req-42", true},
+		{"no id", "", false},
+		{"id with spaces", "req 42", false},
+		{"id too long", strings.Repeat("a", 129), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := captureLogs(t)
+
+			s := &APIServer{}
+			handler := s.logRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				slog.InfoContext(r.Context(), "handled")
+				w.WriteHeader(http.StatusCreated)
+			}))
+
+			r := httptest.NewRequest("POST", "/likes", nil)
+			if tt.header != "" {
+				r.Header.Set("X-Request-ID", tt.header)
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			id := w.Header().Get("X-Request-ID")
+			if (id == tt.header) != tt.keep || id == "" {
+				t.Errorf("X-Request-ID %q for %q, keep %v", id, tt.header, tt.keep)
+			}
+
+			records := logRecords(t, buf)
+			if len(records) != 2 {
+				t.Fatalf("%d records, want the handler log and the access log", len(records))
+			}
+
+			for _, record := range records {
+				if record["request_id"] != id {
+					t.Errorf("record %v without request_id %q", record["msg"], id)
+				}
+			}
+
+			access := records[1]
+			if access["msg"] != "request served" || access["status"] != float64(http.StatusCreated) || access["method"] != "POST" {
+				t.Errorf("access log %v", access)
+			}
+		})
+	}
+}
+
+func TestLogRedaction(t *testing.T) {
+	buf := captureLogs(t)
+
+	slog.InfoContext(context.Background(), "calling",
+		"authorization", "Basic dXNlcjpwYXNz",
+		"header", "Bearer eyJhbGciOi",
+		"raw", "pk_k1_secret",
+		"user", "5",
+	)
+
+	records := logRecords(t, buf)
+	if len(records) != 1 {
+		t.Fatalf("%d records, want 1", len(records))
+	}
+
+	for _, key := range []string{"authorization", "header", "raw"} {
+		if records[0][key] != "[REDACTED]" {
+			t.Errorf("%s written as %v", key, records[0][key])
+		}
+	}
+	if records[0]["user"] != "5" {
+		t.Errorf("user written as %v", records[0]["user"])
+	}
+}
+
+func TestLogLevelAdmin(t *testing.T) {
+	defer logLevel.Set(logLevel.Level())
+
+	tests := []struct {
+		name   string
+		claims *Claims
+		body   string
+		status int
+		level  string
+	}{
+		{"no credentials", nil, `{"level": "DEBUG"}`, http.StatusUnauthorized, "INFO"},
+		{"user token", &Claims{Subject: "1", Verified: true}, `{"level": "DEBUG"}`, http.StatusForbidden, "INFO"},
+		{"invalid level", &Claims{Subject: "1", Scope: "admin", Verified: true}, `{"level": "LOUD"}`, http.StatusBadRequest, "INFO"},
+		{"admin", &Claims{Subject: "1", Scope: "admin", Verified: true}, `{"level": "DEBUG"}`, http.StatusOK, "DEBUG"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logLevel.Set(slog.LevelInfo)
+			s := &APIServer{config: &Config{AdminScope: "admin"}}
+
+			r := httptest.NewRequest("PUT", "/likes/admin/log-level", strings.NewReader(tt.body))
+			if tt.claims != nil {
+				r = r.WithContext(context.WithValue(r.Context(), claimsKey, tt.claims))
+			}
+
+			w := httptest.NewRecorder()
+			makeHTTPHandleFunc(s.handleLogLevel)(w, r)
+
+			if w.Code != tt.status || logLevel.Level().String() != tt.level {
+				t.Errorf("status %d level %s, want %d %s", w.Code, logLevel.Level(), tt.status, tt.level)
+			}
+		})
+	}
+}
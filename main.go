@@ -1,19 +1,127 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 )
 
 func main() {
-	fmt.Println("Hello! Welcome to PerfectPick Likes Microservice")
+	config, err := LoadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := SetupLogging(config); err != nil {
+		log.Fatal(err)
+	}
+
+	slog.Info("Starting PerfectPick Likes Microservice")
+
+	shutdownTracing, err := SetupTracing(config)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	store, err := NewNeo4jStore()
+	neo4jStore, err := NewNeo4jStore(config)
 	if err != nil {
 		log.Fatal(err)
 	}
+	store := NewInstrumentedStore(neo4jStore)
+
+	if len(os.Args) > 1 {
+		err := runCommand(context.Background(), store, config, os.Args[1:])
+		store.CloseSession()
+		if err != nil {
+			slog.Error("Command failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if config.SchemaOnStartup {
+		report, err := ApplySchema(context.Background(), store)
+		if err != nil {
+			slog.Error("Schema apply failed", "error", err)
+		} else {
+			logSchemaReport(report)
+		}
+	}
+
+	publisher, err := NewPublisher(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// SIGTERM is what Docker sends on stop
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var background sync.WaitGroup
+	runBackground := func(run func()) {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			run()
+		}()
+	}
+
+	runBackground(func() { RunPurge(ctx, store, config.PurgeInterval) })
+	dispatcher := NewWebhookDispatcher(store, config.WebhookMaxAttempts, config.WebhookBackoff, config.WebhookAllowPrivate)
+	runBackground(func() { RunWebhookDeliveries(ctx, dispatcher, config.RelayInterval) })
+	broker := NewStreamBroker(store, config.StreamBacklogTTL)
+	publishers := MultiPublisher{publisher, dispatcher, broker}
+	runBackground(func() { RunRelay(ctx, store, publishers, config.RelayInterval, config.RelayMaxAttempts) })
+
+	auth, err := NewAuthenticator(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if auth == nil && !config.RequireCredentials {
+		slog.Warn("Authentication disabled: set JWT_HS256_SECRET, JWT_JWKS_FILE, JWT_JWKS_URL or API_KEYS_REQUIRED to enable it")
+	}
+
+	apiKeys := NewAPIKeyManager(store, config.BootstrapAPIKey, config.APIKeyGrace, config.APIKeyCacheTTL)
+	runBackground(func() { RunAPIKeyUsage(ctx, apiKeys, config.APIKeyUsageFlush) })
+
+	limits := NewMemoryLimitBackend()
+	runBackground(func() { RunLimitSweep(ctx, limits, time.Minute, config.ReadLimit, config.WriteLimit) })
+
+	idempotency, err := NewIdempotencyBackend(config, store)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if memory, ok := idempotency.(*MemoryIdempotencyBackend); ok {
+		runBackground(func() { RunIdempotencySweep(ctx, memory, time.Minute) })
+	}
+
+	server := NewAPIServer(":3000", store, config, dispatcher, broker, auth, apiKeys, limits, idempotency)
+	if err := server.Run(ctx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("REST API server stopped", "error", err)
+	}
+
+	// In-flight requests are done, stop the background work before closing
+	// what it uses. Pending webhook deliveries may still write dead letters.
+	stop()
+	background.Wait()
+	apiKeys.Flush()
+
+	if err := publishers.Close(); err != nil {
+		slog.Error("Closing publishers failed", "error", err)
+	}
+
+	store.CloseSession()
+
+	if err := shutdownTracing(context.Background()); err != nil {
+		slog.Error("Flushing spans failed", "error", err)
+	}
 
-	fmt.Printf("%+v\n", store)
-	server := NewAPIServer(":3000", store)
-	server.Run()
+	slog.Info("Shutdown complete")
 }
@@ -1,5 +1,7 @@
 package main
 
 type GetMediaLikes struct {
-	Likes []LikeRelation `json:"likes"`
+	Likes     []LikeRelation `json:"likes"`
+	Reactions map[string]int `json:"reactions"` // Count of likes per reaction code
+	Score     float64        `json:"score"`     // Sum of the reaction weights
 }
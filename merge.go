@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	MergeNewestWins = "newest_wins"
+	MergeKeepTarget = "keep_target"
+	MergePreferLike = "prefer_like"
+)
+
+// mergePolicies return, for a relation type, the Cypher condition under which
+// the relation r of the merged node replaces the relation t the target
+// already has with the same node.
+var mergePolicies = map[string]func(rel string) string{
+	MergeNewestWins: func(rel string) string {
+		return "coalesce(r.updated_at, 0) > coalesce(t.updated_at, 0)"
+	},
+	MergeKeepTarget: func(rel string) string {
+		return "false"
+	},
+	// Ratings and wishlist entries have no like to prefer, the target keeps them
+	MergePreferLike: func(rel string) string {
+		if rel != "PREF" {
+			return "false"
+		}
+		return `r.type = "LK" AND coalesce(t.type, "") <> "LK"`
+	},
+}
+
+var (
+	errMergeNotFound      = errors.New("node to merge not found")
+	errMergeTargetDeleted = errors.New("merge target is deleted")
+)
+
+type MergeUsers struct {
+	From    int    `json:"from"`
+	To      int    `json:"to"`
+	Policy  string `json:"policy"`  // 'newest_wins' | 'keep_target' | 'prefer_like', defaults to MERGE_CONFLICT_POLICY
+	Batched bool   `json:"batched"` // Commit each batch on its own instead of a single transaction
+}
+
+type RekeyMedia struct {
+	MediaType string `json:"media_type"` // 'MOV' | 'BOO' | 'SON'
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Policy    string `json:"policy"`
+	Batched   bool   `json:"batched"`
+}
+
+// MergeStep is a statement moving at most $batch_size rows from $from to $to
+// and returning how many in its "changed" column. Steps are run until they
+// return 0, so they only match what is left to move and an interrupted merge
+// resumes when run again. Moves touch the nodes whose relations change.
+type MergeStep struct {
+	Name      string
+	Statement string
+}
+
+// NodeMerge moves every relation of a node to the node with the same label
+// and the To id, created when missing, then soft deletes it. The last step is
+// the soft delete, which commits with Event.
+type NodeMerge struct {
+	Label   string
+	Key     string
+	From    any
+	To      any
+	Params  map[string]any
+	Steps   []MergeStep
+	Batched bool
+	Event   *Event
+}
+
+type MergeReceipt struct {
+	Label    string           `json:"label"`
+	From     any              `json:"from"`
+	To       any              `json:"to"`
+	Policy   string           `json:"policy"`
+	Moved    map[string]int64 `json:"moved"` // Rows changed by each step
+	MergedAt time.Time        `json:"merged_at"`
+}
+
+// moveStep moves the relations of a type, resolving conflicts with the
+// policy and rewriting the denormalized id of the merged node.
+func moveStep(label string, key string, rel string, property string, outgoing bool, policy string) MergeStep {
+	from, to := fmt.Sprintf("-[r:%s]->(n)", rel), fmt.Sprintf("-[k:%s]->(n)", rel)
+	target := fmt.Sprintf("-[t:%s]->(n)", rel)
+	if !outgoing {
+		from, to = fmt.Sprintf("<-[r:%s]-(n)", rel), fmt.Sprintf("<-[k:%s]-(n)", rel)
+		target = fmt.Sprintf("<-[t:%s]-(n)", rel)
+	}
+
+	return MergeStep{
+		Name: rel,
+		Statement: fmt.Sprintf(`
+		MATCH (from:%s {%s: $from})%s
+		WITH r, n LIMIT $batch_size
+		MATCH (to:%s {%s: $to})
+		OPTIONAL MATCH (to)%s
+		FOREACH (_ IN CASE WHEN t IS NULL OR (%s) THEN [1] ELSE [] END |
+			MERGE (to)%s
+			SET k = properties(r), k.%s = $to
+		)
+		DELETE r
+		SET n.version = coalesce(n.version, 0) + 1, to.version = coalesce(to.version, 0) + 1
+		RETURN count(r) as changed
+		`, label, key, from, label, key, target, mergePolicies[policy](rel), to, property),
+	}
+}
+
+// softDeleteStep marks the merged node, which keeps its id from being reused
+// until it is purged.
+func softDeleteStep(label string, key string) MergeStep {
+	return MergeStep{
+		Name: "merged",
+		Statement: fmt.Sprintf(`
+		MATCH (from:%s {%s: $from})
+		WHERE from.deleted_at IS NULL
+		SET from.deleted_at = timestamp(), from.merged_into = $to, from.version = coalesce(from.version, 0) + 1
+		RETURN count(from) as changed
+		`, label, key),
+	}
+}
+
+// NewUserMerge moves the likes, ratings, wishlist, follows and history of a
+// user to another one. Follows of one by the other are dropped.
+func NewUserMerge(merge *MergeUsers, actor string) *NodeMerge {
+	event := NewEvent(EventUserMerged)
+	event.UserID = merge.To
+	event.OldValue = merge.From
+	event.NewValue = merge.To
+	event.Actor = actor
+
+	return &NodeMerge{
+		Label:  "User",
+		Key:    "id_user",
+		From:   merge.From,
+		To:     merge.To,
+		Params: map[string]any{"from": merge.From, "to": merge.To},
+		Steps: []MergeStep{
+			moveStep("User", "id_user", "PREF", "user_id", true, merge.Policy),
+			moveStep("User", "id_user", "RTE", "user_id", true, merge.Policy),
+			moveStep("User", "id_user", "WSH", "user_id", true, merge.Policy),
+			{
+				Name: "FOLLOWS",
+				Statement: `
+				MATCH (from:User {id_user: $from})-[r:FOLLOWS]->(n)
+				WITH r, n LIMIT $batch_size
+				MATCH (to:User {id_user: $to})
+				FOREACH (_ IN CASE WHEN n <> to THEN [1] ELSE [] END |
+					MERGE (to)-[k:FOLLOWS]->(n)
+					ON CREATE SET k = properties(r), k.user_id = $to
+				)
+				DELETE r
+				SET n.version = coalesce(n.version, 0) + 1, to.version = coalesce(to.version, 0) + 1
+				RETURN count(r) as changed
+				`,
+			},
+			{
+				Name: "FOLLOWERS",
+				Statement: `
+				MATCH (from:User {id_user: $from})<-[r:FOLLOWS]-(n)
+				WITH r, n LIMIT $batch_size
+				MATCH (to:User {id_user: $to})
+				FOREACH (_ IN CASE WHEN n <> to THEN [1] ELSE [] END |
+					MERGE (to)<-[k:FOLLOWS]-(n)
+					ON CREATE SET k = properties(r), k.followed_id = $to
+				)
+				DELETE r
+				SET n.version = coalesce(n.version, 0) + 1, to.version = coalesce(to.version, 0) + 1
+				RETURN count(r) as changed
+				`,
+			},
+			{
+				Name: "history",
+				Statement: `
+				MATCH (c:PreferenceChange)
+				WHERE c.user_id = $from
+				WITH c LIMIT $batch_size
+				SET c.user_id = $to
+				RETURN count(c) as changed
+				`,
+			},
+			softDeleteStep("User", "id_user"),
+		},
+		Batched: merge.Batched,
+		Event:   event,
+	}
+}
+
+// NewMediaRekey moves the likes, ratings, wishlist entries and history of a
+// media to another id of the same type.
+func NewMediaRekey(rekey *RekeyMedia, actor string) *NodeMerge {
+	label, key := mediaNode(rekey.MediaType)
+
+	event := NewEvent(EventMediaRekeyed)
+	event.MediaID = rekey.To
+	event.MediaType = rekey.MediaType
+	event.OldValue = rekey.From
+	event.NewValue = rekey.To
+	event.Actor = actor
+
+	return &NodeMerge{
+		Label:  label,
+		Key:    key,
+		From:   rekey.From,
+		To:     rekey.To,
+		Params: map[string]any{"from": rekey.From, "to": rekey.To, "media_type": rekey.MediaType},
+		Steps: []MergeStep{
+			moveStep(label, key, "PREF", "media_id", false, rekey.Policy),
+			moveStep(label, key, "RTE", "media_id", false, rekey.Policy),
+			moveStep(label, key, "WSH", "media_id", false, rekey.Policy),
+			{
+				Name: "history",
+				Statement: `
+				MATCH (c:PreferenceChange)
+				WHERE c.media_id = $from AND c.media_type = $media_type
+				WITH c LIMIT $batch_size
+				SET c.media_id = $to
+				RETURN count(c) as changed
+				`,
+			},
+			softDeleteStep(label, key),
+		},
+		Batched: rekey.Batched,
+		Event:   event,
+	}
+}
+
+// RunMerge runs a merge and logs what it moved.
+func RunMerge(ctx context.Context, store Storage, merge *NodeMerge, policy string, batchSize int64) (*MergeReceipt, error) {
+	moved, err := store.MergeNodes(ctx, merge, batchSize)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.InfoContext(ctx, "Nodes merged", "label", merge.Label, "from", merge.From, "to", merge.To, "policy", policy, "moved", moved)
+
+	return &MergeReceipt{
+		Label:    merge.Label,
+		From:     merge.From,
+		To:       merge.To,
+		Policy:   policy,
+		Moved:    moved,
+		MergedAt: time.Now().UTC(),
+	}, nil
+}
+
+// writeMergeError answers a failed merge.
+func writeMergeError(w http.ResponseWriter, err error) error {
+	if errors.Is(err, errMergeNotFound) {
+		return WriteJSON(w, http.StatusNotFound, err.Error()) // 404
+	}
+
+	if errors.Is(err, errMergeTargetDeleted) {
+		return WriteJSON(w, http.StatusConflict, err.Error()) // 409
+	}
+
+	return err
+}
+
+func (s *APIServer) handleMergeUsers(w http.ResponseWriter, r *http.Request) error {
+	if err := s.authorizeAdmin(r); err != nil {
+		return writeAuthError(w, err)
+	}
+
+	if r.Method != "POST" {
+		return fmt.Errorf("method not allowed %s", r.Method)
+	}
+
+	merge := new(MergeUsers)
+
+	if err := json.NewDecoder(r.Body).Decode(merge); err != nil {
+		return WriteJSON(w, http.StatusBadRequest, "Guard failed") // 400
+	}
+
+	if merge.From == 0 || merge.To == 0 || merge.From == merge.To {
+		return WriteJSON(w, http.StatusBadRequest, "Two different user ids are required") // 400
+	}
+
+	if merge.Policy == "" {
+		merge.Policy = s.config.MergePolicy
+	}
+
+	if _, ok := mergePolicies[merge.Policy]; !ok {
+		return WriteJSON(w, http.StatusBadRequest, "Invalid policy") // 400
+	}
+
+	receipt, err := RunMerge(r.Context(), s.storeFor(r), NewUserMerge(merge, actorID(r, merge.To)), merge.Policy, s.config.MigrationBatchSize)
+	if err != nil {
+		return writeMergeError(w, err)
+	}
+
+	return WriteJSON(w, http.StatusOK, receipt)
+}
+
+func (s *APIServer) handleRekeyMedia(w http.ResponseWriter, r *http.Request) error {
+	if err := s.authorizeAdmin(r); err != nil {
+		return writeAuthError(w, err)
+	}
+
+	if r.Method != "POST" {
+		return fmt.Errorf("method not allowed %s", r.Method)
+	}
+
+	rekey := new(RekeyMedia)
+
+	if err := json.NewDecoder(r.Body).Decode(rekey); err != nil {
+		return WriteJSON(w, http.StatusBadRequest, "Guard failed") // 400
+	}
+
+	if rekey.MediaType != "MOV" && rekey.MediaType != "SON" && rekey.MediaType != "BOO" {
+		return WriteJSON(w, http.StatusBadRequest, "Media type not allowed") // 400
+	}
+
+	if rekey.From == "" || rekey.To == "" || rekey.From == rekey.To {
+		return WriteJSON(w, http.StatusBadRequest, "Two different media ids are required") // 400
+	}
+
+	if rekey.Policy == "" {
+		rekey.Policy = s.config.MergePolicy
+	}
+
+	if _, ok := mergePolicies[rekey.Policy]; !ok {
+		return WriteJSON(w, http.StatusBadRequest, "Invalid policy") // 400
+	}
+
+	receipt, err := RunMerge(r.Context(), s.storeFor(r), NewMediaRekey(rekey, actorID(r, 0)), rekey.Policy, s.config.MigrationBatchSize)
+	if err != nil {
+		return writeMergeError(w, err)
+	}
+
+	return WriteJSON(w, http.StatusOK, receipt)
+}
@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func TestMergeEvents(t *testing.T) {
+	tests := []struct {
+		name  string
+		merge *NodeMerge
+		tp    string
+		want  Event
+	}{
+		{
+			"user merge",
+			NewUserMerge(&MergeUsers{From: 3, To: 7, Policy: MergeKeepTarget}, "admin"),
+			EventUserMerged,
+			Event{UserID: 7, OldValue: 3, NewValue: 7, Actor: "admin"},
+		},
+		{
+			"media rekey",
+			NewMediaRekey(&RekeyMedia{MediaType: "SON", From: "a", To: "b", Policy: MergeKeepTarget}, "admin"),
+			EventMediaRekeyed,
+			Event{MediaID: "b", MediaType: "SON", OldValue: "a", NewValue: "b", Actor: "admin"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := tt.merge.Event
+			if event == nil || event.Type != tt.tp || event.ID == "" {
+				t.Fatalf("event %+v, want a %s event", event, tt.tp)
+			}
+
+			if event.UserID != tt.want.UserID || event.MediaID != tt.want.MediaID || event.MediaType != tt.want.MediaType ||
+				event.OldValue != tt.want.OldValue || event.NewValue != tt.want.NewValue || event.Actor != tt.want.Actor {
+				t.Errorf("event %+v, want %+v", event, tt.want)
+			}
+
+			// The event is queued with the soft delete, which must come last
+			if last := tt.merge.Steps[len(tt.merge.Steps)-1]; last.Name != "merged" {
+				t.Errorf("last step %s, want merged", last.Name)
+			}
+		})
+	}
+}
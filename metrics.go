@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "likes_http_requests_total",
+		Help: "HTTP requests by route template, method and status code.",
+	}, []string{"route", "method", "status"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "likes_http_request_duration_seconds",
+		Help:    "HTTP request latency by route template and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	storageCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "likes_storage_calls_total",
+		Help: "Storage calls by method.",
+	}, []string{"method"})
+
+	storageErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "likes_storage_errors_total",
+		Help: "Storage calls which failed, by method.",
+	}, []string{"method"})
+
+	storageDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "likes_storage_duration_seconds",
+		Help:    "Storage call latency by method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method"})
+
+	// Acquisition failures are the one sign of an exhausted pool the driver
+	// gives, they are counted apart from the other errors.
+	neo4jAcquisitionErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "likes_neo4j_acquisition_errors_total",
+		Help: "Storage calls which failed to get a connection from the Neo4j pool, by method.",
+	}, []string{"method"})
+
+	// The driver does not expose its pool usage, the calls in flight are the
+	// closest measure of the connections in use.
+	storageInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "likes_storage_in_flight",
+		Help: "Storage calls in progress.",
+	})
+
+	neo4jPoolSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "likes_neo4j_pool_max_size",
+		Help: "Maximum size of the Neo4j connection pool.",
+	})
+
+	likesWritten = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "likes_likes_written_total",
+		Help: "Likes set, by reaction and media type.",
+	}, []string{"reaction", "media_type"})
+
+	ratingsWritten = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "likes_ratings_written_total",
+		Help: "Ratings set, by media type.",
+	}, []string{"media_type"})
+)
+
+var metricsRegistry = prometheus.NewRegistry()
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests, httpDuration,
+		storageCalls, storageErrors, storageDuration, storageInFlight, neo4jPoolSize, neo4jAcquisitionErrors,
+		likesWritten, ratingsWritten,
+	)
+}
+
+// acquisitionError reports whether a storage call failed because no pool
+// connection was free within the acquisition timeout. The pool errors of the
+// driver are internal types, wrapped in a ConnectivityError or in the
+// TransactionExecutionLimit of the retries, so only their messages are left.
+func acquisitionError(err error) bool {
+	message := err.Error()
+	return strings.Contains(message, "Timeout while waiting for connection") || strings.Contains(message, "No idle connections")
+}
+
+// statusRecorder keeps the status code of a response. It flushes and unwraps
+// to the wrapped writer so media streams keep working.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// routeTemplate returns the template of the matched route, so ids do not
+// multiply the series and span names.
+func routeTemplate(r *http.Request) string {
+	if current := mux.CurrentRoute(r); current != nil {
+		if template, err := current.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+
+	return "unknown"
+}
+
+// instrument counts and times the requests by route template.
+func (s *APIServer) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeTemplate(r)
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+
+		next.ServeHTTP(recorder, r)
+
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(recorder.status)).Inc()
+		httpDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// metricsFakeStore sets likes, or fails with its error. Other Storage methods
+// are not implemented.
+type metricsFakeStore struct {
+	Storage
+	err error
+}
+
+func (s *metricsFakeStore) SetLike(like *Like, actor string, ifMatch IfMatch) (int64, error) {
+	return 1, s.err
+}
+
+func TestInstrumentRouteTemplate(t *testing.T) {
+	s := &APIServer{}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/likes/user/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	router.Use(s.instrument)
+
+	before := testutil.ToFloat64(httpRequests.WithLabelValues("/likes/user/{id}", "GET", "418"))
+
+	for _, id := range []string{"1", "2", "3"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/likes/user/"+id, nil))
+	}
+
+	if got := testutil.ToFloat64(httpRequests.WithLabelValues("/likes/user/{id}", "GET", "418")) - before; got != 3 {
+		t.Errorf("counted %v requests on the route template, want 3", got)
+	}
+}
+
+func TestInstrumentedStoreMetrics(t *testing.T) {
+	acquisition := errors.New("ConnectivityError: Timeout while waiting for connection")
+
+	tests := []struct {
+		name        string
+		err         error
+		written     float64
+		errors      float64
+		acquisition float64
+	}{
+		{"written", nil, 1, 0, 0},
+		{"failed", errors.New("constraint violated"), 0, 1, 0},
+		{"pool exhausted", acquisition, 0, 1, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewInstrumentedStore(&metricsFakeStore{err: tt.err})
+
+			written := testutil.ToFloat64(likesWritten.WithLabelValues("LOV", "MOV"))
+			failed := testutil.ToFloat64(storageErrors.WithLabelValues("SetLike"))
+			exhausted := testutil.ToFloat64(neo4jAcquisitionErrors.WithLabelValues("SetLike"))
+			calls := testutil.ToFloat64(storageCalls.WithLabelValues("SetLike"))
+
+			if _, err := store.SetLike(&Like{Reaction: "LOV", MediaType: "MOV"}, "1", nil); !errors.Is(err, tt.err) {
+				t.Fatalf("SetLike = %v, want %v", err, tt.err)
+			}
+
+			if got := testutil.ToFloat64(storageCalls.WithLabelValues("SetLike")) - calls; got != 1 {
+				t.Errorf("calls %v, want 1", got)
+			}
+			if got := testutil.ToFloat64(likesWritten.WithLabelValues("LOV", "MOV")) - written; got != tt.written {
+				t.Errorf("likes written %v, want %v", got, tt.written)
+			}
+			if got := testutil.ToFloat64(storageErrors.WithLabelValues("SetLike")) - failed; got != tt.errors {
+				t.Errorf("errors %v, want %v", got, tt.errors)
+			}
+			if got := testutil.ToFloat64(neo4jAcquisitionErrors.WithLabelValues("SetLike")) - exhausted; got != tt.acquisition {
+				t.Errorf("acquisition errors %v, want %v", got, tt.acquisition)
+			}
+			if got := testutil.ToFloat64(storageInFlight); got != 0 {
+				t.Errorf("%v calls left in flight", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Migration changes the data of the graph. Batched statements run again and
+// again, each time in a transaction of their own, until they return 0 in
+// their "changed" column. They must change at most $batch_size rows at once.
+type Migration struct {
+	Version int64
+	Name    string
+	Up      []string
+	Down    []string // Empty when the migration can not be reverted
+	Batched bool
+}
+
+// Checksum identifies the content of a migration, so applied ones can not be
+// edited.
+func (m *Migration) Checksum() string {
+	sum := sha256.Sum256([]byte(m.Name + "\n" + strings.Join(m.Up, "\n") + "\n" + strings.Join(m.Down, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+type AppliedMigration struct {
+	Version    int64     `json:"version"`
+	Name       string    `json:"name"`
+	Checksum   string    `json:"checksum"`
+	AppliedAt  time.Time `json:"applied_at"`
+	DurationMs int64     `json:"duration_ms"`
+}
+
+func NewAppliedMigration(props map[string]any) *AppliedMigration {
+	appliedAt, _ := props["applied_at"].(int64)
+
+	migration := &AppliedMigration{AppliedAt: time.UnixMilli(appliedAt)}
+	migration.Version, _ = props["version"].(int64)
+	migration.Name, _ = props["name"].(string)
+	migration.Checksum, _ = props["checksum"].(string)
+	migration.DurationMs, _ = props["duration_ms"].(int64)
+
+	return migration
+}
+
+type MigrationStatus struct {
+	Version   int64      `json:"version"`
+	Name      string     `json:"name"`
+	State     string     `json:"state"` // 'applied' | 'pending' | 'modified' | 'unknown'
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+}
+
+// migrations must stay ordered by version. Never edit or remove one which may
+// have been applied, add a new one instead.
+var migrations = []Migration{
+	{
+		// Likes set before reactions only have a type
+		Version: 1,
+		Name:    "backfill_pref_reaction",
+		Up: []string{`
+		MATCH ()-[r:PREF]->()
+		WHERE r.reaction IS NULL AND r.type IS NOT NULL
+		WITH r LIMIT $batch_size
+		SET r.reaction = r.type
+		RETURN count(r) as changed
+		`},
+		// Reads fall back to the type, so the copies can go
+		Down: []string{`
+		MATCH ()-[r:PREF]->()
+		WHERE r.reaction IS NOT NULL AND r.reaction = r.type
+		WITH r LIMIT $batch_size
+		REMOVE r.reaction
+		RETURN count(r) as changed
+		`},
+		Batched: true,
+	},
+	{
+		// Reviews written before moderation have no status
+		Version: 2,
+		Name:    "backfill_rte_review_status",
+		Up: []string{`
+		MATCH ()-[r:RTE]->()
+		WHERE r.review IS NOT NULL AND r.review_status IS NULL
+		WITH r LIMIT $batch_size
+		SET r.review_status = "VIS"
+		RETURN count(r) as changed
+		`},
+		// Reads take a missing status as visible
+		Down: []string{`
+		MATCH ()-[r:RTE]->()
+		WHERE r.review_status = "VIS"
+		WITH r LIMIT $batch_size
+		REMOVE r.review_status
+		RETURN count(r) as changed
+		`},
+		Batched: true,
+	},
+	{
+		// Feed cursors break the ties between changes with their id
+		Version: 3,
+		Name:    "backfill_preference_change_id",
+		Up: []string{`
+		MATCH (c:PreferenceChange)
+		WHERE c.id IS NULL
+		WITH c LIMIT $batch_size
+		SET c.id = randomUUID()
+		RETURN count(c) as changed
+		`},
+		// Only the backfilled ids are UUIDs with dashes, newID has none
+		Down: []string{`
+		MATCH (c:PreferenceChange)
+		WHERE c.id CONTAINS "-"
+		WITH c LIMIT $batch_size
+		REMOVE c.id
+		RETURN count(c) as changed
+		`},
+		Batched: true,
+	},
+}
+
+// MigrationStatuses compares the migrations with the applied ones, in order.
+func MigrationStatuses(ctx context.Context, store Storage) ([]MigrationStatus, error) {
+	applied, err := store.GetAppliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	known := map[int64]*AppliedMigration{}
+	for i := range applied {
+		known[applied[i].Version] = &applied[i]
+	}
+
+	statuses := []MigrationStatus{}
+	for _, migration := range migrations {
+		status := MigrationStatus{Version: migration.Version, Name: migration.Name, State: "pending"}
+
+		if record, ok := known[migration.Version]; ok {
+			status.State = "applied"
+			if record.Checksum != migration.Checksum() {
+				status.State = "modified"
+			}
+			status.AppliedAt = &record.AppliedAt
+			delete(known, migration.Version)
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	// Applied by a newer version of the service
+	for _, record := range known {
+		statuses = append(statuses, MigrationStatus{
+			Version:   record.Version,
+			Name:      record.Name,
+			State:     "unknown",
+			AppliedAt: &record.AppliedAt,
+		})
+	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+
+	return statuses, nil
+}
+
+// checkMigrations refuses to migrate when applied migrations were edited.
+func checkMigrations(statuses []MigrationStatus) error {
+	for _, status := range statuses {
+		if status.State == "modified" {
+			return fmt.Errorf("migration %d %s was edited after being applied", status.Version, status.Name)
+		}
+	}
+
+	return nil
+}
+
+func findMigration(version int64) *Migration {
+	for i := range migrations {
+		if migrations[i].Version == version {
+			return &migrations[i]
+		}
+	}
+
+	return nil
+}
+
+// MigrateUp applies the pending migrations up to a version, or all of them
+// when target is 0.
+func MigrateUp(ctx context.Context, store Storage, target int64, batchSize int64) ([]MigrationStatus, error) {
+	statuses, err := MigrationStatuses(ctx, store)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkMigrations(statuses); err != nil {
+		return nil, err
+	}
+
+	for _, status := range statuses {
+		if status.State != "pending" || (target > 0 && status.Version > target) {
+			continue
+		}
+
+		migration := findMigration(status.Version)
+		slog.Info("Applying migration", "version", migration.Version, "name", migration.Name)
+
+		if err := store.ApplyMigration(ctx, migration, true, batchSize); err != nil {
+			return nil, fmt.Errorf("migration %d %s: %w", migration.Version, migration.Name, err)
+		}
+	}
+
+	return MigrationStatuses(ctx, store)
+}
+
+// MigrateDown reverts the applied migrations above a version, or the last one
+// when target is negative.
+func MigrateDown(ctx context.Context, store Storage, target int64, batchSize int64) ([]MigrationStatus, error) {
+	statuses, err := MigrationStatuses(ctx, store)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkMigrations(statuses); err != nil {
+		return nil, err
+	}
+
+	for i := len(statuses) - 1; i >= 0; i-- {
+		status := statuses[i]
+		if status.State == "pending" {
+			continue
+		}
+		if target >= 0 && status.Version <= target {
+			break
+		}
+
+		migration := findMigration(status.Version)
+		if migration == nil {
+			return nil, fmt.Errorf("migration %d %s is unknown to this version", status.Version, status.Name)
+		}
+		if len(migration.Down) == 0 {
+			return nil, fmt.Errorf("migration %d %s can not be reverted", migration.Version, migration.Name)
+		}
+
+		slog.Info("Reverting migration", "version", migration.Version, "name", migration.Name)
+
+		if err := store.ApplyMigration(ctx, migration, false, batchSize); err != nil {
+			return nil, fmt.Errorf("migration %d %s: %w", migration.Version, migration.Name, err)
+		}
+
+		if target < 0 {
+			break
+		}
+	}
+
+	return MigrationStatuses(ctx, store)
+}
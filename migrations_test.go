@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+// migrationStore returns the applied migrations it holds. Other Storage
+// methods are not implemented.
+type migrationStore struct {
+	Storage
+	applied []AppliedMigration
+}
+
+func (s *migrationStore) GetAppliedMigrations(ctx context.Context) ([]AppliedMigration, error) {
+	return s.applied, nil
+}
+
+func TestMigrationStatuses(t *testing.T) {
+	first := migrations[0]
+
+	tests := []struct {
+		name     string
+		checksum string
+		state    string
+	}{
+		{"current checksum", first.Checksum(), "applied"},
+		{"edited", "0000", "modified"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &migrationStore{applied: []AppliedMigration{{Version: first.Version, Name: first.Name, Checksum: tt.checksum}}}
+
+			statuses, err := MigrationStatuses(context.Background(), store)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if statuses[0].State != tt.state {
+				t.Errorf("state %s, want %s", statuses[0].State, tt.state)
+			}
+			for _, status := range statuses[1:] {
+				if status.State != "pending" {
+					t.Errorf("migration %d is %s, want pending", status.Version, status.State)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+)
+
+type OutboxEvent struct {
+	Event
+	Seq           int64
+	OrderingKey   string
+	Attempts      int64
+	NextAttemptAt time.Time
+}
+
+func NewOutboxEvent(props map[string]any) (*OutboxEvent, error) {
+	outbox := &OutboxEvent{}
+
+	payload, _ := props["payload"].(string)
+	if err := json.Unmarshal([]byte(payload), &outbox.Event); err != nil {
+		return nil, err
+	}
+
+	nextAttemptAt, _ := props["next_attempt_at"].(int64)
+
+	outbox.Seq, _ = props["seq"].(int64)
+	outbox.OrderingKey, _ = props["ordering_key"].(string)
+	outbox.Attempts, _ = props["attempts"].(int64)
+	outbox.NextAttemptAt = time.UnixMilli(nextAttemptAt)
+
+	return outbox, nil
+}
+
+// RunRelay delivers the pending outbox events to the publisher every interval.
+// Events sharing an ordering key (the same user, or the same media for media
+// events) are delivered in order: once one of them can not be delivered, the
+// following ones wait for it. An event failing maxAttempts times is marked
+// dead, so it holds its key back for a bounded time.
+func RunRelay(ctx context.Context, store Storage, publisher Publisher, interval time.Duration, maxAttempts int64) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := relayEvents(store, publisher, interval, maxAttempts); err != nil {
+			slog.Error("Relay of outbox events failed", "error", err)
+		}
+	}
+}
+
+func relayEvents(store Storage, publisher Publisher, interval time.Duration, maxAttempts int64) error {
+	events, err := store.GetPendingEvents(500)
+	if err != nil {
+		return err
+	}
+
+	blocked := map[string]bool{}
+	now := time.Now()
+
+	for r := 0; r < len(events); r++ {
+		e := events[r]
+
+		if blocked[e.OrderingKey] {
+			continue
+		}
+
+		if e.NextAttemptAt.After(now) {
+			blocked[e.OrderingKey] = true
+			continue
+		}
+
+		if err := publisher.Publish(&e.Event); err != nil {
+			if e.Attempts+1 >= maxAttempts {
+				slog.Error("Outbox event dead", "event_id", e.ID, "type", e.Type, "attempts", e.Attempts+1, "error", err)
+
+				if err := store.MarkEventDead(e.ID, err.Error()); err != nil {
+					return err
+				}
+				continue
+			}
+
+			blocked[e.OrderingKey] = true
+
+			if err := store.MarkEventFailed(e.ID, now.Add(relayBackoff(interval, e.Attempts)), err.Error()); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := store.MarkEventSent(e.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// relayBackoff doubles the wait after every failed attempt, up to an hour.
+func relayBackoff(interval time.Duration, attempts int64) time.Duration {
+	backoff := interval
+	for a := int64(0); a < attempts && backoff < time.Hour; a++ {
+		backoff = backoff * 2
+	}
+
+	if backoff > time.Hour {
+		return time.Hour
+	}
+
+	return backoff
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// outboxStore serves pending events and records what the relay did with them.
+// Other Storage methods are not implemented.
+type outboxStore struct {
+	Storage
+	events []OutboxEvent
+	marked []string // "<status> <event id>"
+}
+
+func (s *outboxStore) GetPendingEvents(limit int) ([]OutboxEvent, error) {
+	return s.events, nil
+}
+
+func (s *outboxStore) MarkEventSent(id string) error {
+	s.marked = append(s.marked, "SENT "+id)
+	return nil
+}
+
+func (s *outboxStore) MarkEventFailed(id string, retryAt time.Time, reason string) error {
+	s.marked = append(s.marked, "FAILED "+id)
+	return nil
+}
+
+func (s *outboxStore) MarkEventDead(id string, reason string) error {
+	s.marked = append(s.marked, "DEAD "+id)
+	return nil
+}
+
+// failingPublisher fails to publish the events in fail.
+type failingPublisher struct {
+	fail map[string]bool
+}
+
+func (p *failingPublisher) Publish(e *Event) error {
+	if p.fail[e.ID] {
+		return errors.New("unavailable")
+	}
+	return nil
+}
+
+func (p *failingPublisher) Close() error {
+	return nil
+}
+
+func TestRelayOrdering(t *testing.T) {
+	event := func(id string, key string, attempts int64, next time.Time) OutboxEvent {
+		return OutboxEvent{Event: Event{ID: id}, OrderingKey: key, Attempts: attempts, NextAttemptAt: next}
+	}
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Minute)
+
+	tests := []struct {
+		name   string
+		events []OutboxEvent
+		fail   []string
+		want   []string
+	}{
+		{
+			"all delivered",
+			[]OutboxEvent{event("1", "user:1", 0, past), event("2", "user:1", 0, past), event("3", "user:2", 0, past)},
+			nil,
+			[]string{"SENT 1", "SENT 2", "SENT 3"},
+		},
+		{
+			"failure holds back its key only",
+			[]OutboxEvent{event("1", "user:1", 0, past), event("2", "user:2", 0, past), event("3", "user:1", 0, past)},
+			[]string{"1"},
+			[]string{"FAILED 1", "SENT 2"},
+		},
+		{
+			"event waiting for its retry holds back its key",
+			[]OutboxEvent{event("1", "user:1", 1, future), event("2", "user:1", 0, past), event("3", "user:2", 0, past)},
+			nil,
+			[]string{"SENT 3"},
+		},
+		{
+			"dead event releases its key",
+			[]OutboxEvent{event("1", "user:1", 2, past), event("2", "user:1", 0, past)},
+			[]string{"1"},
+			[]string{"DEAD 1", "SENT 2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &outboxStore{events: tt.events}
+			publisher := &failingPublisher{fail: map[string]bool{}}
+			for _, id := range tt.fail {
+				publisher.fail[id] = true
+			}
+
+			if err := relayEvents(store, publisher, time.Second, 3); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(store.marked, tt.want) {
+				t.Errorf("marked %v, want %v", store.marked, tt.want)
+			}
+		})
+	}
+}
+
+func TestRelayBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int64
+		want     time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{3, 8 * time.Second},
+		{30, time.Hour},
+	}
+
+	for _, tt := range tests {
+		if got := relayBackoff(time.Second, tt.attempts); got != tt.want {
+			t.Errorf("relayBackoff(1s, %d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import "fmt"
+
+// Visibility levels of a user's likes and ratings
+const (
+	PrivacyPublic    = "PUB"
+	PrivacyFollowers = "FOL"
+	PrivacyPrivate   = "PRV"
+)
+
+type PrivacySettings struct {
+	Default   string            `json:"default"`   // 'PUB' | 'FOL' | 'PRV'
+	Overrides map[string]string `json:"overrides"` // Level per media type, overriding the default one
+}
+
+// Level returns the visibility level applying to a media type.
+func (p *PrivacySettings) Level(mediaType string) string {
+	if level, ok := p.Overrides[mediaType]; ok {
+		return level
+	}
+
+	if p.Default == "" {
+		return PrivacyPublic
+	}
+
+	return p.Default
+}
+
+func (p *PrivacySettings) Validate() error {
+	if !validPrivacyLevel(p.Default) {
+		return fmt.Errorf("privacy level %s not allowed", p.Default)
+	}
+
+	for mediaType, level := range p.Overrides {
+		if mediaType != "MOV" && mediaType != "SON" && mediaType != "BOO" {
+			return fmt.Errorf("media type %s not allowed", mediaType)
+		}
+
+		if !validPrivacyLevel(level) {
+			return fmt.Errorf("privacy level %s not allowed", level)
+		}
+	}
+
+	return nil
+}
+
+func validPrivacyLevel(level string) bool {
+	return level == PrivacyPublic || level == PrivacyFollowers || level == PrivacyPrivate
+}
+
+// visibleTo returns the Cypher condition under which the preferences of the
+// user bound to alias on mediaType are visible to the user $viewer. Settings
+// are stored on the User node as privacy and privacy_<media type>.
+func visibleTo(alias string, mediaType string) string {
+	level := fmt.Sprintf(`coalesce(%[1]s["privacy_" + %[2]s], %[1]s.privacy, "PUB")`, alias, mediaType)
+
+	return fmt.Sprintf(`(%[1]s.id_user = $viewer OR %[2]s = "PUB" OR (%[2]s = "FOL" AND EXISTS { MATCH (:User {id_user: $viewer})-[:FOLLOWS]->(%[1]s) }))`, alias, level)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// privacyStore holds the privacy settings of user 5 and the users following
+// it. Other Storage methods are not implemented.
+type privacyStore struct {
+	Storage
+	settings  *PrivacySettings
+	followers map[int]bool
+}
+
+func (s *privacyStore) GetPrivacy(i int) (*PrivacySettings, error) {
+	return s.settings, nil
+}
+
+func (s *privacyStore) GetUserVersion(i int) (int64, error) {
+	return 1, nil
+}
+
+func (s *privacyStore) IsFollowing(i int, target int) (bool, error) {
+	return s.followers[i], nil
+}
+
+func (s *privacyStore) GetUserLikes(i int, media string, tp string) (*GetUserLikes, error) {
+	like := func(media string) []LikeRelation {
+		return []LikeRelation{{UserID: i, MediaID: "7", MediaType: media, LikeType: "LK", Reaction: "LK", Weight: 1}}
+	}
+	return &GetUserLikes{UserID: i, Movies: like("MOV"), Songs: like("SON"), Books: like("BOO")}, nil
+}
+
+func TestVisibleMediaTypes(t *testing.T) {
+	mixed := &PrivacySettings{Default: PrivacyPrivate, Overrides: map[string]string{"MOV": PrivacyPublic, "SON": PrivacyFollowers}}
+
+	tests := []struct {
+		name     string
+		settings *PrivacySettings
+		caller   string // Subject of a verified token
+		want     map[string]bool
+	}{
+		{"public to anonymous", &PrivacySettings{Default: PrivacyPublic}, "", map[string]bool{"MOV": true, "SON": true, "BOO": true}},
+		{"private to anonymous", &PrivacySettings{Default: PrivacyPrivate}, "", map[string]bool{"MOV": false, "SON": false, "BOO": false}},
+		{"private to its owner", &PrivacySettings{Default: PrivacyPrivate}, "5", map[string]bool{"MOV": true, "SON": true, "BOO": true}},
+		{"followers to a follower", &PrivacySettings{Default: PrivacyFollowers}, "8", map[string]bool{"MOV": true, "SON": true, "BOO": true}},
+		{"followers to another user", &PrivacySettings{Default: PrivacyFollowers}, "9", map[string]bool{"MOV": false, "SON": false, "BOO": false}},
+		{"overrides to a follower", mixed, "8", map[string]bool{"MOV": true, "SON": true, "BOO": false}},
+		{"overrides to another user", mixed, "9", map[string]bool{"MOV": true, "SON": false, "BOO": false}},
+		{"no settings", &PrivacySettings{}, "", map[string]bool{"MOV": true, "SON": true, "BOO": true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &APIServer{store: &privacyStore{settings: tt.settings, followers: map[int]bool{8: true}}, config: &Config{}}
+
+			r := httptest.NewRequest("GET", "/likes/user/5", nil)
+			if tt.caller != "" {
+				r = r.WithContext(context.WithValue(r.Context(), claimsKey, &Claims{Subject: tt.caller, Verified: true}))
+			}
+
+			visible, err := s.visibleMediaTypes(r, 5)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(visible, tt.want) {
+				t.Errorf("visible %v, want %v", visible, tt.want)
+			}
+		})
+	}
+}
+
+func TestUserLikesPrivacy(t *testing.T) {
+	settings := &PrivacySettings{Default: PrivacyPublic, Overrides: map[string]string{"BOO": PrivacyPrivate}}
+	s := &APIServer{store: &privacyStore{settings: settings}, config: &Config{}}
+
+	r := httptest.NewRequest("GET", "/likes/user/5", nil)
+	r = mux.SetURLVars(r, map[string]string{"id": "5"})
+
+	w := httptest.NewRecorder()
+	if err := s.handleGetUserLikes(w, r); err != nil {
+		t.Fatal(err)
+	}
+
+	var likes GetUserLikes
+	if err := json.NewDecoder(w.Body).Decode(&likes); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(likes.Movies) != 1 || len(likes.Songs) != 1 || len(likes.Books) != 0 {
+		t.Errorf("got %d movies, %d songs and %d books, want the private books hidden", len(likes.Movies), len(likes.Songs), len(likes.Books))
+	}
+}
+
+func TestForgedActorID(t *testing.T) {
+	settings := &PrivacySettings{Default: PrivacyPrivate}
+
+	tests := []struct {
+		name   string
+		secret string // JWT_HS256_SECRET, authentication is disabled when empty
+	}{
+		{"auth disabled", ""},
+		{"auth enabled", testSecret},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &APIServer{store: &privacyStore{settings: settings}, config: &Config{AdminScope: "admin"}}
+			if tt.secret != "" {
+				auth, err := NewAuthenticator(&Config{JWTSecret: tt.secret})
+				if err != nil {
+					t.Fatal(err)
+				}
+				s.auth = auth
+			}
+
+			// The owner's id, claimed without any token
+			r := httptest.NewRequest("GET", "/likes/user/5", nil)
+			r = mux.SetURLVars(r, map[string]string{"id": "5"})
+			r.Header.Set("X-Actor-ID", "5")
+
+			w := httptest.NewRecorder()
+			s.authenticate(makeHTTPHandleFunc(s.handleGetUserLikes)).ServeHTTP(w, r)
+
+			var likes GetUserLikes
+			if err := json.NewDecoder(w.Body).Decode(&likes); err != nil {
+				t.Fatal(err)
+			}
+
+			if w.Code != http.StatusOK || len(likes.Movies)+len(likes.Songs)+len(likes.Books) != 0 {
+				t.Errorf("status %d with %d movies, %d songs and %d books, want %d with nothing", w.Code, len(likes.Movies), len(likes.Songs), len(likes.Books), http.StatusOK)
+			}
+		})
+	}
+}
+
+func TestPrivacySettingsValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings PrivacySettings
+		valid    bool
+	}{
+		{"default only", PrivacySettings{Default: PrivacyFollowers}, true},
+		{"with overrides", PrivacySettings{Default: PrivacyPublic, Overrides: map[string]string{"MOV": PrivacyPrivate}}, true},
+		{"unknown level", PrivacySettings{Default: "ALL"}, false},
+		{"missing default", PrivacySettings{}, false},
+		{"unknown media type", PrivacySettings{Default: PrivacyPublic, Overrides: map[string]string{"TV": PrivacyPrivate}}, false},
+		{"unknown override level", PrivacySettings{Default: PrivacyPublic, Overrides: map[string]string{"SON": "ALL"}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.settings.Validate(); (err == nil) != tt.valid {
+				t.Errorf("Validate() = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+func NewPublisher(config *Config) (Publisher, error) {
+	if config.Publisher == "file" {
+		return NewFilePublisher(config.EventsFile)
+	} else if config.Publisher == "nats" {
+		return NewNATSPublisher(config.NATSURL, config.EventsSubject)
+	} else if config.Publisher != "memory" {
+		return nil, fmt.Errorf("unknown events publisher %s", config.Publisher)
+	}
+
+	return NewMemoryPublisher(), nil
+}
+
+// MultiPublisher publishes every event to several publishers.
+type MultiPublisher []Publisher
+
+func (p MultiPublisher) Publish(e *Event) error {
+	var errs []error
+
+	for _, publisher := range p {
+		if err := publisher.Publish(e); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (p MultiPublisher) Close() error {
+	var errs []error
+
+	for _, publisher := range p {
+		if err := publisher.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// MemoryPublisher fans events out to in-process subscribers.
+type MemoryPublisher struct {
+	mu          sync.RWMutex
+	subscribers map[int]func(*Event)
+	next        int
+}
+
+func NewMemoryPublisher() *MemoryPublisher {
+	return &MemoryPublisher{
+		subscribers: map[int]func(*Event){},
+	}
+}
+
+// Subscribe registers a handler called for every published event and returns
+// a function removing it. Handlers must not block.
+func (p *MemoryPublisher) Subscribe(handler func(*Event)) func() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	id := p.next
+	p.next++
+	p.subscribers[id] = handler
+
+	return func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		delete(p.subscribers, id)
+	}
+}
+
+func (p *MemoryPublisher) Publish(e *Event) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, handler := range p.subscribers {
+		handler(e)
+	}
+
+	return nil
+}
+
+func (p *MemoryPublisher) Close() error {
+	return nil
+}
+
+// FilePublisher appends events to a JSON Lines file.
+type FilePublisher struct {
+	mu      sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+func NewFilePublisher(path string) (*FilePublisher, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FilePublisher{
+		file:    file,
+		encoder: json.NewEncoder(file),
+	}, nil
+}
+
+func (p *FilePublisher) Publish(e *Event) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.encoder.Encode(e)
+}
+
+func (p *FilePublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.file.Close()
+}
+
+// NATSPublisher publishes events on "<subject>.<event type>" using the NATS
+// client protocol, so it works against any NATS server or NATS compatible
+// bridge (such as a Kafka connector).
+type NATSPublisher struct {
+	mu      sync.Mutex
+	address string
+	subject string
+	conn    net.Conn
+}
+
+func NewNATSPublisher(natsURL string, subject string) (*NATSPublisher, error) {
+	parsed, err := url.Parse(natsURL)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &NATSPublisher{
+		address: parsed.Host,
+		subject: subject,
+	}
+
+	if err := p.connect(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// connect opens the connection and waits for the server to acknowledge it.
+// It must be called with the lock held.
+func (p *NATSPublisher) connect() error {
+	conn, err := net.DialTimeout("tcp", p.address, 5*time.Second)
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(conn)
+
+	// The server greets with INFO before accepting CONNECT
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if line, err := reader.ReadString('\n'); err != nil || !strings.HasPrefix(line, "INFO") {
+		conn.Close()
+		return fmt.Errorf("unexpected NATS greeting %q: %v", line, err)
+	}
+
+	if _, err := conn.Write([]byte("CONNECT {\"verbose\":false,\"pedantic\":false,\"name\":\"PerfectPick_Likes_ms\"}\r\nPING\r\n")); err != nil {
+		conn.Close()
+		return err
+	}
+
+	if line, err := reader.ReadString('\n'); err != nil || !strings.HasPrefix(line, "PONG") {
+		conn.Close()
+		return fmt.Errorf("NATS connection refused %q: %v", line, err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	p.conn = conn
+	go p.readLoop(conn, reader)
+
+	return nil
+}
+
+// readLoop answers the server keep alive pings until the connection drops.
+func (p *NATSPublisher) readLoop(conn net.Conn, reader *bufio.Reader) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			p.mu.Lock()
+			if p.conn == conn {
+				p.conn = nil
+			}
+			p.mu.Unlock()
+			conn.Close()
+			return
+		}
+
+		if strings.HasPrefix(line, "PING") {
+			p.mu.Lock()
+			conn.Write([]byte("PONG\r\n"))
+			p.mu.Unlock()
+		} else if strings.HasPrefix(line, "-ERR") {
+			slog.Error("NATS error", "error", strings.TrimSpace(line))
+		}
+	}
+}
+
+func (p *NATSPublisher) Publish(e *Event) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn == nil {
+		if err := p.connect(); err != nil {
+			return err
+		}
+	}
+
+	message := fmt.Sprintf("PUB %s.%s %d\r\n%s\r\n", p.subject, e.Type, len(payload), payload)
+	if _, err := p.conn.Write([]byte(message)); err != nil {
+		p.conn.Close()
+		p.conn = nil
+		return err
+	}
+
+	return nil
+}
+
+func (p *NATSPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn == nil {
+		return nil
+	}
+
+	err := p.conn.Close()
+	p.conn = nil
+
+	return err
+}
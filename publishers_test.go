@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// natsStandIn accepts a single NATS client and sends every message it
+// publishes to messages, as "<subject> <payload>".
+func natsStandIn(t *testing.T) (string, chan string) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	messages := make(chan string, 16)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		fmt.Fprint(conn, "INFO {\"server_id\":\"stand-in\"}\r\n")
+
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			switch {
+			case strings.HasPrefix(line, "PING"):
+				fmt.Fprint(conn, "PONG\r\n")
+			case strings.HasPrefix(line, "PUB "):
+				var subject string
+				var size int
+				fmt.Sscanf(line, "PUB %s %d", &subject, &size)
+
+				payload := make([]byte, size+2)
+				if _, err := io.ReadFull(reader, payload); err != nil {
+					return
+				}
+				messages <- subject + " " + strings.TrimSpace(string(payload))
+			}
+		}
+	}()
+
+	return "nats://" + listener.Addr().String(), messages
+}
+
+func TestNATSPublisher(t *testing.T) {
+	url, messages := natsStandIn(t)
+
+	publisher, err := NewNATSPublisher(url, "likes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+
+	event := NewEvent(EventLikeCreated)
+	event.UserID = 7
+	event.MediaID = "42"
+	event.MediaType = "MOV"
+
+	if err := publisher.Publish(event); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case message := <-messages:
+		subject, payload, _ := strings.Cut(message, " ")
+		if subject != "likes.like.created" {
+			t.Errorf("subject = %s, want likes.like.created", subject)
+		}
+
+		var published Event
+		if err := json.Unmarshal([]byte(payload), &published); err != nil {
+			t.Fatal(err)
+		}
+		if published.ID != event.ID || published.MediaID != "42" {
+			t.Errorf("published %+v, want %+v", published, event)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message published")
+	}
+}
+
+func TestNATSPublisherRefused(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	if _, err := NewNATSPublisher("nats://"+address, "likes"); err == nil {
+		t.Fatal("connected to a closed port")
+	}
+}
+
+func TestFilePublisher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+
+	publisher, err := NewFilePublisher(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	types := []string{EventLikeCreated, EventRatingUpdated, EventWishlistAdded}
+	for _, tp := range types {
+		if err := publisher.Publish(NewEvent(tp)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := publisher.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(file)), "\n")
+	if len(lines) != len(types) {
+		t.Fatalf("%d lines written, want %d", len(lines), len(types))
+	}
+
+	for l, line := range lines {
+		var event Event
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Type != types[l] {
+			t.Errorf("line %d has type %s, want %s", l, event.Type, types[l])
+		}
+	}
+}
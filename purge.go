@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// RunPurge hard deletes the soft deleted users and media past their retention
+// period every interval.
+func RunPurge(ctx context.Context, store Storage, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		purged, err := store.PurgeDeleted()
+		if err != nil {
+			slog.Error("Purge of deleted nodes failed", "error", err)
+			continue
+		}
+
+		if purged > 0 {
+			slog.Info("Purged deleted nodes", "count", purged)
+		}
+	}
+}
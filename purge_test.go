@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// deletionStore keeps which users exist and which of them are soft deleted.
+// Other Storage methods are not implemented.
+type deletionStore struct {
+	Storage
+	deleted map[int]bool
+}
+
+func (s *deletionStore) CreateUser(i int) error {
+	if s.deleted[i] {
+		return fmt.Errorf("user %v %w", i, errDeleted)
+	}
+	s.deleted[i] = false
+	return nil
+}
+
+func (s *deletionStore) DeleteUser(i int) error {
+	s.deleted[i] = true
+	return nil
+}
+
+func (s *deletionStore) RestoreUser(i int) error {
+	if !s.deleted[i] {
+		return fmt.Errorf("deleted user %v not found", i)
+	}
+	s.deleted[i] = false
+	return nil
+}
+
+func TestSoftDeleteAndRestore(t *testing.T) {
+	s := &APIServer{store: &deletionStore{deleted: map[int]bool{}}, config: &Config{}}
+	handlers := map[string]apiFunc{
+		"create":  s.handleCreateUser,
+		"delete":  s.handleDeleteUser,
+		"restore": s.handleRestoreUser,
+	}
+
+	steps := []struct {
+		action string
+		status int
+	}{
+		{"create", http.StatusCreated},
+		{"restore", http.StatusNotFound},
+		{"delete", http.StatusNoContent},
+		{"create", http.StatusConflict},
+		{"restore", http.StatusOK},
+		{"restore", http.StatusNotFound},
+		{"create", http.StatusCreated},
+	}
+
+	for i, step := range steps {
+		r := httptest.NewRequest("POST", "/likes/user/5", nil)
+		r = mux.SetURLVars(r, map[string]string{"id": "5"})
+
+		// The 204 of a deletion refuses the encoded body, only the status matters
+		w := httptest.NewRecorder()
+		handlers[step.action](w, r)
+
+		if w.Code != step.status {
+			t.Errorf("step %d %s: status %d, want %d", i, step.action, w.Code, step.status)
+		}
+	}
+}
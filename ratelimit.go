@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Limit is a token bucket refilled with PerMinute tokens a minute, holding up
+// to Burst tokens.
+type Limit struct {
+	PerMinute int64
+	Burst     int64
+}
+
+type Decision struct {
+	Allowed   bool
+	Limit     int64
+	Remaining int64
+	Reset     time.Duration // Until the bucket is full again
+	Retry     time.Duration // Until the next token when not allowed
+}
+
+// LimitBackend holds the buckets. The memory backend is enough for a single
+// instance, several instances need a shared one.
+type LimitBackend interface {
+	Take(key string, limit Limit) (*Decision, error)
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+type MemoryLimitBackend struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+func NewMemoryLimitBackend() *MemoryLimitBackend {
+	return &MemoryLimitBackend{buckets: map[string]*bucket{}}
+}
+
+func (b *MemoryLimitBackend) Take(key string, limit Limit) (*Decision, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	rate := float64(limit.PerMinute) / float64(time.Minute) // Tokens a nanosecond
+	burst := float64(limit.Burst)
+
+	bk, ok := b.buckets[key]
+	if !ok {
+		bk = &bucket{tokens: burst, updated: now}
+		b.buckets[key] = bk
+	}
+
+	bk.tokens = math.Min(burst, bk.tokens+rate*float64(now.Sub(bk.updated)))
+	bk.updated = now
+
+	decision := &Decision{Limit: limit.Burst}
+
+	if bk.tokens >= 1 {
+		bk.tokens--
+		decision.Allowed = true
+	} else {
+		decision.Retry = time.Duration((1 - bk.tokens) / rate)
+	}
+
+	decision.Remaining = int64(bk.tokens)
+	decision.Reset = time.Duration((burst - bk.tokens) / rate)
+
+	return decision, nil
+}
+
+// Sweep forgets the full buckets, which behave like missing ones.
+func (b *MemoryLimitBackend) Sweep(limits ...Limit) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	for key, bk := range b.buckets {
+		full := true
+		for _, limit := range limits {
+			rate := float64(limit.PerMinute) / float64(time.Minute)
+			if bk.tokens+rate*float64(now.Sub(bk.updated)) < float64(limit.Burst) {
+				full = false
+			}
+		}
+
+		if full {
+			delete(b.buckets, key)
+		}
+	}
+}
+
+// RunLimitSweep sweeps the memory buckets every interval.
+func RunLimitSweep(ctx context.Context, b *MemoryLimitBackend, interval time.Duration, limits ...Limit) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		b.Sweep(limits...)
+	}
+}
+
+// rateLimitKey identifies who is limited: the API key of a service, the
+// authenticated user, or else the client IP.
+func rateLimitKey(r *http.Request) string {
+	if claims, ok := ClaimsFromContext(r.Context()); ok && claims.Verified {
+		if claims.APIKey != "" {
+			return "key:" + claims.APIKey
+		}
+
+		return "user:" + claims.Subject
+	}
+
+	return clientIPKey(r)
+}
+
+func clientIPKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return "ip:" + host
+}
+
+// rateLimit takes a token from the read or the write budget of the caller and
+// answers 429 when there is none left. It must run after authenticate, which
+// charges the requests it rejects to the client IP itself.
+func (s *APIServer) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.takeToken(w, r, rateLimitKey(r)) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// takeToken takes a token from the budget of a key for the request method,
+// and answers 429 and returns false when there is none left.
+func (s *APIServer) takeToken(w http.ResponseWriter, r *http.Request, key string) bool {
+	budget, limit := "write", s.config.WriteLimit
+	if r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS" {
+		budget, limit = "read", s.config.ReadLimit
+	}
+
+	if limit.PerMinute <= 0 || s.limits == nil {
+		return true
+	}
+
+	decision, err := s.limits.Take(budget+":"+key, limit)
+	if err != nil {
+		// Failing open keeps the API up when a shared backend is down
+		slog.ErrorContext(r.Context(), "Rate limit backend failed", "error", err)
+		return true
+	}
+
+	w.Header().Set("RateLimit-Limit", strconv.FormatInt(decision.Limit, 10))
+	w.Header().Set("RateLimit-Remaining", strconv.FormatInt(decision.Remaining, 10))
+	w.Header().Set("RateLimit-Reset", strconv.FormatInt(int64(math.Ceil(decision.Reset.Seconds())), 10))
+
+	if !decision.Allowed {
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(decision.Retry.Seconds())), 10))
+		WriteJSON(w, http.StatusTooManyRequests, ApiError{Error: "rate limit exceeded"})
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// failingLimits is a shared backend which is down.
+type failingLimits struct{}
+
+func (failingLimits) Take(key string, limit Limit) (*Decision, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestMemoryLimitBackend(t *testing.T) {
+	b := NewMemoryLimitBackend()
+	limit := Limit{PerMinute: 60, Burst: 2}
+
+	for i, allowed := range []bool{true, true, false} {
+		decision, err := b.Take("a", limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decision.Allowed != allowed {
+			t.Errorf("take %d allowed %v, want %v", i, decision.Allowed, allowed)
+		}
+	}
+
+	decision, _ := b.Take("a", limit)
+	if decision.Remaining != 0 || decision.Retry <= 0 || decision.Retry > time.Second {
+		t.Errorf("empty bucket %+v, want a retry within a second", decision)
+	}
+
+	if decision, _ := b.Take("b", limit); !decision.Allowed || decision.Remaining != 1 {
+		t.Errorf("other key %+v, want its own full bucket", decision)
+	}
+
+	// One token a second refills the bucket of a
+	b.buckets["a"].updated = b.buckets["a"].updated.Add(-1500 * time.Millisecond)
+	if decision, _ := b.Take("a", limit); !decision.Allowed {
+		t.Errorf("refilled bucket %+v, want allowed", decision)
+	}
+
+	b.buckets["b"].updated = b.buckets["b"].updated.Add(-time.Minute)
+	b.Sweep(limit)
+	if _, ok := b.buckets["b"]; ok {
+		t.Error("full bucket not swept")
+	}
+	if _, ok := b.buckets["a"]; !ok {
+		t.Error("bucket in use swept")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	s := &APIServer{
+		config: &Config{ReadLimit: Limit{PerMinute: 1, Burst: 2}, WriteLimit: Limit{PerMinute: 1, Burst: 1}},
+		limits: NewMemoryLimitBackend(),
+	}
+	handler := s.rateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	user := &Claims{Subject: "1", Verified: true}
+	forged := &Claims{Subject: "1"}
+	service := &Claims{Subject: "1", APIKey: "k", Verified: true}
+
+	tests := []struct {
+		name   string
+		method string
+		remote string
+		claims *Claims
+		status int
+	}{
+		{"user read", "GET", "203.0.113.7:1", user, http.StatusOK},
+		{"user read", "GET", "203.0.113.8:1", user, http.StatusOK},
+		{"user reads spent from another IP", "GET", "203.0.113.9:1", user, http.StatusTooManyRequests},
+		{"user write has its own budget", "POST", "203.0.113.7:1", user, http.StatusOK},
+		{"user writes spent", "POST", "203.0.113.7:1", user, http.StatusTooManyRequests},
+		{"service key has its own budget", "POST", "203.0.113.7:1", service, http.StatusOK},
+		{"unverified caller limited by IP", "POST", "203.0.113.7:2", forged, http.StatusOK},
+		{"unverified caller limited by IP", "POST", "203.0.113.7:3", nil, http.StatusTooManyRequests},
+		{"other IP", "POST", "203.0.113.8:1", forged, http.StatusOK},
+	}
+
+	for i, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/likes/user/1", nil)
+		r.RemoteAddr = tt.remote
+		if tt.claims != nil {
+			r = r.WithContext(context.WithValue(r.Context(), claimsKey, tt.claims))
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != tt.status {
+			t.Errorf("%d %s: status %d, want %d", i, tt.name, w.Code, tt.status)
+		}
+		if w.Header().Get("RateLimit-Limit") == "" {
+			t.Errorf("%d %s: RateLimit headers missing", i, tt.name)
+		}
+		if got := w.Header().Get("Retry-After"); (got != "") != (tt.status == http.StatusTooManyRequests) {
+			t.Errorf("%d %s: Retry-After %q", i, tt.name, got)
+		}
+	}
+}
+
+func TestRateLimitFailOpen(t *testing.T) {
+	s := &APIServer{config: &Config{ReadLimit: Limit{PerMinute: 1, Burst: 1}}, limits: failingLimits{}}
+	handler := s.rateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/likes/user/1", nil))
+
+		if w.Code != http.StatusOK {
+			t.Errorf("request %d: status %d with the backend down, want %d", i, w.Code, http.StatusOK)
+		}
+	}
+}
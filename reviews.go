@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+var errReviewBanned = errors.New("banned from reviewing")
+
+type Review struct {
+	UserID    any `json:"user_id"`
+	MediaID   any `json:"media_id"`
+	MediaType any `json:"media_type"` // 'MOV' | 'BOO' | 'SON'
+	Rating    any `json:"rating"`
+	Review    any `json:"review"`
+	Status    any `json:"status"` // 'VIS' | 'FLG' | 'RMV'
+}
+
+type GetReviews struct {
+	Reviews []Review `json:"reviews"`
+}
+
+type ReportReview struct {
+	ReporterID int    `json:"reporter_id"`
+	Reason     string `json:"reason"`
+}
+
+type FlaggedReview struct {
+	Review
+	Reporters int   `json:"reporters"`
+	Reasons   []any `json:"reasons"`
+}
+
+type ModerateReview struct {
+	AdminID string `json:"-"`      // Verified caller, never read from the body
+	Action  string `json:"action"` // 'APR' | 'RMV' | 'BAN'
+	Note    string `json:"note"`
+}
+
+type ModerationAudit struct {
+	AdminID   any       `json:"admin_id"`
+	Action    any       `json:"action"` // 'APR' | 'RMV' | 'BAN'
+	UserID    any       `json:"user_id"`
+	MediaID   any       `json:"media_id"`
+	MediaType any       `json:"media_type"` // 'MOV' | 'BOO' | 'SON'
+	Review    any       `json:"review"`
+	Note      any       `json:"note"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func NewReview(props map[string]any) *Review {
+	return &Review{
+		UserID:    props["user_id"],
+		MediaID:   props["media_id"],
+		MediaType: props["media_type"],
+		Rating:    props["rating"],
+		Review:    props["review"],
+		Status:    props["review_status"],
+	}
+}
+
+func NewModerationAudit(props map[string]any) *ModerationAudit {
+	createdAt, _ := props["created_at"].(int64)
+
+	return &ModerationAudit{
+		AdminID:   props["admin_id"],
+		Action:    props["action"],
+		UserID:    props["user_id"],
+		MediaID:   props["media_id"],
+		MediaType: props["media_type"],
+		Review:    props["review"],
+		Note:      props["note"],
+		CreatedAt: time.UnixMilli(createdAt),
+	}
+}
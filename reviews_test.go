@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// ratingStore refuses the reviews of banned users, like Neo4jStore does.
+// Other Storage methods are not implemented.
+type ratingStore struct {
+	Storage
+	banned map[int]bool
+	rated  int
+}
+
+func (s *ratingStore) SetAverage(i int, md string, tp string, rate *Rate, actor string, ifMatch IfMatch) (int64, error) {
+	if rate.Review != "" && s.banned[i] {
+		return 0, fmt.Errorf("%w: user %d can not review media %s", errReviewBanned, i, md)
+	}
+
+	s.rated++
+	return 1, nil
+}
+
+func TestCreateRateBannedReviewer(t *testing.T) {
+	tests := []struct {
+		name   string
+		user   string
+		body   string
+		status int
+		rated  int
+	}{
+		{"rating", "1", `{"rating": 4}`, http.StatusCreated, 1},
+		{"rating with a review", "1", `{"rating": 4, "review": "Great"}`, http.StatusCreated, 1},
+		{"banned user rating", "2", `{"rating": 4}`, http.StatusCreated, 1},
+		{"banned user reviewing", "2", `{"rating": 4, "review": "Great"}`, http.StatusForbidden, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &ratingStore{banned: map[int]bool{2: true}}
+			s := &APIServer{store: store, config: &Config{}}
+
+			r := httptest.NewRequest("POST", "/likes/rate/7", strings.NewReader(tt.body))
+			r = mux.SetURLVars(r, map[string]string{"id": "7", "media_type": "MOV", "user_id": tt.user})
+
+			w := httptest.NewRecorder()
+			if err := s.handleCreateRate(w, r); err != nil {
+				t.Fatal(err)
+			}
+
+			if w.Code != tt.status || store.rated != tt.rated {
+				t.Errorf("status %d with %d ratings written, want %d with %d", w.Code, store.rated, tt.status, tt.rated)
+			}
+		})
+	}
+}
+
+// moderationStore keeps the last moderation. Other Storage methods are not
+// implemented.
+type moderationStore struct {
+	Storage
+	moderate *ModerateReview
+}
+
+func (s *moderationStore) ModerateReview(i int, md string, tp string, moderate *ModerateReview) error {
+	s.moderate = moderate
+	return nil
+}
+
+func TestModerateReviewAdmin(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims *Claims
+		status int
+		admin  string
+	}{
+		{"admin token", &Claims{Subject: "ops-1", Scope: "admin", Verified: true}, http.StatusOK, "ops-1"},
+		{"admin key acting for a user", &Claims{Subject: "ops-1", Scope: "admin", Verified: true, APIKey: "k1"}, http.StatusOK, "key:k1"},
+		{"X-Actor-ID only", &Claims{Subject: "ops-1", Scope: "admin"}, http.StatusUnauthorized, ""},
+		{"no credentials", nil, http.StatusUnauthorized, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &moderationStore{}
+			s := &APIServer{store: store, config: &Config{AdminScope: "admin"}}
+
+			// The admin claimed in the body is ignored
+			r := httptest.NewRequest("POST", "/likes/admin/reviews/7?media_type=MOV&user_id=1", strings.NewReader(`{"admin_id": 99, "action": "RMV"}`))
+			r = mux.SetURLVars(r, map[string]string{"id": "7", "media_type": "MOV", "user_id": "1"})
+			if tt.claims != nil {
+				r = r.WithContext(context.WithValue(r.Context(), claimsKey, tt.claims))
+			}
+
+			w := httptest.NewRecorder()
+			if err := s.handleModerateReview(w, r); err != nil {
+				t.Fatal(err)
+			}
+
+			admin := ""
+			if store.moderate != nil {
+				admin = store.moderate.AdminID
+			}
+
+			if w.Code != tt.status || admin != tt.admin {
+				t.Errorf("status %d recorded %q, want %d recording %q", w.Code, admin, tt.status, tt.admin)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+const (
+	SchemaUniqueness = "UNIQUENESS"
+	SchemaIndex      = "INDEX"
+)
+
+// SchemaItem is a uniqueness constraint or a single property index, on nodes
+// or relationships.
+type SchemaItem struct {
+	Name     string `json:"name"`
+	Kind     string `json:"kind"`   // 'UNIQUENESS' | 'INDEX'
+	Entity   string `json:"entity"` // 'NODE' | 'RELATIONSHIP'
+	Label    string `json:"label"`  // Label or relationship type
+	Property string `json:"property"`
+}
+
+// expectedSchema lists the constraints on the ids the queries merge on, and
+// the indexes on the properties they filter by.
+var expectedSchema = []SchemaItem{
+	{Name: "user_id_unique", Kind: SchemaUniqueness, Entity: "NODE", Label: "User", Property: "id_user"},
+	{Name: "movie_id_unique", Kind: SchemaUniqueness, Entity: "NODE", Label: "Movie", Property: "id_movie"},
+	{Name: "song_id_unique", Kind: SchemaUniqueness, Entity: "NODE", Label: "Song", Property: "id_song"},
+	{Name: "book_id_unique", Kind: SchemaUniqueness, Entity: "NODE", Label: "Book", Property: "id_book"},
+	{Name: "webhook_id_unique", Kind: SchemaUniqueness, Entity: "NODE", Label: "Webhook", Property: "id"},
+	{Name: "webhook_delivery_id_unique", Kind: SchemaUniqueness, Entity: "NODE", Label: "WebhookDelivery", Property: "id"},
+	{Name: "api_key_id_unique", Kind: SchemaUniqueness, Entity: "NODE", Label: "APIKey", Property: "id"},
+	{Name: "outbox_event_id_unique", Kind: SchemaUniqueness, Entity: "NODE", Label: "OutboxEvent", Property: "id"},
+	{Name: "outbox_sequence_key_unique", Kind: SchemaUniqueness, Entity: "NODE", Label: "OutboxSequence", Property: "key"},
+	{Name: "idempotency_key_unique", Kind: SchemaUniqueness, Entity: "NODE", Label: "IdempotencyKey", Property: "key"},
+	{Name: "schema_migration_version_unique", Kind: SchemaUniqueness, Entity: "NODE", Label: "SchemaMigration", Property: "version"},
+	{Name: "outbox_event_status", Kind: SchemaIndex, Entity: "NODE", Label: "OutboxEvent", Property: "status"},
+	{Name: "preference_change_user", Kind: SchemaIndex, Entity: "NODE", Label: "PreferenceChange", Property: "user_id"},
+	{Name: "pref_type", Kind: SchemaIndex, Entity: "RELATIONSHIP", Label: "PREF", Property: "type"},
+	{Name: "rte_review_status", Kind: SchemaIndex, Entity: "RELATIONSHIP", Label: "RTE", Property: "review_status"},
+	{Name: "follows_created_at", Kind: SchemaIndex, Entity: "RELATIONSHIP", Label: "FOLLOWS", Property: "created_at"},
+}
+
+// Statement returns the Cypher creating the item, a no-op when it exists.
+func (i SchemaItem) Statement() string {
+	pattern := fmt.Sprintf("(e:%s)", i.Label)
+	if i.Entity == "RELATIONSHIP" {
+		pattern = fmt.Sprintf("()-[e:%s]-()", i.Label)
+	}
+
+	if i.Kind == SchemaUniqueness {
+		return fmt.Sprintf("CREATE CONSTRAINT %s IF NOT EXISTS FOR %s REQUIRE e.%s IS UNIQUE", i.Name, pattern, i.Property)
+	}
+
+	return fmt.Sprintf("CREATE INDEX %s IF NOT EXISTS FOR %s ON (e.%s)", i.Name, pattern, i.Property)
+}
+
+// String returns the item as "Label.property".
+func (i SchemaItem) String() string {
+	return i.Label + "." + i.Property
+}
+
+// sameDefinition compares items regardless of their name.
+func (i SchemaItem) sameDefinition(other SchemaItem) bool {
+	return i.Kind == other.Kind && i.Entity == other.Entity && i.Label == other.Label && i.Property == other.Property
+}
+
+type SchemaReport struct {
+	InSync     bool         `json:"in_sync"`
+	Created    []string     `json:"created,omitempty"` // Names of the items created by an apply
+	Missing    []SchemaItem `json:"missing"`           // Expected items not in the database
+	Unexpected []SchemaItem `json:"unexpected"`        // Items of the database which are not expected
+	Errors     []string     `json:"errors,omitempty"`  // Items an apply failed to create
+	CheckedAt  time.Time    `json:"checked_at"`
+}
+
+// CheckSchema reports the drift between the expected schema and the database.
+func CheckSchema(ctx context.Context, store Storage) (*SchemaReport, error) {
+	existing, err := store.GetSchema(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &SchemaReport{
+		Missing:    []SchemaItem{},
+		Unexpected: []SchemaItem{},
+		CheckedAt:  time.Now().UTC(),
+	}
+
+	for _, expected := range expectedSchema {
+		found := false
+		for _, item := range existing {
+			found = found || expected.sameDefinition(item)
+		}
+
+		if !found {
+			report.Missing = append(report.Missing, expected)
+		}
+	}
+
+	for _, item := range existing {
+		found := false
+		for _, expected := range expectedSchema {
+			found = found || expected.sameDefinition(item)
+		}
+
+		if !found {
+			report.Unexpected = append(report.Unexpected, item)
+		}
+	}
+
+	report.InSync = len(report.Missing) == 0 && len(report.Unexpected) == 0
+
+	return report, nil
+}
+
+// ApplySchema creates the missing items and reports the drift left. Unexpected
+// items are never dropped. A uniqueness constraint can not be created while
+// duplicates exist, which is reported as an error.
+func ApplySchema(ctx context.Context, store Storage) (*SchemaReport, error) {
+	before, err := CheckSchema(ctx, store)
+	if err != nil {
+		return nil, err
+	}
+
+	var created, errors []string
+	for _, item := range before.Missing {
+		if err := store.ApplySchema(ctx, item.Statement()); err != nil {
+			errors = append(errors, fmt.Sprintf("%s: %s", item.Name, err))
+			continue
+		}
+		created = append(created, item.Name)
+	}
+
+	report, err := CheckSchema(ctx, store)
+	if err != nil {
+		return nil, err
+	}
+
+	report.Created = created
+	report.Errors = errors
+
+	return report, nil
+}
+
+// logSchemaReport writes the outcome of a check or an apply.
+func logSchemaReport(report *SchemaReport) {
+	level := slog.LevelInfo
+	if !report.InSync {
+		level = slog.LevelWarn
+	}
+
+	names := func(items []SchemaItem) []string {
+		list := []string{}
+		for _, item := range items {
+			list = append(list, item.Name)
+		}
+		return list
+	}
+
+	slog.Log(context.Background(), level, "Schema checked",
+		"in_sync", report.InSync,
+		"created", report.Created,
+		"missing", names(report.Missing),
+		"unexpected", names(report.Unexpected),
+		"errors", report.Errors,
+	)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// schemaStore holds the schema items of a database, failing to create the
+// constraints of the labels with duplicates. Other Storage methods are not
+// implemented.
+type schemaStore struct {
+	Storage
+	items      []SchemaItem
+	duplicates string
+	statements []string
+}
+
+func (s *schemaStore) GetSchema(ctx context.Context) ([]SchemaItem, error) {
+	return s.items, nil
+}
+
+func (s *schemaStore) ApplySchema(ctx context.Context, statement string) error {
+	s.statements = append(s.statements, statement)
+
+	for _, item := range expectedSchema {
+		if item.Statement() != statement {
+			continue
+		}
+
+		if item.Label == s.duplicates && item.Kind == SchemaUniqueness {
+			return errors.New("duplicate nodes")
+		}
+		s.items = append(s.items, item)
+	}
+
+	return nil
+}
+
+func TestCheckSchema(t *testing.T) {
+	// Every item but the first, one of them under another name
+	items := slices.Clone(expectedSchema[1:])
+	items[0].Name = "constraint_1a2b3c"
+	extra := SchemaItem{Name: "user_name", Kind: SchemaIndex, Entity: "NODE", Label: "User", Property: "name"}
+
+	report, err := CheckSchema(context.Background(), &schemaStore{items: append(items, extra)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.InSync {
+		t.Error("report in sync, want drift")
+	}
+	if len(report.Missing) != 1 || report.Missing[0].Name != expectedSchema[0].Name {
+		t.Errorf("missing %v, want %s", report.Missing, expectedSchema[0].Name)
+	}
+	if len(report.Unexpected) != 1 || report.Unexpected[0].Name != extra.Name {
+		t.Errorf("unexpected %v, want %s", report.Unexpected, extra.Name)
+	}
+
+	report, err = CheckSchema(context.Background(), &schemaStore{items: expectedSchema})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.InSync || len(report.Missing) != 0 || len(report.Unexpected) != 0 {
+		t.Errorf("report %+v, want in sync", report)
+	}
+}
+
+func TestApplySchema(t *testing.T) {
+	extra := SchemaItem{Name: "user_name", Kind: SchemaIndex, Entity: "NODE", Label: "User", Property: "name"}
+	store := &schemaStore{items: []SchemaItem{expectedSchema[0], extra}, duplicates: "Movie"}
+
+	report, err := ApplySchema(context.Background(), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(store.statements) != len(expectedSchema)-1 {
+		t.Errorf("%d statements, want one for each missing item", len(store.statements))
+	}
+	for _, statement := range store.statements {
+		if !strings.Contains(statement, "IF NOT EXISTS") {
+			t.Errorf("statement %q fails on existing items", statement)
+		}
+	}
+
+	if len(report.Created) != len(expectedSchema)-2 || slices.Contains(report.Created, "movie_id_unique") {
+		t.Errorf("created %v, want every missing item but movie_id_unique", report.Created)
+	}
+	if len(report.Errors) != 1 || !strings.HasPrefix(report.Errors[0], "movie_id_unique") {
+		t.Errorf("errors %v, want the constraint on duplicates", report.Errors)
+	}
+	if len(report.Missing) != 1 || len(report.Unexpected) != 1 || report.InSync {
+		t.Errorf("report %+v, want the failed item missing and the extra index kept", report)
+	}
+}
+
+func TestSchemaItemStatement(t *testing.T) {
+	tests := []struct {
+		item SchemaItem
+		want string
+	}{
+		{
+			SchemaItem{Name: "user_id_unique", Kind: SchemaUniqueness, Entity: "NODE", Label: "User", Property: "id_user"},
+			"CREATE CONSTRAINT user_id_unique IF NOT EXISTS FOR (e:User) REQUIRE e.id_user IS UNIQUE",
+		},
+		{
+			SchemaItem{Name: "pref_type", Kind: SchemaIndex, Entity: "RELATIONSHIP", Label: "PREF", Property: "type"},
+			"CREATE INDEX pref_type IF NOT EXISTS FOR ()-[e:PREF]-() ON (e.type)",
+		},
+	}
+
+	for _, tt := range tests {
+		if got := tt.item.Statement(); got != tt.want {
+			t.Errorf("Statement() = %q, want %q", got, tt.want)
+		}
+	}
+}
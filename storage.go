@@ -2,6 +2,11 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
 )
@@ -10,563 +15,870 @@ type Storage interface {
 	// Create
 	CreateUser(int) error
 	CreateMedia(string, string) error
-	SetLike(*Like) error
-	AddToWishlist(int, string, string) error
-	SetAverage(int, string, string, float64) error
+	SetLike(*Like, string, IfMatch) (int64, error)
+	AddToWishlist(int, string, string, string, IfMatch) (int64, error)
+	SetAverage(int, string, string, *Rate, string, IfMatch) (int64, error)
 
 	// Get
 	GetUserLikes(int, string, string) (*GetUserLikes, error)
-	GetMediaLikes(string, string, string) (*GetMediaLikes, error)
+	GetMediaLikes(string, string, string, int) (*GetMediaLikes, error)
 	GetSpecificLike(int, string, string) (*LikeRelation, error)
 	GetAverage(string, string) (float64, error)
 	GetRating(string, string, int) (float64, error)
 	GetWishlist(int, string) (*GetWishlist, error)
+	GetMediaCounts(string, string) (*MediaCounts, error)
 
 	//Delete
 	DeleteUser(int) error
 	DeleteMedia(string, string) error
-	DeleteLike(int, string, string) error
-	RemoveFromWishlist(int, string, string) error
+	DeleteLike(int, string, string, string, IfMatch) (int64, error)
+	RestoreUser(int) error
+	RestoreMedia(string, string) error
+	PurgeDeleted() (int64, error)
+	RemoveFromWishlist(int, string, string, string, IfMatch) (int64, error)
+
+	// Reviews
+	GetReviews(string, string, int) (*GetReviews, error)
+	ReportReview(int, string, string, *ReportReview) error
+	GetFlaggedReviews() ([]FlaggedReview, error)
+	ModerateReview(int, string, string, *ModerateReview) error
+	GetModerationAudit() ([]ModerationAudit, error)
+
+	// History
+	GetHistory(int, *HistoryFilter) (*GetHistory, error)
+
+	// Follows
+	Follow(int, int) error
+	Unfollow(int, int) error
+	GetFollowers(int) (*GetFollows, error)
+	GetFollowing(int) (*GetFollows, error)
+	GetFeed(int, *FeedFilter) (*GetFeed, error)
+	IsFollowing(int, int) (bool, error)
+
+	// Versions
+	GetUserVersion(int) (int64, error)
+	GetMediaVersion(string, string) (int64, error)
+
+	// Privacy
+	GetPrivacy(int) (*PrivacySettings, error)
+	SetPrivacy(int, *PrivacySettings) error
+
+	// Outbox
+	GetPendingEvents(int) ([]OutboxEvent, error)
+	MarkEventSent(string) error
+	MarkEventFailed(string, time.Time, string) error
+	MarkEventDead(string, string) error
+
+	// Webhooks
+	CreateWebhook(*Webhook) error
+	GetWebhooks() ([]Webhook, error)
+	GetWebhook(string) (*Webhook, error)
+	UpdateWebhook(*Webhook) error
+	DeleteWebhook(string) error
+	AddDeadLetter(*DeadLetter) error
+	GetDeadLetters(string) ([]DeadLetter, error)
+	EnqueueDeliveries(*Event, []string) error
+	GetPendingDeliveries(int) ([]WebhookDelivery, error)
+	MarkDeliveryFailed(string, time.Time, string) error
+	DeleteDelivery(string) error
+
+	// API keys
+	CreateAPIKey(*APIKey) error
+	GetAPIKeys() ([]APIKey, error)
+	GetAPIKey(string) (*APIKey, error)
+	RotateAPIKey(string, string, time.Time) (*APIKey, error)
+	RevokeAPIKey(string) error
+	AddAPIKeyUsage(string, int64, time.Time) error
+
+	// Idempotency keys
+	ReserveIdempotencyKey(*IdempotentResponse) (*IdempotentResponse, error)
+	SaveIdempotentResponse(*IdempotentResponse) error
+	ReleaseIdempotencyKey(string, string) error
+
+	// GDPR
+	GetUserExport(int) (*GDPRExport, error)
+	EraseUser(int) (*ErasureReceipt, error)
+	VerifyErasure(int) (*ErasureReceipt, error)
+
+	// Health
+	VerifyConnectivity(context.Context) error
+
+	// Schema
+	GetSchema(context.Context) ([]SchemaItem, error)
+	ApplySchema(context.Context, string) error
+	GetAppliedMigrations(context.Context) ([]AppliedMigration, error)
+	ApplyMigration(context.Context, *Migration, bool, int64) error
+
+	// Integrity
+	FindIntegrityIssues(context.Context, *IntegrityCheck, int64) (*IntegrityResult, error)
+	RepairIntegrity(context.Context, *IntegrityCheck, int64) (int64, error)
+
+	// Merges
+	MergeNodes(context.Context, *NodeMerge, int64) (map[string]int64, error)
 
 	//Close Session
 	CloseSession()
 }
 
 type Neo4jStore struct {
-	session neo4j.SessionWithContext
-	ctx     context.Context
-	driver  neo4j.DriverWithContext
+	ctx    context.Context
+	driver neo4j.DriverWithContext
+	config *Config
 }
 
-func NewNeo4jStore() (*Neo4jStore, error) {
+func NewNeo4jStore(config *Config) (*Neo4jStore, error) {
 	ctx := context.Background()
 	dbUri := "neo4j://neo4j:7687" //"neo4j://localhost:7000" --> for local | "neo4j://neo4j:7687"  ---> for docker
 	dbUser := "neo4j"
 	dbPassword := "0900pass"
 	driver, _ := neo4j.NewDriverWithContext(
 		dbUri,
-		neo4j.BasicAuth(dbUser, dbPassword, ""))
+		neo4j.BasicAuth(dbUser, dbPassword, ""),
+		func(c *neo4j.Config) { c.MaxConnectionPoolSize = int(config.Neo4jPoolSize) })
+	neo4jPoolSize.Set(float64(config.Neo4jPoolSize))
 
 	err := driver.VerifyConnectivity(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	session := driver.NewSession(ctx, neo4j.SessionConfig{AccessMode: neo4j.AccessModeWrite})
-
 	return &Neo4jStore{
-		session: session,
-		ctx:     ctx,
-		driver:  driver,
+		ctx:    ctx,
+		driver: driver,
+		config: config,
 	}, nil
 }
 
-func (s *Neo4jStore) CloseSession() {
-	s.driver.Close(s.ctx)
-	s.session.Close(s.ctx)
+func (s *Neo4jStore) VerifyConnectivity(ctx context.Context) error {
+	return s.driver.VerifyConnectivity(ctx)
 }
 
-// Create Functions
-func (s *Neo4jStore) CreateUser(i int) error {
-
-	_, err := s.session.ExecuteWrite(s.ctx, func(transaction neo4j.ManagedTransaction) (any, error) {
-		result, err := transaction.Run(s.ctx, "CREATE (u:User {id_user: $id})", map[string]interface{}{"id": i})
-		if err != nil {
-			return nil, err
-		}
+// GetSchema returns the constraints and the indexes not backing a constraint.
+// Token lookup indexes are built in, so they are left out. It uses its own
+// session so health checks never wait behind other queries.
+func (s *Neo4jStore) GetSchema(ctx context.Context) ([]SchemaItem, error) {
+	queryConstraints := `
+	SHOW CONSTRAINTS YIELD name, type, entityType, labelsOrTypes, properties
+	RETURN name, type, entityType, labelsOrTypes[0] as label, properties
+	`
+	queryIndexes := `
+	SHOW INDEXES YIELD name, type, entityType, labelsOrTypes, properties
+	WHERE type <> 'LOOKUP'
+	RETURN name, type, entityType, labelsOrTypes[0] as label, properties
+	`
 
-		if result.Next(s.ctx) {
-			return result.Record().Values[0], nil
+	session := s.driver.NewSession(ctx, neo4j.SessionConfig{AccessMode: neo4j.AccessModeRead})
+	defer session.Close(ctx)
+
+	items, err := session.ExecuteRead(ctx, func(transaction neo4j.ManagedTransaction) (any, error) {
+		items := []SchemaItem{}
+		constraints := map[string]bool{}
+
+		for _, query := range []string{queryConstraints, queryIndexes} {
+			result, err := transaction.Run(ctx, query, nil)
+			if err != nil {
+				return nil, err
+			}
+
+			for result.Next(ctx) {
+				record := result.Record().AsMap()
+				name := record["name"].(string)
+
+				item := SchemaItem{
+					Name:   name,
+					Kind:   SchemaIndex,
+					Entity: record["entityType"].(string),
+				}
+				item.Label, _ = record["label"].(string)
+
+				// Composite items never match an expected one
+				properties := stringList(record["properties"])
+				for p, property := range properties {
+					if p > 0 {
+						item.Property += ","
+					}
+					item.Property += property
+				}
+
+				if query == queryConstraints {
+					constraints[name] = true
+					item.Kind = record["type"].(string)
+				} else if constraints[name] {
+					continue // Index backing a constraint, named after it
+				}
+
+				items = append(items, item)
+			}
+
+			if err := result.Err(); err != nil {
+				return nil, err
+			}
 		}
 
-		return nil, result.Err()
+		return items, nil
 	})
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return items.([]SchemaItem), nil
 }
 
-func (s *Neo4jStore) CreateMedia(i string, tp string) error {
+// ApplySchema runs a schema statement, in a transaction of its own as schema
+// and data changes can not be mixed.
+func (s *Neo4jStore) ApplySchema(ctx context.Context, statement string) error {
+	session := s.driver.NewSession(ctx, neo4j.SessionConfig{AccessMode: neo4j.AccessModeWrite})
+	defer session.Close(ctx)
 
-	query := "CREATE (m:Movie {id_movie: $id})"
+	_, err := session.ExecuteWrite(ctx, func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, err := transaction.Run(ctx, statement, nil)
+		if err != nil {
+			return nil, err
+		}
 
-	if tp == "SON" {
-		query = "CREATE (s:Song {id_song: $id})"
-	} else if tp == "BOO" {
-		query = "CREATE (b:Book {id_book: $id})"
-	}
+		_, err = result.Consume(ctx)
+		return nil, err
+	})
 
-	_, err := s.session.ExecuteWrite(s.ctx, func(transaction neo4j.ManagedTransaction) (any, error) {
-		result, err := transaction.Run(s.ctx, query, map[string]interface{}{"id": i})
+	return err
+}
+
+func (s *Neo4jStore) GetAppliedMigrations(ctx context.Context) ([]AppliedMigration, error) {
+	query := "MATCH (m:SchemaMigration) RETURN m as migration ORDER BY m.version"
+
+	session := s.driver.NewSession(ctx, neo4j.SessionConfig{AccessMode: neo4j.AccessModeRead})
+	defer session.Close(ctx)
+
+	migrations, err := session.ExecuteRead(ctx, func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, err := transaction.Run(ctx, query, nil)
 		if err != nil {
 			return nil, err
 		}
 
-		if result.Next(s.ctx) {
-			return result.Record().Values[0], nil
+		migrations := []AppliedMigration{}
+		for result.Next(ctx) {
+			migrations = append(migrations, *NewAppliedMigration(result.Record().AsMap()["migration"].(neo4j.Node).Props))
 		}
 
-		return nil, result.Err()
+		return migrations, result.Err()
 	})
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return migrations.([]AppliedMigration), nil
 }
 
-func (s *Neo4jStore) SetLike(l *Like) error {
+// ApplyMigration runs the up or down statements of a migration and records
+// it. Plain migrations run in the same transaction as the record, batched
+// ones commit each batch before it.
+func (s *Neo4jStore) ApplyMigration(ctx context.Context, m *Migration, up bool, batchSize int64) error {
+	statements := m.Up
+	if !up {
+		statements = m.Down
+	}
 
-	query := `
-	MERGE (n:User {id_user: $id_user})
-	MERGE (m:Movie {id_movie: $id_media})
-	MERGE (n)-[r:PREF]->(m)
-	ON CREATE
-		SET
-			r.type = $type,
-			r.media_id = $id_media,
-			r.media_type = "MOV",
-			r.user_id = $id_user
-	ON MATCH
-		SET
-			r.type = $type,
-			r.media_id = $id_media,
-			r.media_type = "MOV",
-			r.user_id = $id_user
+	queryRecord := `
+	MERGE (m:SchemaMigration {version: $version})
+	SET m.name = $name, m.checksum = $checksum, m.applied_at = timestamp(), m.duration_ms = $duration_ms
 	`
+	if !up {
+		queryRecord = "MATCH (m:SchemaMigration {version: $version}) DELETE m"
+	}
 
-	if l.MediaType == "SON" {
-		query = `
-		MERGE (n:User {id_user: $id_user})
-		MERGE (m:Song {id_song: $id_media})
-		MERGE (n)-[r:PREF]->(m)
-		ON CREATE
-			SET
-				r.type = $type,
-				r.media_id = $id_media,
-				r.media_type = "SON",
-				r.user_id = $id_user
-		ON MATCH
-			SET
-				r.type = $type,
-				r.media_id = $id_media,
-				r.media_type = "SON",
-				r.user_id = $id_user
-		`
-	} else if l.MediaType == "BOO" {
-		query = `
-		MERGE (n:User {id_user: $id_user})
-		MERGE (m:Book {id_book: $id_media})
-		MERGE (n)-[r:PREF]->(m)
-		ON CREATE
-			SET
-				r.type = $type,
-				r.media_id = $id_media,
-				r.media_type = "BOO",
-				r.user_id = $id_user
-		ON MATCH
-			SET
-				r.type = $type,
-				r.media_id = $id_media,
-				r.media_type = "BOO",
-				r.user_id = $id_user
-		`
+	session := s.driver.NewSession(ctx, neo4j.SessionConfig{AccessMode: neo4j.AccessModeWrite})
+	defer session.Close(ctx)
+
+	start := time.Now()
+
+	if m.Batched {
+		for _, statement := range statements {
+			if _, err := runBatched(ctx, session, statement, map[string]any{"batch_size": batchSize}); err != nil {
+				return err
+			}
+		}
 	}
 
-	_, err := s.session.ExecuteWrite(s.ctx, func(transaction neo4j.ManagedTransaction) (any, error) {
-		result, err := transaction.Run(s.ctx, query, map[string]interface{}{"id_media": l.MediaID, "id_user": l.UserID, "type": l.LikeType})
-		if err != nil {
-			return nil, err
+	_, err := session.ExecuteWrite(ctx, func(transaction neo4j.ManagedTransaction) (any, error) {
+		if !m.Batched {
+			for _, statement := range statements {
+				result, err := transaction.Run(ctx, statement, nil)
+				if err != nil {
+					return nil, err
+				}
+
+				if _, err := result.Consume(ctx); err != nil {
+					return nil, err
+				}
+			}
 		}
 
-		if result.Next(s.ctx) {
-			return result.Record().Values[0], nil
+		result, err := transaction.Run(ctx, queryRecord, map[string]interface{}{
+			"version":     m.Version,
+			"name":        m.Name,
+			"checksum":    m.Checksum(),
+			"duration_ms": time.Since(start).Milliseconds(),
+		})
+		if err != nil {
+			return nil, err
 		}
 
-		return nil, result.Err()
+		_, err = result.Consume(ctx)
+		return nil, err
 	})
 
+	return err
+}
+
+// runBatch runs a statement changing at most $batch_size rows once, and
+// returns its "changed" column.
+func runBatch(ctx context.Context, transaction neo4j.ManagedTransaction, statement string, params map[string]any) (int64, error) {
+	result, err := transaction.Run(ctx, statement, params)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	return nil
+	record, err := result.Single(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	changed, _ := record.AsMap()["changed"].(int64)
+	return changed, nil
 }
 
-// Delete Functions
-func (s *Neo4jStore) DeleteUser(i int) error {
-	_, err := s.session.ExecuteWrite(s.ctx, func(transaction neo4j.ManagedTransaction) (any, error) {
-		result, err := transaction.Run(s.ctx, "MATCH (u:User) WHERE u.id_user = $id DETACH DELETE u", map[string]interface{}{"id": i})
+// runBatched runs a statement changing at most $batch_size rows, each time in
+// a transaction of its own, until its "changed" column is 0. It returns the
+// total of rows changed.
+func runBatched(ctx context.Context, session neo4j.SessionWithContext, statement string, params map[string]any) (int64, error) {
+	var total int64
+
+	for {
+		changed, err := session.ExecuteWrite(ctx, func(transaction neo4j.ManagedTransaction) (any, error) {
+			return runBatch(ctx, transaction, statement, params)
+		})
+
 		if err != nil {
-			return nil, err
+			return total, err
 		}
 
-		if result.Next(s.ctx) {
-			return result.Record().Values[0], nil
+		if changed.(int64) == 0 {
+			return total, nil
 		}
 
-		return nil, result.Err()
-	})
-
-	if err != nil {
-		return err
+		total += changed.(int64)
 	}
-
-	return nil
 }
 
-func (s *Neo4jStore) DeleteMedia(i string, tp string) error {
-	query := "MATCH (m:Movie) WHERE m.id_movie = $id DETACH DELETE m"
+// FindIntegrityIssues counts the issues of a check and returns a sample.
+func (s *Neo4jStore) FindIntegrityIssues(ctx context.Context, check *IntegrityCheck, sampleSize int64) (*IntegrityResult, error) {
+	queryCount := fmt.Sprintf("CALL { %s } RETURN count(issue) as count", check.Find)
+	querySamples := fmt.Sprintf("CALL { %s } RETURN issue LIMIT $sample_size", check.Find)
 
-	if tp == "SON" {
-		query = "MATCH (s:Song) WHERE s.id_song = $id DETACH DELETE s"
-	} else if tp == "BOO" {
-		query = "MATCH (b:Book) WHERE b.id_book = $id DETACH DELETE b"
-	}
+	session := s.driver.NewSession(ctx, neo4j.SessionConfig{AccessMode: neo4j.AccessModeRead})
+	defer session.Close(ctx)
 
-	_, err := s.session.ExecuteWrite(s.ctx, func(transaction neo4j.ManagedTransaction) (any, error) {
-		result, err := transaction.Run(s.ctx, query, map[string]interface{}{"id": i})
+	result, err := session.ExecuteRead(ctx, func(transaction neo4j.ManagedTransaction) (any, error) {
+		integrity := &IntegrityResult{
+			Check:       check.Name,
+			Description: check.Description,
+			Samples:     []map[string]any{},
+			Repairable:  check.Repair != "",
+		}
+
+		result, err := transaction.Run(ctx, queryCount, nil)
 		if err != nil {
 			return nil, err
 		}
 
-		if result.Next(s.ctx) {
-			return result.Record().Values[0], nil
+		record, err := result.Single(ctx)
+		if err != nil {
+			return nil, err
 		}
+		integrity.Count, _ = record.AsMap()["count"].(int64)
 
-		return nil, result.Err()
-	})
-
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func (s *Neo4jStore) DeleteLike(user_id int, media_id string, tp string) error {
-	queryLK := "MATCH (:Movie {id_movie: $id_media})-[r:PREF]-(:User {id_user: $id_user}) DELETE r"
-
-	if tp == "SON" {
-		queryLK = "MATCH (:Song {id_song: $id_media})-[r:PREF]-(:User {id_user: $id_user}) DELETE r"
-	} else if tp == "BOO" {
-		queryLK = "MATCH (:Book {id_book: $id_media})-[r:PREF]-(:User {id_user: $id_user}) DELETE r"
-	}
+		if integrity.Count == 0 {
+			return integrity, nil
+		}
 
-	_, err := s.session.ExecuteWrite(s.ctx, func(transaction neo4j.ManagedTransaction) (any, error) {
-		result, err := transaction.Run(s.ctx, queryLK, map[string]interface{}{"id_media": media_id, "id_user": user_id})
+		result, err = transaction.Run(ctx, querySamples, map[string]interface{}{"sample_size": sampleSize})
 		if err != nil {
 			return nil, err
 		}
 
-		if result.Next(s.ctx) {
-			return result.Record().Values[0], nil
+		for result.Next(ctx) {
+			if issue, ok := result.Record().AsMap()["issue"].(map[string]any); ok {
+				integrity.Samples = append(integrity.Samples, issue)
+			}
 		}
 
-		return nil, result.Err()
+		return integrity, result.Err()
 	})
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return result.(*IntegrityResult), nil
 }
 
-// Get Functions
-func (s *Neo4jStore) GetUserLikes(i int, media string, tp string) (*GetUserLikes, error) {
-	queryLK := "MATCH (:User {id_user: $id_user})-[r:PREF]-(n) RETURN r as relation"
+// RepairIntegrity runs the repair of a check in batches and returns how many
+// rows it changed.
+func (s *Neo4jStore) RepairIntegrity(ctx context.Context, check *IntegrityCheck, batchSize int64) (int64, error) {
+	session := s.driver.NewSession(ctx, neo4j.SessionConfig{AccessMode: neo4j.AccessModeWrite})
+	defer session.Close(ctx)
 
-	if media == "SON" {
-		queryLK = "MATCH (:User {id_user: $id_user})-[r:PREF]-(:Song) RETURN r as relation"
-	} else if media == "BOO" {
-		queryLK = "MATCH (:User {id_user: $id_user})-[r:PREF]-(:Book) RETURN r as relation"
-	} else if media == "MOV" {
-		queryLK = "MATCH (:User {id_user: $id_user})-[r:PREF]-(:Movie) RETURN r as relation"
-	}
+	return runBatched(ctx, session, check.Repair, map[string]any{"batch_size": batchSize})
+}
 
-	if tp == "LK" {
-		queryLK = "MATCH (:User {id_user: $id_user})-[r:PREF {type: LK}]-(:Song) RETURN r as relation"
-	} else if tp == "DLK" {
-		queryLK = "MATCH (:User {id_user: $id_user})-[r:PREF {type: DLK}]-(:Book) RETURN r as relation"
+// MergeNodes runs the steps of a merge, in a single transaction or each
+// batch in its own, and returns the rows changed by each step. The target is
+// created first when missing. The event of the merge is queued in the
+// transaction soft deleting the merged node, so running a finished merge
+// again emits nothing.
+func (s *Neo4jStore) MergeNodes(ctx context.Context, merge *NodeMerge, batchSize int64) (map[string]int64, error) {
+	query := fmt.Sprintf(`
+	OPTIONAL MATCH (from:%s {%s: $from})
+	WITH count(from) as found
+	OPTIONAL MATCH (to:%s {%s: $to})
+	RETURN found, count(to.deleted_at) as deleted
+	`, merge.Label, merge.Key, merge.Label, merge.Key)
+	queryTarget := fmt.Sprintf("MERGE (to:%s {%s: $to})", merge.Label, merge.Key)
+
+	params := map[string]any{"batch_size": batchSize}
+	for key, value := range merge.Params {
+		params[key] = value
 	}
 
-	var results []neo4j.Relationship
-	var movies []LikeRelation
-	var songs []LikeRelation
-	var books []LikeRelation
+	// prepare checks both nodes and creates the target
+	prepare := func(transaction neo4j.ManagedTransaction) error {
+		result, err := transaction.Run(ctx, query, params)
+		if err != nil {
+			return err
+		}
 
-	_, errLK := s.session.ExecuteWrite(s.ctx, func(transaction neo4j.ManagedTransaction) (any, error) {
-		result, errLK := transaction.Run(s.ctx, queryLK, map[string]interface{}{"id_user": i})
-		if errLK != nil {
-			return nil, errLK
+		record, err := result.Single(ctx)
+		if err != nil {
+			return err
 		}
 
-		for result.Next(s.ctx) {
-			results = append(results, result.Record().AsMap()["relation"].(neo4j.Relationship))
+		if found, _ := record.AsMap()["found"].(int64); found == 0 {
+			return fmt.Errorf("%w: %s %v", errMergeNotFound, merge.Label, merge.From)
 		}
 
-		return nil, result.Err()
-	})
+		if deleted, _ := record.AsMap()["deleted"].(int64); deleted > 0 {
+			return fmt.Errorf("%w: %s %v", errMergeTargetDeleted, merge.Label, merge.To)
+		}
 
-	if errLK != nil {
-		return nil, errLK
+		result, err = transaction.Run(ctx, queryTarget, params)
+		if err != nil {
+			return err
+		}
+
+		_, err = result.Consume(ctx)
+		return err
 	}
 
-	for r := 0; r < len(results); r++ {
-		props := results[r].Props
-		mediaType := props["media_type"]
-		like := NewLikeRelation(i, props["media_id"], mediaType, props["type"])
+	session := s.driver.NewSession(ctx, neo4j.SessionConfig{AccessMode: neo4j.AccessModeWrite})
+	defer session.Close(ctx)
 
-		if mediaType == "MOV" {
-			movies = append(movies, *like)
-		} else if mediaType == "SON" {
-			songs = append(songs, *like)
-		} else {
-			books = append(books, *like)
+	moved := map[string]int64{}
+
+	if merge.Batched {
+		_, err := session.ExecuteWrite(ctx, func(transaction neo4j.ManagedTransaction) (any, error) {
+			return nil, prepare(transaction)
+		})
+		if err != nil {
+			return nil, err
 		}
-	}
 
-	return &GetUserLikes{
-		UserID: i,
-		Movies: movies,
-		Songs:  songs,
-		Books:  books,
-	}, nil
-}
+		last := merge.Steps[len(merge.Steps)-1]
+		for _, step := range merge.Steps[:len(merge.Steps)-1] {
+			changed, err := runBatched(ctx, session, step.Statement, params)
+			moved[step.Name] += changed
+			if err != nil {
+				return moved, err
+			}
+		}
 
-func (s *Neo4jStore) GetMediaLikes(i string, media string, tp string) (*GetMediaLikes, error) {
+		// The soft delete changes a single node, it fits in one batch
+		changed, err := session.ExecuteWrite(ctx, func(transaction neo4j.ManagedTransaction) (any, error) {
+			changed, err := runBatch(ctx, transaction, last.Statement, params)
+			if err != nil || changed == 0 {
+				return changed, err
+			}
 
-	queryLK := `MATCH (:Movie {id_movie: $id})-[r:PREF]-(n) RETURN r as relation`
+			return changed, s.enqueueEvent(transaction, merge.Event)
+		})
+		if err != nil {
+			return moved, err
+		}
+		moved[last.Name] += changed.(int64)
 
-	if tp == "LK" {
-		queryLK = `MATCH (:Movie {id_movie: $id})-[r:PREF {type: "LK"}]-(n) RETURN r as relation`
-	} else if tp == "DLK" {
-		queryLK = `MATCH (:Movie {id_movie: $id})-[r:PREF {type: "DLK"}]-(n) RETURN r as relation`
+		return moved, nil
 	}
 
-	if media == "SON" {
-		queryLK = `MATCH (:Song {id_song: $id})-[r:PREF]-(n) RETURN r as relation`
+	_, err := session.ExecuteWrite(ctx, func(transaction neo4j.ManagedTransaction) (any, error) {
+		// A retried transaction starts over
+		moved = map[string]int64{}
 
-		if tp == "LK" {
-			queryLK = `MATCH (:Song {id_song: $id})-[r:PREF {type: "LK"}]-(n) RETURN r as relation`
-		} else if tp == "DLK" {
-			queryLK = `MATCH (:Song {id_song: $id})-[r:PREF {type: "DLK"}]-(n) RETURN r as relation`
+		if err := prepare(transaction); err != nil {
+			return nil, err
 		}
-	} else if media == "BOO" {
-		queryLK = `MATCH (:Book {id_book: $id})-[r:PREF]-(n) RETURN r as relation`
 
-		if tp == "LK" {
-			queryLK = `MATCH (:Book {id_book: $id})-[r:PREF {type: "LK"}]-(n) RETURN r as relation`
-		} else if tp == "DLK" {
-			queryLK = `MATCH (:Book {id_book: $id})-[r:PREF {type: "DLK"}]-(n) RETURN r as relation`
-		}
-	}
+		for _, step := range merge.Steps {
+			for {
+				changed, err := runBatch(ctx, transaction, step.Statement, params)
+				if err != nil {
+					return nil, err
+				}
 
-	var results []neo4j.Relationship
-	var likes []LikeRelation
+				if changed == 0 {
+					break
+				}
 
-	_, errLK := s.session.ExecuteWrite(s.ctx, func(transaction neo4j.ManagedTransaction) (any, error) {
-		result, errLK := transaction.Run(s.ctx, queryLK, map[string]interface{}{"id": i})
-		if errLK != nil {
-			return nil, errLK
+				moved[step.Name] += changed
+			}
 		}
 
-		for result.Next(s.ctx) {
-			results = append(results, result.Record().AsMap()["relation"].(neo4j.Relationship))
+		if moved[merge.Steps[len(merge.Steps)-1].Name] == 0 {
+			return nil, nil
 		}
 
-		return nil, result.Err()
+		return nil, s.enqueueEvent(transaction, merge.Event)
 	})
 
-	if errLK != nil {
-		return nil, errLK
-	}
-
-	for r := 0; r < len(results); r++ {
-		props := results[r].Props
-		mediaType := props["media_type"]
-		like := NewLikeRelation(props["user_id"], i, mediaType, props["type"])
-		likes = append(likes, *like)
+	if err != nil {
+		return nil, err
 	}
 
-	return &GetMediaLikes{
-		Likes: likes,
-	}, nil
+	return moved, nil
 }
 
-func (s *Neo4jStore) GetSpecificLike(i int, media_id string, media string) (*LikeRelation, error) {
+func (s *Neo4jStore) CloseSession() {
+	s.driver.Close(s.ctx)
+}
 
-	queryLK := "MATCH (:Movie {id_movie: $id})-[r:PREF]-(:User {id_user: $user_id}) RETURN r as relation"
+// executeWrite runs a write transaction in a session of its own. Sessions can
+// not be shared by goroutines, and handlers and background jobs call the store
+// concurrently.
+func (s *Neo4jStore) executeWrite(work neo4j.ManagedTransactionWork) (any, error) {
+	session := s.driver.NewSession(s.ctx, neo4j.SessionConfig{AccessMode: neo4j.AccessModeWrite})
+	defer session.Close(s.ctx)
 
-	if media == "SON" {
-		queryLK = "MATCH (:Song {id_song: $id})-[r:PREF]-(:User {id_user: $user_id}) RETURN r as relation"
-	} else if media == "BOO" {
-		queryLK = "MATCH (:Book {id_book: $id})-[r:PREF]-(:User {id_user: $user_id}) RETURN r as relation"
-	}
+	return session.ExecuteWrite(s.ctx, work)
+}
 
-	var results []neo4j.Relationship
+// executeRead runs a read transaction in a session of its own.
+func (s *Neo4jStore) executeRead(work neo4j.ManagedTransactionWork) (any, error) {
+	session := s.driver.NewSession(s.ctx, neo4j.SessionConfig{AccessMode: neo4j.AccessModeRead})
+	defer session.Close(s.ctx)
 
-	_, errLK := s.session.ExecuteWrite(s.ctx, func(transaction neo4j.ManagedTransaction) (any, error) {
-		result, errLK := transaction.Run(s.ctx, queryLK, map[string]interface{}{"id": media_id, "user_id": i})
-		if errLK != nil {
-			return nil, errLK
-		}
+	return session.ExecuteRead(s.ctx, work)
+}
 
-		for result.Next(s.ctx) {
-			results = append(results, result.Record().AsMap()["relation"].(neo4j.Relationship))
-		}
+// mediaNode returns the node label and id property used for a media type.
+func mediaNode(tp string) (string, string) {
+	if tp == "SON" {
+		return "Song", "id_song"
+	} else if tp == "BOO" {
+		return "Book", "id_book"
+	}
 
-		return nil, result.Err()
-	})
+	return "Movie", "id_movie"
+}
 
-	if errLK != nil {
-		return nil, errLK
+// newLikeRelation builds a LikeRelation from the properties of a PREF edge.
+// Edges written before reactions existed only carry the like type.
+func (s *Neo4jStore) newLikeRelation(id any, media any, props map[string]any) *LikeRelation {
+	reaction := props["reaction"]
+	if reaction == nil {
+		reaction = props["type"]
 	}
 
-	props := results[0].Props
-	mediaType := props["media_type"]
-	like := NewLikeRelation(i, media_id, mediaType, props["type"])
-
-	return like, nil
+	return NewLikeRelation(id, media, props["media_type"], props["type"], reaction, s.config.Weight(reaction))
 }
 
-func (s *Neo4jStore) GetAverage(i string, tp string) (float64, error) {
-	queryLK := "MATCH (:Movie {id_movie: $id})-[r:RTE]-(n) RETURN r as relation"
+// relationValue returns the current value of the relation between a user and a
+// media inside a transaction, as stored in the preference history.
+func (s *Neo4jStore) relationValue(transaction neo4j.ManagedTransaction, rel string, user int, md string, tp string) (any, error) {
+	label, key := mediaNode(tp)
 
-	if tp == "SON" {
-		queryLK = "MATCH (:Song {id_song: $id})-[r:RTE]-(n) RETURN r as relation"
-	} else if tp == "BOO" {
-		queryLK = "MATCH (:Book {id_book: $id})-[r:RTE]-(n) RETURN r as relation"
+	value := "coalesce(r.reaction, r.type)"
+	if rel == "RTE" {
+		value = "r.rating"
+	} else if rel == "WSH" {
+		value = "true"
 	}
 
-	var results []neo4j.Relationship
-	var sumRating float64
+	query := fmt.Sprintf("MATCH (:User {id_user: $id_user})-[r:%s]-(:%s {%s: $id_media}) RETURN %s as value", rel, label, key, value)
 
-	_, errLK := s.session.ExecuteWrite(s.ctx, func(transaction neo4j.ManagedTransaction) (any, error) {
-		result, errLK := transaction.Run(s.ctx, queryLK, map[string]interface{}{"id": i})
-		if errLK != nil {
-			return nil, errLK
+	result, err := transaction.Run(s.ctx, query, map[string]interface{}{"id_media": md, "id_user": user})
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Next(s.ctx) {
+		return result.Record().AsMap()["value"], nil
+	}
+
+	if rel == "WSH" {
+		return false, result.Err()
+	}
+
+	return nil, result.Err()
+}
+
+// errDeleted is returned when creating a user or a media which is soft
+// deleted, as the node would stay hidden: it has to be restored instead.
+var errDeleted = errors.New("is deleted, restore it instead")
+
+// checkNotDeleted fails with errDeleted when a node is soft deleted.
+func (s *Neo4jStore) checkNotDeleted(transaction neo4j.ManagedTransaction, label string, key string, id any) error {
+	query := fmt.Sprintf("MATCH (n:%s {%s: $id}) WHERE n.deleted_at IS NOT NULL RETURN n.deleted_at", label, key)
+
+	result, err := transaction.Run(s.ctx, query, map[string]interface{}{"id": id})
+	if err != nil {
+		return err
+	}
+
+	if result.Next(s.ctx) {
+		return fmt.Errorf("%s %v %w", strings.ToLower(label), id, errDeleted)
+	}
+
+	return result.Err()
+}
+
+// checkActive fails when the user or the media of a mutation is soft deleted.
+func (s *Neo4jStore) checkActive(transaction neo4j.ManagedTransaction, user int, md string, tp string) error {
+	label, key := mediaNode(tp)
+
+	query := fmt.Sprintf(`
+	OPTIONAL MATCH (u:User {id_user: $id_user})
+	OPTIONAL MATCH (m:%s {%s: $id_media})
+	RETURN u.deleted_at IS NOT NULL as user_deleted, m.deleted_at IS NOT NULL as media_deleted
+	`, label, key)
+
+	result, err := transaction.Run(s.ctx, query, map[string]interface{}{"id_media": md, "id_user": user})
+	if err != nil {
+		return err
+	}
+
+	if result.Next(s.ctx) {
+		record := result.Record().AsMap()
+
+		if record["user_deleted"] == true {
+			return fmt.Errorf("user %d is deleted", user)
 		}
 
-		for result.Next(s.ctx) {
-			results = append(results, result.Record().AsMap()["relation"].(neo4j.Relationship))
+		if record["media_deleted"] == true {
+			return fmt.Errorf("media %s is deleted", md)
 		}
+	}
 
-		return nil, result.Err()
-	})
+	return result.Err()
+}
 
-	if errLK != nil {
-		return 0.0, errLK
+// touchUser increments the version of a user, which the ETags of its likes
+// and wishlist derive from. With related, the media it has relations with
+// are touched too, as their likes list the user.
+func (s *Neo4jStore) touchUser(transaction neo4j.ManagedTransaction, i any, related bool) error {
+	query := "MATCH (u:User {id_user: $id}) SET u.version = coalesce(u.version, 0) + 1"
+	if related {
+		query += " WITH u OPTIONAL MATCH (u)-[:PREF|RTE|WSH]->(m) SET m.version = coalesce(m.version, 0) + 1"
 	}
 
-	sumRating = 0.0
-	for r := 0; r < len(results); r++ {
-		props := results[r].Props
-		rating := props["rating"]
-		if rating != -1 {
-			sumRating = sumRating + rating.(float64)
-		}
+	result, err := transaction.Run(s.ctx, query, map[string]interface{}{"id": i})
+	if err != nil {
+		return err
 	}
 
-	return sumRating / float64(len(results)), nil
+	_, err = result.Consume(s.ctx)
+	return err
 }
 
-func (s *Neo4jStore) GetRating(i string, tp string, u int) (float64, error) {
-	queryLK := "MATCH (:Movie {id_movie: $id})-[r:RTE]-(:User {id_user:$user_id}) RETURN r as relation"
+// lockUser increments the version of a user, which holds its write lock
+// until the transaction ends, and returns the new version. A user that does
+// not exist is not created.
+func (s *Neo4jStore) lockUser(transaction neo4j.ManagedTransaction, i int) (int64, bool, error) {
+	query := "MATCH (u:User {id_user: $id}) SET u.version = coalesce(u.version, 0) + 1 RETURN u.version as version"
 
-	if tp == "SON" {
-		queryLK = "MATCH (:Song {id_song: $id})-[r:RTE]-(:User {id_user:$user_id}) RETURN r as relation"
-	} else if tp == "BOO" {
-		queryLK = "MATCH (:Book {id_book: $id})-[r:RTE]-(:User {id_user:$user_id}) RETURN r as relation"
+	result, err := transaction.Run(s.ctx, query, map[string]interface{}{"id": i})
+	if err != nil {
+		return 0, false, err
 	}
 
-	var results []neo4j.Relationship
+	if result.Next(s.ctx) {
+		return result.Record().AsMap()["version"].(int64), true, nil
+	}
 
-	_, errLK := s.session.ExecuteWrite(s.ctx, func(transaction neo4j.ManagedTransaction) (any, error) {
-		result, errLK := transaction.Run(s.ctx, queryLK, map[string]interface{}{"id": i, "user_id": u})
-		if errLK != nil {
-			return nil, errLK
+	return 0, false, result.Err()
+}
+
+// executeUserWrite runs a change to the relations of a user in a write
+// transaction that locks the user first, so the If-Match check holds until
+// the change is committed. It returns the version of the user after it.
+func (s *Neo4jStore) executeUserWrite(i int, ifMatch IfMatch, work func(neo4j.ManagedTransaction) error) (int64, error) {
+	version, err := s.executeWrite(func(transaction neo4j.ManagedTransaction) (any, error) {
+		version, found, err := s.lockUser(transaction, i)
+		if err != nil {
+			return nil, err
 		}
 
-		for result.Next(s.ctx) {
-			results = append(results, result.Record().AsMap()["relation"].(neo4j.Relationship))
+		current := int64(0)
+		if found {
+			current = version - 1
 		}
 
-		return nil, result.Err()
+		if !ifMatch.Accepts(current) {
+			return nil, errPreconditionFailed
+		}
+
+		if err := work(transaction); err != nil {
+			return nil, err
+		}
+
+		// The change may have created the user
+		if !found {
+			version, _, err = s.lockUser(transaction, i)
+		}
+
+		return version, err
 	})
 
-	if errLK != nil {
-		return 0.0, errLK
+	if err != nil {
+		return 0, err
 	}
 
-	props := results[0].Props
+	return version.(int64), nil
+}
 
-	return props["rating"].(float64), nil
+// touchMedia increments the version of a media, and with related the
+// versions of the users having relations with it.
+func (s *Neo4jStore) touchMedia(transaction neo4j.ManagedTransaction, md any, tp string, related bool) error {
+	label, key := mediaNode(tp)
+
+	query := fmt.Sprintf("MATCH (m:%s {%s: $id}) SET m.version = coalesce(m.version, 0) + 1", label, key)
+	if related {
+		query += " WITH m OPTIONAL MATCH (m)<-[:PREF|RTE|WSH]-(u) SET u.version = coalesce(u.version, 0) + 1"
+	}
+
+	result, err := transaction.Run(s.ctx, query, map[string]interface{}{"id": md})
+	if err != nil {
+		return err
+	}
+
+	_, err = result.Consume(s.ctx)
+	return err
 }
 
-func (s *Neo4jStore) SetAverage(i int, md string, tp string, rate float64) error {
+// enqueueEvent writes an event to the outbox inside the transaction of its
+// mutation, so it is only delivered if the mutation is committed. Events are
+// numbered per ordering key, whose counter is locked until the transaction
+// ends, so events of a key are numbered in commit order and mutations of
+// other keys do not wait. ordered_at never goes back within a key, which lets
+// the relay read the oldest events of every key first.
+func (s *Neo4jStore) enqueueEvent(transaction neo4j.ManagedTransaction, e *Event) error {
+	if e == nil {
+		return nil
+	}
+
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	orderingKey := fmt.Sprintf("media:%v:%v", e.MediaType, e.MediaID)
+	if e.UserID != nil {
+		orderingKey = fmt.Sprintf("user:%v", e.UserID)
+	}
+
 	query := `
-	MERGE (n:User {id_user: $id_user})
-	MERGE (m:Movie {id_movie: $id_media})
-	MERGE (n)-[r:RTE]->(m)
-	ON CREATE
-		SET
-			r.media_id = $id_media,
-			r.media_type = "MOV",
-			r.user_id = $id_user
-	ON MATCH
-		SET
-			r.rating = $rate,
-			r.media_id = $id_media,
-			r.media_type = "MOV",
-			r.user_id = $id_user
+	MERGE (seq:OutboxSequence {key: $ordering_key})
+	SET
+		seq.value = coalesce(seq.value, 0) + 1,
+		seq.ordered_at = CASE WHEN timestamp() > coalesce(seq.ordered_at, 0) THEN timestamp() ELSE seq.ordered_at END
+	CREATE (:OutboxEvent {
+		id: $id,
+		type: $type,
+		user_id: $id_user,
+		ordering_key: $ordering_key,
+		payload: $payload,
+		seq: seq.value,
+		ordered_at: seq.ordered_at,
+		status: "PENDING",
+		attempts: 0,
+		next_attempt_at: timestamp(),
+		created_at: timestamp()
+	})
 	`
 
-	if tp == "SON" {
-		query = `
-		MERGE (n:User {id_user: $id_user})
-		MERGE (m:Song {id_song: $id_media})
-		MERGE (n)-[r:RTE]->(m)
-		ON CREATE
-			SET
-				r.rating = $rate,
-				r.media_id = $id_media,
-				r.media_type = "SON",
-				r.user_id = $id_user
-		ON MATCH
-			SET
-				r.rating = $rate,
-				r.media_id = $id_media,
-				r.media_type = "SON",
-				r.user_id = $id_user
-		`
-	} else if tp == "BOO" {
-		query = `
-		MERGE (n:User {id_user: $id_user})
-		MERGE (m:Book {id_book: $id_media})
-		MERGE (n)-[r:RTE]->(m)
-		ON CREATE
-			SET
-				r.rating = $rate,
-				r.media_id = $id_media,
-				r.media_type = "BOO",
-				r.user_id = $id_user
-		ON MATCH
-			SET
-				r.rating = $rate,
-				r.media_id = $id_media,
-				r.media_type = "BOO",
-				r.user_id = $id_user
-		`
+	_, err = transaction.Run(s.ctx, query, map[string]interface{}{
+		"id":           e.ID,
+		"type":         e.Type,
+		"id_user":      e.UserID,
+		"ordering_key": orderingKey,
+		"payload":      string(payload),
+	})
+
+	return err
+}
+
+// recordChange appends a change to the preference history and queues its event
+// inside the transaction that performs it.
+func (s *Neo4jStore) recordChange(transaction neo4j.ManagedTransaction, change *PreferenceChange) error {
+	if change.IsNoop() {
+		return nil
+	}
+
+	query := `
+	CREATE (:PreferenceChange {
+		id: $id,
+		user_id: $id_user,
+		media_id: $id_media,
+		media_type: $media_type,
+		kind: $kind,
+		old_value: $old_value,
+		new_value: $new_value,
+		actor: $actor,
+		created_at: timestamp()
+	})
+	`
+
+	_, err := transaction.Run(s.ctx, query, map[string]interface{}{
+		"id":         change.ID,
+		"id_user":    change.UserID,
+		"id_media":   change.MediaID,
+		"media_type": change.MediaType,
+		"kind":       change.Kind,
+		"old_value":  change.OldValue,
+		"new_value":  change.NewValue,
+		"actor":      change.Actor,
+	})
+	if err != nil {
+		return err
+	}
+
+	// The user is locked, and so touched, by executeUserWrite
+	mediaType, _ := change.MediaType.(string)
+	if err := s.touchMedia(transaction, change.MediaID, mediaType, false); err != nil {
+		return err
 	}
 
-	_, err := s.session.ExecuteWrite(s.ctx, func(transaction neo4j.ManagedTransaction) (any, error) {
-		result, err := transaction.Run(s.ctx, query, map[string]interface{}{"id_media": md, "id_user": i, "rate": rate})
+	return s.enqueueEvent(transaction, NewChangeEvent(change))
+}
+
+// Create Functions
+func (s *Neo4jStore) CreateUser(i int) error {
+
+	_, err := s.executeWrite(func(transaction neo4j.ManagedTransaction) (any, error) {
+		if err := s.checkNotDeleted(transaction, "User", "id_user", i); err != nil {
+			return nil, err
+		}
+
+		result, err := transaction.Run(s.ctx, "MERGE (u:User {id_user: $id})", map[string]interface{}{"id": i})
 		if err != nil {
 			return nil, err
 		}
@@ -585,120 +897,156 @@ func (s *Neo4jStore) SetAverage(i int, md string, tp string, rate float64) error
 	return nil
 }
 
-func (s *Neo4jStore) GetWishlist(i int, tp string) (*GetWishlist, error) {
-	queryLK := "MATCH (:User {id_user: $id_user})-[r:WSH]-(n) RETURN r as relation"
+func (s *Neo4jStore) CreateMedia(i string, tp string) error {
+
+	query := "MERGE (m:Movie {id_movie: $id})"
 
 	if tp == "SON" {
-		queryLK = "MATCH (:User {id_user: $id_user})-[r:WSH]-(:Song) RETURN r as relation"
+		query = "MERGE (s:Song {id_song: $id})"
 	} else if tp == "BOO" {
-		queryLK = "MATCH (:User {id_user: $id_user})-[r:WSH]-(:Book) RETURN r as relation"
-	} else if tp == "MOV" {
-		queryLK = "MATCH (:User {id_user: $id_user})-[r:WSH]-(:Movie) RETURN r as relation"
+		query = "MERGE (b:Book {id_book: $id})"
 	}
 
-	var results []neo4j.Relationship
-	var movies []string
-	var songs []string
-	var books []string
+	label, key := mediaNode(tp)
 
-	_, errLK := s.session.ExecuteWrite(s.ctx, func(transaction neo4j.ManagedTransaction) (any, error) {
-		result, errLK := transaction.Run(s.ctx, queryLK, map[string]interface{}{"id_user": i})
-		if errLK != nil {
-			return nil, errLK
+	_, err := s.executeWrite(func(transaction neo4j.ManagedTransaction) (any, error) {
+		if err := s.checkNotDeleted(transaction, label, key, i); err != nil {
+			return nil, err
 		}
 
-		for result.Next(s.ctx) {
-			results = append(results, result.Record().AsMap()["relation"].(neo4j.Relationship))
+		result, err := transaction.Run(s.ctx, query, map[string]interface{}{"id": i})
+		if err != nil {
+			return nil, err
+		}
+
+		if result.Next(s.ctx) {
+			return result.Record().Values[0], nil
 		}
 
 		return nil, result.Err()
 	})
 
-	if errLK != nil {
-		return nil, errLK
-	}
-
-	for r := 0; r < len(results); r++ {
-		props := results[r].Props
-		mediaType := props["media_type"]
-		mediaID := props["media_id"].(string)
-
-		if mediaType == "MOV" {
-			movies = append(movies, mediaID)
-		} else if mediaType == "SON" {
-			songs = append(songs, mediaID)
-		} else {
-			books = append(books, mediaID)
-		}
+	if err != nil {
+		return err
 	}
 
-	return &GetWishlist{
-		UserID: i,
-		Movies: movies,
-		Songs:  songs,
-		Books:  books,
-	}, nil
+	return nil
 }
 
-func (s *Neo4jStore) AddToWishlist(i int, md string, tp string) error {
+func (s *Neo4jStore) SetLike(l *Like, actor string, ifMatch IfMatch) (int64, error) {
+
 	query := `
 	MERGE (n:User {id_user: $id_user})
 	MERGE (m:Movie {id_movie: $id_media})
-	MERGE (n)-[r:WSH]->(m)
+	MERGE (n)-[r:PREF]->(m)
 	ON CREATE
 		SET
+			r.type = $type,
+			r.reaction = $reaction,
 			r.media_id = $id_media,
 			r.media_type = "MOV",
-			r.user_id = $id_user
+			r.user_id = $id_user,
+			r.updated_at = timestamp()
 	ON MATCH
 		SET
+			r.type = $type,
+			r.reaction = $reaction,
 			r.media_id = $id_media,
 			r.media_type = "MOV",
-			r.user_id = $id_user
+			r.user_id = $id_user,
+			r.updated_at = timestamp()
 	`
 
-	if tp == "SON" {
+	if l.MediaType == "SON" {
 		query = `
 		MERGE (n:User {id_user: $id_user})
 		MERGE (m:Song {id_song: $id_media})
-		MERGE (n)-[r:WSH]->(m)
+		MERGE (n)-[r:PREF]->(m)
 		ON CREATE
 			SET
+				r.type = $type,
+				r.reaction = $reaction,
 				r.media_id = $id_media,
 				r.media_type = "SON",
-				r.user_id = $id_user
+				r.user_id = $id_user,
+				r.updated_at = timestamp()
 		ON MATCH
 			SET
+				r.type = $type,
+				r.reaction = $reaction,
 				r.media_id = $id_media,
 				r.media_type = "SON",
-				r.user_id = $id_user
+				r.user_id = $id_user,
+				r.updated_at = timestamp()
 		`
-	} else if tp == "BOO" {
+	} else if l.MediaType == "BOO" {
 		query = `
 		MERGE (n:User {id_user: $id_user})
 		MERGE (m:Book {id_book: $id_media})
-		MERGE (n)-[r:WSH]->(m)
+		MERGE (n)-[r:PREF]->(m)
 		ON CREATE
 			SET
+				r.type = $type,
+				r.reaction = $reaction,
 				r.media_id = $id_media,
 				r.media_type = "BOO",
-				r.user_id = $id_user
+				r.user_id = $id_user,
+				r.updated_at = timestamp()
 		ON MATCH
 			SET
+				r.type = $type,
+				r.reaction = $reaction,
 				r.media_id = $id_media,
 				r.media_type = "BOO",
-				r.user_id = $id_user
+				r.user_id = $id_user,
+				r.updated_at = timestamp()
 		`
 	}
 
-	_, err := s.session.ExecuteWrite(s.ctx, func(transaction neo4j.ManagedTransaction) (any, error) {
-		result, err := transaction.Run(s.ctx, query, map[string]interface{}{"id_media": md, "id_user": i})
+	return s.executeUserWrite(l.UserID, ifMatch, func(transaction neo4j.ManagedTransaction) error {
+		if err := s.checkActive(transaction, l.UserID, l.MediaID, l.MediaType); err != nil {
+			return err
+		}
+
+		old, err := s.relationValue(transaction, "PREF", l.UserID, l.MediaID, l.MediaType)
+		if err != nil {
+			return err
+		}
+
+		result, err := transaction.Run(s.ctx, query, map[string]interface{}{"id_media": l.MediaID, "id_user": l.UserID, "type": l.LikeType, "reaction": l.Reaction})
+		if err != nil {
+			return err
+		}
+
+		if _, err := result.Consume(s.ctx); err != nil {
+			return err
+		}
+
+		return s.recordChange(transaction, NewPreferenceChange(l.UserID, l.MediaID, l.MediaType, "PREF", old, l.Reaction, actor))
+	})
+}
+
+// Delete Functions
+
+// DeleteUser and DeleteMedia only mark the node as deleted, which hides it and
+// its relations from every read. PurgeDeleted removes it once the retention
+// period is over.
+func (s *Neo4jStore) DeleteUser(i int) error {
+	_, err := s.executeWrite(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, err := transaction.Run(s.ctx, "MATCH (u:User) WHERE u.id_user = $id AND u.deleted_at IS NULL SET u.deleted_at = timestamp() RETURN u.id_user", map[string]interface{}{"id": i})
 		if err != nil {
 			return nil, err
 		}
 
 		if result.Next(s.ctx) {
-			return result.Record().Values[0], nil
+			if err := s.touchUser(transaction, i, true); err != nil {
+				return nil, err
+			}
+
+			event := NewEvent(EventUserDeleted)
+			event.UserID = i
+
+			return nil, s.enqueueEvent(transaction, event)
 		}
 
 		return nil, result.Err()
@@ -711,31 +1059,2355 @@ func (s *Neo4jStore) AddToWishlist(i int, md string, tp string) error {
 	return nil
 }
 
-func (s *Neo4jStore) RemoveFromWishlist(user_id int, media_id string, tp string) error {
-	queryLK := "MATCH (:Movie {id_movie: $id_media})-[r:WSH]-(:User {id_user: $id_user}) DELETE r"
+func (s *Neo4jStore) DeleteMedia(i string, tp string) error {
+	query := "MATCH (m:Movie) WHERE m.id_movie = $id AND m.deleted_at IS NULL SET m.deleted_at = timestamp() RETURN m.id_movie"
 
 	if tp == "SON" {
-		queryLK = "MATCH (:Song {id_song: $id_media})-[r:WSH]-(:User {id_user: $id_user}) DELETE r"
+		query = "MATCH (s:Song) WHERE s.id_song = $id AND s.deleted_at IS NULL SET s.deleted_at = timestamp() RETURN s.id_song"
 	} else if tp == "BOO" {
-		queryLK = "MATCH (:Book {id_book: $id_media})-[r:WSH]-(:User {id_user: $id_user}) DELETE r"
+		query = "MATCH (b:Book) WHERE b.id_book = $id AND b.deleted_at IS NULL SET b.deleted_at = timestamp() RETURN b.id_book"
 	}
 
-	_, err := s.session.ExecuteWrite(s.ctx, func(transaction neo4j.ManagedTransaction) (any, error) {
-		result, err := transaction.Run(s.ctx, queryLK, map[string]interface{}{"id_media": media_id, "id_user": user_id})
+	_, err := s.executeWrite(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, err := transaction.Run(s.ctx, query, map[string]interface{}{"id": i})
 		if err != nil {
 			return nil, err
 		}
 
 		if result.Next(s.ctx) {
-			return result.Record().Values[0], nil
-		}
+			if err := s.touchMedia(transaction, i, tp, true); err != nil {
+				return nil, err
+			}
+
+			event := NewEvent(EventMediaDeleted)
+			event.MediaID = i
+			event.MediaType = tp
+
+			return nil, s.enqueueEvent(transaction, event)
+		}
+
+		return nil, result.Err()
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *Neo4jStore) DeleteLike(user_id int, media_id string, tp string, actor string, ifMatch IfMatch) (int64, error) {
+	queryLK := "MATCH (:Movie {id_movie: $id_media})-[r:PREF]-(:User {id_user: $id_user}) DELETE r"
+
+	if tp == "SON" {
+		queryLK = "MATCH (:Song {id_song: $id_media})-[r:PREF]-(:User {id_user: $id_user}) DELETE r"
+	} else if tp == "BOO" {
+		queryLK = "MATCH (:Book {id_book: $id_media})-[r:PREF]-(:User {id_user: $id_user}) DELETE r"
+	}
+
+	return s.executeUserWrite(user_id, ifMatch, func(transaction neo4j.ManagedTransaction) error {
+		old, err := s.relationValue(transaction, "PREF", user_id, media_id, tp)
+		if err != nil {
+			return err
+		}
+
+		result, err := transaction.Run(s.ctx, queryLK, map[string]interface{}{"id_media": media_id, "id_user": user_id})
+		if err != nil {
+			return err
+		}
+
+		if _, err := result.Consume(s.ctx); err != nil {
+			return err
+		}
+
+		return s.recordChange(transaction, NewPreferenceChange(user_id, media_id, tp, "PREF", old, nil, actor))
+	})
+}
+
+func (s *Neo4jStore) RestoreUser(i int) error {
+	query := `
+	MATCH (u:User {id_user: $id})
+	WHERE u.deleted_at IS NOT NULL AND u.deleted_at >= timestamp() - $retention
+	REMOVE u.deleted_at
+	RETURN u
+	`
+
+	found, err := s.executeWrite(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, err := transaction.Run(s.ctx, query, map[string]interface{}{"id": i, "retention": s.config.Retention.Milliseconds()})
+		if err != nil {
+			return false, err
+		}
+
+		if !result.Next(s.ctx) {
+			return false, result.Err()
+		}
+
+		return true, s.touchUser(transaction, i, true)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if !found.(bool) {
+		return fmt.Errorf("no restorable user %d", i)
+	}
+
+	return nil
+}
+
+func (s *Neo4jStore) RestoreMedia(i string, tp string) error {
+	label, key := mediaNode(tp)
+
+	query := fmt.Sprintf(`
+	MATCH (m:%s {%s: $id})
+	WHERE m.deleted_at IS NOT NULL AND m.deleted_at >= timestamp() - $retention
+	REMOVE m.deleted_at
+	RETURN m
+	`, label, key)
+
+	found, err := s.executeWrite(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, err := transaction.Run(s.ctx, query, map[string]interface{}{"id": i, "retention": s.config.Retention.Milliseconds()})
+		if err != nil {
+			return false, err
+		}
+
+		if !result.Next(s.ctx) {
+			return false, result.Err()
+		}
+
+		return true, s.touchMedia(transaction, i, tp, true)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if !found.(bool) {
+		return fmt.Errorf("no restorable media %s", i)
+	}
+
+	return nil
+}
+
+// purgeStatements hard delete what was soft deleted before $before, at most
+// $batch_size nodes at once, and return how many they deleted.
+var purgeStatements = []string{
+	// The history of the users purged next
+	`
+	MATCH (u:User) WHERE u.deleted_at < $before
+	MATCH (c:PreferenceChange {user_id: u.id_user})
+	WITH c LIMIT $batch_size
+	DELETE c
+	RETURN count(c) as purged
+	`,
+	`
+	MATCH (n)
+	WHERE (n:User OR n:Movie OR n:Song OR n:Book) AND n.deleted_at < $before
+	WITH n LIMIT $batch_size
+	DETACH DELETE n
+	RETURN count(n) as purged
+	`,
+	// Outbox events delivered, or given up on, before the retention period
+	`
+	MATCH (e:OutboxEvent)
+	WHERE (e.status = "SENT" AND e.sent_at < $before) OR (e.status = "DEAD" AND e.dead_at < $before)
+	WITH e LIMIT $batch_size
+	DELETE e
+	RETURN count(e) as purged
+	`,
+	// Idempotency keys past their expiry
+	`
+	MATCH (k:IdempotencyKey) WHERE k.expires_at < timestamp()
+	WITH k LIMIT $batch_size
+	DELETE k
+	RETURN count(k) as purged
+	`,
+}
+
+// PurgeDeleted hard deletes the users and media soft deleted before the
+// retention period, along with all their relations and the history of the
+// users, the outbox events delivered or dead before it, and the expired
+// idempotency keys. Each batch is deleted in a transaction of its own, so a
+// large purge stays within the transaction memory limit.
+func (s *Neo4jStore) PurgeDeleted() (int64, error) {
+	params := map[string]interface{}{
+		"before":     time.Now().Add(-s.config.Retention).UnixMilli(),
+		"batch_size": s.config.PurgeBatchSize,
+	}
+
+	var total int64
+	for _, query := range purgeStatements {
+		for {
+			purged, err := s.executeWrite(func(transaction neo4j.ManagedTransaction) (any, error) {
+				result, err := transaction.Run(s.ctx, query, params)
+				if err != nil {
+					return int64(0), err
+				}
+
+				record, err := result.Single(s.ctx)
+				if err != nil {
+					return int64(0), err
+				}
+
+				return record.AsMap()["purged"], nil
+			})
+
+			if err != nil {
+				return total, err
+			}
+
+			if purged.(int64) == 0 {
+				break
+			}
+			total += purged.(int64)
+		}
+	}
+
+	return total, nil
+}
+
+// Get Functions
+func (s *Neo4jStore) GetUserLikes(i int, media string, tp string) (*GetUserLikes, error) {
+	label := ""
+	if media == "SON" || media == "BOO" || media == "MOV" {
+		label, _ = mediaNode(media)
+		label = ":" + label
+	}
+
+	queryLK := fmt.Sprintf(`
+	MATCH (u:User {id_user: $id_user})-[r:PREF]-(m%s)
+	WHERE u.deleted_at IS NULL AND m.deleted_at IS NULL AND ($preference = "" OR r.type = $preference)
+	RETURN r as relation
+	`, label)
+
+	var results []neo4j.Relationship
+	var movies []LikeRelation
+	var songs []LikeRelation
+	var books []LikeRelation
+
+	_, errLK := s.executeWrite(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, errLK := transaction.Run(s.ctx, queryLK, map[string]interface{}{"id_user": i, "preference": tp})
+		if errLK != nil {
+			return nil, errLK
+		}
+
+		for result.Next(s.ctx) {
+			results = append(results, result.Record().AsMap()["relation"].(neo4j.Relationship))
+		}
+
+		return nil, result.Err()
+	})
+
+	if errLK != nil {
+		return nil, errLK
+	}
+
+	for r := 0; r < len(results); r++ {
+		props := results[r].Props
+		mediaType := props["media_type"]
+		like := s.newLikeRelation(i, props["media_id"], props)
+
+		if mediaType == "MOV" {
+			movies = append(movies, *like)
+		} else if mediaType == "SON" {
+			songs = append(songs, *like)
+		} else {
+			books = append(books, *like)
+		}
+	}
+
+	return &GetUserLikes{
+		UserID: i,
+		Movies: movies,
+		Songs:  songs,
+		Books:  books,
+	}, nil
+}
+
+// GetMediaLikes lists the likes of a media that the viewer is allowed to see.
+// Reaction counts and score are computed on every like.
+func (s *Neo4jStore) GetMediaLikes(i string, media string, tp string, viewer int) (*GetMediaLikes, error) {
+	label, key := mediaNode(media)
+
+	// LK and DLK filter by like type, any other preference by reaction code
+	filter := ""
+	if tp == "LK" || tp == "DLK" {
+		filter = "AND r.type = $preference"
+	} else if tp != "" {
+		filter = "AND r.reaction = $preference"
+	}
+
+	queryLK := fmt.Sprintf(`
+	MATCH (m:%s {%s: $id})-[r:PREF]-(u:User)
+	WHERE u.deleted_at IS NULL AND m.deleted_at IS NULL %s
+	RETURN r as relation, %s as visible
+	`, label, key, filter, visibleTo("u", "$media_type"))
+
+	var results []neo4j.Relationship
+	var visible []bool
+	var likes []LikeRelation
+
+	_, errLK := s.executeWrite(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, errLK := transaction.Run(s.ctx, queryLK, map[string]interface{}{"id": i, "preference": tp, "media_type": media, "viewer": viewer})
+		if errLK != nil {
+			return nil, errLK
+		}
+
+		for result.Next(s.ctx) {
+			record := result.Record().AsMap()
+			results = append(results, record["relation"].(neo4j.Relationship))
+			visible = append(visible, record["visible"] == true)
+		}
+
+		return nil, result.Err()
+	})
+
+	if errLK != nil {
+		return nil, errLK
+	}
+
+	reactions := map[string]int{}
+	score := 0.0
+
+	for r := 0; r < len(results); r++ {
+		props := results[r].Props
+		like := s.newLikeRelation(props["user_id"], i, props)
+		if visible[r] {
+			likes = append(likes, *like)
+		}
+
+		if reaction, ok := like.Reaction.(string); ok {
+			reactions[reaction]++
+		}
+		score = score + like.Weight
+	}
+
+	return &GetMediaLikes{
+		Likes:     likes,
+		Reactions: reactions,
+		Score:     score,
+	}, nil
+}
+
+func (s *Neo4jStore) GetSpecificLike(i int, media_id string, media string) (*LikeRelation, error) {
+
+	queryLK := "MATCH (m:Movie {id_movie: $id})-[r:PREF]-(u:User {id_user: $user_id}) WHERE u.deleted_at IS NULL AND m.deleted_at IS NULL RETURN r as relation"
+
+	if media == "SON" {
+		queryLK = "MATCH (m:Song {id_song: $id})-[r:PREF]-(u:User {id_user: $user_id}) WHERE u.deleted_at IS NULL AND m.deleted_at IS NULL RETURN r as relation"
+	} else if media == "BOO" {
+		queryLK = "MATCH (m:Book {id_book: $id})-[r:PREF]-(u:User {id_user: $user_id}) WHERE u.deleted_at IS NULL AND m.deleted_at IS NULL RETURN r as relation"
+	}
+
+	var results []neo4j.Relationship
+
+	_, errLK := s.executeWrite(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, errLK := transaction.Run(s.ctx, queryLK, map[string]interface{}{"id": media_id, "user_id": i})
+		if errLK != nil {
+			return nil, errLK
+		}
+
+		for result.Next(s.ctx) {
+			results = append(results, result.Record().AsMap()["relation"].(neo4j.Relationship))
+		}
+
+		return nil, result.Err()
+	})
+
+	if errLK != nil {
+		return nil, errLK
+	}
+
+	if len(results) == 0 {
+		return nil, fmt.Errorf("relation not found")
+	}
+
+	props := results[0].Props
+	like := s.newLikeRelation(i, media_id, props)
+
+	return like, nil
+}
+
+func (s *Neo4jStore) GetAverage(i string, tp string) (float64, error) {
+	// Flagged and removed reviews are hidden from aggregates
+	queryLK := `MATCH (m:Movie {id_movie: $id})-[r:RTE]-(u) WHERE u.deleted_at IS NULL AND m.deleted_at IS NULL AND NOT coalesce(r.review_status, "VIS") IN ["FLG", "RMV"] RETURN r as relation`
+
+	if tp == "SON" {
+		queryLK = `MATCH (m:Song {id_song: $id})-[r:RTE]-(u) WHERE u.deleted_at IS NULL AND m.deleted_at IS NULL AND NOT coalesce(r.review_status, "VIS") IN ["FLG", "RMV"] RETURN r as relation`
+	} else if tp == "BOO" {
+		queryLK = `MATCH (m:Book {id_book: $id})-[r:RTE]-(u) WHERE u.deleted_at IS NULL AND m.deleted_at IS NULL AND NOT coalesce(r.review_status, "VIS") IN ["FLG", "RMV"] RETURN r as relation`
+	}
+
+	var results []neo4j.Relationship
+	var sumRating float64
+
+	_, errLK := s.executeWrite(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, errLK := transaction.Run(s.ctx, queryLK, map[string]interface{}{"id": i})
+		if errLK != nil {
+			return nil, errLK
+		}
+
+		for result.Next(s.ctx) {
+			results = append(results, result.Record().AsMap()["relation"].(neo4j.Relationship))
+		}
+
+		return nil, result.Err()
+	})
+
+	if errLK != nil {
+		return 0.0, errLK
+	}
+
+	// Every rating may be hidden, which would average to NaN
+	if len(results) == 0 {
+		return 0.0, nil
+	}
+
+	sumRating = 0.0
+	for r := 0; r < len(results); r++ {
+		props := results[r].Props
+		rating := props["rating"]
+		if rating != -1 {
+			sumRating = sumRating + rating.(float64)
+		}
+	}
+
+	return sumRating / float64(len(results)), nil
+}
+
+func (s *Neo4jStore) GetRating(i string, tp string, u int) (float64, error) {
+	queryLK := "MATCH (m:Movie {id_movie: $id})-[r:RTE]-(u:User {id_user:$user_id}) WHERE u.deleted_at IS NULL AND m.deleted_at IS NULL RETURN r as relation"
+
+	if tp == "SON" {
+		queryLK = "MATCH (m:Song {id_song: $id})-[r:RTE]-(u:User {id_user:$user_id}) WHERE u.deleted_at IS NULL AND m.deleted_at IS NULL RETURN r as relation"
+	} else if tp == "BOO" {
+		queryLK = "MATCH (m:Book {id_book: $id})-[r:RTE]-(u:User {id_user:$user_id}) WHERE u.deleted_at IS NULL AND m.deleted_at IS NULL RETURN r as relation"
+	}
+
+	var results []neo4j.Relationship
+
+	_, errLK := s.executeWrite(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, errLK := transaction.Run(s.ctx, queryLK, map[string]interface{}{"id": i, "user_id": u})
+		if errLK != nil {
+			return nil, errLK
+		}
+
+		for result.Next(s.ctx) {
+			results = append(results, result.Record().AsMap()["relation"].(neo4j.Relationship))
+		}
+
+		return nil, result.Err()
+	})
+
+	if errLK != nil {
+		return 0.0, errLK
+	}
+
+	if len(results) == 0 {
+		return 0.0, fmt.Errorf("rating not found")
+	}
+
+	props := results[0].Props
+
+	return props["rating"].(float64), nil
+}
+
+// SetAverage rates a media, and reviews it when the rate has a review. Both are
+// written in the same transaction, so a banned user writes neither.
+func (s *Neo4jStore) SetAverage(i int, md string, tp string, rate *Rate, actor string, ifMatch IfMatch) (int64, error) {
+	query := `
+	MERGE (n:User {id_user: $id_user})
+	MERGE (m:Movie {id_movie: $id_media})
+	MERGE (n)-[r:RTE]->(m)
+	ON CREATE
+		SET
+			r.rating = $rate,
+			r.media_id = $id_media,
+			r.media_type = "MOV",
+			r.user_id = $id_user,
+			r.updated_at = timestamp()
+	ON MATCH
+		SET
+			r.rating = $rate,
+			r.media_id = $id_media,
+			r.media_type = "MOV",
+			r.user_id = $id_user,
+			r.updated_at = timestamp()
+	`
+
+	if tp == "SON" {
+		query = `
+		MERGE (n:User {id_user: $id_user})
+		MERGE (m:Song {id_song: $id_media})
+		MERGE (n)-[r:RTE]->(m)
+		ON CREATE
+			SET
+				r.rating = $rate,
+				r.media_id = $id_media,
+				r.media_type = "SON",
+				r.user_id = $id_user,
+				r.updated_at = timestamp()
+		ON MATCH
+			SET
+				r.rating = $rate,
+				r.media_id = $id_media,
+				r.media_type = "SON",
+				r.user_id = $id_user,
+				r.updated_at = timestamp()
+		`
+	} else if tp == "BOO" {
+		query = `
+		MERGE (n:User {id_user: $id_user})
+		MERGE (m:Book {id_book: $id_media})
+		MERGE (n)-[r:RTE]->(m)
+		ON CREATE
+			SET
+				r.rating = $rate,
+				r.media_id = $id_media,
+				r.media_type = "BOO",
+				r.user_id = $id_user,
+				r.updated_at = timestamp()
+		ON MATCH
+			SET
+				r.rating = $rate,
+				r.media_id = $id_media,
+				r.media_type = "BOO",
+				r.user_id = $id_user,
+				r.updated_at = timestamp()
+		`
+	}
+
+	return s.executeUserWrite(i, ifMatch, func(transaction neo4j.ManagedTransaction) error {
+		if err := s.checkActive(transaction, i, md, tp); err != nil {
+			return err
+		}
+
+		old, err := s.relationValue(transaction, "RTE", i, md, tp)
+		if err != nil {
+			return err
+		}
+
+		result, err := transaction.Run(s.ctx, query, map[string]interface{}{"id_media": md, "id_user": i, "rate": rate.Rating})
+		if err != nil {
+			return err
+		}
+
+		if _, err := result.Consume(s.ctx); err != nil {
+			return err
+		}
+
+		if rate.Review != "" {
+			if err := s.setReview(transaction, i, md, tp, rate.Review); err != nil {
+				return err
+			}
+		}
+
+		return s.recordChange(transaction, NewPreferenceChange(i, md, tp, "RTE", old, rate.Rating, actor))
+	})
+}
+
+func (s *Neo4jStore) GetWishlist(i int, tp string) (*GetWishlist, error) {
+	queryLK := "MATCH (u:User {id_user: $id_user})-[r:WSH]-(m) WHERE u.deleted_at IS NULL AND m.deleted_at IS NULL RETURN r as relation"
+
+	if tp == "SON" {
+		queryLK = "MATCH (u:User {id_user: $id_user})-[r:WSH]-(m:Song) WHERE u.deleted_at IS NULL AND m.deleted_at IS NULL RETURN r as relation"
+	} else if tp == "BOO" {
+		queryLK = "MATCH (u:User {id_user: $id_user})-[r:WSH]-(m:Book) WHERE u.deleted_at IS NULL AND m.deleted_at IS NULL RETURN r as relation"
+	} else if tp == "MOV" {
+		queryLK = "MATCH (u:User {id_user: $id_user})-[r:WSH]-(m:Movie) WHERE u.deleted_at IS NULL AND m.deleted_at IS NULL RETURN r as relation"
+	}
+
+	var results []neo4j.Relationship
+	var movies []string
+	var songs []string
+	var books []string
+
+	_, errLK := s.executeWrite(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, errLK := transaction.Run(s.ctx, queryLK, map[string]interface{}{"id_user": i})
+		if errLK != nil {
+			return nil, errLK
+		}
+
+		for result.Next(s.ctx) {
+			results = append(results, result.Record().AsMap()["relation"].(neo4j.Relationship))
+		}
+
+		return nil, result.Err()
+	})
+
+	if errLK != nil {
+		return nil, errLK
+	}
+
+	for r := 0; r < len(results); r++ {
+		props := results[r].Props
+		mediaType := props["media_type"]
+		mediaID := props["media_id"].(string)
+
+		if mediaType == "MOV" {
+			movies = append(movies, mediaID)
+		} else if mediaType == "SON" {
+			songs = append(songs, mediaID)
+		} else {
+			books = append(books, mediaID)
+		}
+	}
+
+	return &GetWishlist{
+		UserID: i,
+		Movies: movies,
+		Songs:  songs,
+		Books:  books,
+	}, nil
+}
+
+func (s *Neo4jStore) AddToWishlist(i int, md string, tp string, actor string, ifMatch IfMatch) (int64, error) {
+	query := `
+	MERGE (n:User {id_user: $id_user})
+	MERGE (m:Movie {id_movie: $id_media})
+	MERGE (n)-[r:WSH]->(m)
+	ON CREATE
+		SET
+			r.media_id = $id_media,
+			r.media_type = "MOV",
+			r.user_id = $id_user,
+			r.updated_at = timestamp()
+	ON MATCH
+		SET
+			r.media_id = $id_media,
+			r.media_type = "MOV",
+			r.user_id = $id_user,
+			r.updated_at = timestamp()
+	`
+
+	if tp == "SON" {
+		query = `
+		MERGE (n:User {id_user: $id_user})
+		MERGE (m:Song {id_song: $id_media})
+		MERGE (n)-[r:WSH]->(m)
+		ON CREATE
+			SET
+				r.media_id = $id_media,
+				r.media_type = "SON",
+				r.user_id = $id_user,
+				r.updated_at = timestamp()
+		ON MATCH
+			SET
+				r.media_id = $id_media,
+				r.media_type = "SON",
+				r.user_id = $id_user,
+				r.updated_at = timestamp()
+		`
+	} else if tp == "BOO" {
+		query = `
+		MERGE (n:User {id_user: $id_user})
+		MERGE (m:Book {id_book: $id_media})
+		MERGE (n)-[r:WSH]->(m)
+		ON CREATE
+			SET
+				r.media_id = $id_media,
+				r.media_type = "BOO",
+				r.user_id = $id_user,
+				r.updated_at = timestamp()
+		ON MATCH
+			SET
+				r.media_id = $id_media,
+				r.media_type = "BOO",
+				r.user_id = $id_user,
+				r.updated_at = timestamp()
+		`
+	}
+
+	return s.executeUserWrite(i, ifMatch, func(transaction neo4j.ManagedTransaction) error {
+		if err := s.checkActive(transaction, i, md, tp); err != nil {
+			return err
+		}
+
+		old, err := s.relationValue(transaction, "WSH", i, md, tp)
+		if err != nil {
+			return err
+		}
+
+		result, err := transaction.Run(s.ctx, query, map[string]interface{}{"id_media": md, "id_user": i})
+		if err != nil {
+			return err
+		}
+
+		if _, err := result.Consume(s.ctx); err != nil {
+			return err
+		}
+
+		return s.recordChange(transaction, NewPreferenceChange(i, md, tp, "WSH", old, true, actor))
+	})
+}
+
+func (s *Neo4jStore) RemoveFromWishlist(user_id int, media_id string, tp string, actor string, ifMatch IfMatch) (int64, error) {
+	queryLK := "MATCH (:Movie {id_movie: $id_media})-[r:WSH]-(:User {id_user: $id_user}) DELETE r"
+
+	if tp == "SON" {
+		queryLK = "MATCH (:Song {id_song: $id_media})-[r:WSH]-(:User {id_user: $id_user}) DELETE r"
+	} else if tp == "BOO" {
+		queryLK = "MATCH (:Book {id_book: $id_media})-[r:WSH]-(:User {id_user: $id_user}) DELETE r"
+	}
+
+	return s.executeUserWrite(user_id, ifMatch, func(transaction neo4j.ManagedTransaction) error {
+		old, err := s.relationValue(transaction, "WSH", user_id, media_id, tp)
+		if err != nil {
+			return err
+		}
+
+		result, err := transaction.Run(s.ctx, queryLK, map[string]interface{}{"id_media": media_id, "id_user": user_id})
+		if err != nil {
+			return err
+		}
+
+		if _, err := result.Consume(s.ctx); err != nil {
+			return err
+		}
+
+		return s.recordChange(transaction, NewPreferenceChange(user_id, media_id, tp, "WSH", old, false, actor))
+	})
+}
+
+func (s *Neo4jStore) GetMediaCounts(i string, tp string) (*MediaCounts, error) {
+	label, key := mediaNode(tp)
+
+	queryLK := fmt.Sprintf(`
+	MATCH (m:%s {%s: $id})
+	WHERE m.deleted_at IS NULL
+	OPTIONAL MATCH (m)<-[p:PREF]-(u:User)
+	WHERE u.deleted_at IS NULL
+	WITH m, sum(CASE WHEN p.type = "LK" THEN 1 ELSE 0 END) as likes, sum(CASE WHEN p.type = "DLK" THEN 1 ELSE 0 END) as dislikes
+	OPTIONAL MATCH (m)<-[r:RTE]-(v:User)
+	WHERE v.deleted_at IS NULL AND r.rating IS NOT NULL AND NOT coalesce(r.review_status, "VIS") IN ["FLG", "RMV"]
+	RETURN likes, dislikes, count(r) as ratings, coalesce(avg(r.rating), 0.0) as average
+	`, label, key)
+
+	counts := &MediaCounts{
+		MediaID:   i,
+		MediaType: tp,
+	}
+
+	_, errLK := s.executeRead(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, errLK := transaction.Run(s.ctx, queryLK, map[string]interface{}{"id": i})
+		if errLK != nil {
+			return nil, errLK
+		}
+
+		if result.Next(s.ctx) {
+			record := result.Record().AsMap()
+			counts.Likes, _ = record["likes"].(int64)
+			counts.Dislikes, _ = record["dislikes"].(int64)
+			counts.Ratings, _ = record["ratings"].(int64)
+			counts.Average, _ = record["average"].(float64)
+		}
+
+		return nil, result.Err()
+	})
+
+	if errLK != nil {
+		return nil, errLK
+	}
+
+	return counts, nil
+}
+
+// Review Functions
+// setReview sets the review of a rating inside the transaction writing it.
+func (s *Neo4jStore) setReview(transaction neo4j.ManagedTransaction, i int, md string, tp string, review string) error {
+	label, key := mediaNode(tp)
+
+	// A flagged review stays in the queue even if its author edits it
+	query := fmt.Sprintf(`
+	MATCH (n:User {id_user: $id_user})-[r:RTE]->(m:%s {%s: $id_media})
+	WHERE coalesce(n.review_banned, false) = false
+	SET
+		r.review = $review,
+		r.review_status = CASE WHEN r.review_status = "FLG" THEN "FLG" ELSE "VIS" END
+	RETURN r as relation
+	`, label, key)
+
+	result, err := transaction.Run(s.ctx, query, map[string]interface{}{"id_media": md, "id_user": i, "review": review})
+	if err != nil {
+		return err
+	}
+
+	if !result.Next(s.ctx) {
+		if err := result.Err(); err != nil {
+			return err
+		}
+
+		return fmt.Errorf("%w: user %d can not review media %s", errReviewBanned, i, md)
+	}
+
+	return nil
+}
+
+func (s *Neo4jStore) GetReviews(i string, tp string, viewer int) (*GetReviews, error) {
+	label, key := mediaNode(tp)
+
+	queryLK := fmt.Sprintf(`
+	MATCH (m:%s {%s: $id})-[r:RTE]-(u:User)
+	WHERE u.deleted_at IS NULL AND m.deleted_at IS NULL AND r.review IS NOT NULL AND NOT coalesce(r.review_status, "VIS") IN ["FLG", "RMV"]
+		AND %s
+	RETURN r as relation
+	`, label, key, visibleTo("u", "$media_type"))
+
+	var results []neo4j.Relationship
+	var reviews []Review
+
+	_, errLK := s.executeRead(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, errLK := transaction.Run(s.ctx, queryLK, map[string]interface{}{"id": i, "media_type": tp, "viewer": viewer})
+		if errLK != nil {
+			return nil, errLK
+		}
+
+		for result.Next(s.ctx) {
+			results = append(results, result.Record().AsMap()["relation"].(neo4j.Relationship))
+		}
+
+		return nil, result.Err()
+	})
+
+	if errLK != nil {
+		return nil, errLK
+	}
+
+	for r := 0; r < len(results); r++ {
+		reviews = append(reviews, *NewReview(results[r].Props))
+	}
+
+	return &GetReviews{
+		Reviews: reviews,
+	}, nil
+}
+
+func (s *Neo4jStore) ReportReview(i int, md string, tp string, report *ReportReview) error {
+	label, key := mediaNode(tp)
+
+	// Reported reviews are hidden until an admin moderates them
+	query := fmt.Sprintf(`
+	MATCH (:User {id_user: $id_user})-[r:RTE]->(:%s {%s: $id_media})
+	WHERE r.review IS NOT NULL AND coalesce(r.review_status, "VIS") <> "RMV"
+	SET
+		r.review_status = "FLG",
+		r.report_reasons = CASE WHEN $reporter IN coalesce(r.reporters, []) THEN r.report_reasons ELSE coalesce(r.report_reasons, []) + $reason END,
+		r.reporters = CASE WHEN $reporter IN coalesce(r.reporters, []) THEN r.reporters ELSE coalesce(r.reporters, []) + $reporter END
+	RETURN r as relation
+	`, label, key)
+
+	found, err := s.executeWrite(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, err := transaction.Run(s.ctx, query, map[string]interface{}{"id_media": md, "id_user": i, "reporter": report.ReporterID, "reason": report.Reason})
+		if err != nil {
+			return false, err
+		}
+
+		return result.Next(s.ctx), result.Err()
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if !found.(bool) {
+		return fmt.Errorf("review of user %d on media %s not found", i, md)
+	}
+
+	return nil
+}
+
+func (s *Neo4jStore) GetFlaggedReviews() ([]FlaggedReview, error) {
+	queryLK := `
+	MATCH (u:User)-[r:RTE {review_status: "FLG"}]->(m)
+	WHERE u.deleted_at IS NULL AND m.deleted_at IS NULL
+	RETURN r as relation
+	ORDER BY size(r.reporters) DESC
+	`
+
+	var results []neo4j.Relationship
+	var flagged []FlaggedReview
+
+	_, errLK := s.executeRead(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, errLK := transaction.Run(s.ctx, queryLK, nil)
+		if errLK != nil {
+			return nil, errLK
+		}
+
+		for result.Next(s.ctx) {
+			results = append(results, result.Record().AsMap()["relation"].(neo4j.Relationship))
+		}
+
+		return nil, result.Err()
+	})
+
+	if errLK != nil {
+		return nil, errLK
+	}
+
+	for r := 0; r < len(results); r++ {
+		props := results[r].Props
+		reporters, _ := props["reporters"].([]any)
+		reasons, _ := props["report_reasons"].([]any)
+
+		flagged = append(flagged, FlaggedReview{
+			Review:    *NewReview(props),
+			Reporters: len(reporters),
+			Reasons:   reasons,
+		})
+	}
+
+	return flagged, nil
+}
+
+func (s *Neo4jStore) ModerateReview(i int, md string, tp string, moderate *ModerateReview) error {
+	label, key := mediaNode(tp)
+
+	action := `
+		SET r.review_status = "VIS", r.reporters = [], r.report_reasons = []
+	`
+
+	if moderate.Action == "RMV" {
+		action = `
+		SET r.review_status = "RMV"
+		REMOVE r.review
+		`
+	} else if moderate.Action == "BAN" {
+		action = `
+		SET r.review_status = "RMV", n.review_banned = true
+		REMOVE r.review
+		`
+	} else if moderate.Action != "APR" {
+		return fmt.Errorf("moderation action %s not allowed", moderate.Action)
+	}
+
+	// The audit entry keeps a copy of the review text before it is removed
+	query := fmt.Sprintf(`
+	MATCH (n:User {id_user: $id_user})-[r:RTE]->(:%s {%s: $id_media})
+	WHERE r.review IS NOT NULL
+	CREATE (:ModerationAudit {
+		admin_id: $admin_id,
+		action: $action,
+		user_id: $id_user,
+		media_id: $id_media,
+		media_type: $media_type,
+		review: r.review,
+		note: $note,
+		created_at: timestamp()
+	})
+	%s
+	RETURN r as relation
+	`, label, key, action)
+
+	found, err := s.executeWrite(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, err := transaction.Run(s.ctx, query, map[string]interface{}{
+			"id_media":   md,
+			"id_user":    i,
+			"media_type": tp,
+			"admin_id":   moderate.AdminID,
+			"action":     moderate.Action,
+			"note":       moderate.Note,
+		})
+		if err != nil {
+			return false, err
+		}
+
+		return result.Next(s.ctx), result.Err()
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if !found.(bool) {
+		return fmt.Errorf("review of user %d on media %s not found", i, md)
+	}
+
+	return nil
+}
+
+func (s *Neo4jStore) GetModerationAudit() ([]ModerationAudit, error) {
+	queryLK := "MATCH (a:ModerationAudit) RETURN a as audit ORDER BY a.created_at DESC"
+
+	var results []neo4j.Node
+	var audit []ModerationAudit
+
+	_, errLK := s.executeRead(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, errLK := transaction.Run(s.ctx, queryLK, nil)
+		if errLK != nil {
+			return nil, errLK
+		}
+
+		for result.Next(s.ctx) {
+			results = append(results, result.Record().AsMap()["audit"].(neo4j.Node))
+		}
+
+		return nil, result.Err()
+	})
+
+	if errLK != nil {
+		return nil, errLK
+	}
+
+	for r := 0; r < len(results); r++ {
+		audit = append(audit, *NewModerationAudit(results[r].Props))
+	}
+
+	return audit, nil
+}
+
+// History Functions
+func (s *Neo4jStore) GetHistory(i int, filter *HistoryFilter) (*GetHistory, error) {
+	queryLK := `
+	MATCH (c:PreferenceChange {user_id: $id_user})
+	WHERE ($media_id = "" OR c.media_id = $media_id)
+		AND ($media_type = "" OR c.media_type = $media_type)
+		AND ($from = 0 OR c.created_at >= $from)
+		AND ($to = 0 OR c.created_at <= $to)
+	RETURN c as change
+	ORDER BY c.created_at DESC
+	`
+
+	var from, to int64
+	if !filter.From.IsZero() {
+		from = filter.From.UnixMilli()
+	}
+	if !filter.To.IsZero() {
+		to = filter.To.UnixMilli()
+	}
+
+	var results []neo4j.Node
+	var changes []PreferenceChange
+
+	_, errLK := s.executeRead(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, errLK := transaction.Run(s.ctx, queryLK, map[string]interface{}{
+			"id_user":    i,
+			"media_id":   filter.MediaID,
+			"media_type": filter.MediaType,
+			"from":       from,
+			"to":         to,
+		})
+		if errLK != nil {
+			return nil, errLK
+		}
+
+		for result.Next(s.ctx) {
+			results = append(results, result.Record().AsMap()["change"].(neo4j.Node))
+		}
+
+		return nil, result.Err()
+	})
+
+	if errLK != nil {
+		return nil, errLK
+	}
+
+	for r := 0; r < len(results); r++ {
+		changes = append(changes, *NewPreferenceChangeFromProps(results[r].Props))
+	}
+
+	return &GetHistory{
+		UserID:  i,
+		Changes: changes,
+	}, nil
+}
+
+// Follow Functions
+func (s *Neo4jStore) Follow(i int, target int) error {
+	query := `
+	MERGE (a:User {id_user: $id_user})
+	MERGE (b:User {id_user: $id_target})
+	WITH a, b
+	WHERE a.deleted_at IS NULL AND b.deleted_at IS NULL
+	MERGE (a)-[r:FOLLOWS]->(b)
+	ON CREATE
+		SET
+			r.user_id = $id_user,
+			r.followed_id = $id_target,
+			r.created_at = timestamp()
+	RETURN r as relation
+	`
+
+	found, err := s.executeWrite(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, err := transaction.Run(s.ctx, query, map[string]interface{}{"id_user": i, "id_target": target})
+		if err != nil {
+			return false, err
+		}
+
+		if !result.Next(s.ctx) {
+			return false, result.Err()
+		}
+
+		if err := s.touchUser(transaction, i, false); err != nil {
+			return false, err
+		}
+
+		return true, s.touchUser(transaction, target, false)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if !found.(bool) {
+		return fmt.Errorf("user %d can not follow user %d", i, target)
+	}
+
+	return nil
+}
+
+func (s *Neo4jStore) Unfollow(i int, target int) error {
+	query := "MATCH (:User {id_user: $id_user})-[r:FOLLOWS]->(:User {id_user: $id_target}) DELETE r"
+
+	_, err := s.executeWrite(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, err := transaction.Run(s.ctx, query, map[string]interface{}{"id_user": i, "id_target": target})
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := result.Consume(s.ctx); err != nil {
+			return nil, err
+		}
+
+		// Follows change what each user sees of the other
+		if err := s.touchUser(transaction, i, false); err != nil {
+			return nil, err
+		}
+
+		return nil, s.touchUser(transaction, target, false)
+	})
+
+	return err
+}
+
+func (s *Neo4jStore) GetFollowers(i int) (*GetFollows, error) {
+	queryLK := `
+	MATCH (f:User)-[r:FOLLOWS]->(u:User {id_user: $id_user})
+	WHERE u.deleted_at IS NULL AND f.deleted_at IS NULL
+	RETURN f.id_user as user, r.created_at as since
+	ORDER BY since DESC
+	`
+
+	return s.getFollows(i, queryLK)
+}
+
+func (s *Neo4jStore) GetFollowing(i int) (*GetFollows, error) {
+	queryLK := `
+	MATCH (u:User {id_user: $id_user})-[r:FOLLOWS]->(f:User)
+	WHERE u.deleted_at IS NULL AND f.deleted_at IS NULL
+	RETURN f.id_user as user, r.created_at as since
+	ORDER BY since DESC
+	`
+
+	return s.getFollows(i, queryLK)
+}
+
+func (s *Neo4jStore) getFollows(i int, queryLK string) (*GetFollows, error) {
+	var users []Follow
+
+	_, errLK := s.executeRead(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, errLK := transaction.Run(s.ctx, queryLK, map[string]interface{}{"id_user": i})
+		if errLK != nil {
+			return nil, errLK
+		}
+
+		for result.Next(s.ctx) {
+			record := result.Record().AsMap()
+			users = append(users, *NewFollow(record["user"], record["since"]))
+		}
+
+		return nil, result.Err()
+	})
+
+	if errLK != nil {
+		return nil, errLK
+	}
+
+	return &GetFollows{
+		UserID: i,
+		Users:  users,
+	}, nil
+}
+
+// GetFeed builds the activity feed of a user from the preference history of
+// the users it follows. Removals are left out.
+func (s *Neo4jStore) GetFeed(i int, filter *FeedFilter) (*GetFeed, error) {
+	queryLK := `
+	MATCH (u:User {id_user: $id_user})-[:FOLLOWS]->(f:User)
+	WHERE u.deleted_at IS NULL AND f.deleted_at IS NULL
+	MATCH (c:PreferenceChange {user_id: f.id_user})
+	WHERE %s
+		AND c.new_value IS NOT NULL
+		AND c.new_value <> false
+		AND ($media_type = "" OR c.media_type = $media_type)
+		AND ($before = 0 OR c.created_at < $before OR (c.created_at = $before AND coalesce(c.id, "") < $before_id))
+		AND NOT EXISTS { MATCH (m:Movie {id_movie: c.media_id}) WHERE c.media_type = "MOV" AND m.deleted_at IS NOT NULL }
+		AND NOT EXISTS { MATCH (m:Song {id_song: c.media_id}) WHERE c.media_type = "SON" AND m.deleted_at IS NOT NULL }
+		AND NOT EXISTS { MATCH (m:Book {id_book: c.media_id}) WHERE c.media_type = "BOO" AND m.deleted_at IS NOT NULL }
+	RETURN c as change
+	ORDER BY c.created_at DESC, coalesce(c.id, "") DESC
+	LIMIT $limit
+	`
+	queryLK = fmt.Sprintf(queryLK, visibleTo("f", "c.media_type"))
+
+	var before int64
+	if !filter.Before.IsZero() {
+		before = filter.Before.UnixMilli()
+	}
+
+	var results []neo4j.Node
+	var items []PreferenceChange
+
+	_, errLK := s.executeRead(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, errLK := transaction.Run(s.ctx, queryLK, map[string]interface{}{
+			"id_user":    i,
+			"viewer":     i,
+			"media_type": filter.MediaType,
+			"before":     before,
+			"before_id":  filter.BeforeID,
+			"limit":      filter.Limit,
+		})
+		if errLK != nil {
+			return nil, errLK
+		}
+
+		for result.Next(s.ctx) {
+			results = append(results, result.Record().AsMap()["change"].(neo4j.Node))
+		}
+
+		return nil, result.Err()
+	})
+
+	if errLK != nil {
+		return nil, errLK
+	}
+
+	for r := 0; r < len(results); r++ {
+		items = append(items, *NewPreferenceChangeFromProps(results[r].Props))
+	}
+
+	feed := &GetFeed{
+		UserID: i,
+		Items:  items,
+	}
+
+	if len(items) == filter.Limit {
+		feed.Next = NewFeedCursor(&items[len(items)-1])
+	}
+
+	return feed, nil
+}
+
+func (s *Neo4jStore) IsFollowing(i int, target int) (bool, error) {
+	queryLK := "MATCH (:User {id_user: $id_user})-[r:FOLLOWS]->(:User {id_user: $id_target}) RETURN r as relation"
+
+	following, errLK := s.executeRead(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, errLK := transaction.Run(s.ctx, queryLK, map[string]interface{}{"id_user": i, "id_target": target})
+		if errLK != nil {
+			return false, errLK
+		}
+
+		return result.Next(s.ctx), result.Err()
+	})
+
+	if errLK != nil {
+		return false, errLK
+	}
+
+	return following.(bool), nil
+}
+
+// Privacy Functions
+// GetUserVersion returns the version of a user, 0 when it does not exist.
+func (s *Neo4jStore) GetUserVersion(i int) (int64, error) {
+	return s.getVersion("MATCH (n:User {id_user: $id}) RETURN coalesce(n.version, 0) as version", i)
+}
+
+// GetMediaVersion returns the version of a media, 0 when it does not exist.
+func (s *Neo4jStore) GetMediaVersion(i string, tp string) (int64, error) {
+	label, key := mediaNode(tp)
+
+	return s.getVersion(fmt.Sprintf("MATCH (n:%s {%s: $id}) RETURN coalesce(n.version, 0) as version", label, key), i)
+}
+
+func (s *Neo4jStore) getVersion(query string, id any) (int64, error) {
+	version, err := s.executeRead(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, err := transaction.Run(s.ctx, query, map[string]interface{}{"id": id})
+		if err != nil {
+			return int64(0), err
+		}
+
+		if result.Next(s.ctx) {
+			return result.Record().AsMap()["version"], nil
+		}
+
+		return int64(0), result.Err()
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return version.(int64), nil
+}
+
+func (s *Neo4jStore) GetPrivacy(i int) (*PrivacySettings, error) {
+	queryLK := "MATCH (u:User {id_user: $id_user}) RETURN u as user"
+
+	var results []neo4j.Node
+
+	_, errLK := s.executeRead(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, errLK := transaction.Run(s.ctx, queryLK, map[string]interface{}{"id_user": i})
+		if errLK != nil {
+			return nil, errLK
+		}
+
+		for result.Next(s.ctx) {
+			results = append(results, result.Record().AsMap()["user"].(neo4j.Node))
+		}
+
+		return nil, result.Err()
+	})
+
+	if errLK != nil {
+		return nil, errLK
+	}
+
+	settings := &PrivacySettings{
+		Default:   PrivacyPublic,
+		Overrides: map[string]string{},
+	}
+
+	for r := 0; r < len(results); r++ {
+		props := results[r].Props
+
+		if level, ok := props["privacy"].(string); ok {
+			settings.Default = level
+		}
+
+		for _, mediaType := range []string{"MOV", "SON", "BOO"} {
+			if level, ok := props["privacy_"+mediaType].(string); ok {
+				settings.Overrides[mediaType] = level
+			}
+		}
+	}
+
+	return settings, nil
+}
+
+func (s *Neo4jStore) SetPrivacy(i int, settings *PrivacySettings) error {
+	query := `
+	MERGE (u:User {id_user: $id_user})
+	SET
+		u.privacy = $default,
+		u.privacy_MOV = $MOV,
+		u.privacy_SON = $SON,
+		u.privacy_BOO = $BOO
+	`
+
+	params := map[string]interface{}{"id_user": i, "default": settings.Default}
+	for _, mediaType := range []string{"MOV", "SON", "BOO"} {
+		// Setting a property to null removes it
+		params[mediaType] = nil
+		if level, ok := settings.Overrides[mediaType]; ok {
+			params[mediaType] = level
+		}
+	}
+
+	_, err := s.executeWrite(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, err := transaction.Run(s.ctx, query, params)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := result.Consume(s.ctx); err != nil {
+			return nil, err
+		}
+
+		// The likes of the user on media may be hidden or shown
+		return nil, s.touchUser(transaction, i, true)
+	})
+
+	return err
+}
+
+// Outbox Functions
+// GetPendingEvents returns the oldest pending events, in order within each
+// ordering key. Events written before the sequences were per key have no
+// ordered_at. Events whose payload can not be read are marked dead.
+func (s *Neo4jStore) GetPendingEvents(limit int) ([]OutboxEvent, error) {
+	queryLK := `
+	MATCH (e:OutboxEvent {status: "PENDING"})
+	RETURN e as event
+	ORDER BY coalesce(e.ordered_at, e.created_at), e.seq
+	LIMIT $limit
+	`
+
+	var results []neo4j.Node
+	var events []OutboxEvent
+
+	_, errLK := s.executeRead(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, errLK := transaction.Run(s.ctx, queryLK, map[string]interface{}{"limit": limit})
+		if errLK != nil {
+			return nil, errLK
+		}
+
+		for result.Next(s.ctx) {
+			results = append(results, result.Record().AsMap()["event"].(neo4j.Node))
+		}
+
+		return nil, result.Err()
+	})
+
+	if errLK != nil {
+		return nil, errLK
+	}
+
+	for r := 0; r < len(results); r++ {
+		event, err := NewOutboxEvent(results[r].Props)
+		if err != nil {
+			id, _ := results[r].Props["id"].(string)
+			if err := s.MarkEventDead(id, err.Error()); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		events = append(events, *event)
+	}
+
+	return events, nil
+}
+
+func (s *Neo4jStore) MarkEventSent(id string) error {
+	_, err := s.executeWrite(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, err := transaction.Run(s.ctx, `MATCH (e:OutboxEvent {id: $id}) SET e.status = "SENT", e.sent_at = timestamp()`, map[string]interface{}{"id": id})
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = result.Consume(s.ctx)
+		return nil, err
+	})
+
+	return err
+}
+
+func (s *Neo4jStore) MarkEventFailed(id string, retryAt time.Time, reason string) error {
+	query := `
+	MATCH (e:OutboxEvent {id: $id})
+	SET e.attempts = e.attempts + 1, e.next_attempt_at = $retry_at, e.last_error = $reason
+	`
+
+	_, err := s.executeWrite(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, err := transaction.Run(s.ctx, query, map[string]interface{}{"id": id, "retry_at": retryAt.UnixMilli(), "reason": reason})
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = result.Consume(s.ctx)
+		return nil, err
+	})
+
+	return err
+}
+
+// MarkEventDead gives up on an event. Dead events no longer hold back the
+// events sharing their ordering key, and are kept for inspection until
+// PurgeDeleted removes them.
+func (s *Neo4jStore) MarkEventDead(id string, reason string) error {
+	query := `
+	MATCH (e:OutboxEvent {id: $id})
+	SET e.status = "DEAD", e.attempts = e.attempts + 1, e.last_error = $reason, e.dead_at = timestamp()
+	`
+
+	_, err := s.executeWrite(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, err := transaction.Run(s.ctx, query, map[string]interface{}{"id": id, "reason": reason})
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = result.Consume(s.ctx)
+		return nil, err
+	})
+
+	return err
+}
+
+// Webhook Functions
+func (s *Neo4jStore) CreateWebhook(w *Webhook) error {
+	query := `
+	CREATE (:Webhook {
+		id: $id,
+		url: $url,
+		secret: $secret,
+		event_types: $event_types,
+		media_types: $media_types,
+		created_at: timestamp()
+	})
+	`
+
+	_, err := s.executeWrite(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, err := transaction.Run(s.ctx, query, map[string]interface{}{
+			"id":          w.ID,
+			"url":         w.URL,
+			"secret":      w.Secret,
+			"event_types": w.EventTypes,
+			"media_types": w.MediaTypes,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = result.Consume(s.ctx)
+		return nil, err
+	})
+
+	return err
+}
+
+func (s *Neo4jStore) GetWebhooks() ([]Webhook, error) {
+	queryLK := "MATCH (w:Webhook) RETURN w as webhook ORDER BY w.created_at"
+
+	var results []neo4j.Node
+	var webhooks []Webhook
+
+	_, errLK := s.executeRead(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, errLK := transaction.Run(s.ctx, queryLK, nil)
+		if errLK != nil {
+			return nil, errLK
+		}
+
+		for result.Next(s.ctx) {
+			results = append(results, result.Record().AsMap()["webhook"].(neo4j.Node))
+		}
+
+		return nil, result.Err()
+	})
+
+	if errLK != nil {
+		return nil, errLK
+	}
+
+	for r := 0; r < len(results); r++ {
+		webhooks = append(webhooks, *NewWebhook(results[r].Props))
+	}
+
+	return webhooks, nil
+}
+
+func (s *Neo4jStore) GetWebhook(id string) (*Webhook, error) {
+	queryLK := "MATCH (w:Webhook {id: $id}) RETURN w as webhook"
+
+	var results []neo4j.Node
+
+	_, errLK := s.executeRead(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, errLK := transaction.Run(s.ctx, queryLK, map[string]interface{}{"id": id})
+		if errLK != nil {
+			return nil, errLK
+		}
+
+		for result.Next(s.ctx) {
+			results = append(results, result.Record().AsMap()["webhook"].(neo4j.Node))
+		}
+
+		return nil, result.Err()
+	})
+
+	if errLK != nil {
+		return nil, errLK
+	}
+
+	if len(results) == 0 {
+		return nil, fmt.Errorf("webhook %s not found", id)
+	}
+
+	return NewWebhook(results[0].Props), nil
+}
+
+func (s *Neo4jStore) UpdateWebhook(w *Webhook) error {
+	query := `
+	MATCH (w:Webhook {id: $id})
+	SET w.url = $url, w.event_types = $event_types, w.media_types = $media_types
+	RETURN w
+	`
+
+	found, err := s.executeWrite(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, err := transaction.Run(s.ctx, query, map[string]interface{}{
+			"id":          w.ID,
+			"url":         w.URL,
+			"event_types": w.EventTypes,
+			"media_types": w.MediaTypes,
+		})
+		if err != nil {
+			return false, err
+		}
+
+		return result.Next(s.ctx), result.Err()
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if !found.(bool) {
+		return fmt.Errorf("webhook %s not found", w.ID)
+	}
+
+	return nil
+}
+
+func (s *Neo4jStore) DeleteWebhook(id string) error {
+	query := `
+	MATCH (w:Webhook {id: $id})
+	OPTIONAL MATCH (d:WebhookDeadLetter {webhook_id: $id})
+	OPTIONAL MATCH (p:WebhookDelivery {webhook_id: $id})
+	DETACH DELETE w, d, p
+	`
+
+	_, err := s.executeWrite(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, err := transaction.Run(s.ctx, query, map[string]interface{}{"id": id})
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = result.Consume(s.ctx)
+		return nil, err
+	})
+
+	return err
+}
+
+func (s *Neo4jStore) AddDeadLetter(d *DeadLetter) error {
+	payload, err := json.Marshal(d.Event)
+	if err != nil {
+		return err
+	}
+
+	query := `
+	CREATE (:WebhookDeadLetter {
+		id: $id,
+		webhook_id: $webhook_id,
+		user_id: $id_user,
+		payload: $payload,
+		attempts: $attempts,
+		last_error: $last_error,
+		created_at: timestamp()
+	})
+	`
+
+	_, err = s.executeWrite(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, err := transaction.Run(s.ctx, query, map[string]interface{}{
+			"id":         d.ID,
+			"webhook_id": d.WebhookID,
+			"id_user":    d.Event.UserID,
+			"payload":    string(payload),
+			"attempts":   d.Attempts,
+			"last_error": d.LastError,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = result.Consume(s.ctx)
+		return nil, err
+	})
+
+	return err
+}
+
+func (s *Neo4jStore) GetDeadLetters(id string) ([]DeadLetter, error) {
+	queryLK := "MATCH (d:WebhookDeadLetter {webhook_id: $id}) RETURN d as letter ORDER BY d.created_at DESC"
+
+	var results []neo4j.Node
+	var letters []DeadLetter
+
+	_, errLK := s.executeRead(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, errLK := transaction.Run(s.ctx, queryLK, map[string]interface{}{"id": id})
+		if errLK != nil {
+			return nil, errLK
+		}
+
+		for result.Next(s.ctx) {
+			results = append(results, result.Record().AsMap()["letter"].(neo4j.Node))
+		}
+
+		return nil, result.Err()
+	})
+
+	if errLK != nil {
+		return nil, errLK
+	}
+
+	for r := 0; r < len(results); r++ {
+		letter, err := NewDeadLetter(results[r].Props)
+		if err != nil {
+			return nil, err
+		}
+
+		letters = append(letters, *letter)
+	}
+
+	return letters, nil
+}
+
+// EnqueueDeliveries stores a delivery of an event for each webhook. A
+// delivery is identified by its webhook and event, so publishing an event
+// again does not store it twice.
+func (s *Neo4jStore) EnqueueDeliveries(e *Event, webhooks []string) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	query := `
+	UNWIND $webhooks as webhook
+	MERGE (d:WebhookDelivery {id: webhook + ":" + $event_id})
+	ON CREATE SET
+		d.webhook_id = webhook,
+		d.user_id = $id_user,
+		d.payload = $payload,
+		d.attempts = 0,
+		d.next_attempt_at = timestamp(),
+		d.created_at = timestamp()
+	`
+
+	_, err = s.executeWrite(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, err := transaction.Run(s.ctx, query, map[string]interface{}{
+			"webhooks": webhooks,
+			"event_id": e.ID,
+			"id_user":  e.UserID,
+			"payload":  string(payload),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = result.Consume(s.ctx)
+		return nil, err
+	})
+
+	return err
+}
+
+// GetPendingDeliveries returns the deliveries which are due, oldest first,
+// with their webhook.
+func (s *Neo4jStore) GetPendingDeliveries(limit int) ([]WebhookDelivery, error) {
+	queryLK := `
+	MATCH (d:WebhookDelivery)
+	WHERE d.next_attempt_at <= timestamp()
+	WITH d ORDER BY d.next_attempt_at LIMIT $limit
+	OPTIONAL MATCH (w:Webhook {id: d.webhook_id})
+	RETURN d as delivery, w as webhook
+	`
+
+	var deliveries []WebhookDelivery
+
+	_, errLK := s.executeRead(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, errLK := transaction.Run(s.ctx, queryLK, map[string]interface{}{"limit": limit})
+		if errLK != nil {
+			return nil, errLK
+		}
+
+		for result.Next(s.ctx) {
+			record := result.Record().AsMap()
+
+			delivery, err := NewWebhookDelivery(record["delivery"].(neo4j.Node).Props)
+			if err != nil {
+				return nil, err
+			}
+
+			if webhook, ok := record["webhook"].(neo4j.Node); ok {
+				delivery.Webhook = NewWebhook(webhook.Props)
+			}
+
+			deliveries = append(deliveries, *delivery)
+		}
+
+		return nil, result.Err()
+	})
+
+	if errLK != nil {
+		return nil, errLK
+	}
+
+	return deliveries, nil
+}
+
+func (s *Neo4jStore) MarkDeliveryFailed(id string, retryAt time.Time, reason string) error {
+	query := `
+	MATCH (d:WebhookDelivery {id: $id})
+	SET d.attempts = d.attempts + 1, d.next_attempt_at = $retry_at, d.last_error = $reason
+	`
+
+	_, err := s.executeWrite(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, err := transaction.Run(s.ctx, query, map[string]interface{}{"id": id, "retry_at": retryAt.UnixMilli(), "reason": reason})
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = result.Consume(s.ctx)
+		return nil, err
+	})
+
+	return err
+}
+
+func (s *Neo4jStore) DeleteDelivery(id string) error {
+	_, err := s.executeWrite(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, err := transaction.Run(s.ctx, "MATCH (d:WebhookDelivery {id: $id}) DELETE d", map[string]interface{}{"id": id})
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = result.Consume(s.ctx)
+		return nil, err
+	})
+
+	return err
+}
+
+// GDPR Functions
+func (s *Neo4jStore) GetUserExport(i int) (*GDPRExport, error) {
+	// Soft deleted nodes are exported too, they are still stored. Reports only
+	// hold what the user wrote, the reviews belong to other users.
+	queries := map[string]string{
+		"user":       "MATCH (u:User {id_user: $id}) RETURN u as value",
+		"likes":      "MATCH (:User {id_user: $id})-[r:PREF]->() RETURN r as value",
+		"ratings":    "MATCH (:User {id_user: $id})-[r:RTE]->() RETURN r as value",
+		"wishlist":   "MATCH (:User {id_user: $id})-[r:WSH]->() RETURN r as value",
+		"history":    "MATCH (c:PreferenceChange {user_id: $id}) RETURN c as value ORDER BY c.created_at",
+		"following":  "MATCH (:User {id_user: $id})-[r:FOLLOWS]->(f:User) RETURN {user: f.id_user, since: r.created_at} as value ORDER BY r.created_at",
+		"followers":  "MATCH (f:User)-[r:FOLLOWS]->(:User {id_user: $id}) RETURN {user: f.id_user, since: r.created_at} as value ORDER BY r.created_at",
+		"reported":   "MATCH ()-[r:RTE]->() WHERE $id IN r.reporters WITH r, [k IN range(0, size(r.reporters) - 1) WHERE r.reporters[k] = $id][0] as k RETURN {media_id: r.media_id, media_type: r.media_type, reason: r.report_reasons[k]} as value",
+		"moderation": "MATCH (a:ModerationAudit {user_id: $id}) RETURN a as value ORDER BY a.created_at",
+	}
+
+	results := map[string][]any{}
+
+	_, errLK := s.executeRead(func(transaction neo4j.ManagedTransaction) (any, error) {
+		for name, queryLK := range queries {
+			result, errLK := transaction.Run(s.ctx, queryLK, map[string]interface{}{"id": i})
+			if errLK != nil {
+				return nil, errLK
+			}
+
+			for result.Next(s.ctx) {
+				results[name] = append(results[name], result.Record().AsMap()["value"])
+			}
+
+			if errLK := result.Err(); errLK != nil {
+				return nil, errLK
+			}
+		}
+
+		return nil, nil
+	})
+
+	if errLK != nil {
+		return nil, errLK
+	}
+
+	export := &GDPRExport{
+		UserID:      i,
+		GeneratedAt: time.Now().UTC(),
+		User:        map[string]any{},
+	}
+
+	for _, user := range results["user"] {
+		export.User = user.(neo4j.Node).Props
+	}
+
+	for _, like := range results["likes"] {
+		props := like.(neo4j.Relationship).Props
+		export.Likes = append(export.Likes, *s.newLikeRelation(i, props["media_id"], props))
+	}
+
+	for _, rating := range results["ratings"] {
+		export.Ratings = append(export.Ratings, *NewReview(rating.(neo4j.Relationship).Props))
+	}
+
+	for _, wish := range results["wishlist"] {
+		props := wish.(neo4j.Relationship).Props
+		export.Wishlist = append(export.Wishlist, WishlistEntry{MediaID: props["media_id"], MediaType: props["media_type"]})
+	}
+
+	for _, change := range results["history"] {
+		export.History = append(export.History, *NewPreferenceChangeFromProps(change.(neo4j.Node).Props))
+	}
+
+	for _, follow := range results["following"] {
+		props := follow.(map[string]any)
+		export.Following = append(export.Following, *NewFollow(props["user"], props["since"]))
+	}
+
+	for _, follow := range results["followers"] {
+		props := follow.(map[string]any)
+		export.Followers = append(export.Followers, *NewFollow(props["user"], props["since"]))
+	}
+
+	for _, reported := range results["reported"] {
+		props := reported.(map[string]any)
+		export.Reported = append(export.Reported, ReportEntry{MediaID: props["media_id"], MediaType: props["media_type"], Reason: props["reason"]})
+	}
+
+	for _, audit := range results["moderation"] {
+		export.Moderation = append(export.Moderation, *NewModerationAudit(audit.(neo4j.Node).Props))
+	}
+
+	return export, nil
+}
+
+// EraseUser hard deletes a user with all its relations, history and
+// idempotency keys, takes it out of the reports made on other reviews and
+// anonymizes the moderation audit of its reviews. The returned receipt is verified in the same transaction.
+func (s *Neo4jStore) EraseUser(i int) (*ErasureReceipt, error) {
+	queries := []struct {
+		name  string
+		query string
+	}{
+		{"relationships", `
+		MATCH (u:User {id_user: $id})
+		OPTIONAL MATCH (u)-[r]-()
+		RETURN count(r) as erased
+		`},
+		{"users", `
+		MATCH (u:User {id_user: $id})
+		DETACH DELETE u
+		RETURN count(*) as erased
+		`},
+		{"history", `
+		MATCH (c:PreferenceChange {user_id: $id})
+		DELETE c
+		RETURN count(*) as erased
+		`},
+		{"reports", `
+		MATCH ()-[r:RTE]->()
+		WHERE $id IN r.reporters
+		WITH r, [k IN range(0, size(r.reporters) - 1) WHERE r.reporters[k] <> $id] as keep
+		SET
+			r.report_reasons = [k IN keep | r.report_reasons[k]],
+			r.reporters = [k IN keep | r.reporters[k]]
+		RETURN count(r) as erased
+		`},
+		{"events", `
+		MATCH (e:OutboxEvent {user_id: $id})
+		DELETE e
+		RETURN count(*) as erased
+		`},
+		{"dead_letters", `
+		MATCH (d:WebhookDeadLetter {user_id: $id})
+		DELETE d
+		RETURN count(*) as erased
+		`},
+		{"deliveries", `
+		MATCH (d:WebhookDelivery {user_id: $id})
+		DELETE d
+		RETURN count(*) as erased
+		`},
+		{"idempotency", `
+		MATCH (k:IdempotencyKey)
+		WHERE k.key STARTS WITH 'user:' + toString($id) + ':'
+		DELETE k
+		RETURN count(*) as erased
+		`},
+		{"moderation", `
+		MATCH (a:ModerationAudit {user_id: $id})
+		REMOVE a.user_id, a.review
+		SET a.anonymized = true
+		RETURN count(a) as erased
+		`},
+	}
+
+	receipt, err := s.executeWrite(func(transaction neo4j.ManagedTransaction) (any, error) {
+		erased := map[string]int64{}
+
+		if err := s.touchUser(transaction, i, true); err != nil {
+			return nil, err
+		}
+
+		for _, q := range queries {
+			result, err := transaction.Run(s.ctx, q.query, map[string]interface{}{"id": i})
+			if err != nil {
+				return nil, err
+			}
+
+			for result.Next(s.ctx) {
+				count, _ := result.Record().AsMap()["erased"].(int64)
+				erased[q.name] = erased[q.name] + count
+			}
+
+			if err := result.Err(); err != nil {
+				return nil, err
+			}
+		}
+
+		receipt, err := s.verifyErasure(transaction, i)
+		if err != nil {
+			return nil, err
+		}
+
+		receipt.Erased = erased
+
+		return receipt, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return receipt.(*ErasureReceipt), nil
+}
+
+func (s *Neo4jStore) VerifyErasure(i int) (*ErasureReceipt, error) {
+	receipt, err := s.executeRead(func(transaction neo4j.ManagedTransaction) (any, error) {
+		return s.verifyErasure(transaction, i)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return receipt.(*ErasureReceipt), nil
+}
+
+// verifyErasure counts everything still stored about a user, including any
+// relationship left with its id in the user_id property.
+func (s *Neo4jStore) verifyErasure(transaction neo4j.ManagedTransaction, i int) (*ErasureReceipt, error) {
+	query := `
+	CALL { MATCH (u:User {id_user: $id}) RETURN count(u) as users }
+	CALL { MATCH ()-[r]->() WHERE r.user_id = $id RETURN count(r) as relationships }
+	CALL { MATCH (c:PreferenceChange {user_id: $id}) RETURN count(c) as history }
+	CALL { MATCH ()-[r:RTE]->() WHERE $id IN r.reporters RETURN count(r) as reports }
+	CALL { MATCH (a:ModerationAudit {user_id: $id}) RETURN count(a) as moderation }
+	CALL { MATCH (e:OutboxEvent {user_id: $id}) RETURN count(e) as events }
+	CALL { MATCH (d:WebhookDeadLetter {user_id: $id}) RETURN count(d) as dead_letters }
+	CALL { MATCH (d:WebhookDelivery {user_id: $id}) RETURN count(d) as deliveries }
+	CALL {
+		MATCH (k:IdempotencyKey)
+		WHERE k.key STARTS WITH 'user:' + toString($id) + ':'
+		RETURN count(k) as idempotency
+	}
+	RETURN users, relationships, history, reports, moderation, events, dead_letters, deliveries, idempotency
+	`
+
+	result, err := transaction.Run(s.ctx, query, map[string]interface{}{"id": i})
+	if err != nil {
+		return nil, err
+	}
+
+	remaining := map[string]int64{}
+	verified := true
+
+	if result.Next(s.ctx) {
+		for name, value := range result.Record().AsMap() {
+			count, _ := value.(int64)
+			remaining[name] = count
+			verified = verified && count == 0
+		}
+	}
+
+	if err := result.Err(); err != nil {
+		return nil, err
+	}
+
+	return &ErasureReceipt{
+		UserID:    i,
+		CheckedAt: time.Now().UTC(),
+		Remaining: remaining,
+		Verified:  verified,
+	}, nil
+}
+
+// API Key Functions
+func (s *Neo4jStore) CreateAPIKey(k *APIKey) error {
+	query := `
+	CREATE (:APIKey {
+		id: $id,
+		name: $name,
+		hash: $hash,
+		scopes: $scopes,
+		usage: 0,
+		created_at: timestamp()
+	})
+	`
+
+	_, err := s.executeWrite(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, err := transaction.Run(s.ctx, query, map[string]interface{}{
+			"id":     k.ID,
+			"name":   k.Name,
+			"hash":   k.Hash,
+			"scopes": k.Scopes,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = result.Consume(s.ctx)
+		return nil, err
+	})
+
+	return err
+}
+
+func (s *Neo4jStore) GetAPIKeys() ([]APIKey, error) {
+	queryLK := "MATCH (k:APIKey) RETURN k as key ORDER BY k.created_at"
+
+	var results []neo4j.Node
+	keys := []APIKey{}
+
+	_, errLK := s.executeRead(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, errLK := transaction.Run(s.ctx, queryLK, nil)
+		if errLK != nil {
+			return nil, errLK
+		}
+
+		for result.Next(s.ctx) {
+			results = append(results, result.Record().AsMap()["key"].(neo4j.Node))
+		}
+
+		return nil, result.Err()
+	})
+
+	if errLK != nil {
+		return nil, errLK
+	}
+
+	for r := 0; r < len(results); r++ {
+		keys = append(keys, *NewAPIKey(results[r].Props))
+	}
+
+	return keys, nil
+}
+
+func (s *Neo4jStore) GetAPIKey(id string) (*APIKey, error) {
+	queryLK := "MATCH (k:APIKey {id: $id}) RETURN k as key"
+
+	var results []neo4j.Node
+
+	_, errLK := s.executeRead(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, errLK := transaction.Run(s.ctx, queryLK, map[string]interface{}{"id": id})
+		if errLK != nil {
+			return nil, errLK
+		}
+
+		for result.Next(s.ctx) {
+			results = append(results, result.Record().AsMap()["key"].(neo4j.Node))
+		}
 
 		return nil, result.Err()
 	})
 
+	if errLK != nil {
+		return nil, errLK
+	}
+
+	if len(results) == 0 {
+		return nil, fmt.Errorf("API key %s %w", id, errAPIKeyNotFound)
+	}
+
+	return NewAPIKey(results[0].Props), nil
+}
+
+// RotateAPIKey replaces the secret hash of a key, keeping the previous one
+// valid until a date.
+func (s *Neo4jStore) RotateAPIKey(id string, hash string, until time.Time) (*APIKey, error) {
+	query := `
+	MATCH (k:APIKey {id: $id})
+	WHERE k.revoked_at IS NULL
+	SET k.previous_hash = k.hash, k.previous_expires_at = $until, k.hash = $hash, k.rotated_at = timestamp()
+	RETURN k as key
+	`
+
+	node, err := s.executeWrite(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, err := transaction.Run(s.ctx, query, map[string]interface{}{
+			"id":    id,
+			"hash":  hash,
+			"until": until.UnixMilli(),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if !result.Next(s.ctx) {
+			return nil, result.Err()
+		}
+
+		return result.Record().AsMap()["key"], nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if node == nil {
+		return nil, fmt.Errorf("API key %s not found", id)
+	}
+
+	return NewAPIKey(node.(neo4j.Node).Props), nil
+}
+
+func (s *Neo4jStore) RevokeAPIKey(id string) error {
+	query := `
+	MATCH (k:APIKey {id: $id})
+	SET k.revoked_at = coalesce(k.revoked_at, timestamp())
+	RETURN k
+	`
+
+	found, err := s.executeWrite(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, err := transaction.Run(s.ctx, query, map[string]interface{}{"id": id})
+		if err != nil {
+			return false, err
+		}
+
+		return result.Next(s.ctx), result.Err()
+	})
+
 	if err != nil {
 		return err
 	}
 
+	if !found.(bool) {
+		return fmt.Errorf("API key %s not found", id)
+	}
+
 	return nil
 }
+
+func (s *Neo4jStore) AddAPIKeyUsage(id string, count int64, lastUsed time.Time) error {
+	query := `
+	MATCH (k:APIKey {id: $id})
+	SET k.usage = coalesce(k.usage, 0) + $count, k.last_used_at = $last_used
+	`
+
+	_, err := s.executeWrite(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, err := transaction.Run(s.ctx, query, map[string]interface{}{
+			"id":        id,
+			"count":     count,
+			"last_used": lastUsed.UnixMilli(),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = result.Consume(s.ctx)
+		return nil, err
+	})
+
+	return err
+}
+
+// ReserveIdempotencyKey creates the key unless an unexpired one exists, and
+// returns the stored one. An expired key is replaced.
+func (s *Neo4jStore) ReserveIdempotencyKey(r *IdempotentResponse) (*IdempotentResponse, error) {
+	queryExpired := "MATCH (k:IdempotencyKey {key: $key}) WHERE k.expires_at < timestamp() DELETE k"
+	query := `
+	MERGE (k:IdempotencyKey {key: $key})
+	ON CREATE
+		SET
+			k.fingerprint = $fingerprint,
+			k.token = $token,
+			k.status = 0,
+			k.expires_at = $expires_at
+	RETURN k as key
+	`
+
+	stored, err := s.executeWrite(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, err := transaction.Run(s.ctx, queryExpired, map[string]interface{}{"key": r.Key})
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := result.Consume(s.ctx); err != nil {
+			return nil, err
+		}
+
+		result, err = transaction.Run(s.ctx, query, map[string]interface{}{
+			"key":         r.Key,
+			"fingerprint": r.Fingerprint,
+			"token":       r.Token,
+			"expires_at":  r.ExpiresAt.UnixMilli(),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		record, err := result.Single(s.ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		props := record.AsMap()["key"].(neo4j.Node).Props
+		status, _ := props["status"].(int64)
+		expiresAt, _ := props["expires_at"].(int64)
+		body, _ := props["body"].(string)
+
+		stored := &IdempotentResponse{
+			Key:       r.Key,
+			Status:    int(status),
+			Body:      []byte(body),
+			ExpiresAt: time.UnixMilli(expiresAt),
+		}
+		stored.Fingerprint, _ = props["fingerprint"].(string)
+		stored.Token, _ = props["token"].(string)
+		stored.ContentType, _ = props["content_type"].(string)
+		stored.ETag, _ = props["etag"].(string)
+		stored.Location, _ = props["location"].(string)
+
+		return stored, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return stored.(*IdempotentResponse), nil
+}
+
+func (s *Neo4jStore) SaveIdempotentResponse(r *IdempotentResponse) error {
+	query := `
+	MATCH (k:IdempotencyKey {key: $key, token: $token})
+	SET
+		k.status = $status,
+		k.content_type = $content_type,
+		k.etag = $etag,
+		k.location = $location,
+		k.body = $body
+	`
+
+	_, err := s.executeWrite(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, err := transaction.Run(s.ctx, query, map[string]interface{}{
+			"key":          r.Key,
+			"token":        r.Token,
+			"status":       r.Status,
+			"content_type": r.ContentType,
+			"etag":         r.ETag,
+			"location":     r.Location,
+			"body":         string(r.Body),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = result.Consume(s.ctx)
+		return nil, err
+	})
+
+	return err
+}
+
+func (s *Neo4jStore) ReleaseIdempotencyKey(key string, token string) error {
+	query := "MATCH (k:IdempotencyKey {key: $key, token: $token}) DELETE k"
+
+	_, err := s.executeWrite(func(transaction neo4j.ManagedTransaction) (any, error) {
+		result, err := transaction.Run(s.ctx, query, map[string]interface{}{"key": key, "token": token})
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = result.Consume(s.ctx)
+		return nil, err
+	})
+
+	return err
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of updates kept per media to resume streams from Last-Event-ID
+const streamBacklog = 100
+
+type MediaCounts struct {
+	MediaID   string  `json:"media_id"`
+	MediaType string  `json:"media_type"` // 'MOV' | 'BOO' | 'SON'
+	Likes     int64   `json:"likes"`
+	Dislikes  int64   `json:"dislikes"`
+	Ratings   int64   `json:"ratings"`
+	Average   float64 `json:"avg_rating"`
+}
+
+type StreamUpdate struct {
+	ID     int64
+	Counts *MediaCounts
+}
+
+// StreamBroker is a Publisher pushing the like counters of a media to every
+// stream subscribed to it. Counters are read once per event, whatever the
+// number of subscribers. A media stays watched for backlogTTL after its last
+// stream ends, so a client reconnecting after a blip can resume.
+type StreamBroker struct {
+	mu          sync.Mutex
+	store       Storage
+	backlogTTL  time.Duration
+	subscribers map[string]map[chan StreamUpdate]bool
+	backlog     map[string][]StreamUpdate
+	since       map[string]int64     // Backlogs hold every update of their media after this id
+	expires     map[string]time.Time // When the backlogs of media without streams are dropped
+	seq         int64
+}
+
+func NewStreamBroker(store Storage, backlogTTL time.Duration) *StreamBroker {
+	return &StreamBroker{
+		store:       store,
+		backlogTTL:  backlogTTL,
+		subscribers: map[string]map[chan StreamUpdate]bool{},
+		backlog:     map[string][]StreamUpdate{},
+		since:       map[string]int64{},
+		expires:     map[string]time.Time{},
+	}
+}
+
+func streamKey(id any, tp any) string {
+	return fmt.Sprintf("%v:%v", tp, id)
+}
+
+// Subscribe registers a stream on a media. It returns the updates missed since
+// lastID, or nil when they are not available anymore, and a function ending
+// the subscription.
+func (b *StreamBroker) Subscribe(id string, tp string, lastID int64) (chan StreamUpdate, []StreamUpdate, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := streamKey(id, tp)
+	updates := make(chan StreamUpdate, 16)
+
+	b.expire(time.Now())
+
+	var missed []StreamUpdate
+	if since, ok := b.since[key]; !ok {
+		b.since[key] = b.seq
+	} else if lastID > 0 && lastID >= since && lastID <= b.seq {
+		missed = []StreamUpdate{}
+		for _, update := range b.backlog[key] {
+			if update.ID > lastID {
+				missed = append(missed, update)
+			}
+		}
+	}
+
+	if b.subscribers[key] == nil {
+		b.subscribers[key] = map[chan StreamUpdate]bool{}
+	}
+	b.subscribers[key][updates] = true
+	delete(b.expires, key)
+
+	return updates, missed, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		delete(b.subscribers[key], updates)
+		if len(b.subscribers[key]) == 0 {
+			delete(b.subscribers, key)
+			b.expires[key] = time.Now().Add(b.backlogTTL)
+		}
+	}
+}
+
+// expire drops the backlogs kept longer than the TTL without streams. It must
+// be called with the lock held.
+func (b *StreamBroker) expire(now time.Time) {
+	for key, expires := range b.expires {
+		if !expires.After(now) {
+			delete(b.expires, key)
+			delete(b.backlog, key)
+			delete(b.since, key)
+		}
+	}
+}
+
+func (b *StreamBroker) Publish(e *Event) error {
+	if e.MediaID == nil || !(strings.HasPrefix(e.Type, "like.") || strings.HasPrefix(e.Type, "rating.")) {
+		return nil
+	}
+
+	key := streamKey(e.MediaID, e.MediaType)
+
+	b.mu.Lock()
+	b.expire(time.Now())
+	_, watched := b.since[key]
+	b.mu.Unlock()
+
+	if !watched {
+		return nil
+	}
+
+	counts, err := b.store.GetMediaCounts(fmt.Sprint(e.MediaID), fmt.Sprint(e.MediaType))
+	if err != nil {
+		slog.Error("Stream update of media failed", "media_id", e.MediaID, "media_type", e.MediaType, "error", err)
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq++
+	update := StreamUpdate{ID: b.seq, Counts: counts}
+
+	b.backlog[key] = append(b.backlog[key], update)
+	if len(b.backlog[key]) > streamBacklog {
+		b.since[key] = b.backlog[key][0].ID
+		b.backlog[key] = b.backlog[key][1:]
+	}
+
+	// Every update holds the full counters, so slow streams can skip some
+	for updates := range b.subscribers[key] {
+		select {
+		case updates <- update:
+		default:
+		}
+	}
+
+	return nil
+}
+
+func (b *StreamBroker) Close() error {
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// countsStore counts the reads of media counters. Other Storage methods are
+// not implemented.
+type countsStore struct {
+	Storage
+	reads int64
+}
+
+func (s *countsStore) GetMediaCounts(id string, tp string) (*MediaCounts, error) {
+	s.reads++
+	return &MediaCounts{MediaID: id, MediaType: tp, Likes: s.reads}, nil
+}
+
+func likeEvent(media string) *Event {
+	event := NewEvent(EventLikeCreated)
+	event.MediaID = media
+	event.MediaType = "MOV"
+
+	return event
+}
+
+func publishN(t *testing.T, b *StreamBroker, media string, n int) {
+	t.Helper()
+
+	for r := 0; r < n; r++ {
+		if err := b.Publish(likeEvent(media)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func updateIDs(updates []StreamUpdate) []int64 {
+	ids := []int64{}
+	for _, update := range updates {
+		ids = append(ids, update.ID)
+	}
+
+	return ids
+}
+
+func TestStreamBrokerLiveUpdates(t *testing.T) {
+	store := &countsStore{}
+	broker := NewStreamBroker(store, time.Minute)
+
+	// Nobody watches yet, the counters are not read
+	publishN(t, broker, "1", 1)
+	if store.reads != 0 {
+		t.Fatalf("counters read %d times without streams", store.reads)
+	}
+
+	updates, missed, unsubscribe := broker.Subscribe("1", "MOV", 0)
+	defer unsubscribe()
+
+	if missed != nil {
+		t.Errorf("new stream missed %v", updateIDs(missed))
+	}
+
+	publishN(t, broker, "1", 1)
+	publishN(t, broker, "2", 1)
+	if err := broker.Publish(&Event{Type: EventWishlistAdded, MediaID: "1", MediaType: "MOV"}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case update := <-updates:
+		if update.ID != 1 || update.Counts.MediaID != "1" {
+			t.Errorf("update %d of media %s, want update 1 of media 1", update.ID, update.Counts.MediaID)
+		}
+	default:
+		t.Fatal("no update")
+	}
+
+	select {
+	case update := <-updates:
+		t.Errorf("unexpected update %d of media %s", update.ID, update.Counts.MediaID)
+	default:
+	}
+}
+
+func TestStreamBrokerResume(t *testing.T) {
+	tests := []struct {
+		name      string
+		published int
+		ttl       time.Duration
+		wait      time.Duration
+		lastID    int64
+		missed    []int64 // nil when the updates are not available anymore
+	}{
+		{"resume after reconnecting", 5, time.Minute, 0, 2, []int64{3, 4, 5}},
+		{"nothing missed", 5, time.Minute, 0, 5, []int64{}},
+		{"backlog expired", 5, 10 * time.Millisecond, 30 * time.Millisecond, 2, nil},
+		{"older than the backlog", streamBacklog + 10, time.Minute, 0, 2, nil},
+		{"unknown id", 5, time.Minute, 0, 99, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := NewStreamBroker(&countsStore{}, tt.ttl)
+
+			// Two updates are seen, the stream drops, the others are missed
+			_, _, unsubscribe := broker.Subscribe("1", "MOV", 0)
+			publishN(t, broker, "1", 2)
+			unsubscribe()
+			publishN(t, broker, "1", tt.published-2)
+
+			time.Sleep(tt.wait)
+
+			_, missed, unsubscribe := broker.Subscribe("1", "MOV", tt.lastID)
+			defer unsubscribe()
+
+			if (missed == nil) != (tt.missed == nil) {
+				t.Fatalf("missed = %v, want %v", missed, tt.missed)
+			}
+
+			ids := updateIDs(missed)
+			if len(ids) != len(tt.missed) {
+				t.Fatalf("missed %v, want %v", ids, tt.missed)
+			}
+			for r := range ids {
+				if ids[r] != tt.missed[r] {
+					t.Fatalf("missed %v, want %v", ids, tt.missed)
+				}
+			}
+		})
+	}
+}
+
+func TestStreamBrokerExpiredMediaNotWatched(t *testing.T) {
+	store := &countsStore{}
+	broker := NewStreamBroker(store, 10*time.Millisecond)
+
+	_, _, unsubscribe := broker.Subscribe("1", "MOV", 0)
+	unsubscribe()
+
+	publishN(t, broker, "1", 1)
+	if store.reads != 1 {
+		t.Fatalf("counters read %d times during the TTL, want 1", store.reads)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	publishN(t, broker, "1", 1)
+	if store.reads != 1 {
+		t.Errorf("counters read %d times after the TTL, want 1", store.reads)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// traceStore answers the likes of a user, failing with its error. Other
+// Storage methods are not implemented.
+type traceStore struct {
+	Storage
+	err error
+}
+
+func (s *traceStore) GetUserLikes(user int, mediaType, preference string) (*GetUserLikes, error) {
+	return &GetUserLikes{UserID: user, Movies: []LikeRelation{{UserID: user}, {UserID: user}}}, s.err
+}
+
+var (
+	spansOnce sync.Once
+	spans     *tracetest.InMemoryExporter
+)
+
+// recordSpans returns the spans ended from now on. The global provider is
+// installed once: tracer keeps delegating to the first one set.
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+
+	spansOnce.Do(func() {
+		spans = tracetest.NewInMemoryExporter()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(spans)))
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+	})
+	spans.Reset()
+
+	return spans
+}
+
+func attributes(span tracetest.SpanStub) map[attribute.Key]attribute.Value {
+	values := map[attribute.Key]attribute.Value{}
+	for _, kv := range span.Attributes {
+		values[kv.Key] = kv.Value
+	}
+
+	return values
+}
+
+func TestTraceRequest(t *testing.T) {
+	recorder := recordSpans(t)
+
+	s := &APIServer{store: NewInstrumentedStore(&traceStore{})}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/likes/user/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if _, err := s.storeFor(r).GetUserLikes(5, "MOV", ""); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+	router.Use(s.trace)
+
+	r := httptest.NewRequest("GET", "/likes/user/5", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	router.ServeHTTP(httptest.NewRecorder(), r)
+
+	ended := recorder.GetSpans()
+	if len(ended) != 2 {
+		t.Fatalf("%d spans ended, want the storage call and the request", len(ended))
+	}
+	call, request := ended[0], ended[1]
+
+	if request.Name != "GET /likes/user/{id}" {
+		t.Errorf("request span %q, want the route template", request.Name)
+	}
+	if request.Parent.SpanID().String() != "00f067aa0ba902b7" || request.SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("request span does not continue the trace of the caller")
+	}
+	if got := attributes(request)["http.response.status_code"].AsInt64(); got != http.StatusOK {
+		t.Errorf("status code %d, want %d", got, http.StatusOK)
+	}
+
+	if call.Name != "Storage.GetUserLikes" || call.Parent.SpanID() != request.SpanContext.SpanID() {
+		t.Errorf("storage span %q is not a child of the request span", call.Name)
+	}
+
+	values := attributes(call)
+	if values["likes.media_type"].AsString() != "MOV" || values["db.response.returned_rows"].AsInt64() != 2 {
+		t.Errorf("storage span attributes %v", values)
+	}
+}
+
+func TestTraceStorageError(t *testing.T) {
+	recorder := recordSpans(t)
+
+	store := NewInstrumentedStore(&traceStore{err: errors.New("unavailable")})
+	if _, err := store.GetUserLikes(5, "MOV", ""); err == nil {
+		t.Fatal("GetUserLikes succeeded, want the error of the store")
+	}
+
+	ended := recorder.GetSpans()
+	if len(ended) != 1 {
+		t.Fatalf("%d spans ended, want 1", len(ended))
+	}
+
+	if ended[0].Status.Code != codes.Error || len(ended[0].Events) == 0 {
+		t.Errorf("failed call has status %v and %d events, want an error recorded", ended[0].Status, len(ended[0].Events))
+	}
+}
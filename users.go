@@ -1,10 +1,12 @@
 package main
 
 type LikeRelation struct {
-	UserID    any `json:"user_id"`
-	MediaID   any `json:"media_id"`
-	MediaType any `json:"type"`      // 'MOV' | 'BOO' | 'SON'
-	LikeType  any `json:"like_type"` // 'LK' | 'DLK'
+	UserID    any     `json:"user_id"`
+	MediaID   any     `json:"media_id"`
+	MediaType any     `json:"type"`      // 'MOV' | 'BOO' | 'SON'
+	LikeType  any     `json:"like_type"` // 'LK' | 'DLK'
+	Reaction  any     `json:"reaction"`
+	Weight    float64 `json:"weight"`
 }
 
 type GetUserLikes struct {
@@ -14,11 +16,13 @@ type GetUserLikes struct {
 	Books  []LikeRelation `json:"books"`
 }
 
-func NewLikeRelation(id any, media any, mtype any, ltype any) *LikeRelation {
+func NewLikeRelation(id any, media any, mtype any, ltype any, reaction any, weight float64) *LikeRelation {
 	return &LikeRelation{
 		UserID:    id,
 		MediaID:   media,
 		MediaType: mtype,
 		LikeType:  ltype,
+		Reaction:  reaction,
+		Weight:    weight,
 	}
 }
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// EventWebhookTest is only sent by the "send test event" action
+const EventWebhookTest = "webhook.test"
+
+type Webhook struct {
+	ID         string    `json:"id"`
+	URL        string    `json:"url"`
+	Secret     string    `json:"secret,omitempty"` // Only returned on creation
+	EventTypes []string  `json:"event_types"`      // Empty to receive every event type
+	MediaTypes []string  `json:"media_types"`      // Empty to receive every media type
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type DeadLetter struct {
+	ID        string    `json:"id"`
+	WebhookID string    `json:"webhook_id"`
+	Event     Event     `json:"event"`
+	Attempts  int64     `json:"attempts"`
+	LastError string    `json:"last_error"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type WebhookTestResult struct {
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+func NewWebhook(props map[string]any) *Webhook {
+	createdAt, _ := props["created_at"].(int64)
+	secret, _ := props["secret"].(string)
+
+	return &Webhook{
+		ID:         props["id"].(string),
+		URL:        props["url"].(string),
+		Secret:     secret,
+		EventTypes: stringList(props["event_types"]),
+		MediaTypes: stringList(props["media_types"]),
+		CreatedAt:  time.UnixMilli(createdAt),
+	}
+}
+
+func NewDeadLetter(props map[string]any) (*DeadLetter, error) {
+	letter := &DeadLetter{}
+
+	payload, _ := props["payload"].(string)
+	if err := json.Unmarshal([]byte(payload), &letter.Event); err != nil {
+		return nil, err
+	}
+
+	createdAt, _ := props["created_at"].(int64)
+
+	letter.ID, _ = props["id"].(string)
+	letter.WebhookID, _ = props["webhook_id"].(string)
+	letter.Attempts, _ = props["attempts"].(int64)
+	letter.LastError, _ = props["last_error"].(string)
+	letter.CreatedAt = time.UnixMilli(createdAt)
+
+	return letter, nil
+}
+
+// stringList converts a list property read from Neo4j.
+func stringList(value any) []string {
+	list := []string{}
+
+	values, _ := value.([]any)
+	for _, v := range values {
+		if str, ok := v.(string); ok {
+			list = append(list, str)
+		}
+	}
+
+	return list
+}
+
+func newSecret() string {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+
+	return hex.EncodeToString(secret)
+}
+
+// Matches reports whether the webhook is subscribed to an event.
+func (w *Webhook) Matches(e *Event) bool {
+	if e.Type == EventWebhookTest {
+		return true
+	}
+
+	return contains(w.EventTypes, e.Type) && contains(w.MediaTypes, e.MediaType)
+}
+
+// contains reports whether a filter list accepts a value. Empty lists accept
+// everything.
+func contains(filter []string, value any) bool {
+	if len(filter) == 0 {
+		return true
+	}
+
+	for _, f := range filter {
+		if f == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// WebhookDelivery is an event waiting to be delivered to a webhook. Webhook
+// is nil once the webhook is deleted.
+type WebhookDelivery struct {
+	ID            string
+	Webhook       *Webhook
+	Event         Event
+	Attempts      int64
+	NextAttemptAt time.Time
+}
+
+func NewWebhookDelivery(props map[string]any) (*WebhookDelivery, error) {
+	delivery := &WebhookDelivery{}
+
+	payload, _ := props["payload"].(string)
+	if err := json.Unmarshal([]byte(payload), &delivery.Event); err != nil {
+		return nil, err
+	}
+
+	nextAttemptAt, _ := props["next_attempt_at"].(int64)
+
+	delivery.ID, _ = props["id"].(string)
+	delivery.Attempts, _ = props["attempts"].(int64)
+	delivery.NextAttemptAt = time.UnixMilli(nextAttemptAt)
+
+	return delivery, nil
+}
+
+var errPrivateTarget = errors.New("webhook target is not a public address")
+
+// WebhookDispatcher is a Publisher delivering events to the registered
+// webhooks. Publish stores a delivery for every subscribed webhook, so the
+// outbox event is only marked sent once they are stored. RunWebhookDeliveries
+// sends them; failed ones are retried with exponential backoff and end up in
+// the dead letter list of the webhook once MaxAttempts is reached.
+type WebhookDispatcher struct {
+	store        Storage
+	client       *http.Client
+	maxAttempts  int64
+	backoff      time.Duration
+	allowPrivate bool
+}
+
+// NewWebhookDispatcher returns a dispatcher which, unless allowPrivate, never
+// connects to loopback, link-local or private addresses, whatever the webhook
+// host resolves to when it is called.
+func NewWebhookDispatcher(store Storage, maxAttempts int64, backoff time.Duration, allowPrivate bool) *WebhookDispatcher {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if !allowPrivate {
+		dialer.Control = func(network string, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+
+			if !publicAddress(net.ParseIP(host)) {
+				return errPrivateTarget
+			}
+
+			return nil
+		}
+	}
+
+	return &WebhookDispatcher{
+		store:        store,
+		client:       &http.Client{Timeout: 10 * time.Second, Transport: &http.Transport{DialContext: dialer.DialContext}},
+		maxAttempts:  maxAttempts,
+		backoff:      backoff,
+		allowPrivate: allowPrivate,
+	}
+}
+
+// publicAddress reports whether an address can be reached from the internet.
+func publicAddress(ip net.IP) bool {
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+
+	// Shared address space of carrier grade NAT, and "this network"
+	if ip4 := ip.To4(); ip4 != nil && ((ip4[0] == 100 && ip4[1]&0xc0 == 64) || ip4[0] == 0) {
+		return false
+	}
+
+	return true
+}
+
+// ValidateURL checks that a webhook url is http(s) and, unless private
+// targets are allowed, that its host only resolves to public addresses.
+func (d *WebhookDispatcher) ValidateURL(ctx context.Context, raw string) error {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Hostname() == "" {
+		return errors.New("webhook url must be http or https with a host")
+	}
+
+	if d.allowPrivate {
+		return nil
+	}
+
+	host := parsed.Hostname()
+	if ip := net.ParseIP(host); ip != nil {
+		if !publicAddress(ip) {
+			return errPrivateTarget
+		}
+		return nil
+	}
+
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("webhook host can not be resolved: %w", err)
+	}
+
+	for _, address := range addresses {
+		if !publicAddress(address.IP) {
+			return errPrivateTarget
+		}
+	}
+
+	return nil
+}
+
+func (d *WebhookDispatcher) Publish(e *Event) error {
+	webhooks, err := d.store.GetWebhooks()
+	if err != nil {
+		return err
+	}
+
+	var ids []string
+	for r := 0; r < len(webhooks); r++ {
+		if webhooks[r].Matches(e) {
+			ids = append(ids, webhooks[r].ID)
+		}
+	}
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	return d.store.EnqueueDeliveries(e, ids)
+}
+
+// Close has nothing to wait for, deliveries are stored until they are sent.
+func (d *WebhookDispatcher) Close() error {
+	return nil
+}
+
+// RunWebhookDeliveries sends the deliveries which are due every interval.
+func RunWebhookDeliveries(ctx context.Context, d *WebhookDispatcher, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := d.DeliverPending(ctx); err != nil {
+			slog.Error("Webhook deliveries failed", "error", err)
+		}
+	}
+}
+
+// DeliverPending sends the deliveries which are due, concurrently. Cancelling
+// the context aborts the requests in progress, which are retried later.
+func (d *WebhookDispatcher) DeliverPending(ctx context.Context) error {
+	deliveries, err := d.store.GetPendingDeliveries(100)
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	for r := 0; r < len(deliveries); r++ {
+		wg.Add(1)
+		go func(delivery *WebhookDelivery) {
+			defer wg.Done()
+
+			if err := d.deliver(ctx, delivery); err != nil {
+				slog.Error("Webhook delivery not updated", "delivery_id", delivery.ID, "event_id", delivery.Event.ID, "error", err)
+			}
+		}(&deliveries[r])
+	}
+	wg.Wait()
+
+	return nil
+}
+
+func (d *WebhookDispatcher) deliver(ctx context.Context, delivery *WebhookDelivery) error {
+	if delivery.Webhook == nil {
+		return d.store.DeleteDelivery(delivery.ID)
+	}
+
+	_, err := d.Send(ctx, delivery.Webhook, &delivery.Event)
+	if err == nil {
+		return d.store.DeleteDelivery(delivery.ID)
+	}
+
+	// Interrupted by the shutdown, not a failure of the receiver
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	if delivery.Attempts+1 >= d.maxAttempts {
+		letter := &DeadLetter{
+			ID:        newID(),
+			WebhookID: delivery.Webhook.ID,
+			Event:     delivery.Event,
+			Attempts:  delivery.Attempts + 1,
+			LastError: err.Error(),
+		}
+
+		if err := d.store.AddDeadLetter(letter); err != nil {
+			return err
+		}
+
+		return d.store.DeleteDelivery(delivery.ID)
+	}
+
+	return d.store.MarkDeliveryFailed(delivery.ID, time.Now().Add(relayBackoff(d.backoff, delivery.Attempts)), err.Error())
+}
+
+// Send makes a single signed delivery of an event to a webhook. Non 2xx
+// answers are errors.
+func (d *WebhookDispatcher) Send(ctx context.Context, webhook *Webhook, e *Event) (int, error) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Likes-Event", e.Type)
+	req.Header.Set("X-Likes-Delivery", e.ID)
+	req.Header.Set("X-Likes-Timestamp", timestamp)
+	req.Header.Set("X-Likes-Signature", "sha256="+SignWebhook(webhook.Secret, timestamp, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook answered %d", resp.StatusCode)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// SignWebhook returns the hex HMAC-SHA256 of "<timestamp>.<body>" with the
+// webhook secret. Receivers recompute it to check a delivery.
+func SignWebhook(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookStore keeps webhooks, deliveries and dead letters in memory. Other
+// Storage methods are not implemented.
+type webhookStore struct {
+	Storage
+	mu         sync.Mutex
+	webhooks   []Webhook
+	deliveries map[string]*WebhookDelivery
+	letters    []DeadLetter
+	retries    []time.Duration // Wait before each retry, as scheduled
+}
+
+func newWebhookStore(webhooks ...Webhook) *webhookStore {
+	return &webhookStore{webhooks: webhooks, deliveries: map[string]*WebhookDelivery{}}
+}
+
+func (s *webhookStore) GetWebhooks() ([]Webhook, error) {
+	return s.webhooks, nil
+}
+
+func (s *webhookStore) EnqueueDeliveries(e *Event, webhooks []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, id := range webhooks {
+		for r := range s.webhooks {
+			if s.webhooks[r].ID == id {
+				s.deliveries[id+":"+e.ID] = &WebhookDelivery{ID: id + ":" + e.ID, Webhook: &s.webhooks[r], Event: *e}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *webhookStore) GetPendingDeliveries(limit int) ([]WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []WebhookDelivery
+	for _, delivery := range s.deliveries {
+		if !delivery.NextAttemptAt.After(time.Now()) && len(due) < limit {
+			due = append(due, *delivery)
+		}
+	}
+
+	return due, nil
+}
+
+func (s *webhookStore) MarkDeliveryFailed(id string, retryAt time.Time, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.retries = append(s.retries, time.Until(retryAt))
+	s.deliveries[id].Attempts++
+	s.deliveries[id].NextAttemptAt = retryAt
+
+	return nil
+}
+
+func (s *webhookStore) DeleteDelivery(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.deliveries, id)
+
+	return nil
+}
+
+func (s *webhookStore) AddDeadLetter(d *DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.letters = append(s.letters, *d)
+
+	return nil
+}
+
+// webhookReceiver checks the signature of every delivery and answers the
+// statuses in order, then 200.
+type webhookReceiver struct {
+	mu       sync.Mutex
+	secret   string
+	statuses []int
+	received int
+	invalid  int
+}
+
+func (h *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	body, _ := io.ReadAll(r.Body)
+	signature := strings.TrimPrefix(r.Header.Get("X-Likes-Signature"), "sha256=")
+	expected := SignWebhook(h.secret, r.Header.Get("X-Likes-Timestamp"), body)
+
+	decoded, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(decoded, mustDecodeHex(expected)) {
+		h.invalid++
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	status := http.StatusOK
+	if h.received < len(h.statuses) {
+		status = h.statuses[h.received]
+	}
+	h.received++
+
+	w.WriteHeader(status)
+}
+
+func mustDecodeHex(s string) []byte {
+	decoded, _ := hex.DecodeString(s)
+	return decoded
+}
+
+// deliverAll runs delivery passes until nothing is pending or the timeout.
+func deliverAll(t *testing.T, d *WebhookDispatcher, store *webhookStore) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if err := d.DeliverPending(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		store.mu.Lock()
+		pending := len(store.deliveries)
+		store.mu.Unlock()
+
+		if pending == 0 {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	t.Fatal("deliveries still pending")
+}
+
+func TestWebhookSignature(t *testing.T) {
+	receiver := &webhookReceiver{secret: newSecret()}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	dispatcher := NewWebhookDispatcher(nil, 1, time.Millisecond, true)
+
+	tests := []struct {
+		name   string
+		secret string
+		status int
+	}{
+		{"valid secret", receiver.secret, http.StatusOK},
+		{"other secret", newSecret(), http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			webhook := &Webhook{ID: "w", URL: server.URL, Secret: tt.secret}
+
+			status, _ := dispatcher.Send(context.Background(), webhook, NewEvent(EventWebhookTest))
+			if status != tt.status {
+				t.Errorf("status = %d, want %d", status, tt.status)
+			}
+		})
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	tests := []struct {
+		name        string
+		statuses    []int
+		maxAttempts int64
+		received    int
+		retries     int
+		dead        bool
+	}{
+		{"first attempt", nil, 3, 1, 0, false},
+		{"retried until delivered", []int{500, 503}, 3, 3, 2, false},
+		{"dead letter after max attempts", []int{500, 500, 500}, 3, 3, 2, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receiver := &webhookReceiver{secret: newSecret(), statuses: tt.statuses}
+			server := httptest.NewServer(receiver)
+			defer server.Close()
+
+			store := newWebhookStore(Webhook{ID: "w", URL: server.URL, Secret: receiver.secret})
+			dispatcher := NewWebhookDispatcher(store, tt.maxAttempts, 10*time.Millisecond, true)
+
+			if err := dispatcher.Publish(NewEvent(EventLikeCreated)); err != nil {
+				t.Fatal(err)
+			}
+
+			deliverAll(t, dispatcher, store)
+
+			if receiver.received != tt.received || receiver.invalid != 0 {
+				t.Errorf("received %d valid and %d invalid deliveries, want %d valid", receiver.received, receiver.invalid, tt.received)
+			}
+
+			if len(store.retries) != tt.retries {
+				t.Fatalf("%d retries, want %d", len(store.retries), tt.retries)
+			}
+
+			// The wait doubles after every failure
+			for r, wait := range store.retries {
+				want := 10 * time.Millisecond << r
+				if wait > want || wait <= want/2 {
+					t.Errorf("retry %d waits %s, want %s", r, wait, want)
+				}
+			}
+
+			if dead := len(store.letters) == 1; dead != tt.dead {
+				t.Errorf("dead letter = %v, want %v", dead, tt.dead)
+			}
+			if tt.dead && store.letters[0].Attempts != tt.maxAttempts {
+				t.Errorf("dead letter after %d attempts, want %d", store.letters[0].Attempts, tt.maxAttempts)
+			}
+		})
+	}
+}
+
+func TestWebhookDeliveryCancelled(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	store := newWebhookStore(Webhook{ID: "w", URL: server.URL})
+	dispatcher := NewWebhookDispatcher(store, 1, time.Millisecond, true)
+
+	if err := dispatcher.Publish(NewEvent(EventLikeCreated)); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := dispatcher.DeliverPending(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("cancelled delivery took %s", elapsed)
+	}
+
+	// Neither retried nor dead, it is sent again after the restart
+	if len(store.deliveries) != 1 || len(store.letters) != 0 || len(store.retries) != 0 {
+		t.Errorf("cancelled delivery was not kept as it was")
+	}
+}
+
+func TestWebhookPrivateTargets(t *testing.T) {
+	dispatcher := NewWebhookDispatcher(nil, 1, time.Millisecond, false)
+
+	tests := []struct {
+		url   string
+		valid bool
+	}{
+		{"https://93.184.216.34/hook", true},
+		{"http://93.184.216.34:8080/hook", true},
+		{"ftp://93.184.216.34/hook", false},
+		{"file:///etc/passwd", false},
+		{"http:///hook", false},
+		{"http://127.0.0.1/hook", false},
+		{"http://localhost/hook", false},
+		{"http://[::1]/hook", false},
+		{"http://10.0.0.5/hook", false},
+		{"http://172.20.0.3/hook", false},
+		{"http://192.168.1.1/hook", false},
+		{"http://169.254.169.254/latest/meta-data", false},
+		{"http://100.64.0.1/hook", false},
+		{"http://0.0.0.0/hook", false},
+		{"http://[fe80::1]/hook", false},
+		{"http://[::ffff:127.0.0.1]/hook", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			err := dispatcher.ValidateURL(context.Background(), tt.url)
+			if (err == nil) != tt.valid {
+				t.Errorf("ValidateURL(%s) = %v, want valid %v", tt.url, err, tt.valid)
+			}
+		})
+	}
+
+	// Checked again when connecting, whatever the host resolves to then
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	_, err := dispatcher.Send(context.Background(), &Webhook{ID: "w", URL: server.URL}, NewEvent(EventWebhookTest))
+	if !errors.Is(err, errPrivateTarget) {
+		t.Errorf("delivery to %s: %v, want %v", server.URL, err, errPrivateTarget)
+	}
+}